@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	approvalTimeoutReject  = "reject"
+	approvalTimeoutApprove = "approve"
+)
+
+// Reviewers recorded for replies that were approved or rejected without an
+// operator.
+const (
+	reviewerTrustedAuthor = "auto:trusted-author"
+	reviewerLowRisk       = "auto:low-risk"
+	reviewerTimeout       = "auto:timeout"
+)
+
+const approvalSweepInterval = time.Minute
+
+const approvalTimeoutReason = "approval timed out"
+
+type ApprovalConfig struct {
+	Required       bool
+	TrustedAuthors []string
+	MaxRisk        float64
+	Timeout        time.Duration
+	TimeoutAction  string
+}
+
+// autoApprove reports whether a generated reply can be sent without review,
+// and the reviewer to record for it. Without APPROVAL_REQUIRED every reply is
+// approved and no reviewer is recorded.
+func (b *Bot) autoApprove(message database.ClaimNextMessageRow, text string) (string, bool) {
+	config := b.currentConfig()
+	if !config.Approval.Required {
+		return "", true
+	}
+	if matchesAuthor(config.Approval.TrustedAuthors, message.AuthorDid, message.AuthorHandle) {
+		return reviewerTrustedAuthor, true
+	}
+
+	moderator := b.moderationProvider()
+	if config.Approval.MaxRisk <= 0 || moderator == nil {
+		return "", false
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+	result, err := moderator.Moderate(ctx, config.Guardrails.ModerationModel, text)
+	if err != nil {
+		b.logger.Warn("Failed to score reply risk, leaving it for review",
+			"message_id", message.ID,
+			"error", err)
+		return "", false
+	}
+	b.logger.Info("Scored reply risk",
+		"message_id", message.ID,
+		"risk", result.Score,
+		"max_risk", config.Approval.MaxRisk)
+	if result.Flagged || result.Score > config.Approval.MaxRisk {
+		return "", false
+	}
+	return reviewerLowRisk, true
+}
+
+func (b *Bot) submitForApproval(messageID int64, reply llmReply) error {
+	if err := b.queries.SubmitMessageForApproval(b.ctx, database.SubmitMessageForApprovalParams{
+		ID:             messageID,
+		LlmResponse:    &reply.Text,
+		ModelName:      &reply.ModelName,
+		LengthStrategy: reply.LengthStrategy,
+	}); err != nil {
+		return fmt.Errorf("failed to submit message for approval: %w", err)
+	}
+
+	b.logger.Info("Reply is awaiting approval", "message_id", messageID)
+	return nil
+}
+
+func (b *Bot) runApprovalSweeper() {
+	b.logger.Info("Starting approval sweeper...")
+
+	ticker := time.NewTicker(approvalSweepInterval)
+	defer ticker.Stop()
+
+	b.sweepApprovals()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.logger.Info("Approval sweeper shutting down...")
+			return
+		case <-ticker.C:
+			b.sweepApprovals()
+		}
+	}
+}
+
+// sweepApprovals applies APPROVAL_TIMEOUT_ACTION to the replies that have
+// been awaiting approval for longer than APPROVAL_TIMEOUT.
+func (b *Bot) sweepApprovals() {
+	config := b.currentConfig().Approval
+	if config.Timeout <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-config.Timeout)
+	ids, err := b.queries.ListExpiredApprovals(b.ctx, pgtype.Timestamptz{Time: cutoff, Valid: true})
+	if err != nil {
+		b.logger.Error("Error listing expired approvals", "error", err)
+		return
+	}
+
+	for _, id := range ids {
+		var updated int64
+		if config.TimeoutAction == approvalTimeoutApprove {
+			updated, err = b.queries.ApproveQueueMessage(b.ctx, database.ApproveQueueMessageParams{
+				ReviewedBy: new(reviewerTimeout),
+				ID:         id,
+			})
+		} else {
+			updated, err = b.queries.RejectQueueMessage(b.ctx, database.RejectQueueMessageParams{
+				ID:         id,
+				Reason:     new(approvalTimeoutReason),
+				ReviewedBy: reviewerTimeout,
+			})
+		}
+		if err != nil {
+			b.logger.Error("Error applying approval timeout",
+				"message_id", id,
+				"error", err)
+			continue
+		}
+		if updated > 0 {
+			b.logger.Info("Approval timed out",
+				"message_id", id,
+				"action", config.TimeoutAction)
+		}
+	}
+}
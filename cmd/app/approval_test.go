@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func newApprovalTestBot(approval ApprovalConfig) *testBot {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	approval.Required = true
+	config.Approval = approval
+	config.Guardrails.ModerationModel = "omni-moderation-latest"
+	bot.config.Store(config)
+	return bot
+}
+
+func TestProcessNextMessageSubmitsReplyForApproval(t *testing.T) {
+	bot := newApprovalTestBot(ApprovalConfig{})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, AuthorHandle: "alice.test", MessageText: "hello"}}
+	bot.model.responses = []*schema.Message{schema.AssistantMessage("Hi there!", nil)}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+	if len(bot.queries.llmResponses) != 0 {
+		t.Fatalf("stored responses = %+v; want the reply held for approval", bot.queries.llmResponses)
+	}
+	if len(bot.queries.approvalRequests) != 1 || *bot.queries.approvalRequests[0].LlmResponse != "Hi there!" {
+		t.Fatalf("approval requests = %+v", bot.queries.approvalRequests)
+	}
+}
+
+func TestProcessNextMessageAutoApprovesReplies(t *testing.T) {
+	tests := []struct {
+		name     string
+		author   string
+		score    float64
+		reviewer string
+	}{
+		{name: "trusted author", author: "@friend.test", score: 0.9, reviewer: reviewerTrustedAuthor},
+		{name: "low risk", author: "alice.test", score: 0.05, reviewer: reviewerLowRisk},
+		{name: "high risk", author: "alice.test", score: 0.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot := newApprovalTestBot(ApprovalConfig{TrustedAuthors: []string{"@friend.test"}, MaxRisk: 0.1})
+			bot.moderator = &fakeModerator{result: ModerationResult{Score: test.score}}
+			bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, AuthorHandle: strings.TrimPrefix(test.author, "@"), MessageText: "hello"}}
+			bot.model.responses = []*schema.Message{schema.AssistantMessage("Hi there!", nil)}
+
+			if err := bot.processNextMessage(); err != nil {
+				t.Fatalf("processNextMessage() error = %v", err)
+			}
+			if test.reviewer == "" {
+				if len(bot.queries.approvalRequests) != 1 {
+					t.Fatalf("approval requests = %+v; want the reply held for approval", bot.queries.approvalRequests)
+				}
+				return
+			}
+			if len(bot.queries.llmResponses) != 1 {
+				t.Fatalf("stored responses = %+v; want the reply approved", bot.queries.llmResponses)
+			}
+			got := bot.queries.llmResponses[0]
+			if got.ReviewedBy == nil || *got.ReviewedBy != test.reviewer || !got.ReviewedAt.Valid {
+				t.Fatalf("reviewer = %v; want %s", got.ReviewedBy, test.reviewer)
+			}
+		})
+	}
+}
+
+func TestSweepApprovalsAppliesTimeoutAction(t *testing.T) {
+	for _, action := range []string{approvalTimeoutReject, approvalTimeoutApprove} {
+		t.Run(action, func(t *testing.T) {
+			bot := newApprovalTestBot(ApprovalConfig{Timeout: time.Hour, TimeoutAction: action})
+			bot.queries.queue = []database.MessageQueue{
+				{ID: 1, Status: "awaiting_approval", LlmResponse: new("old"), ApprovalRequestedAt: timestamptz(time.Now().Add(-2 * time.Hour))},
+				{ID: 2, Status: "awaiting_approval", LlmResponse: new("new"), ApprovalRequestedAt: timestamptz(time.Now())},
+			}
+
+			bot.sweepApprovals()
+
+			if action == approvalTimeoutApprove {
+				if bot.queries.queue[0].Status != "ready_to_send" || *bot.queries.queue[0].ReviewedBy != reviewerTimeout {
+					t.Fatalf("expired message = %+v; want it approved", bot.queries.queue[0])
+				}
+			} else if len(bot.queries.historyRows) != 1 || bot.queries.historyRows[0].Status != "rejected" || len(bot.queries.queue) != 1 {
+				t.Fatalf("history = %+v, queue = %+v; want the expired reply rejected", bot.queries.historyRows, bot.queries.queue)
+			}
+			if remaining := bot.queries.queue[len(bot.queries.queue)-1]; remaining.ID != 2 || remaining.Status != "awaiting_approval" {
+				t.Fatalf("recent message = %+v; want it still awaiting approval", remaining)
+			}
+		})
+	}
+}
+
+func TestCLIApproval(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	queries.queue = []database.MessageQueue{
+		{ID: 1, Status: "awaiting_approval", LlmResponse: new("draft")},
+		{ID: 2, Status: "awaiting_approval", LlmResponse: new("draft")},
+		{ID: 3, Status: "pending"},
+	}
+
+	if err := c.run(context.Background(), []string{"approval", "edit", "-reviewer", "carol", "-text", "edited", "1"}); err != nil {
+		t.Fatalf("approval edit error = %v", err)
+	}
+	if got := queries.queue[0]; got.Status != "ready_to_send" || *got.LlmResponse != "edited" || *got.ReviewedBy != "carol" {
+		t.Fatalf("edited message = %+v", got)
+	}
+
+	if err := c.run(context.Background(), []string{"approval", "reject", "-reviewer", "carol", "-reason", "off brand", "2", "3"}); err != nil {
+		t.Fatalf("approval reject error = %v", err)
+	}
+	if len(queries.historyRows) != 1 || *queries.historyRows[0].ReviewedBy != "carol" || *queries.historyRows[0].ErrorMessage != "off brand" {
+		t.Fatalf("history = %+v", queries.historyRows)
+	}
+	if !strings.Contains(stdout.String(), "Rejected message 2") || strings.Contains(stdout.String(), "Rejected message 3") {
+		t.Fatalf("output = %q", stdout.String())
+	}
+
+	if err := c.run(context.Background(), []string{"approval", "edit", "-reviewer", "carol", "1"}); err == nil {
+		t.Fatal("approval edit without -text succeeded; want usage error")
+	}
+}
+
+func (q *fakeQuerier) SubmitMessageForApproval(_ context.Context, arg database.SubmitMessageForApprovalParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.approvalRequests = append(q.approvalRequests, arg)
+	return nil
+}
+
+func (q *fakeQuerier) ListExpiredApprovals(_ context.Context, requestedBefore pgtype.Timestamptz) ([]int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ids []int64
+	for _, message := range q.queue {
+		if message.Status == "awaiting_approval" && message.ApprovalRequestedAt.Time.Before(requestedBefore.Time) {
+			ids = append(ids, message.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (q *fakeQuerier) ApproveQueueMessage(_ context.Context, arg database.ApproveQueueMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, message := range q.queue {
+		if message.ID == arg.ID && message.Status == "awaiting_approval" {
+			q.queue[i].Status = "ready_to_send"
+			if arg.LlmResponse != nil {
+				q.queue[i].LlmResponse = arg.LlmResponse
+			}
+			q.queue[i].ReviewedBy = arg.ReviewedBy
+			q.queue[i].ReviewedAt = timestamptz(time.Now())
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (q *fakeQuerier) RejectQueueMessage(_ context.Context, arg database.RejectQueueMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, message := range q.queue {
+		if message.ID == arg.ID && message.Status == "awaiting_approval" {
+			q.queue = slices.Delete(q.queue, i, i+1)
+			q.historyRows = append(q.historyRows, database.MessageHistory{
+				ID:           int64(len(q.historyRows) + 1),
+				MessageUri:   message.MessageUri,
+				LlmResponse:  derefString(message.LlmResponse),
+				Status:       "rejected",
+				ErrorMessage: arg.Reason,
+				ReviewedBy:   &arg.ReviewedBy,
+				ReviewedAt:   timestamptz(time.Now()),
+			})
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
@@ -1,45 +1,422 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	indigoutil "github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/xrpc"
 )
 
-func (b *Bot) createAuthenticatedBlueskyClient(config *Config) (*xrpc.Client, *atproto.ServerCreateSession_Output, error) {
-	client := &xrpc.Client{Host: config.BlueskyHost}
+// BlueskyClient is the subset of the Bluesky API used by the bot.
+type BlueskyClient interface {
+	ListNotifications(ctx context.Context, cursor string, limit int64, reasons []string) (*bsky.NotificationListNotifications_Output, error)
+	UpdateSeen(ctx context.Context, seenAt time.Time) error
+	// WaitForWrite blocks until a record may be created without exceeding
+	// the rate limits or the write budget.
+	WaitForWrite(ctx context.Context) error
+	CreatePost(ctx context.Context, post *bsky.FeedPost) (string, string, error)
+	CreatePostgate(ctx context.Context, gate *bsky.FeedPostgate) error
+	DeletePost(ctx context.Context, uri string) error
+	ResolveHandle(ctx context.Context, handle string) (string, error)
+	SelfDID(ctx context.Context) (string, error)
+	GetPostThread(ctx context.Context, uri string, depth int64) (*bsky.FeedGetPostThread_Output, error)
+	GetPosts(ctx context.Context, uris []string) ([]*bsky.FeedDefs_PostView, error)
+	RecordExists(ctx context.Context, uri string) (bool, error)
+	GetProfile(ctx context.Context, actor string) (*bsky.ActorDefs_ProfileViewDetailed, error)
+	ListUnreadConvos(ctx context.Context) ([]*chat.ConvoDefs_ConvoView, error)
+	GetConvoMessages(ctx context.Context, convoID string, limit int64) ([]*chat.ConvoDefs_MessageView, error)
+	UpdateConvoRead(ctx context.Context, convoID, messageID string) error
+	SendChatMessage(ctx context.Context, convoID, text string) (string, error)
+}
+
+// chatProxy routes chat.bsky.* calls through the PDS to the Bluesky chat
+// service.
+const chatProxy = "did:web:api.bsky.chat#bsky_chat"
+
+// XRPCBlueskyClient implements BlueskyClient against a PDS. It signs in lazily
+// and signs in again when the access token has expired. Every call is paced
+// by the rate limits the PDS reports.
+type XRPCBlueskyClient struct {
+	host       string
+	identifier string
+	password   string
+	httpClient *http.Client
+	pacer      *BlueskyPacer
+
+	mu     sync.Mutex
+	client *xrpc.Client
+	did    string
+}
+
+func NewBlueskyClient(host, identifier, password string, budget WriteBudget, logger *slog.Logger) *XRPCBlueskyClient {
+	pacer := NewBlueskyPacer(budget, logger)
+	httpClient := indigoutil.RobustHTTPClient()
+	httpClient.Transport = &rateLimitTransport{next: httpClient.Transport, pacer: pacer}
+
+	return &XRPCBlueskyClient{
+		host:       host,
+		identifier: identifier,
+		password:   password,
+		httpClient: httpClient,
+		pacer:      pacer,
+	}
+}
+
+func (c *XRPCBlueskyClient) RateLimitStatus() BlueskyRateStatus {
+	return c.pacer.Status()
+}
+
+func (c *XRPCBlueskyClient) ListNotifications(ctx context.Context, cursor string, limit int64, reasons []string) (*bsky.NotificationListNotifications_Output, error) {
+	var out *bsky.NotificationListNotifications_Output
+	err := c.withSession(ctx, "app.bsky.notification.listNotifications", func(client *xrpc.Client, _ string) error {
+		var err error
+		out, err = bsky.NotificationListNotifications(ctx, client, cursor, limit, false, reasons, "")
+		return err
+	})
+	return out, err
+}
+
+func (c *XRPCBlueskyClient) UpdateSeen(ctx context.Context, seenAt time.Time) error {
+	return c.withSession(ctx, "app.bsky.notification.updateSeen", func(client *xrpc.Client, _ string) error {
+		return bsky.NotificationUpdateSeen(ctx, client, &bsky.NotificationUpdateSeen_Input{
+			SeenAt: seenAt.UTC().Format(time.RFC3339),
+		})
+	})
+}
+
+func (c *XRPCBlueskyClient) WaitForWrite(ctx context.Context) error {
+	return c.pacer.Wait(ctx, "com.atproto.repo.createRecord", true)
+}
+
+func (c *XRPCBlueskyClient) CreatePost(ctx context.Context, post *bsky.FeedPost) (string, string, error) {
+	resp, err := c.createRecord(ctx, "app.bsky.feed.post", nil, post)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Uri, resp.Cid, nil
+}
+
+// CreatePostgate stores gate under the record key of the post it applies to,
+// as required for postgate records.
+func (c *XRPCBlueskyClient) CreatePostgate(ctx context.Context, gate *bsky.FeedPostgate) error {
+	uri, err := syntax.ParseATURI(gate.Post)
+	if err != nil {
+		return fmt.Errorf("invalid post uri %q: %w", gate.Post, err)
+	}
+	rkey := uri.RecordKey().String()
+	_, err = c.createRecord(ctx, "app.bsky.feed.postgate", &rkey, gate)
+	return err
+}
+
+func (c *XRPCBlueskyClient) DeletePost(ctx context.Context, uri string) error {
+	parsed, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return fmt.Errorf("invalid post uri %q: %w", uri, err)
+	}
+	if err := c.pacer.Wait(ctx, "com.atproto.repo.deleteRecord", true); err != nil {
+		return err
+	}
+
+	return c.withSession(ctx, "com.atproto.repo.deleteRecord", func(client *xrpc.Client, did string) error {
+		_, err := atproto.RepoDeleteRecord(ctx, client, &atproto.RepoDeleteRecord_Input{
+			Repo:       did,
+			Collection: parsed.Collection().String(),
+			Rkey:       parsed.RecordKey().String(),
+		})
+		if err == nil {
+			c.pacer.RecordWrite(time.Now(), deleteRecordPoints)
+		}
+		return err
+	})
+}
+
+func (c *XRPCBlueskyClient) createRecord(ctx context.Context, collection string, rkey *string, record util.CBOR) (*atproto.RepoCreateRecord_Output, error) {
+	if err := c.pacer.Wait(ctx, "com.atproto.repo.createRecord", true); err != nil {
+		return nil, err
+	}
+
+	var resp *atproto.RepoCreateRecord_Output
+	err := c.withSession(ctx, "com.atproto.repo.createRecord", func(client *xrpc.Client, did string) error {
+		var err error
+		resp, err = atproto.RepoCreateRecord(ctx, client, &atproto.RepoCreateRecord_Input{
+			Repo:       did,
+			Collection: collection,
+			Rkey:       rkey,
+			Record:     &util.LexiconTypeDecoder{Val: record},
+		})
+		if err == nil {
+			c.pacer.RecordWrite(time.Now(), createRecordPoints)
+		}
+		return err
+	})
+	return resp, err
+}
+
+func (c *XRPCBlueskyClient) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	var did string
+	err := c.withSession(ctx, "com.atproto.identity.resolveHandle", func(client *xrpc.Client, _ string) error {
+		out, err := atproto.IdentityResolveHandle(ctx, client, handle)
+		if err != nil {
+			return err
+		}
+		did = out.Did
+		return nil
+	})
+	return did, err
+}
+
+// SelfDID returns the DID of the bot account, signing in when needed.
+func (c *XRPCBlueskyClient) SelfDID(ctx context.Context) (string, error) {
+	_, did, err := c.session(ctx, false)
+	return did, err
+}
+
+func (c *XRPCBlueskyClient) GetPostThread(ctx context.Context, uri string, depth int64) (*bsky.FeedGetPostThread_Output, error) {
+	var out *bsky.FeedGetPostThread_Output
+	err := c.withSession(ctx, "app.bsky.feed.getPostThread", func(client *xrpc.Client, _ string) error {
+		var err error
+		out, err = bsky.FeedGetPostThread(ctx, client, depth, 0, uri)
+		return err
+	})
+	return out, err
+}
+
+func (c *XRPCBlueskyClient) GetProfile(ctx context.Context, actor string) (*bsky.ActorDefs_ProfileViewDetailed, error) {
+	var out *bsky.ActorDefs_ProfileViewDetailed
+	err := c.withSession(ctx, "app.bsky.actor.getProfile", func(client *xrpc.Client, _ string) error {
+		var err error
+		out, err = bsky.ActorGetProfile(ctx, client, actor)
+		return err
+	})
+	return out, err
+}
+
+// GetPosts returns the posts in uris that exist and are visible. Deleted posts
+// are left out.
+func (c *XRPCBlueskyClient) GetPosts(ctx context.Context, uris []string) ([]*bsky.FeedDefs_PostView, error) {
+	var posts []*bsky.FeedDefs_PostView
+	for batch := range slices.Chunk(uris, getPostsBatchSize) {
+		err := c.withSession(ctx, "app.bsky.feed.getPosts", func(client *xrpc.Client, _ string) error {
+			out, err := bsky.FeedGetPosts(ctx, client, batch)
+			if err != nil {
+				return err
+			}
+			posts = append(posts, out.Posts...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return posts, nil
+}
+
+// RecordExists reports whether the record at uri still exists in its repo. It
+// tells deleted posts apart from posts that getPosts hides from the bot, such
+// as posts of authors who block it.
+func (c *XRPCBlueskyClient) RecordExists(ctx context.Context, uri string) (bool, error) {
+	parsed, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return false, fmt.Errorf("invalid record uri %q: %w", uri, err)
+	}
+
+	exists := true
+	err = c.withSession(ctx, "com.atproto.repo.getRecord", func(client *xrpc.Client, _ string) error {
+		_, err := atproto.RepoGetRecord(ctx, client, "", parsed.Collection().String(), parsed.Authority().String(), parsed.RecordKey().String())
+		var apiErr *xrpc.XRPCError
+		if errors.As(err, &apiErr) && apiErr.ErrStr == "RecordNotFound" {
+			exists = false
+			return nil
+		}
+		return err
+	})
+	return exists, err
+}
+
+// ListUnreadConvos returns the direct conversations with unread messages.
+func (c *XRPCBlueskyClient) ListUnreadConvos(ctx context.Context) ([]*chat.ConvoDefs_ConvoView, error) {
+	var convos []*chat.ConvoDefs_ConvoView
+	cursor := ""
+	for {
+		var out *chat.ConvoListConvos_Output
+		err := c.withChatSession(ctx, "chat.bsky.convo.listConvos", func(client *xrpc.Client) error {
+			var err error
+			out, err = chat.ConvoListConvos(ctx, client, cursor, "", 100, "", "unread", "")
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, convo := range out.Convos {
+			if convo.Kind == nil || convo.Kind.ConvoDefs_GroupConvo == nil {
+				convos = append(convos, convo)
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" {
+			return convos, nil
+		}
+		cursor = *out.Cursor
+	}
+}
+
+// GetConvoMessages returns up to limit messages of a conversation, newest
+// first. Deleted and system messages are left out.
+func (c *XRPCBlueskyClient) GetConvoMessages(ctx context.Context, convoID string, limit int64) ([]*chat.ConvoDefs_MessageView, error) {
+	var messages []*chat.ConvoDefs_MessageView
+	err := c.withChatSession(ctx, "chat.bsky.convo.getMessages", func(client *xrpc.Client) error {
+		out, err := chat.ConvoGetMessages(ctx, client, convoID, "", limit)
+		if err != nil {
+			return err
+		}
+		for _, message := range out.Messages {
+			if message.ConvoDefs_MessageView != nil {
+				messages = append(messages, message.ConvoDefs_MessageView)
+			}
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// UpdateConvoRead marks a conversation as read up to messageID, or entirely
+// when messageID is empty.
+func (c *XRPCBlueskyClient) UpdateConvoRead(ctx context.Context, convoID, messageID string) error {
+	input := &chat.ConvoUpdateRead_Input{ConvoId: convoID}
+	if messageID != "" {
+		input.MessageId = &messageID
+	}
+	return c.withChatSession(ctx, "chat.bsky.convo.updateRead", func(client *xrpc.Client) error {
+		_, err := chat.ConvoUpdateRead(ctx, client, input)
+		return err
+	})
+}
+
+// SendChatMessage sends text to a conversation and returns the message ID.
+func (c *XRPCBlueskyClient) SendChatMessage(ctx context.Context, convoID, text string) (string, error) {
+	var messageID string
+	err := c.withChatSession(ctx, "chat.bsky.convo.sendMessage", func(client *xrpc.Client) error {
+		out, err := chat.ConvoSendMessage(ctx, client, &chat.ConvoSendMessage_Input{
+			ConvoId: convoID,
+			Message: &chat.ConvoDefs_MessageInput{
+				Text:   text,
+				Facets: linkFacets(text),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		messageID = out.Id
+		return nil
+	})
+	return messageID, err
+}
+
+// withChatSession is withSession for chat calls, which the PDS forwards to
+// the chat service named in the proxy header.
+func (c *XRPCBlueskyClient) withChatSession(ctx context.Context, method string, call func(client *xrpc.Client) error) error {
+	return c.withSession(ctx, method, func(client *xrpc.Client, _ string) error {
+		proxied := *client
+		proxied.Headers = map[string]string{"atproto-proxy": chatProxy}
+		return call(&proxied)
+	})
+}
+
+// withSession runs call with a signed-in client after waiting for the rate
+// limit of method. Write calls wait for their write budget before calling
+// withSession.
+func (c *XRPCBlueskyClient) withSession(ctx context.Context, method string, call func(client *xrpc.Client, did string) error) error {
+	if err := c.pacer.Wait(ctx, method, false); err != nil {
+		return err
+	}
+
+	client, did, err := c.session(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = call(client, did)
+	if err == nil || !isExpiredSessionError(err) {
+		return err
+	}
+
+	client, did, err = c.session(ctx, true)
+	if err != nil {
+		return err
+	}
+	return call(client, did)
+}
+
+func (c *XRPCBlueskyClient) session(ctx context.Context, renew bool) (*xrpc.Client, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil && !renew {
+		return c.client, c.did, nil
+	}
 
 	auth, err := atproto.ServerCreateSession(
-		b.ctx,
-		client,
+		ctx,
+		&xrpc.Client{Client: c.httpClient, Host: c.host},
 		&atproto.ServerCreateSession_Input{
-			Identifier: config.BlueskyIdentifier,
-			Password:   config.BlueskyPassword,
+			Identifier: c.identifier,
+			Password:   c.password,
 		},
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("authentication failed: %w", err)
+		c.client = nil
+		return nil, "", fmt.Errorf("authentication failed: %w", err)
 	}
 
-	authClient := &xrpc.Client{
-		Host: client.Host,
-		Auth: &xrpc.AuthInfo{AccessJwt: auth.AccessJwt},
+	c.client = &xrpc.Client{
+		Client: c.httpClient,
+		Host:   c.host,
+		Auth: &xrpc.AuthInfo{
+			AccessJwt:  auth.AccessJwt,
+			RefreshJwt: auth.RefreshJwt,
+			Handle:     auth.Handle,
+			Did:        auth.Did,
+		},
 	}
+	c.did = auth.Did
+	return c.client, c.did, nil
+}
 
-	return authClient, auth, nil
+func isExpiredSessionError(err error) bool {
+	var xrpcErr *xrpc.Error
+	if !errors.As(err, &xrpcErr) {
+		return false
+	}
+	if xrpcErr.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+
+	var apiErr *xrpc.XRPCError
+	return errors.As(err, &apiErr) && (apiErr.ErrStr == "ExpiredToken" || apiErr.ErrStr == "InvalidToken")
 }
 
-func (b *Bot) checkNotifications(authClient *xrpc.Client) ([]*bsky.NotificationListNotifications_Notification, error) {
+func (b *Bot) checkNotifications() ([]*bsky.NotificationListNotifications_Notification, error) {
 	limit := int64(10)
 	reasons := []string{"mention"}
+	if b.currentConfig().AuthorDelete {
+		reasons = append(reasons, "reply")
+	}
 	cursor := ""
 	var allUnreadNotifications []*bsky.NotificationListNotifications_Notification
 
 	for {
-		notificationsList, err := bsky.NotificationListNotifications(b.ctx, authClient, cursor, limit, false, reasons, "")
+		notificationsList, err := b.bluesky.ListNotifications(b.ctx, cursor, limit, reasons)
 		if err != nil {
 			return nil, fmt.Errorf("failed to list notifications: %w", err)
 		}
@@ -73,12 +450,7 @@ func (b *Bot) checkNotifications(authClient *xrpc.Client) ([]*bsky.NotificationL
 	}
 
 	if len(allUnreadNotifications) > 0 {
-		seenInput := &bsky.NotificationUpdateSeen_Input{
-			SeenAt: time.Now().UTC().Format(time.RFC3339),
-		}
-
-		err := bsky.NotificationUpdateSeen(b.ctx, authClient, seenInput)
-		if err != nil {
+		if err := b.bluesky.UpdateSeen(b.ctx, time.Now()); err != nil {
 			return nil, fmt.Errorf("failed to mark notifications as seen: %w", err)
 		}
 	}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+)
+
+// createRecordPoints is what the PDS charges against the write budget for
+// every created record.
+const createRecordPoints = 3
+
+// deleteRecordPoints is what a deleted record costs.
+const deleteRecordPoints = 1
+
+// rateLimitReserve is the share of a rate limit window the pacer keeps
+// unused. Below it, requests are spread over the rest of the window.
+const rateLimitReserve = 0.2
+
+type WriteBudget struct {
+	PointsPerHour int
+	PointsPerDay  int
+}
+
+type rateLimitState struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	Policy    string    `json:"policy,omitempty"`
+}
+
+type writeRecord struct {
+	at     time.Time
+	points int
+}
+
+type BlueskyRateStatus struct {
+	Endpoints        map[string]rateLimitState `json:"endpoints"`
+	WritePointsHour  int                       `json:"write_points_hour"`
+	WritePointsDay   int                       `json:"write_points_day"`
+	HourlyPointLimit int                       `json:"hourly_point_limit"`
+	DailyPointLimit  int                       `json:"daily_point_limit"`
+}
+
+// BlueskyPacer tracks the rate limits the PDS reports per XRPC method and the
+// bot's own write-points budget, and delays calls so that the bot slows down
+// before it is throttled.
+type BlueskyPacer struct {
+	mu        sync.Mutex
+	endpoints map[string]rateLimitState
+	writes    []writeRecord
+	budget    WriteBudget
+	logger    *slog.Logger
+}
+
+func NewBlueskyPacer(budget WriteBudget, logger *slog.Logger) *BlueskyPacer {
+	return &BlueskyPacer{
+		endpoints: map[string]rateLimitState{},
+		budget:    budget,
+		logger:    logger,
+	}
+}
+
+// Observe records the rate-limit headers of a response to the given method.
+func (p *BlueskyPacer) Observe(method string, statusCode int, header http.Header) {
+	limit, limitErr := strconv.Atoi(header.Get("ratelimit-limit"))
+	remaining, remainingErr := strconv.Atoi(header.Get("ratelimit-remaining"))
+	reset, resetErr := strconv.ParseInt(header.Get("ratelimit-reset"), 10, 64)
+	if resetErr != nil || (remainingErr != nil && statusCode != http.StatusTooManyRequests) {
+		return
+	}
+	if statusCode == http.StatusTooManyRequests {
+		remaining = 0
+	}
+	if limitErr != nil {
+		limit = remaining
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endpoints[method] = rateLimitState{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+		Policy:    header.Get("ratelimit-policy"),
+	}
+
+	if statusCode == http.StatusTooManyRequests && p.logger != nil {
+		p.logger.Warn("Bluesky rate limit reached",
+			"method", method,
+			"reset_at", time.Unix(reset, 0).Format(time.RFC3339))
+	}
+}
+
+// RecordWrite charges points against the local write budget.
+func (p *BlueskyPacer) RecordWrite(now time.Time, points int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writes = append(p.writes, writeRecord{at: now, points: points})
+	p.pruneWrites(now)
+}
+
+// Delay returns how long a call to method should wait. Writes additionally
+// respect the hourly and daily write-points budget.
+func (p *BlueskyPacer) Delay(method string, write bool, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delay := endpointDelay(p.endpoints[method], now)
+	if write {
+		p.pruneWrites(now)
+		delay = max(delay,
+			p.writeBudgetDelay(time.Hour, p.budget.PointsPerHour, now),
+			p.writeBudgetDelay(24*time.Hour, p.budget.PointsPerDay, now))
+	}
+	return delay
+}
+
+// Wait blocks until a call to method is within the known limits.
+func (p *BlueskyPacer) Wait(ctx context.Context, method string, write bool) error {
+	delay := p.Delay(method, write, time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	if p.logger != nil && delay >= time.Second {
+		p.logger.Info("Pacing Bluesky request to stay within rate limits",
+			"method", method,
+			"delay", delay.Round(time.Second).String())
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (p *BlueskyPacer) Status() BlueskyRateStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.pruneWrites(now)
+	status := BlueskyRateStatus{
+		Endpoints:        make(map[string]rateLimitState, len(p.endpoints)),
+		WritePointsHour:  p.writePointsSince(now.Add(-time.Hour)),
+		WritePointsDay:   p.writePointsSince(now.Add(-24 * time.Hour)),
+		HourlyPointLimit: p.budget.PointsPerHour,
+		DailyPointLimit:  p.budget.PointsPerDay,
+	}
+	for method, state := range p.endpoints {
+		status.Endpoints[method] = state
+	}
+	return status
+}
+
+func endpointDelay(state rateLimitState, now time.Time) time.Duration {
+	untilReset := state.Reset.Sub(now)
+	if state.Reset.IsZero() || untilReset <= 0 {
+		return 0
+	}
+	if state.Remaining <= 0 {
+		return untilReset
+	}
+	if float64(state.Remaining) > float64(state.Limit)*rateLimitReserve {
+		return 0
+	}
+	return untilReset / time.Duration(state.Remaining+1)
+}
+
+// writeBudgetDelay paces writes at the steady rate the budget allows once
+// most of the window is used, and waits for old writes to expire once the
+// budget is exhausted.
+func (p *BlueskyPacer) writeBudgetDelay(window time.Duration, limit int, now time.Time) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+
+	windowStart := now.Add(-window)
+	used := p.writePointsSince(windowStart)
+	if used+createRecordPoints > limit {
+		excess := used + createRecordPoints - limit
+		for _, write := range p.writes {
+			if write.at.Before(windowStart) {
+				continue
+			}
+			excess -= write.points
+			if excess <= 0 {
+				return write.at.Add(window).Sub(now)
+			}
+		}
+		return window
+	}
+
+	if float64(limit-used) > float64(limit)*rateLimitReserve {
+		return 0
+	}
+
+	steadyInterval := window / time.Duration(max(limit/createRecordPoints, 1))
+	if len(p.writes) == 0 {
+		return 0
+	}
+	return max(p.writes[len(p.writes)-1].at.Add(steadyInterval).Sub(now), 0)
+}
+
+func (p *BlueskyPacer) writePointsSince(since time.Time) int {
+	points := 0
+	for _, write := range p.writes {
+		if !write.at.Before(since) {
+			points += write.points
+		}
+	}
+	return points
+}
+
+func (p *BlueskyPacer) pruneWrites(now time.Time) {
+	cutoff := now.Add(-24 * time.Hour)
+	i := 0
+	for i < len(p.writes) && p.writes[i].at.Before(cutoff) {
+		i++
+	}
+	p.writes = p.writes[i:]
+}
+
+// rateLimitTransport feeds the rate-limit headers of every XRPC response into
+// the pacer.
+type rateLimitTransport struct {
+	next  http.RoundTripper
+	pacer *BlueskyPacer
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	t.pacer.Observe(xrpcMethod(req.URL.Path), resp.StatusCode, resp.Header)
+	return resp, nil
+}
+
+func xrpcMethod(path string) string {
+	return strings.TrimPrefix(path, "/xrpc/")
+}
+
+func isRateLimitedError(err error) bool {
+	var xrpcErr *xrpc.Error
+	return errors.As(err, &xrpcErr) && xrpcErr.StatusCode == http.StatusTooManyRequests
+}
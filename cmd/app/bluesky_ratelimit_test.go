@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+func rateLimitHeader(limit, remaining int, reset time.Time) http.Header {
+	header := http.Header{}
+	header.Set("ratelimit-limit", strconv.Itoa(limit))
+	header.Set("ratelimit-remaining", strconv.Itoa(remaining))
+	header.Set("ratelimit-reset", strconv.FormatInt(reset.Unix(), 10))
+	return header
+}
+
+func TestBlueskyPacerEndpointDelay(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	reset := now.Add(100 * time.Second)
+
+	tests := []struct {
+		name      string
+		status    int
+		remaining int
+		want      time.Duration
+	}{
+		{name: "plenty remaining", status: http.StatusOK, remaining: 50, want: 0},
+		{name: "low remaining spreads calls", status: http.StatusOK, remaining: 9, want: 10 * time.Second},
+		{name: "exhausted waits for reset", status: http.StatusOK, remaining: 0, want: 100 * time.Second},
+		{name: "too many requests waits for reset", status: http.StatusTooManyRequests, remaining: 40, want: 100 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pacer := NewBlueskyPacer(WriteBudget{}, nil)
+			pacer.Observe("com.atproto.repo.createRecord", tt.status, rateLimitHeader(100, tt.remaining, reset))
+
+			if got := pacer.Delay("com.atproto.repo.createRecord", false, now); got != tt.want {
+				t.Fatalf("Delay() = %s; want %s", got, tt.want)
+			}
+			if got := pacer.Delay("app.bsky.feed.getPostThread", false, now); got != 0 {
+				t.Fatalf("Delay() for another method = %s; want 0", got)
+			}
+			if got := pacer.Delay("com.atproto.repo.createRecord", false, reset); got != 0 {
+				t.Fatalf("Delay() after reset = %s; want 0", got)
+			}
+		})
+	}
+}
+
+func TestBlueskyPacerIgnoresResponsesWithoutHeaders(t *testing.T) {
+	pacer := NewBlueskyPacer(WriteBudget{}, nil)
+	pacer.Observe("app.bsky.notification.listNotifications", http.StatusTooManyRequests, http.Header{})
+
+	if got := pacer.Delay("app.bsky.notification.listNotifications", false, time.Now()); got != 0 {
+		t.Fatalf("Delay() = %s; want 0", got)
+	}
+}
+
+func TestBlueskyPacerWriteBudget(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	pacer := NewBlueskyPacer(WriteBudget{PointsPerHour: 30, PointsPerDay: 1000}, nil)
+
+	for i := range 7 {
+		pacer.RecordWrite(now.Add(time.Duration(i)*time.Minute), createRecordPoints)
+	}
+	last := now.Add(6 * time.Minute)
+
+	// 21 of 30 points used: still above the reserve.
+	if got := pacer.Delay("com.atproto.repo.createRecord", true, last); got != 0 {
+		t.Fatalf("Delay() with budget left = %s; want 0", got)
+	}
+	if got := pacer.Delay("com.atproto.repo.createRecord", false, last); got != 0 {
+		t.Fatalf("Delay() for a read = %s; want 0", got)
+	}
+
+	pacer.RecordWrite(last.Add(time.Minute), createRecordPoints)
+	pacer.RecordWrite(last.Add(2*time.Minute), createRecordPoints)
+	// 27 of 30 points used: writes are spaced at the steady rate of 10 per hour.
+	if got := pacer.Delay("com.atproto.repo.createRecord", true, last.Add(2*time.Minute)); got != 6*time.Minute {
+		t.Fatalf("Delay() near the limit = %s; want 6m", got)
+	}
+
+	pacer.RecordWrite(last.Add(3*time.Minute), createRecordPoints)
+	// Budget exhausted: wait until the first write leaves the hourly window.
+	if got := pacer.Delay("com.atproto.repo.createRecord", true, last.Add(3*time.Minute)); got != 51*time.Minute {
+		t.Fatalf("Delay() at the limit = %s; want 51m", got)
+	}
+
+	status := pacer.Status()
+	if status.HourlyPointLimit != 30 || status.DailyPointLimit != 1000 {
+		t.Fatalf("status limits = %d/%d", status.HourlyPointLimit, status.DailyPointLimit)
+	}
+}
+
+func TestBlueskyClientObservesRateLimitHeaders(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"accessJwt":  "access",
+				"refreshJwt": "refresh",
+				"handle":     "bot.test",
+				"did":        "did:plc:bot",
+			})
+		case "/xrpc/app.bsky.notification.listNotifications":
+			for key, values := range rateLimitHeader(3000, 0, reset) {
+				w.Header()[key] = values
+			}
+			_ = json.NewEncoder(w).Encode(bsky.NotificationListNotifications_Output{
+				Notifications: []*bsky.NotificationListNotifications_Notification{},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewBlueskyClient(server.URL, "bot.test", "password", WriteBudget{}, nil)
+	if _, err := client.ListNotifications(context.Background(), "", 10, nil); err != nil {
+		t.Fatalf("ListNotifications() error = %v", err)
+	}
+
+	state, ok := client.RateLimitStatus().Endpoints["app.bsky.notification.listNotifications"]
+	if !ok || state.Limit != 3000 || state.Remaining != 0 {
+		t.Fatalf("rate limit state = %+v, %t", state, ok)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.ListNotifications(ctx, "", 10, nil); err == nil {
+		t.Fatal("ListNotifications() with exhausted limit = nil error; want context deadline")
+	}
+}
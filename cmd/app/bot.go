@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	"log/slog"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudwego/eino/components/model"
-	"github.com/jackc/pgx/v5/pgxpool"
 
 	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
 )
@@ -18,61 +19,116 @@ type Bot struct {
 	ingestorCtx     context.Context
 	ingestorCancel  context.CancelFunc
 	wg              sync.WaitGroup
-	pool            *pgxpool.Pool
-	queries         *database.Queries
+	config          atomic.Pointer[Config]
+	queries         database.Querier
+	bluesky         BlueskyClient
 	chatModel       model.BaseChatModel
-	llmModelName    string
-	maxOutputTokens int
 	spendingLimiter *SpendingLimiter
 	requestLimiter  *RequestLimiter
-	botHandle       string
-	maxRetries      int
+	knowledge       *KnowledgeBase
+	circuitBreaker  *CircuitBreaker
+	fetchClient     *http.Client
+	search          SearchProvider
+	moderator       Moderator
+	notifier        Notifier
 	logger          *slog.Logger
 }
 
-func NewBot(pool *pgxpool.Pool, chatModel model.BaseChatModel, llmModelName string, maxOutputTokens int, spendingLimiter *SpendingLimiter, requestLimiter *RequestLimiter, botHandle string, maxRetries int, logger *slog.Logger) *Bot {
+func NewBot(config *Config, queries database.Querier, bluesky BlueskyClient, chatModel model.BaseChatModel, spendingLimiter *SpendingLimiter, requestLimiter *RequestLimiter, knowledge *KnowledgeBase, logger *slog.Logger) *Bot {
 	ctx, cancel := context.WithCancel(context.Background())
 	ingestorCtx, ingestorCancel := context.WithCancel(ctx)
 
-	queries := database.New(pool)
-
-	return &Bot{
+	bot := &Bot{
 		ctx:             ctx,
 		cancel:          cancel,
 		ingestorCtx:     ingestorCtx,
 		ingestorCancel:  ingestorCancel,
-		pool:            pool,
 		queries:         queries,
+		bluesky:         bluesky,
 		chatModel:       chatModel,
-		llmModelName:    llmModelName,
-		maxOutputTokens: maxOutputTokens,
 		spendingLimiter: spendingLimiter,
 		requestLimiter:  requestLimiter,
-		botHandle:       botHandle,
-		maxRetries:      maxRetries,
+		knowledge:       knowledge,
+		circuitBreaker:  NewCircuitBreaker(config.CircuitBreaker.Failures, config.CircuitBreaker.OpenDuration, logger),
+		fetchClient:     newFetchClient(),
 		logger:          logger,
 	}
+	bot.config.Store(config)
+	return bot
+}
+
+func (b *Bot) currentConfig() *Config {
+	return b.config.Load()
+}
+
+func (b *Bot) Reload(next *Config) {
+	current := b.currentConfig()
+	for _, name := range current.RestartRequiredChanges(next) {
+		b.logger.Warn("Changed setting requires a restart and was not applied", "setting", name)
+	}
+
+	merged := current.WithReloadedSettings(next)
+	if b.spendingLimiter != nil {
+		b.spendingLimiter.Update(merged.UsagePricing, merged.SpendingLimits())
+	}
+	if b.requestLimiter != nil {
+		b.requestLimiter.SetRequestsPerMinute(merged.LLMRequestsPerMinute)
+	}
+	b.circuitBreaker.Update(merged.CircuitBreaker.Failures, merged.CircuitBreaker.OpenDuration)
+	b.config.Store(merged)
+
+	b.logger.Info("Configuration reloaded",
+		"max_retries", merged.MaxRetries,
+		"daily_spending_limit", merged.DailySpendingLimit,
+		"weekly_spending_limit", merged.WeeklySpendingLimit,
+		"monthly_spending_limit", merged.MonthlySpendingLimit,
+		"llm_requests_per_minute", merged.LLMRequestsPerMinute,
+		"blocked_authors", len(merged.BlockedAuthors))
 }
 
-func (b *Bot) Start(config *Config) {
+func (b *Bot) Start() {
 	b.logger.Info("Starting Bluesky Reply Bot...")
 
 	b.wg.Go(func() {
-		b.runIngestor(config)
+		b.runIngestor()
 	})
 
 	b.wg.Go(func() {
-		b.runWorker(config)
+		b.runWorker()
 	})
 
 	b.wg.Go(func() {
-		b.runReplySender(config)
+		b.runReplySender()
 	})
 
 	b.wg.Go(func() {
 		b.runStaleMessageHandler()
 	})
 
+	if b.currentConfig().SourceCheckInterval > 0 {
+		b.wg.Go(func() {
+			b.runSourceSweeper()
+		})
+	}
+
+	if b.currentConfig().Memory.Enabled {
+		b.wg.Go(func() {
+			b.runMemorySweeper()
+		})
+	}
+
+	if b.currentConfig().Approval.Required {
+		b.wg.Go(func() {
+			b.runApprovalSweeper()
+		})
+	}
+
+	if addr := b.currentConfig().StatusListenAddr; addr != "" {
+		b.wg.Go(func() {
+			b.runStatusServer(addr)
+		})
+	}
+
 	b.logger.Info("Bot started successfully")
 }
 
@@ -82,7 +138,8 @@ func (b *Bot) Stop() {
 	b.logger.Info("Stopping ingestion...")
 	b.ingestorCancel()
 
-	b.logger.Info("Waiting for workers to complete", "timeout", "2m")
+	timeout := b.currentConfig().ShutdownTimeout
+	b.logger.Info("Waiting for workers to complete", "timeout", timeout.String())
 
 	done := make(chan struct{})
 	go func() {
@@ -94,8 +151,8 @@ func (b *Bot) Stop() {
 	select {
 	case <-done:
 		b.logger.Info("All workers completed gracefully")
-	case <-time.After(2 * time.Minute):
-		b.logger.Warn("Shutdown timeout reached, forcing shutdown", "timeout", "2m")
+	case <-time.After(timeout):
+		b.logger.Warn("Shutdown timeout reached, forcing shutdown", "timeout", timeout.String())
 	}
 
 	b.logger.Info("Bot stopped")
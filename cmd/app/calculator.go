@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// evaluateExpression evaluates an arithmetic expression with + - * / %, ^ for
+// powers, parentheses and the functions sqrt and abs. Powers bind tighter
+// than a leading minus, so -2^2 is -4.
+func evaluateExpression(expression string) (float64, error) {
+	p := &expressionParser{input: []rune(expression)}
+	value, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return value, nil
+}
+
+type expressionParser struct {
+	input []rune
+	pos   int
+	depth int
+}
+
+// maxExpressionDepth bounds the nesting of parentheses and unary operators.
+const maxExpressionDepth = 100
+
+func (p *expressionParser) expression() (float64, error) {
+	value, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			right, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			value += right
+		case '-':
+			p.pos++
+			right, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			value -= right
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (p *expressionParser) term() (float64, error) {
+	value, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		operator := p.peek()
+		if operator != '*' && operator != '/' && operator != '%' {
+			return value, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch operator {
+		case '*':
+			value *= right
+		case '/':
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			value /= right
+		case '%':
+			if right == 0 {
+				return 0, errors.New("division by zero")
+			}
+			value = math.Mod(value, right)
+		}
+	}
+}
+
+func (p *expressionParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-', '+':
+		sign := p.input[p.pos]
+		p.pos++
+		if err := p.enter(); err != nil {
+			return 0, err
+		}
+		value, err := p.unary()
+		p.depth--
+		if sign == '-' {
+			value = -value
+		}
+		return value, err
+	}
+	return p.power()
+}
+
+func (p *expressionParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	if err := p.enter(); err != nil {
+		return 0, err
+	}
+	exponent, err := p.unary()
+	p.depth--
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *expressionParser) primary() (float64, error) {
+	r := p.peek()
+	switch {
+	case r == '(':
+		p.pos++
+		return p.parenthesized()
+	case unicode.IsDigit(r) || r == '.':
+		return p.number()
+	case unicode.IsLetter(r):
+		name := p.identifier()
+		if p.peek() != '(' {
+			return 0, fmt.Errorf("unknown name %q", name)
+		}
+		p.pos++
+		value, err := p.parenthesized()
+		if err != nil {
+			return 0, err
+		}
+		switch strings.ToLower(name) {
+		case "sqrt":
+			if value < 0 {
+				return 0, errors.New("square root of a negative number")
+			}
+			return math.Sqrt(value), nil
+		case "abs":
+			return math.Abs(value), nil
+		default:
+			return 0, fmt.Errorf("unknown function %q", name)
+		}
+	case r == 0:
+		return 0, errors.New("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q at position %d", r, p.pos+1)
+	}
+}
+
+func (p *expressionParser) parenthesized() (float64, error) {
+	if err := p.enter(); err != nil {
+		return 0, err
+	}
+	value, err := p.expression()
+	p.depth--
+	if err != nil {
+		return 0, err
+	}
+	if p.peek() != ')' {
+		return 0, errors.New("missing closing parenthesis")
+	}
+	p.pos++
+	return value, nil
+}
+
+func (p *expressionParser) number() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.' || p.input[p.pos] == '_') {
+		p.pos++
+	}
+	text := strings.ReplaceAll(string(p.input[start:p.pos]), "_", "")
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", text)
+	}
+	return value, nil
+}
+
+func (p *expressionParser) identifier() string {
+	start := p.pos
+	for p.pos < len(p.input) && unicode.IsLetter(p.input[p.pos]) {
+		p.pos++
+	}
+	return string(p.input[start:p.pos])
+}
+
+func (p *expressionParser) enter() error {
+	p.depth++
+	if p.depth > maxExpressionDepth {
+		return errors.New("expression is nested too deeply")
+	}
+	return nil
+}
+
+// peek skips white space and returns the next rune, or 0 at the end.
+func (p *expressionParser) peek() rune {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
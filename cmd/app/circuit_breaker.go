@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+type CircuitSnapshot struct {
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	RetryAt             *time.Time   `json:"retry_at,omitempty"`
+}
+
+// CircuitBreaker stops LLM calls after consecutive provider failures. Once the
+// open duration has passed it lets a single probe request through; a
+// successful probe closes the circuit, a failed one opens it again.
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openDuration     time.Duration
+	state            CircuitState
+	failures         int
+	openedAt         time.Time
+	probing          bool
+	logger           *slog.Logger
+}
+
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration, logger *slog.Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		state:            CircuitClosed,
+		logger:           logger,
+	}
+}
+
+func (c *CircuitBreaker) Update(failureThreshold int, openDuration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failureThreshold = failureThreshold
+	c.openDuration = openDuration
+	if failureThreshold <= 0 && c.state != CircuitClosed {
+		c.transition(CircuitClosed)
+	}
+}
+
+// Allow reports whether an LLM request may be made now. In the half-open state
+// only one probe is allowed until its result is recorded.
+func (c *CircuitBreaker) Allow(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		if now.Sub(c.openedAt) < c.openDuration {
+			return false
+		}
+		c.transition(CircuitHalfOpen)
+		c.probing = true
+		return true
+	case CircuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (c *CircuitBreaker) RecordSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures = 0
+	c.probing = false
+	if c.state != CircuitClosed {
+		c.transition(CircuitClosed)
+	}
+}
+
+func (c *CircuitBreaker) RecordFailure(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures++
+	c.probing = false
+	if c.failureThreshold <= 0 {
+		return
+	}
+	if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= c.failureThreshold) {
+		c.openedAt = now
+		c.transition(CircuitOpen)
+	}
+}
+
+// ReleaseProbe gives up a half-open probe slot without a result, for example
+// when the claimed queue was empty.
+func (c *CircuitBreaker) ReleaseProbe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+}
+
+func (c *CircuitBreaker) IsOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == CircuitOpen
+}
+
+func (c *CircuitBreaker) Snapshot() CircuitSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := CircuitSnapshot{State: c.state, ConsecutiveFailures: c.failures}
+	if c.state != CircuitClosed {
+		openedAt := c.openedAt
+		retryAt := c.openedAt.Add(c.openDuration)
+		snapshot.OpenedAt = &openedAt
+		snapshot.RetryAt = &retryAt
+	}
+	return snapshot
+}
+
+func (c *CircuitBreaker) transition(next CircuitState) {
+	previous := c.state
+	c.state = next
+	if c.logger == nil {
+		return
+	}
+
+	attrs := []any{"from", previous, "to", next, "consecutive_failures", c.failures}
+	if next == CircuitOpen {
+		attrs = append(attrs, "retry_at", c.openedAt.Add(c.openDuration).Format(time.RFC3339))
+		c.logger.Warn("LLM circuit breaker state changed", attrs...)
+		return
+	}
+	c.logger.Info("LLM circuit breaker state changed", attrs...)
+}
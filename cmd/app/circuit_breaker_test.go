@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute, nil)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	breaker.RecordFailure(now)
+	if !breaker.Allow(now) {
+		t.Fatal("Allow() = false after one failure; want true")
+	}
+	breaker.RecordFailure(now)
+	if breaker.Allow(now.Add(30*time.Second)) {
+		t.Fatal("Allow() = true while open; want false")
+	}
+
+	probeAt := now.Add(time.Minute)
+	if !breaker.Allow(probeAt) {
+		t.Fatal("Allow() = false after open duration; want probe")
+	}
+	if breaker.Allow(probeAt) {
+		t.Fatal("Allow() = true for a second probe; want false")
+	}
+	breaker.RecordFailure(probeAt)
+	if got := breaker.Snapshot().State; got != CircuitOpen {
+		t.Fatalf("state after failed probe = %s; want open", got)
+	}
+
+	if !breaker.Allow(probeAt.Add(time.Minute)) {
+		t.Fatal("Allow() = false after second open duration; want probe")
+	}
+	breaker.RecordSuccess()
+	if got := breaker.Snapshot(); got.State != CircuitClosed || got.ConsecutiveFailures != 0 {
+		t.Fatalf("snapshot after successful probe = %+v; want closed", got)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := NewCircuitBreaker(0, time.Minute, nil)
+	now := time.Now()
+	for range 10 {
+		breaker.RecordFailure(now)
+	}
+	if !breaker.Allow(now) {
+		t.Fatal("Allow() = false with breaker disabled; want true")
+	}
+}
+
+func TestProcessNextMessageReleasesWhenCircuitOpens(t *testing.T) {
+	bot := newTestBot(3)
+	bot.circuitBreaker.Update(1, time.Hour)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 4, MessageText: "hello"}, {ID: 5, MessageText: "hello"}}
+	bot.model.errs = []error{errors.New("provider unavailable")}
+
+	if err := bot.processNextMessage(); err == nil {
+		t.Fatal("processNextMessage() error = nil; want generation error")
+	}
+	if len(bot.queries.released) != 1 || bot.queries.released[0].ID != 4 || len(bot.queries.failed) != 0 {
+		t.Fatalf("released = %+v, failed = %+v; want message 4 released without retry", bot.queries.released, bot.queries.failed)
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() while open error = %v", err)
+	}
+	if len(bot.queries.claimable) != 1 || bot.model.calls != 1 {
+		t.Fatalf("claimed or called model while circuit open: claimable = %d, calls = %d", len(bot.queries.claimable), bot.model.calls)
+	}
+}
+
+func TestStatusHandlerReportsCircuitState(t *testing.T) {
+	bot := newTestBot(3)
+	bot.circuitBreaker.Update(1, time.Hour)
+	bot.circuitBreaker.RecordFailure(time.Now())
+
+	rec := httptest.NewRecorder()
+	bot.statusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	var status BotStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if rec.Code != http.StatusOK || status.CircuitBreaker.State != CircuitOpen || status.CircuitBreaker.RetryAt == nil {
+		t.Fatalf("status = %d %+v; want open circuit", rec.Code, status)
+	}
+}
+
+func (q *fakeQuerier) ReleaseMessage(_ context.Context, arg database.ReleaseMessageParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.released = append(q.released, arg)
+	return nil
+}
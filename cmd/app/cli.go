@@ -0,0 +1,1113 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const cliUsage = `Usage: app [command]
+
+Commands:
+  run                                       run the bot (default)
+  config check [FILE]                       validate the configuration
+  migrate up|down|status                    manage database migrations
+  queue list [-status S] [-limit N]         list queued messages
+  queue show ID                             show a queued message
+  queue requeue ID                          reset a queued message to pending
+  queue purge (-status S | ID)              delete queued messages
+  deadletter list [-limit N]                list dead-lettered messages
+  deadletter show ID                        show a dead letter with errors, attempts and payload
+  deadletter replay [-model M] [-force] (-all | ID...)
+                                            queue dead letters again, optionally with another model
+  deadletter discard (-all | ID...)         permanently delete dead letters
+  history search [-author A] [-status S] [-query Q] [-limit N]
+  history export -from DATE [-to DATE] [-format jsonl|csv]
+  history delete [-regenerate] [-model M] ID
+                                            delete the posts of a reply, optionally queue the message again
+  history tools ID                          show the tool calls made while generating a reply
+  spend today                               show today's LLM spend, budgets and forecast
+  spend range -from DATE [-to DATE]         show daily LLM spend for a date range
+  post-test [-text TEXT] URI                send a test reply to a post
+  prompt render (-id ID | -text TEXT)       print the LLM prompt for a message
+  kb ingest [-chunk-size N] PATH...         add or update Markdown and text documents in the knowledge base
+  kb list                                   list knowledge base documents
+  kb search [-k N] QUERY                    show the passages retrieved for a query
+  kb remove SOURCE...                       remove documents from the knowledge base
+  memory show DID                           show what the bot remembers about a user
+  memory forget DID...                      wipe the memory of users
+  approval list [-limit N]                  list replies awaiting approval
+  approval approve [-reviewer R] ID...      send replies awaiting approval
+  approval edit [-reviewer R] -text TEXT ID
+                                            replace a reply awaiting approval and send it
+  approval reject [-reviewer R] [-reason R] ID...
+                                            drop replies awaiting approval
+
+Approval commands record $USER as the reviewer unless -reviewer is given.
+Dates use the YYYY-MM-DD format and are interpreted in UTC.
+`
+
+var errUsage = errors.New("invalid usage")
+
+type cli struct {
+	config  *Config
+	queries database.Querier
+	bluesky BlueskyClient
+	// knowledge is nil unless EMBEDDING_MODEL is set.
+	knowledge *KnowledgeBase
+	spending  *SpendingLimiter
+	stdout    io.Writer
+	stderr    io.Writer
+	logger    *slog.Logger
+}
+
+func runCommand(ctx context.Context, args []string, stdout, stderr io.Writer, logger *slog.Logger) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stdout, cliUsage)
+		return nil
+	}
+
+	if args[0] == "config" {
+		return runConfigCheck(args[1:], stdout)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if args[0] == "migrate" {
+		if len(args) != 2 || (args[1] != "up" && args[1] != "down" && args[1] != "status") {
+			return usageError("migrate requires one of up, down or status")
+		}
+		return runMigrationCommand(ctx, config.DatabaseURL, args[1], logger)
+	}
+
+	pool, err := openDatabase(config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	c := &cli{
+		config:   config,
+		queries:  database.New(pool),
+		bluesky:  NewBlueskyClient(config.BlueskyHost, config.BlueskyIdentifier, config.BlueskyPassword, config.BlueskyWriteBudget, logger),
+		spending: NewSpendingLimiter(NewPostgresSpendingStore(pool), config.UsagePricing, config.SpendingLimits()),
+		stdout:   stdout,
+		stderr:   stderr,
+		logger:   logger,
+	}
+	if config.Embedding.Model != "" {
+		embedder, err := NewEmbedder(ctx, config.Embedding)
+		if err != nil {
+			return fmt.Errorf("failed to initialize embedding model: %w", err)
+		}
+		c.knowledge = NewKnowledgeBase(c.queries, embedder, config.Embedding.Model, config.KnowledgeBase.Index, c.spending)
+	}
+	return c.run(ctx, args)
+}
+
+func runConfigCheck(args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		return usageError("config requires the check subcommand")
+	}
+	if len(args) == 2 {
+		if err := os.Setenv("CONFIG_FILE", args[1]); err != nil {
+			return err
+		}
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("configuration is invalid:\n%w", err)
+	}
+
+	source := "environment only"
+	if config.ConfigFile != "" {
+		source = config.ConfigFile + " and environment"
+	}
+	fmt.Fprintf(stdout, "Configuration is valid (%s)\n", source)
+	for _, line := range configSummary(config) {
+		fmt.Fprintf(stdout, "  %s\n", line)
+	}
+	return nil
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "queue":
+		return c.runQueue(ctx, args[1:])
+	case "deadletter":
+		return c.runDeadLetter(ctx, args[1:])
+	case "history":
+		return c.runHistory(ctx, args[1:])
+	case "spend":
+		return c.runSpend(ctx, args[1:])
+	case "post-test":
+		return c.runPostTest(ctx, args[1:])
+	case "prompt":
+		return c.runPrompt(ctx, args[1:])
+	case "kb":
+		return c.runKnowledgeBase(ctx, args[1:])
+	case "memory":
+		return c.runMemory(ctx, args[1:])
+	case "approval":
+		return c.runApproval(ctx, args[1:])
+	default:
+		return usageError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+}
+
+func usageError(message string) error {
+	return fmt.Errorf("%w: %s\n\n%s", errUsage, message, cliUsage)
+}
+
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs
+}
+
+func (c *cli) runQueue(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("queue requires a subcommand")
+	}
+
+	switch args[0] {
+	case "list":
+		fs := c.flagSet("queue list")
+		status := fs.String("status", "", "only list messages with this status")
+		limit := fs.Int("limit", 50, "maximum number of messages")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		rows, err := c.queries.ListQueueMessages(ctx, database.ListQueueMessagesParams{
+			Status:   optionalString(*status),
+			RowLimit: int32(*limit),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list queue: %w", err)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tRETRIES\tAUTHOR\tCREATED\tDEFERRED UNTIL\tNEXT ATTEMPT\tTEXT")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				row.ID, row.Status, row.RetryCount, row.AuthorHandle,
+				formatTimestamp(row.CreatedAt), formatTimestamp(row.DeferredUntil), formatTimestamp(row.NextAttemptAt),
+				truncateText(row.MessageText, 60))
+		}
+		return w.Flush()
+	case "show":
+		id, err := parseIDArg(args[1:])
+		if err != nil {
+			return err
+		}
+		message, err := c.queries.GetQueueMessage(ctx, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("queue message %d not found", id)
+			}
+			return fmt.Errorf("failed to load queue message: %w", err)
+		}
+		return c.writeJSON(message)
+	case "requeue":
+		id, err := parseIDArg(args[1:])
+		if err != nil {
+			return err
+		}
+		updated, err := c.queries.RequeueMessage(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to requeue message: %w", err)
+		}
+		if updated == 0 {
+			return fmt.Errorf("queue message %d not found or currently processing", id)
+		}
+		fmt.Fprintf(c.stdout, "Requeued message %d\n", id)
+		return nil
+	case "purge":
+		fs := c.flagSet("queue purge")
+		status := fs.String("status", "", "delete all messages with this status")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *status != "" {
+			deleted, err := c.queries.PurgeQueueMessages(ctx, *status)
+			if err != nil {
+				return fmt.Errorf("failed to purge queue: %w", err)
+			}
+			fmt.Fprintf(c.stdout, "Deleted %d messages with status %s\n", deleted, *status)
+			return nil
+		}
+		id, err := parseIDArg(fs.Args())
+		if err != nil {
+			return err
+		}
+		if err := c.queries.DeleteMessageFromQueue(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete queue message: %w", err)
+		}
+		fmt.Fprintf(c.stdout, "Deleted message %d\n", id)
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown queue subcommand %q", args[0]))
+	}
+}
+
+func (c *cli) runDeadLetter(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("deadletter requires a subcommand")
+	}
+
+	switch args[0] {
+	case "list":
+		fs := c.flagSet("deadletter list")
+		limit := fs.Int("limit", 50, "maximum number of dead letters")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		rows, err := c.queries.ListDeadLetters(ctx, int32(*limit))
+		if err != nil {
+			return fmt.Errorf("failed to list dead letters: %w", err)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTAGE\tRETRIES\tANSWERED\tAUTHOR\tDEAD LETTERED\tTEXT\tLAST ERROR")
+		for _, row := range rows {
+			lastError := ""
+			if row.LastError != nil {
+				lastError = *row.LastError
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%t\t%s\t%s\t%s\t%s\n",
+				row.ID, row.Stage, row.RetryCount, row.Answered, row.AuthorHandle, formatTimestamp(row.DeadLetteredAt),
+				truncateText(row.MessageText, 40), truncateText(lastError, 60))
+		}
+		return w.Flush()
+	case "show":
+		id, err := parseIDArg(args[1:])
+		if err != nil {
+			return err
+		}
+		deadLetter, err := c.queries.GetDeadLetter(ctx, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("dead letter %d not found", id)
+			}
+			return fmt.Errorf("failed to load dead letter: %w", err)
+		}
+		return c.writeJSON(deadLetter)
+	case "replay":
+		fs := c.flagSet("deadletter replay")
+		modelName := fs.String("model", "", "model to use instead of LLM_MODEL")
+		all := fs.Bool("all", false, "replay all dead letters")
+		force := fs.Bool("force", false, "also replay dead letters whose post was already answered")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		ids, err := c.deadLetterIDs(ctx, *all, fs.Args())
+		if err != nil {
+			return err
+		}
+		replayed := 0
+		for _, id := range ids {
+			deadLetter, err := c.queries.GetDeadLetter(ctx, id)
+			if errors.Is(err, pgx.ErrNoRows) {
+				fmt.Fprintf(c.stderr, "Skipped dead letter %d: not found\n", id)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load dead letter %d: %w", id, err)
+			}
+			if deadLetter.Answered && !*force {
+				fmt.Fprintf(c.stderr, "Skipped dead letter %d: the post was already answered; use -force to reply again\n", id)
+				continue
+			}
+			_, err = c.queries.ReplayDeadLetter(ctx, database.ReplayDeadLetterParams{
+				ModelOverride: optionalString(*modelName),
+				ID:            id,
+			})
+			if errors.Is(err, pgx.ErrNoRows) {
+				fmt.Fprintf(c.stderr, "Skipped dead letter %d: not found or message already queued\n", id)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to replay dead letter %d: %w", id, err)
+			}
+			replayed++
+		}
+		fmt.Fprintf(c.stdout, "Replayed %d of %d dead letters\n", replayed, len(ids))
+		return nil
+	case "discard":
+		fs := c.flagSet("deadletter discard")
+		all := fs.Bool("all", false, "discard all dead letters")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *all {
+			if fs.NArg() > 0 {
+				return usageError("use either -all or dead letter IDs")
+			}
+			deleted, err := c.queries.DeleteAllDeadLetters(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to discard dead letters: %w", err)
+			}
+			fmt.Fprintf(c.stdout, "Discarded %d dead letters\n", deleted)
+			return nil
+		}
+		ids, err := parseIDArgs(fs.Args())
+		if err != nil {
+			return err
+		}
+		var deleted int64
+		for _, id := range ids {
+			n, err := c.queries.DeleteDeadLetter(ctx, id)
+			if err != nil {
+				return fmt.Errorf("failed to discard dead letter %d: %w", id, err)
+			}
+			deleted += n
+		}
+		fmt.Fprintf(c.stdout, "Discarded %d dead letters\n", deleted)
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown deadletter subcommand %q", args[0]))
+	}
+}
+
+func (c *cli) deadLetterIDs(ctx context.Context, all bool, args []string) ([]int64, error) {
+	if !all {
+		return parseIDArgs(args)
+	}
+	if len(args) > 0 {
+		return nil, usageError("use either -all or dead letter IDs")
+	}
+
+	rows, err := c.queries.ListDeadLetters(ctx, math.MaxInt32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	ids := make([]int64, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return ids, nil
+}
+
+func (c *cli) runHistory(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("history requires a subcommand")
+	}
+
+	switch args[0] {
+	case "search":
+		fs := c.flagSet("history search")
+		author := fs.String("author", "", "author handle or DID")
+		status := fs.String("status", "", "history status")
+		query := fs.String("query", "", "text contained in the message or response")
+		limit := fs.Int("limit", 50, "maximum number of entries")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		rows, err := c.queries.SearchMessageHistory(ctx, database.SearchMessageHistoryParams{
+			Author:   optionalString(*author),
+			Status:   optionalString(*status),
+			Query:    optionalString(*query),
+			RowLimit: int32(*limit),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search history: %w", err)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tAUTHOR\tCOMPLETED\tTEXT\tRESPONSE")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				row.ID, row.Status, row.AuthorHandle, formatTimestamp(row.CompletedAt),
+				truncateText(row.MessageText, 40), truncateText(row.LlmResponse, 40))
+		}
+		return w.Flush()
+	case "export":
+		fs := c.flagSet("history export")
+		from := fs.String("from", "", "first day to export")
+		to := fs.String("to", "", "last day to export (default today)")
+		format := fs.String("format", "jsonl", "output format: jsonl or csv")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		fromDate, toDate, err := parseDateRange(*from, *to, time.UTC)
+		if err != nil {
+			return err
+		}
+		rows, err := c.queries.ListMessageHistoryBetween(ctx, database.ListMessageHistoryBetweenParams{
+			FromTime: pgtype.Timestamptz{Time: fromDate, Valid: true},
+			ToTime:   pgtype.Timestamptz{Time: toDate.AddDate(0, 0, 1), Valid: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export history: %w", err)
+		}
+		switch *format {
+		case "jsonl":
+			encoder := json.NewEncoder(c.stdout)
+			for _, row := range rows {
+				if err := encoder.Encode(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "csv":
+			return writeHistoryCSV(c.stdout, rows)
+		default:
+			return usageError(fmt.Sprintf("unknown export format %q", *format))
+		}
+	case "delete":
+		fs := c.flagSet("history delete")
+		regenerate := fs.Bool("regenerate", false, "queue the message again for a new reply")
+		modelName := fs.String("model", "", "model to use for the new reply instead of LLM_MODEL")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		id, err := parseIDArg(fs.Args())
+		if err != nil {
+			return err
+		}
+		return c.deleteHistoryReply(ctx, id, *regenerate, *modelName)
+	case "tools":
+		id, err := parseIDArg(args[1:])
+		if err != nil {
+			return err
+		}
+		entry, err := c.queries.GetMessageHistory(ctx, id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("history entry %d not found", id)
+			}
+			return fmt.Errorf("failed to load history entry: %w", err)
+		}
+		calls, err := c.queries.ListToolCalls(ctx, entry.MessageUri)
+		if err != nil {
+			return fmt.Errorf("failed to list tool calls: %w", err)
+		}
+		return c.writeJSON(calls)
+	default:
+		return usageError(fmt.Sprintf("unknown history subcommand %q", args[0]))
+	}
+}
+
+func (c *cli) deleteHistoryReply(ctx context.Context, id int64, regenerate bool, modelName string) error {
+	entry, err := c.queries.GetMessageHistory(ctx, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("history entry %d not found", id)
+		}
+		return fmt.Errorf("failed to load history entry: %w", err)
+	}
+
+	deleted, err := deleteReply(ctx, c.bluesky, c.queries, entry, "operator")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Deleted %d posts of history entry %d\n", deleted, id)
+
+	if !regenerate {
+		return nil
+	}
+	queueID, err := c.queries.RegenerateHistoryMessage(ctx, database.RegenerateHistoryMessageParams{
+		ModelOverride: optionalString(modelName),
+		ID:            id,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("message of history entry %d is already queued", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to queue message again: %w", err)
+	}
+	fmt.Fprintf(c.stdout, "Queued message again as %d\n", queueID)
+	return nil
+}
+
+func (c *cli) runSpend(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("spend requires a subcommand")
+	}
+
+	var fromDate, toDate time.Time
+	switch args[0] {
+	case "today":
+		today, err := time.Parse(time.DateOnly, usageDate(time.Now(), c.config.SpendingLimits().location()))
+		if err != nil {
+			return err
+		}
+		fromDate, toDate = today, today
+	case "range":
+		fs := c.flagSet("spend range")
+		from := fs.String("from", "", "first day")
+		to := fs.String("to", "", "last day (default today)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		var err error
+		fromDate, toDate, err = parseDateRange(*from, *to, c.config.SpendingLimits().location())
+		if err != nil {
+			return err
+		}
+	default:
+		return usageError(fmt.Sprintf("unknown spend subcommand %q", args[0]))
+	}
+
+	rows, err := c.queries.ListDailyUsage(ctx, database.ListDailyUsageParams{
+		FromDate: pgtype.Date{Time: fromDate, Valid: true},
+		ToDate:   pgtype.Date{Time: toDate, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load LLM usage: %w", err)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tINPUT CACHE\tINPUT MISS\tOUTPUT\tEMBEDDING\tSPENT\tRESERVED")
+	var total int64
+	for _, row := range rows {
+		total += row.EstimatedSpendMicros
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			row.UsageDate.Time.Format(time.DateOnly), row.InputCacheTokens, row.InputMissTokens, row.OutputTokens, row.EmbeddingTokens,
+			formatMicros(row.EstimatedSpendMicros), formatMicros(row.ReservedSpendMicros))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "\nTotal spent: %s", formatMicros(total))
+	if c.config.DailySpendingLimit > 0 {
+		fmt.Fprintf(c.stdout, " (daily limit %s)", formatMicros(currencyToMicros(c.config.DailySpendingLimit)))
+	}
+	fmt.Fprintln(c.stdout)
+
+	if args[0] == "today" && c.spending != nil {
+		return c.printBudgets(ctx, time.Now())
+	}
+	return nil
+}
+
+// printBudgets shows the spend of every budget period together with the
+// projected spend at its end.
+func (c *cli) printBudgets(ctx context.Context, now time.Time) error {
+	forecast, err := c.spending.Forecast(ctx, now)
+	if err != nil {
+		return err
+	}
+	statuses, err := c.spending.Statuses(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "\nDaily rate: %s\n", formatMicros(forecast.DailyRateMicros))
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BUDGET\tSPENT\tRESERVED\tLIMIT\tUSED\tPROJECTED\tRESETS")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d%%\t%s\t%s\n",
+			status.Period, formatMicros(status.SpentMicros), formatMicros(status.ReservedMicros), formatMicros(status.LimitMicros),
+			status.SpentMicros*100/status.LimitMicros, formatMicros(forecast.projected(status.Period)),
+			status.ResetAt.Format(time.RFC3339))
+	}
+	if len(statuses) == 0 {
+		fmt.Fprintf(w, "none\t\t\t\t\t%s\t%s\n", formatMicros(forecast.EndOfDayMicros), c.spending.nextDailyReset(now).Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (c *cli) runPostTest(ctx context.Context, args []string) error {
+	fs := c.flagSet("post-test")
+	text := fs.String("text", "Test reply from the Bluesky reply bot.", "reply text")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError("post-test requires the URI of the post to reply to")
+	}
+
+	replyRef, err := fetchReplyRef(ctx, c.bluesky, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	uri, cid, err := c.bluesky.CreatePost(ctx, &bsky.FeedPost{
+		Text:      *text,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Reply:     replyRef,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send test reply: %w", err)
+	}
+
+	fmt.Fprintf(c.stdout, "Sent test reply %s (cid %s)\n", uri, cid)
+	return nil
+}
+
+func (c *cli) runPrompt(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "render" {
+		return usageError("prompt requires the render subcommand")
+	}
+
+	fs := c.flagSet("prompt render")
+	id := fs.Int64("id", 0, "queue message ID")
+	text := fs.String("text", "", "message text")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	messageText := *text
+	authorDID := ""
+	if *id != 0 {
+		message, err := c.queries.GetQueueMessage(ctx, *id)
+		if err != nil {
+			return fmt.Errorf("failed to load queue message %d: %w", *id, err)
+		}
+		messageText = message.MessageText
+		authorDID = message.AuthorDid
+	}
+	if messageText == "" {
+		return usageError("prompt render requires -id or -text")
+	}
+
+	data := PromptData{Message: messageText}
+	if authorDID != "" && c.config.Memory.Enabled {
+		memory, err := c.queries.GetUserMemory(ctx, authorDID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("failed to load user memory: %w", err)
+		}
+		data.Memory = memory.Summary
+	}
+	if c.knowledge != nil && c.config.KnowledgeBase.Enabled {
+		passages, err := c.knowledge.Retrieve(ctx, messageText, c.config.KnowledgeBase.TopK, c.config.KnowledgeBase.MinScore)
+		if err != nil {
+			return err
+		}
+		data.Knowledge = formatKnowledge(passages)
+	}
+	prompt, err := c.config.Prompt.Render(data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(c.stdout, prompt)
+	return nil
+}
+
+func (c *cli) runKnowledgeBase(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("kb requires a subcommand")
+	}
+
+	switch args[0] {
+	case "ingest":
+		fs := c.flagSet("kb ingest")
+		chunkSize := fs.Int("chunk-size", c.config.KnowledgeBase.ChunkSize, "maximum passage length in characters")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			return usageError("kb ingest requires at least one file or directory")
+		}
+		if *chunkSize <= 0 {
+			return usageError("-chunk-size must be greater than zero")
+		}
+		if c.knowledge == nil {
+			return errors.New("kb ingest requires EMBEDDING_MODEL")
+		}
+		return c.ingestDocuments(ctx, fs.Args(), *chunkSize)
+	case "list":
+		rows, err := c.queries.ListKBDocuments(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list documents: %w", err)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tTITLE\tPASSAGES\tMODEL\tUPDATED")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				row.Source, truncateText(row.Title, 40), row.Passages, row.EmbeddingModel, formatTimestamp(row.UpdatedAt))
+		}
+		return w.Flush()
+	case "search":
+		fs := c.flagSet("kb search")
+		k := fs.Int("k", c.config.KnowledgeBase.TopK, "number of passages")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			return usageError("kb search requires a query")
+		}
+		if c.knowledge == nil {
+			return errors.New("kb search requires EMBEDDING_MODEL")
+		}
+		passages, err := c.knowledge.Retrieve(ctx, strings.Join(fs.Args(), " "), *k, 0)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SCORE\tSOURCE\tPASSAGE\tTEXT")
+		for _, passage := range passages {
+			fmt.Fprintf(w, "%.3f\t%s\t%s\t%s\n",
+				passage.Score, passage.Source, truncateText(passageLabel(passage.Title, passage.Heading), 40), truncateText(passage.Content, 60))
+		}
+		return w.Flush()
+	case "remove":
+		if len(args) < 2 {
+			return usageError("kb remove requires at least one source")
+		}
+		for _, source := range args[1:] {
+			removed, err := c.queries.DeleteKBDocument(ctx, source)
+			if err != nil {
+				return fmt.Errorf("failed to remove %s: %w", source, err)
+			}
+			if removed == 0 {
+				fmt.Fprintf(c.stdout, "Skipped %s: not in the knowledge base\n", source)
+				continue
+			}
+			fmt.Fprintf(c.stdout, "Removed %s\n", source)
+		}
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown kb subcommand %q", args[0]))
+	}
+}
+
+func (c *cli) runMemory(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("memory requires a subcommand")
+	}
+
+	switch args[0] {
+	case "show":
+		if len(args) != 2 {
+			return usageError("memory show requires a DID")
+		}
+		memory, err := c.queries.GetUserMemory(ctx, args[1])
+		if errors.Is(err, pgx.ErrNoRows) {
+			fmt.Fprintf(c.stdout, "No memory for %s\n", args[1])
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load user memory: %w", err)
+		}
+		fmt.Fprintf(c.stdout, "Updated: %s\n", formatTimestamp(memory.UpdatedAt))
+		if memory.ForgottenAt.Valid {
+			fmt.Fprintf(c.stdout, "Forgotten: %s\n", formatTimestamp(memory.ForgottenAt))
+		}
+		fmt.Fprintf(c.stdout, "Summary:\n%s\n", memory.Summary)
+		return nil
+	case "forget":
+		if len(args) < 2 {
+			return usageError("memory forget requires at least one DID")
+		}
+		for _, did := range args[1:] {
+			if err := c.queries.ForgetUserMemory(ctx, did); err != nil {
+				return fmt.Errorf("failed to forget %s: %w", did, err)
+			}
+			fmt.Fprintf(c.stdout, "Forgot %s\n", did)
+		}
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown memory subcommand %q", args[0]))
+	}
+}
+
+func (c *cli) runApproval(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("approval requires a subcommand")
+	}
+
+	switch args[0] {
+	case "list":
+		fs := c.flagSet("approval list")
+		limit := fs.Int("limit", 50, "maximum number of replies")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		rows, err := c.queries.ListAwaitingApproval(ctx, int32(*limit))
+		if err != nil {
+			return fmt.Errorf("failed to list replies awaiting approval: %w", err)
+		}
+		w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tAUTHOR\tREQUESTED\tTEXT\tREPLY")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n",
+				row.ID, row.AuthorHandle, formatTimestamp(row.ApprovalRequestedAt),
+				truncateText(row.MessageText, 40), truncateText(derefString(row.LlmResponse), 80))
+		}
+		return w.Flush()
+	case "approve", "edit":
+		fs := c.flagSet("approval " + args[0])
+		reviewer := fs.String("reviewer", os.Getenv("USER"), "reviewer recorded in the history")
+		text := fs.String("text", "", "reply text that replaces the generated reply")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *reviewer == "" {
+			return usageError("approval " + args[0] + " requires -reviewer")
+		}
+		var replacement *string
+		if args[0] == "edit" {
+			if strings.TrimSpace(*text) == "" || fs.NArg() != 1 {
+				return usageError("approval edit requires -text and one ID")
+			}
+			replacement = text
+		} else if *text != "" {
+			return usageError("use approval edit to replace the reply")
+		}
+		ids, err := parseIDArgs(fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			updated, err := c.queries.ApproveQueueMessage(ctx, database.ApproveQueueMessageParams{
+				LlmResponse: replacement,
+				ReviewedBy:  reviewer,
+				ID:          id,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to approve message %d: %w", id, err)
+			}
+			if updated == 0 {
+				fmt.Fprintf(c.stderr, "Skipped message %d: not awaiting approval\n", id)
+				continue
+			}
+			fmt.Fprintf(c.stdout, "Approved message %d\n", id)
+		}
+		return nil
+	case "reject":
+		fs := c.flagSet("approval reject")
+		reviewer := fs.String("reviewer", os.Getenv("USER"), "reviewer recorded in the history")
+		reason := fs.String("reason", "", "reason recorded in the history")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *reviewer == "" {
+			return usageError("approval reject requires -reviewer")
+		}
+		ids, err := parseIDArgs(fs.Args())
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rejected, err := c.queries.RejectQueueMessage(ctx, database.RejectQueueMessageParams{
+				ID:         id,
+				Reason:     optionalString(*reason),
+				ReviewedBy: *reviewer,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to reject message %d: %w", id, err)
+			}
+			if rejected == 0 {
+				fmt.Fprintf(c.stderr, "Skipped message %d: not awaiting approval\n", id)
+				continue
+			}
+			fmt.Fprintf(c.stdout, "Rejected message %d\n", id)
+		}
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown approval subcommand %q", args[0]))
+	}
+}
+
+// ingestDocuments ingests the given files and the Markdown and text files in
+// the given directories. Documents are identified by their slash-separated
+// path as given.
+func (c *cli) ingestDocuments(ctx context.Context, paths []string, chunkSize int) error {
+	var files []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(file string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			if file == path || knowledgeFileExtensions[strings.ToLower(filepath.Ext(file))] {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		source := filepath.ToSlash(file)
+		passages, changed, err := c.knowledge.Ingest(ctx, source, string(content), chunkSize)
+		if err != nil {
+			return fmt.Errorf("failed to ingest %s: %w", source, err)
+		}
+		if !changed {
+			fmt.Fprintf(c.stdout, "Unchanged %s\n", source)
+			continue
+		}
+		fmt.Fprintf(c.stdout, "Ingested %s (%d passages)\n", source, passages)
+	}
+	return nil
+}
+
+var knowledgeFileExtensions = map[string]bool{".md": true, ".markdown": true, ".txt": true}
+
+func (c *cli) writeJSON(value any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func fetchReplyRef(ctx context.Context, client BlueskyClient, uri string) (*bsky.FeedPost_ReplyRef, error) {
+	thread, err := client.GetPostThread(ctx, uri, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load post %s: %w", uri, err)
+	}
+	if thread.Thread == nil || thread.Thread.FeedDefs_ThreadViewPost == nil || thread.Thread.FeedDefs_ThreadViewPost.Post == nil {
+		return nil, fmt.Errorf("post %s is not available", uri)
+	}
+
+	post := thread.Thread.FeedDefs_ThreadViewPost.Post
+	parent := &atproto.RepoStrongRef{Uri: post.Uri, Cid: post.Cid}
+	root := parent
+	if post.Record != nil {
+		if record, ok := post.Record.Val.(*bsky.FeedPost); ok && record.Reply != nil && record.Reply.Root != nil {
+			root = record.Reply.Root
+		}
+	}
+
+	return &bsky.FeedPost_ReplyRef{Root: root, Parent: parent}, nil
+}
+
+func writeHistoryCSV(w io.Writer, rows []database.MessageHistory) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{
+		"id", "status", "author_did", "author_handle", "message_uri", "message_text",
+		"llm_response", "reply_uri", "model_name", "length_strategy", "error_message", "received_at", "completed_at",
+	}); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := writer.Write([]string{
+			strconv.FormatInt(row.ID, 10),
+			row.Status,
+			row.AuthorDid,
+			row.AuthorHandle,
+			row.MessageUri,
+			row.MessageText,
+			row.LlmResponse,
+			derefString(row.ReplyUri),
+			derefString(row.ModelName),
+			derefString(row.LengthStrategy),
+			derefString(row.ErrorMessage),
+			formatTimestamp(row.ReceivedAt),
+			formatTimestamp(row.CompletedAt),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func parseIDArg(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, usageError("expected a single message ID")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, usageError(fmt.Sprintf("invalid message ID %q", args[0]))
+	}
+	return id, nil
+}
+
+func parseIDArgs(args []string) ([]int64, error) {
+	if len(args) == 0 {
+		return nil, usageError("expected at least one ID")
+	}
+	ids := make([]int64, len(args))
+	for i, arg := range args {
+		id, err := parseIDArg([]string{arg})
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// parseDateRange parses the dates of -from and -to. -to defaults to the
+// current date in loc.
+func parseDateRange(from, to string, loc *time.Location) (time.Time, time.Time, error) {
+	if from == "" {
+		return time.Time{}, time.Time{}, usageError("-from is required")
+	}
+	fromDate, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		return time.Time{}, time.Time{}, usageError(fmt.Sprintf("invalid -from date %q", from))
+	}
+
+	toDate, err := time.Parse(time.DateOnly, usageDate(time.Now(), loc))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if to != "" {
+		toDate, err = time.Parse(time.DateOnly, to)
+		if err != nil {
+			return time.Time{}, time.Time{}, usageError(fmt.Sprintf("invalid -to date %q", to))
+		}
+	}
+
+	if toDate.Before(fromDate) {
+		return time.Time{}, time.Time{}, usageError("-to must not be before -from")
+	}
+	return fromDate, toDate, nil
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func derefString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func formatTimestamp(ts pgtype.Timestamptz) string {
+	if !ts.Valid {
+		return "-"
+	}
+	return ts.Time.UTC().Format(time.RFC3339)
+}
+
+func formatMicros(micros int64) string {
+	return fmt.Sprintf("%.6f", float64(micros)/microsPerUnit)
+}
+
+func truncateText(text string, maxLen int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= maxLen {
+		return text
+	}
+	return string(runes[:maxLen-1]) + "…"
+}
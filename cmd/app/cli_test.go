@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func newTestCLI() (*cli, *fakeQuerier, *bytes.Buffer) {
+	queries := &fakeQuerier{}
+	stdout := &bytes.Buffer{}
+	return &cli{
+		config:  testConfig(3),
+		queries: queries,
+		bluesky: &fakeBluesky{},
+		stdout:  stdout,
+		stderr:  io.Discard,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, queries, stdout
+}
+
+func TestCLIQueueRequeue(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	queries.queue = []database.MessageQueue{
+		{ID: 1, Status: "failed", RetryCount: 3},
+		{ID: 2, Status: "processing"},
+	}
+
+	if err := c.run(context.Background(), []string{"queue", "requeue", "1"}); err != nil {
+		t.Fatalf("queue requeue error = %v", err)
+	}
+	if queries.queue[0].Status != "pending" || queries.queue[0].RetryCount != 0 {
+		t.Fatalf("message after requeue = %+v", queries.queue[0])
+	}
+	if !strings.Contains(stdout.String(), "Requeued message 1") {
+		t.Fatalf("output = %q", stdout.String())
+	}
+
+	if err := c.run(context.Background(), []string{"queue", "requeue", "2"}); err == nil {
+		t.Fatal("requeue of a processing message succeeded; want error")
+	}
+}
+
+func TestCLIRejectsInvalidUsage(t *testing.T) {
+	c, _, _ := newTestCLI()
+
+	for _, args := range [][]string{
+		{"unknown"},
+		{"queue", "show"},
+		{"queue", "show", "abc"},
+		{"history", "export"},
+		{"prompt", "render"},
+	} {
+		if err := c.run(context.Background(), args); !errors.Is(err, errUsage) {
+			t.Errorf("run(%q) error = %v; want usage error", args, err)
+		}
+	}
+}
+
+func TestCLIPromptRender(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	queries.queue = []database.MessageQueue{{ID: 5, MessageText: "What is a grapheme?"}}
+
+	if err := c.run(context.Background(), []string{"prompt", "render", "-id", "5"}); err != nil {
+		t.Fatalf("prompt render error = %v", err)
+	}
+	want, err := c.config.Prompt.Render(PromptData{Message: "What is a grapheme?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != want {
+		t.Fatalf("rendered prompt = %q", stdout.String())
+	}
+}
+
+func TestCLIHistoryExportCSV(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	completed := time.Date(2026, 2, 10, 8, 0, 0, 0, time.UTC)
+	queries.historyRows = []database.MessageHistory{
+		{ID: 1, Status: "completed", AuthorHandle: "alice.test", MessageText: "hi, bot", LlmResponse: "hello", CompletedAt: timestamptz(completed)},
+		{ID: 2, Status: "completed", CompletedAt: timestamptz(completed.AddDate(0, 0, 2))},
+	}
+
+	if err := c.run(context.Background(), []string{"history", "export", "-from", "2026-02-10", "-to", "2026-02-10", "-format", "csv"}); err != nil {
+		t.Fatalf("history export error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("exported %d lines; want header and one row:\n%s", len(lines), stdout.String())
+	}
+	if !strings.HasPrefix(lines[1], `1,completed,,alice.test,,"hi, bot",hello,`) {
+		t.Fatalf("csv row = %q", lines[1])
+	}
+}
+
+func TestCLIDeadLetterReplayAndDiscard(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	queries.deadLetters = []database.DeadLetter{
+		{ID: 1, MessageUri: "at://did:plc:alice/app.bsky.feed.post/1"},
+		{ID: 2, MessageUri: "at://did:plc:bob/app.bsky.feed.post/2"},
+		{ID: 3, MessageUri: "at://did:plc:carol/app.bsky.feed.post/3"},
+	}
+	queries.queue = []database.MessageQueue{{ID: 9, MessageUri: "at://did:plc:bob/app.bsky.feed.post/2"}}
+
+	if err := c.run(context.Background(), []string{"deadletter", "replay", "-model", "bigger-model", "1", "2"}); err != nil {
+		t.Fatalf("deadletter replay error = %v", err)
+	}
+	if len(queries.replayed) != 1 || queries.replayed[0].ID != 1 || *queries.replayed[0].ModelOverride != "bigger-model" {
+		t.Fatalf("replayed = %+v; want dead letter 1 with bigger-model", queries.replayed)
+	}
+	if !strings.Contains(stdout.String(), "Replayed 1 of 2 dead letters") {
+		t.Fatalf("output = %q", stdout.String())
+	}
+	if len(queries.deadLetters) != 2 {
+		t.Fatalf("dead letters left = %d; want 2", len(queries.deadLetters))
+	}
+
+	if err := c.run(context.Background(), []string{"deadletter", "replay", "1"}); err != nil {
+		t.Fatalf("second deadletter replay error = %v", err)
+	}
+	if len(queries.replayed) != 1 {
+		t.Fatalf("replayed = %+v; a replayed dead letter must not be queued twice", queries.replayed)
+	}
+
+	if err := c.run(context.Background(), []string{"deadletter", "discard", "-all"}); err != nil {
+		t.Fatalf("deadletter discard error = %v", err)
+	}
+	if len(queries.deadLetters) != 0 || !strings.Contains(stdout.String(), "Discarded 2 dead letters") {
+		t.Fatalf("dead letters = %+v, output = %q", queries.deadLetters, stdout.String())
+	}
+}
+
+func TestCLIDeadLetterReplaySkipsAnsweredUnlessForced(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	queries.deadLetters = []database.DeadLetter{
+		{ID: 1, MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", Answered: true},
+	}
+
+	if err := c.run(context.Background(), []string{"deadletter", "replay", "1"}); err != nil {
+		t.Fatalf("deadletter replay error = %v", err)
+	}
+	if len(queries.replayed) != 0 || !strings.Contains(stdout.String(), "Replayed 0 of 1 dead letters") {
+		t.Fatalf("replayed = %+v, output = %q; want answered dead letter skipped", queries.replayed, stdout.String())
+	}
+
+	if err := c.run(context.Background(), []string{"deadletter", "replay", "-force", "1"}); err != nil {
+		t.Fatalf("deadletter replay -force error = %v", err)
+	}
+	if len(queries.replayed) != 1 || len(queries.deadLetters) != 0 {
+		t.Fatalf("replayed = %+v, dead letters = %+v; want forced replay", queries.replayed, queries.deadLetters)
+	}
+}
+
+func TestCLIHistoryDeleteRemovesPostsAndRegenerates(t *testing.T) {
+	c, queries, stdout := newTestCLI()
+	bluesky := c.bluesky.(*fakeBluesky)
+	queries.historyRows = []database.MessageHistory{{
+		ID:            5,
+		MessageUri:    "at://did:plc:alice/app.bsky.feed.post/1",
+		ReplyUri:      new("at://did:plc:bot/app.bsky.feed.post/a"),
+		ReplyPostUris: []string{"at://did:plc:bot/app.bsky.feed.post/a", "at://did:plc:bot/app.bsky.feed.post/b"},
+		Status:        "completed",
+	}}
+
+	if err := c.run(context.Background(), []string{"history", "delete", "-regenerate", "-model", "bigger-model", "5"}); err != nil {
+		t.Fatalf("history delete error = %v", err)
+	}
+
+	want := []string{"at://did:plc:bot/app.bsky.feed.post/b", "at://did:plc:bot/app.bsky.feed.post/a"}
+	if !slices.Equal(bluesky.deletedPosts, want) {
+		t.Fatalf("deleted posts = %v; want %v", bluesky.deletedPosts, want)
+	}
+	entry := queries.historyRows[0]
+	if entry.Status != "deleted" || !entry.DeletedAt.Valid || entry.DeletedBy == nil || *entry.DeletedBy != "operator" {
+		t.Fatalf("history entry = %+v; want deleted by operator", entry)
+	}
+	if len(queries.queue) != 1 || *queries.queue[0].ModelOverride != "bigger-model" {
+		t.Fatalf("queue = %+v; want regenerated message", queries.queue)
+	}
+	if !strings.Contains(stdout.String(), "Deleted 2 posts of history entry 5") {
+		t.Fatalf("output = %q", stdout.String())
+	}
+
+	if err := c.run(context.Background(), []string{"history", "delete", "5"}); err == nil {
+		t.Fatal("second delete succeeded; want already deleted error")
+	}
+}
+
+func TestCLIPrintBudgets(t *testing.T) {
+	c, _, stdout := newTestCLI()
+	store := newFakeSpendingStore()
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	store.usage["2026-03-03"] = DailyUsage{SpentMicros: 2_000_000}
+	store.usage["2026-03-04"] = DailyUsage{SpentMicros: 1_000_000}
+	c.spending = NewSpendingLimiter(store, UsagePricing{OutputPerMillion: 1}, SpendingLimits{Daily: 4, Monthly: 50})
+
+	if err := c.printBudgets(context.Background(), now); err != nil {
+		t.Fatalf("printBudgets() error = %v", err)
+	}
+	out := strings.Join(strings.Fields(stdout.String()), " ")
+	for _, want := range []string{
+		"Daily rate: 2.000000",
+		"daily 1.000000 0.000000 4.000000 25% 2.000000 2026-03-05T00:00:00Z",
+		"monthly 3.000000 0.000000 50.000000 6% 58.000000 2026-04-01T00:00:00Z",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("output = %q; want %q", out, want)
+		}
+	}
+}
+
+func (q *fakeQuerier) GetQueueMessage(_ context.Context, id int64) (database.MessageQueue, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, message := range q.queue {
+		if message.ID == id {
+			return message, nil
+		}
+	}
+	return database.MessageQueue{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) RequeueMessage(_ context.Context, id int64) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, message := range q.queue {
+		if message.ID == id && message.Status != "processing" {
+			q.queue[i].Status = "pending"
+			q.queue[i].RetryCount = 0
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (q *fakeQuerier) ListMessageHistoryBetween(_ context.Context, arg database.ListMessageHistoryBetweenParams) ([]database.MessageHistory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.MessageHistory
+	for _, entry := range q.historyRows {
+		if !entry.CompletedAt.Time.Before(arg.FromTime.Time) && entry.CompletedAt.Time.Before(arg.ToTime.Time) {
+			rows = append(rows, entry)
+		}
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) ListDeadLetters(_ context.Context, rowLimit int32) ([]database.ListDeadLettersRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.ListDeadLettersRow
+	for _, entry := range q.deadLetters {
+		if len(rows) == int(rowLimit) {
+			break
+		}
+		rows = append(rows, database.ListDeadLettersRow{ID: entry.ID, Stage: entry.Stage, AuthorHandle: entry.AuthorHandle, MessageText: entry.MessageText, Answered: entry.Answered})
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) GetDeadLetter(_ context.Context, id int64) (database.DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.deadLetters {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return database.DeadLetter{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) ReplayDeadLetter(_ context.Context, arg database.ReplayDeadLetterParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.deadLetters {
+		if entry.ID != arg.ID {
+			continue
+		}
+		for _, message := range q.queue {
+			if message.MessageUri == entry.MessageUri {
+				return 0, pgx.ErrNoRows
+			}
+		}
+		id := int64(len(q.queue) + 100)
+		q.deadLetters = slices.Delete(q.deadLetters, i, i+1)
+		q.replayed = append(q.replayed, arg)
+		q.queue = append(q.queue, database.MessageQueue{ID: id, Status: "pending", MessageUri: entry.MessageUri, ModelOverride: arg.ModelOverride})
+		return id, nil
+	}
+	return 0, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) DeleteDeadLetter(_ context.Context, id int64) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.deadLetters {
+		if entry.ID == id {
+			q.deadLetters = append(q.deadLetters[:i], q.deadLetters[i+1:]...)
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (q *fakeQuerier) DeleteAllDeadLetters(context.Context) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	deleted := int64(len(q.deadLetters))
+	q.deadLetters = nil
+	return deleted, nil
+}
+
+func (f *fakeBluesky) DeletePost(_ context.Context, uri string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletedPosts = append(f.deletedPosts, uri)
+	return nil
+}
+
+func (q *fakeQuerier) GetMessageHistory(_ context.Context, id int64) (database.MessageHistory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.historyRows {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return database.MessageHistory{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) GetMessageHistoryByReplyPost(_ context.Context, postURI string) (database.MessageHistory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.historyRows {
+		if (entry.ReplyUri != nil && *entry.ReplyUri == postURI) || slices.Contains(entry.ReplyPostUris, postURI) {
+			return entry, nil
+		}
+	}
+	return database.MessageHistory{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) MarkMessageHistoryDeleted(_ context.Context, arg database.MarkMessageHistoryDeletedParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, entry := range q.historyRows {
+		if entry.ID == arg.ID && !entry.DeletedAt.Valid {
+			q.historyRows[i].Status = "deleted"
+			q.historyRows[i].DeletedAt = timestamptz(time.Now())
+			q.historyRows[i].DeletedBy = arg.DeletedBy
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (q *fakeQuerier) RegenerateHistoryMessage(_ context.Context, arg database.RegenerateHistoryMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.historyRows {
+		if entry.ID != arg.ID {
+			continue
+		}
+		for _, message := range q.queue {
+			if message.MessageUri == entry.MessageUri {
+				return 0, pgx.ErrNoRows
+			}
+		}
+		id := int64(len(q.queue) + 100)
+		q.queue = append(q.queue, database.MessageQueue{ID: id, Status: "pending", MessageUri: entry.MessageUri, ModelOverride: arg.ModelOverride})
+		return id, nil
+	}
+	return 0, pgx.ErrNoRows
+}
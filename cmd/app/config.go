@@ -1,31 +1,82 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	DatabaseURL          string
-	BlueskyIdentifier    string
-	BlueskyPassword      string
-	BlueskyHost          string
-	BotHandle            string
-	IngestorInterval     time.Duration
-	WorkerInterval       time.Duration
-	ReplySenderInterval  time.Duration
-	MaxRetries           int
-	ChatModel            ChatModelConfig
-	UsagePricing         UsagePricing
-	DailySpendingLimit   float64
-	LLMRequestsPerMinute int
+	ConfigFile            string
+	DatabaseURL           string
+	BlueskyIdentifier     string
+	BlueskyPassword       string
+	BlueskyHost           string
+	BlueskyWriteBudget    WriteBudget
+	BotHandle             string
+	IngestorInterval      time.Duration
+	WorkerInterval        time.Duration
+	ReplySenderInterval   time.Duration
+	StaleCheckInterval    time.Duration
+	StaleThreshold        time.Duration
+	ReplyPause            time.Duration
+	ThreadChunkPause      time.Duration
+	ReplyBatchSize        int
+	ShutdownTimeout       time.Duration
+	MaxRetries            int
+	RetryBackoffBase      time.Duration
+	RetryBackoffMax       time.Duration
+	ChatModel             ChatModelConfig
+	LLMStreaming          bool
+	MaxThreadPosts        int
+	ThreadLengthStrategy  string
+	FullTextBaseURL       string
+	ThreadMarkerStyle     MarkerStyle
+	Disclosure            DisclosureConfig
+	QuotePolicy           string
+	AuthorDelete          bool
+	SourceCheckInterval   time.Duration
+	DeleteOrphanedReplies bool
+	OrphanedReplyWindow   time.Duration
+	DMEnabled             bool
+	DMContextMessages     int
+	Tools                 ToolsConfig
+	KnowledgeBase         KnowledgeBaseConfig
+	Embedding             EmbeddingConfig
+	Memory                MemoryConfig
+	Guardrails            GuardrailConfig
+	Approval              ApprovalConfig
+	UsagePricing          UsagePricing
+	DailySpendingLimit    float64
+	WeeklySpendingLimit   float64
+	MonthlySpendingLimit  float64
+	BudgetTimezone        *time.Location
+	BudgetWindow          string
+	Alerts                AlertConfig
+	LLMRequestsPerMinute  int
+	Prompt                *PromptTemplate
+	BlockedAuthors        []string
+	CircuitBreaker        CircuitBreakerConfig
+	StatusListenAddr      string
+}
+
+type CircuitBreakerConfig struct {
+	Failures     int
+	OpenDuration time.Duration
+	Silent       bool
 }
 
 func LoadConfig() (*Config, error) {
@@ -34,170 +85,643 @@ func LoadConfig() (*Config, error) {
 		slog.Warn("Error loading .env file", "error", err)
 	}
 
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-	dbSSLMode := os.Getenv("DB_SSLMODE")
+	return loadConfigFile(os.Getenv("CONFIG_FILE"))
+}
 
-	if dbUser == "" || dbPassword == "" || dbHost == "" || dbPort == "" || dbName == "" || dbSSLMode == "" {
-		return nil, fmt.Errorf("all database environment variables (DB_USER, DB_PASSWORD, DB_HOST, DB_PORT, DB_NAME, DB_SSLMODE) are required")
+func loadConfigFile(path string) (*Config, error) {
+	loader := &configLoader{used: map[string]bool{}}
+	if path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		loader.file = file
 	}
 
-	dbURL := buildDatabaseURL(dbUser, dbPassword, dbHost, dbPort, dbName, dbSSLMode)
+	config := loader.load()
+	config.ConfigFile = path
 
-	blueskyIdentifier := os.Getenv("BLUESKY_IDENTIFIER")
-	blueskyPassword := os.Getenv("BLUESKY_PASSWORD")
-	blueskyHost := os.Getenv("BLUESKY_HOST")
-	botHandle := os.Getenv("BOT_HANDLE")
+	if unknown := loader.unknownFileSettings(); len(unknown) > 0 {
+		loader.errorf("unknown settings in %s: %s", path, strings.Join(unknown, ", "))
+	}
 
-	if blueskyIdentifier == "" || blueskyPassword == "" {
-		return nil, fmt.Errorf("BLUESKY_IDENTIFIER and BLUESKY_PASSWORD environment variables are required")
+	if err := errors.Join(loader.errs...); err != nil {
+		return nil, err
 	}
+	return config, nil
+}
+
+func (l *configLoader) load() *Config {
+	l.loadSecretProviders()
 
-	if blueskyHost == "" {
-		return nil, fmt.Errorf("BLUESKY_HOST environment variable is required")
+	dbUser := l.value("DB_USER")
+	dbPassword := l.secret("DB_PASSWORD")
+	dbHost := l.value("DB_HOST")
+	dbPort := l.value("DB_PORT")
+	dbName := l.value("DB_NAME")
+	dbSSLMode := l.value("DB_SSLMODE")
+
+	if dbUser == "" || dbPassword == "" || dbHost == "" || dbPort == "" || dbName == "" || dbSSLMode == "" {
+		l.errorf("all database settings (DB_USER, DB_PASSWORD, DB_HOST, DB_PORT, DB_NAME, DB_SSLMODE) are required")
 	}
 
-	if botHandle == "" {
-		return nil, fmt.Errorf("BOT_HANDLE environment variable is required")
+	blueskyIdentifier := l.value("BLUESKY_IDENTIFIER")
+	blueskyPassword := l.secret("BLUESKY_PASSWORD")
+	if blueskyIdentifier == "" || blueskyPassword == "" {
+		l.errorf("BLUESKY_IDENTIFIER and BLUESKY_PASSWORD are required")
 	}
 
-	chatModelConfig, err := loadChatModelConfig()
-	if err != nil {
-		return nil, err
+	usagePricing := UsagePricing{
+		InputCachePerMillion: l.nonNegativeFloat("LLM_PRICE_INPUT_CACHE_PER_MILLION", 0),
+		InputMissPerMillion:  l.nonNegativeFloat("LLM_PRICE_INPUT_MISS_PER_MILLION", 0),
+		OutputPerMillion:     l.nonNegativeFloat("LLM_PRICE_OUTPUT_PER_MILLION", 0),
+		EmbeddingPerMillion:  l.nonNegativeFloat("LLM_PRICE_EMBEDDING_PER_MILLION", 0),
 	}
 
-	usagePricing, err := loadUsagePricing()
+	dailySpendingLimit := l.nonNegativeFloat("LLM_DAILY_SPENDING_LIMIT", 0)
+	weeklySpendingLimit := l.nonNegativeFloat("LLM_WEEKLY_SPENDING_LIMIT", 0)
+	monthlySpendingLimit := l.nonNegativeFloat("LLM_MONTHLY_SPENDING_LIMIT", 0)
+	if max(dailySpendingLimit, weeklySpendingLimit, monthlySpendingLimit) > 0 && usagePricing.Total() <= 0 {
+		l.errorf("at least one LLM price must be greater than zero when a LLM spending limit is enabled")
+	}
+	budgetTimezone, err := time.LoadLocation(l.optional("BUDGET_TIMEZONE", "UTC"))
 	if err != nil {
-		return nil, err
+		l.errorf("BUDGET_TIMEZONE must be an IANA timezone name such as Europe/Zurich: %v", err)
+		budgetTimezone = time.UTC
 	}
 
-	dailySpendingLimit, err := getOptionalFloat("LLM_DAILY_SPENDING_LIMIT", 0)
-	if err != nil {
-		return nil, err
+	retryBackoffBase := l.positiveDuration("RETRY_BACKOFF_BASE", 30*time.Second)
+	retryBackoffMax := l.positiveDuration("RETRY_BACKOFF_MAX", 30*time.Minute)
+	if retryBackoffMax < retryBackoffBase {
+		l.errorf("RETRY_BACKOFF_MAX must not be less than RETRY_BACKOFF_BASE")
 	}
-	if dailySpendingLimit > 0 && usagePricing.Total() <= 0 {
-		return nil, fmt.Errorf("at least one LLM price must be greater than zero when LLM_DAILY_SPENDING_LIMIT is enabled")
+
+	threadLengthStrategy := l.oneOf("THREAD_LENGTH_STRATEGY", lengthStrategyTruncate,
+		lengthStrategyTruncate, lengthStrategySummarize, lengthStrategyLink)
+	fullTextBaseURL := l.value("FULL_TEXT_BASE_URL")
+	if fullTextBaseURL != "" {
+		if u, err := url.Parse(fullTextBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.errorf("FULL_TEXT_BASE_URL must be an absolute http or https URL")
+		}
+	}
+	if threadLengthStrategy == lengthStrategyLink && (fullTextBaseURL == "" || l.value("STATUS_LISTEN_ADDR") == "") {
+		l.errorf("THREAD_LENGTH_STRATEGY=link requires FULL_TEXT_BASE_URL and STATUS_LISTEN_ADDR")
+	}
+	if replyPolicy := strings.ToLower(strings.TrimSpace(l.value("REPLY_POLICY"))); replyPolicy != "" && replyPolicy != replyPolicyAnyone {
+		l.errorf("REPLY_POLICY=%s is not supported: Bluesky applies threadgate records only to the root post of a thread and the bot only posts replies; QUOTE_POLICY=nobody restricts quotes", replyPolicy)
 	}
 
-	llmRequestsPerMinute, err := getOptionalInt("LLM_REQUESTS_PER_MINUTE", 0)
+	promptTemplate, err := NewPromptTemplate(l.optional("PROMPT_TEMPLATE", defaultPromptTemplate))
 	if err != nil {
-		return nil, err
+		l.errorf("PROMPT_TEMPLATE is invalid: %v", err)
 	}
 
-	maxRetries := 3
-	if maxRetriesEnv := os.Getenv("MAX_RETRIES"); maxRetriesEnv != "" {
-		if parsed, err := strconv.Atoi(maxRetriesEnv); err == nil && parsed > 0 {
-			maxRetries = parsed
-		}
-	}
+	disclosure := l.loadDisclosureConfig()
 
-	config := &Config{
-		DatabaseURL:          dbURL,
-		BlueskyIdentifier:    blueskyIdentifier,
-		BlueskyPassword:      blueskyPassword,
-		BlueskyHost:          blueskyHost,
-		BotHandle:            botHandle,
-		IngestorInterval:     1 * time.Minute,
-		WorkerInterval:       5 * time.Second,
-		ReplySenderInterval:  10 * time.Second,
-		MaxRetries:           maxRetries,
-		ChatModel:            chatModelConfig,
-		UsagePricing:         usagePricing,
-		DailySpendingLimit:   dailySpendingLimit,
-		LLMRequestsPerMinute: llmRequestsPerMinute,
+	chatModel := l.loadChatModelConfig()
+	embedding := l.loadEmbeddingConfig(chatModel)
+	knowledgeBase := KnowledgeBaseConfig{
+		Enabled:   l.boolean("KB_ENABLED", false),
+		Index:     l.oneOf("KB_INDEX", kbIndexMemory, kbIndexMemory, kbIndexPgvector),
+		TopK:      l.positiveInt("KB_TOP_K", 4),
+		MinScore:  l.nonNegativeFloat("KB_MIN_SCORE", 0.3),
+		ChunkSize: l.positiveInt("KB_CHUNK_SIZE", 1000),
+	}
+	if knowledgeBase.MinScore > 1 {
+		l.errorf("KB_MIN_SCORE must not be greater than 1")
+	}
+	if knowledgeBase.Enabled && embedding.Model == "" {
+		l.errorf("KB_ENABLED requires EMBEDDING_MODEL")
+	}
+	if knowledgeBase.Enabled && promptTemplate != nil && !promptTemplate.UsesKnowledge() {
+		l.errorf("KB_ENABLED requires a PROMPT_TEMPLATE that includes {{.Knowledge}}")
 	}
 
-	return config, nil
-}
+	memory := MemoryConfig{
+		Enabled:       l.boolean("MEMORY_ENABLED", false),
+		Retention:     l.positiveDuration("MEMORY_RETENTION", 90*24*time.Hour),
+		SummaryLength: l.positiveInt("MEMORY_SUMMARY_LENGTH", 1000),
+	}
+	if memory.Enabled && promptTemplate != nil && !promptTemplate.UsesMemory() {
+		l.errorf("MEMORY_ENABLED requires a PROMPT_TEMPLATE that includes {{.Memory}}")
+	}
 
-func loadChatModelConfig() (ChatModelConfig, error) {
-	apiKey := os.Getenv("LLM_API_KEY")
-	modelName := os.Getenv("LLM_MODEL")
-	if apiKey == "" || modelName == "" {
-		return ChatModelConfig{}, fmt.Errorf("LLM_API_KEY and LLM_MODEL environment variables are required")
+	guardrails := l.loadGuardrailConfig()
+	approval := ApprovalConfig{
+		Required:       l.boolean("APPROVAL_REQUIRED", false),
+		TrustedAuthors: l.list("APPROVAL_TRUSTED_AUTHORS"),
+		MaxRisk:        l.nonNegativeFloat("APPROVAL_MAX_RISK", 0),
+		Timeout:        l.nonNegativeDuration("APPROVAL_TIMEOUT", 24*time.Hour),
+		TimeoutAction:  l.oneOf("APPROVAL_TIMEOUT_ACTION", approvalTimeoutReject, approvalTimeoutReject, approvalTimeoutApprove),
+	}
+	if approval.MaxRisk > 1 {
+		l.errorf("APPROVAL_MAX_RISK must be between 0 and 1")
+	}
+	if approval.MaxRisk > 0 && guardrails.ModerationModel == "" {
+		l.errorf("APPROVAL_MAX_RISK requires GUARDRAIL_MODERATION_MODEL")
 	}
 
-	temperature, err := getOptionalFloat("LLM_TEMPERATURE", 0.7)
-	if err != nil {
-		return ChatModelConfig{}, err
+	return &Config{
+		DatabaseURL:       buildDatabaseURL(dbUser, dbPassword, dbHost, dbPort, dbName, dbSSLMode),
+		BlueskyIdentifier: blueskyIdentifier,
+		BlueskyPassword:   blueskyPassword,
+		BlueskyHost:       l.required("BLUESKY_HOST"),
+		BlueskyWriteBudget: WriteBudget{
+			PointsPerHour: l.nonNegativeInt("BLUESKY_WRITE_POINTS_PER_HOUR", 5000),
+			PointsPerDay:  l.nonNegativeInt("BLUESKY_WRITE_POINTS_PER_DAY", 35000),
+		},
+		BotHandle:             l.required("BOT_HANDLE"),
+		IngestorInterval:      l.positiveDuration("INGESTOR_INTERVAL", 1*time.Minute),
+		WorkerInterval:        l.positiveDuration("WORKER_INTERVAL", 5*time.Second),
+		ReplySenderInterval:   l.positiveDuration("REPLY_SENDER_INTERVAL", 10*time.Second),
+		StaleCheckInterval:    l.positiveDuration("STALE_CHECK_INTERVAL", 5*time.Minute),
+		StaleThreshold:        l.positiveDuration("STALE_THRESHOLD", 5*time.Minute),
+		ReplyPause:            l.nonNegativeDuration("REPLY_PAUSE", 0),
+		ThreadChunkPause:      l.nonNegativeDuration("THREAD_CHUNK_PAUSE", 0),
+		ReplyBatchSize:        l.positiveInt("REPLY_BATCH_SIZE", 10),
+		ShutdownTimeout:       l.positiveDuration("SHUTDOWN_TIMEOUT", 2*time.Minute),
+		MaxRetries:            l.positiveInt("MAX_RETRIES", 3),
+		RetryBackoffBase:      retryBackoffBase,
+		RetryBackoffMax:       retryBackoffMax,
+		ChatModel:             chatModel,
+		LLMStreaming:          l.boolean("LLM_STREAMING", false),
+		MaxThreadPosts:        l.nonNegativeInt("MAX_THREAD_POSTS", 0),
+		ThreadLengthStrategy:  threadLengthStrategy,
+		FullTextBaseURL:       fullTextBaseURL,
+		ThreadMarkerStyle:     MarkerStyle(l.oneOf("THREAD_MARKER_STYLE", string(MarkerClassic), markerStyles...)),
+		Disclosure:            disclosure,
+		QuotePolicy:           l.oneOf("QUOTE_POLICY", quotePolicyAnyone, quotePolicyAnyone, quotePolicyNobody),
+		AuthorDelete:          l.boolean("AUTHOR_DELETE", false),
+		SourceCheckInterval:   l.nonNegativeDuration("SOURCE_CHECK_INTERVAL", 10*time.Minute),
+		DeleteOrphanedReplies: l.boolean("DELETE_ORPHANED_REPLIES", false),
+		OrphanedReplyWindow:   l.positiveDuration("ORPHANED_REPLY_WINDOW", 7*24*time.Hour),
+		DMEnabled:             l.boolean("DM_ENABLED", false),
+		DMContextMessages:     l.nonNegativeInt("DM_CONTEXT_MESSAGES", 10),
+		Tools:                 l.loadToolsConfig(),
+		KnowledgeBase:         knowledgeBase,
+		Embedding:             embedding,
+		Memory:                memory,
+		Guardrails:            guardrails,
+		Approval:              approval,
+		UsagePricing:          usagePricing,
+		DailySpendingLimit:    dailySpendingLimit,
+		WeeklySpendingLimit:   weeklySpendingLimit,
+		MonthlySpendingLimit:  monthlySpendingLimit,
+		BudgetTimezone:        budgetTimezone,
+		BudgetWindow:          l.oneOf("BUDGET_WINDOW", budgetWindowCalendar, budgetWindowCalendar, budgetWindowRolling),
+		Alerts:                l.loadAlertConfig(),
+		LLMRequestsPerMinute:  l.nonNegativeInt("LLM_REQUESTS_PER_MINUTE", 0),
+		Prompt:                promptTemplate,
+		BlockedAuthors:        l.list("BLOCKED_AUTHORS"),
+		CircuitBreaker: CircuitBreakerConfig{
+			Failures:     l.nonNegativeInt("CIRCUIT_BREAKER_FAILURES", 5),
+			OpenDuration: l.positiveDuration("CIRCUIT_BREAKER_OPEN_DURATION", 1*time.Minute),
+			Silent:       l.boolean("CIRCUIT_BREAKER_SILENT", false),
+		},
+		StatusListenAddr: l.value("STATUS_LISTEN_ADDR"),
 	}
+}
 
-	maxOutputTokens, err := getOptionalPositiveInt("LLM_MAX_OUTPUT_TOKENS", 250)
-	if err != nil {
-		return ChatModelConfig{}, err
+func (l *configLoader) loadChatModelConfig() ChatModelConfig {
+	apiKey := l.secret("LLM_API_KEY")
+	modelName := l.value("LLM_MODEL")
+	if apiKey == "" || modelName == "" {
+		l.errorf("LLM_API_KEY and LLM_MODEL are required")
 	}
 
 	return ChatModelConfig{
-		Provider:        getOptionalString("LLM_PROVIDER", "openai"),
+		Provider:        l.optional("LLM_PROVIDER", "openai"),
 		APIKey:          apiKey,
-		BaseURL:         os.Getenv("LLM_BASE_URL"),
+		BaseURL:         l.value("LLM_BASE_URL"),
 		Model:           modelName,
-		Temperature:     float32(temperature),
-		MaxOutputTokens: maxOutputTokens,
-		Timeout:         60 * time.Second,
-	}, nil
+		Temperature:     float32(l.nonNegativeFloat("LLM_TEMPERATURE", 0.7)),
+		MaxOutputTokens: l.positiveInt("LLM_MAX_OUTPUT_TOKENS", 250),
+		Timeout:         l.positiveDuration("LLM_TIMEOUT", 60*time.Second),
+	}
 }
 
-func loadUsagePricing() (UsagePricing, error) {
-	inputCache, err := getOptionalFloat("LLM_PRICE_INPUT_CACHE_PER_MILLION", 0)
-	if err != nil {
-		return UsagePricing{}, err
+// loadEmbeddingConfig falls back to the API key and base URL of the chat model,
+// so that one OpenAI account serves both.
+func (l *configLoader) loadEmbeddingConfig(chatModel ChatModelConfig) EmbeddingConfig {
+	embedding := EmbeddingConfig{
+		Provider:   l.optional("EMBEDDING_PROVIDER", chatModel.Provider),
+		APIKey:     l.secret("EMBEDDING_API_KEY"),
+		BaseURL:    l.optional("EMBEDDING_BASE_URL", chatModel.BaseURL),
+		Model:      l.value("EMBEDDING_MODEL"),
+		Dimensions: l.nonNegativeInt("EMBEDDING_DIMENSIONS", 0),
+		Timeout:    chatModel.Timeout,
 	}
-	inputMiss, err := getOptionalFloat("LLM_PRICE_INPUT_MISS_PER_MILLION", 0)
-	if err != nil {
-		return UsagePricing{}, err
+	if embedding.APIKey == "" {
+		embedding.APIKey = chatModel.APIKey
 	}
-	output, err := getOptionalFloat("LLM_PRICE_OUTPUT_PER_MILLION", 0)
-	if err != nil {
-		return UsagePricing{}, err
+	return embedding
+}
+
+func (l *configLoader) loadDisclosureConfig() DisclosureConfig {
+	disclosure := DisclosureConfig{
+		Mode:   l.oneOf("DISCLOSURE_MODE", disclosureText, disclosureText, disclosureLabel, disclosureBoth),
+		Label:  l.optional("DISCLOSURE_LABEL", "ai-generated"),
+		Policy: l.oneOf("DISCLOSURE_POLICY", disclosureBestEffort, disclosureBestEffort, disclosureGuaranteed),
+	}
+
+	if text := l.optional("SIGNATURE_TEMPLATE", defaultSignatureTemplate); !strings.EqualFold(strings.TrimSpace(text), "none") {
+		signature, err := NewSignatureTemplate(text)
+		if err != nil {
+			l.errorf("SIGNATURE_TEMPLATE is invalid: %v", err)
+		}
+		disclosure.Signature = signature
+	}
+
+	if disclosure.usesLabel() && !labelValuePattern.MatchString(disclosure.Label) {
+		l.errorf("DISCLOSURE_LABEL must consist of lowercase letters and hyphens")
+	}
+	if disclosure.Mode == disclosureText && disclosure.Signature == nil && disclosure.Policy == disclosureGuaranteed {
+		l.errorf("DISCLOSURE_POLICY=guaranteed requires a SIGNATURE_TEMPLATE or a label DISCLOSURE_MODE")
+	}
+	return disclosure
+}
+
+func (l *configLoader) loadToolsConfig() ToolsConfig {
+	tools := ToolsConfig{
+		Enabled:       l.list("LLM_TOOLS"),
+		MaxIterations: l.positiveInt("LLM_TOOL_MAX_ITERATIONS", 3),
+		SearchURL:     l.value("SEARCH_URL"),
+	}
+
+	for i, name := range tools.Enabled {
+		name = strings.ToLower(name)
+		tools.Enabled[i] = name
+		if !slices.Contains(toolNames, name) {
+			l.errorf("LLM_TOOLS contains unknown tool %q, must be one of %s", name, strings.Join(toolNames, ", "))
+		}
+	}
+	if tools.SearchURL != "" {
+		if u, err := url.Parse(tools.SearchURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.errorf("SEARCH_URL must be an absolute http or https URL")
+		}
+	}
+	if tools.enabled(toolWebSearch) && tools.SearchURL == "" {
+		l.errorf("LLM_TOOLS=%s requires SEARCH_URL", toolWebSearch)
+	}
+	return tools
+}
+
+func (l *configLoader) loadGuardrailConfig() GuardrailConfig {
+	return GuardrailConfig{
+		InjectionCheck:       l.boolean("GUARDRAIL_INJECTION_CHECK", false),
+		BannedTopics:         l.list("GUARDRAIL_BANNED_TOPICS"),
+		ModerationModel:      l.value("GUARDRAIL_MODERATION_MODEL"),
+		PII:                  l.oneOf("GUARDRAIL_PII", guardrailOff, guardrailActions...),
+		HumanClaim:           l.oneOf("GUARDRAIL_HUMAN_CLAIM", guardrailOff, guardrailActions...),
+		BlockedWords:         l.list("GUARDRAIL_BLOCKED_WORDS"),
+		BlockedWordsAction:   l.oneOf("GUARDRAIL_BLOCKED_WORDS_ACTION", guardrailRegenerate, guardrailActions...),
+		BlockedDomains:       l.list("GUARDRAIL_BLOCKED_DOMAINS"),
+		BlockedDomainsAction: l.oneOf("GUARDRAIL_BLOCKED_DOMAINS_ACTION", guardrailRedact, guardrailActions...),
+		MaxRegenerations:     l.nonNegativeInt("GUARDRAIL_MAX_REGENERATIONS", 1),
+		RefusalText:          l.optional("GUARDRAIL_REFUSAL_TEXT", defaultRefusalText),
+	}
+}
+
+func (l *configLoader) loadAlertConfig() AlertConfig {
+	alerts := AlertConfig{
+		Notifier:   l.oneOf("ALERT_NOTIFIER", notifierLog, notifierLog, notifierWebhook, notifierSMTP),
+		WebhookURL: l.value("ALERT_WEBHOOK_URL"),
+		SMTPAddr:   l.optional("ALERT_SMTP_ADDR", "localhost:25"),
+		SMTPFrom:   l.value("ALERT_SMTP_FROM"),
+		SMTPTo:     l.list("ALERT_SMTP_TO"),
+	}
+
+	thresholds := l.optional("SPENDING_ALERT_THRESHOLDS", "50,80,100")
+	if !strings.EqualFold(thresholds, "off") {
+		for item := range strings.SplitSeq(thresholds, ",") {
+			threshold, err := strconv.Atoi(strings.TrimSpace(item))
+			if err != nil || threshold <= 0 {
+				l.errorf("SPENDING_ALERT_THRESHOLDS must be a comma separated list of positive percentages or off")
+				break
+			}
+			alerts.Thresholds = append(alerts.Thresholds, threshold)
+		}
+		slices.Sort(alerts.Thresholds)
+		alerts.Thresholds = slices.Compact(alerts.Thresholds)
+	}
+
+	if alerts.WebhookURL != "" {
+		if u, err := url.Parse(alerts.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.errorf("ALERT_WEBHOOK_URL must be an absolute http or https URL")
+		}
+	}
+	switch alerts.Notifier {
+	case notifierWebhook:
+		if alerts.WebhookURL == "" {
+			l.errorf("ALERT_NOTIFIER=%s requires ALERT_WEBHOOK_URL", notifierWebhook)
+		}
+	case notifierSMTP:
+		if alerts.SMTPFrom == "" || len(alerts.SMTPTo) == 0 {
+			l.errorf("ALERT_NOTIFIER=%s requires ALERT_SMTP_FROM and ALERT_SMTP_TO", notifierSMTP)
+		}
+	}
+	return alerts
+}
+
+// WithReloadedSettings returns a copy of c that takes the settings which are
+// safe to change at runtime from next. Everything else keeps its current value.
+func (c *Config) WithReloadedSettings(next *Config) *Config {
+	merged := *c
+	merged.MaxRetries = next.MaxRetries
+	merged.RetryBackoffBase = next.RetryBackoffBase
+	merged.RetryBackoffMax = next.RetryBackoffMax
+	merged.LLMStreaming = next.LLMStreaming
+	merged.MaxThreadPosts = next.MaxThreadPosts
+	merged.ThreadLengthStrategy = next.ThreadLengthStrategy
+	merged.FullTextBaseURL = next.FullTextBaseURL
+	merged.ThreadMarkerStyle = next.ThreadMarkerStyle
+	merged.Disclosure = next.Disclosure
+	merged.QuotePolicy = next.QuotePolicy
+	merged.AuthorDelete = next.AuthorDelete
+	merged.DeleteOrphanedReplies = next.DeleteOrphanedReplies
+	merged.OrphanedReplyWindow = next.OrphanedReplyWindow
+	merged.DMEnabled = next.DMEnabled
+	merged.DMContextMessages = next.DMContextMessages
+	merged.Tools = next.Tools
+	merged.KnowledgeBase.TopK = next.KnowledgeBase.TopK
+	merged.KnowledgeBase.MinScore = next.KnowledgeBase.MinScore
+	merged.KnowledgeBase.ChunkSize = next.KnowledgeBase.ChunkSize
+	merged.Memory.Retention = next.Memory.Retention
+	merged.Memory.SummaryLength = next.Memory.SummaryLength
+	merged.Guardrails = next.Guardrails
+	merged.Approval.TrustedAuthors = next.Approval.TrustedAuthors
+	merged.Approval.MaxRisk = next.Approval.MaxRisk
+	merged.Approval.Timeout = next.Approval.Timeout
+	merged.Approval.TimeoutAction = next.Approval.TimeoutAction
+	merged.UsagePricing = next.UsagePricing
+	merged.DailySpendingLimit = next.DailySpendingLimit
+	merged.WeeklySpendingLimit = next.WeeklySpendingLimit
+	merged.MonthlySpendingLimit = next.MonthlySpendingLimit
+	merged.BudgetTimezone = next.BudgetTimezone
+	merged.BudgetWindow = next.BudgetWindow
+	merged.Alerts = next.Alerts
+	merged.LLMRequestsPerMinute = next.LLMRequestsPerMinute
+	merged.Prompt = next.Prompt
+	merged.BlockedAuthors = next.BlockedAuthors
+	merged.CircuitBreaker = next.CircuitBreaker
+	return &merged
+}
+
+// RestartRequiredChanges lists the settings that differ between c and next but
+// only take effect after a restart.
+func (c *Config) RestartRequiredChanges(next *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+
+	check("database", c.DatabaseURL != next.DatabaseURL)
+	check("BLUESKY_IDENTIFIER", c.BlueskyIdentifier != next.BlueskyIdentifier)
+	check("BLUESKY_PASSWORD", c.BlueskyPassword != next.BlueskyPassword)
+	check("BLUESKY_HOST", c.BlueskyHost != next.BlueskyHost)
+	check("BLUESKY_WRITE_POINTS_PER_HOUR", c.BlueskyWriteBudget.PointsPerHour != next.BlueskyWriteBudget.PointsPerHour)
+	check("BLUESKY_WRITE_POINTS_PER_DAY", c.BlueskyWriteBudget.PointsPerDay != next.BlueskyWriteBudget.PointsPerDay)
+	check("BOT_HANDLE", c.BotHandle != next.BotHandle)
+	check("INGESTOR_INTERVAL", c.IngestorInterval != next.IngestorInterval)
+	check("WORKER_INTERVAL", c.WorkerInterval != next.WorkerInterval)
+	check("REPLY_SENDER_INTERVAL", c.ReplySenderInterval != next.ReplySenderInterval)
+	check("STALE_CHECK_INTERVAL", c.StaleCheckInterval != next.StaleCheckInterval)
+	check("STALE_THRESHOLD", c.StaleThreshold != next.StaleThreshold)
+	check("SOURCE_CHECK_INTERVAL", c.SourceCheckInterval != next.SourceCheckInterval)
+	check("REPLY_PAUSE", c.ReplyPause != next.ReplyPause)
+	check("THREAD_CHUNK_PAUSE", c.ThreadChunkPause != next.ThreadChunkPause)
+	check("REPLY_BATCH_SIZE", c.ReplyBatchSize != next.ReplyBatchSize)
+	check("SHUTDOWN_TIMEOUT", c.ShutdownTimeout != next.ShutdownTimeout)
+	check("LLM model settings", c.ChatModel != next.ChatModel)
+	check("KB_ENABLED", c.KnowledgeBase.Enabled != next.KnowledgeBase.Enabled)
+	check("KB_INDEX", c.KnowledgeBase.Index != next.KnowledgeBase.Index)
+	check("embedding model settings", c.Embedding != next.Embedding)
+	check("MEMORY_ENABLED", c.Memory.Enabled != next.Memory.Enabled)
+	check("APPROVAL_REQUIRED", c.Approval.Required != next.Approval.Required)
+	check("STATUS_LISTEN_ADDR", c.StatusListenAddr != next.StatusListenAddr)
+	return changed
+}
+
+func (c *Config) SpendingLimits() SpendingLimits {
+	return SpendingLimits{
+		Daily:    c.DailySpendingLimit,
+		Weekly:   c.WeeklySpendingLimit,
+		Monthly:  c.MonthlySpendingLimit,
+		Location: c.BudgetTimezone,
+		Rolling:  c.BudgetWindow == budgetWindowRolling,
+	}
+}
+
+func (c *Config) IsBlockedAuthor(did, handle string) bool {
+	return matchesAuthor(c.BlockedAuthors, did, handle)
+}
+
+// matchesAuthor reports whether authors contains the DID or the handle, with
+// or without a leading @.
+func matchesAuthor(authors []string, did, handle string) bool {
+	for _, author := range authors {
+		if strings.EqualFold(author, did) || strings.EqualFold(strings.TrimPrefix(author, "@"), handle) {
+			return true
+		}
+	}
+	return false
+}
+
+type configLoader struct {
+	file            map[string]string
+	used            map[string]bool
+	errs            []error
+	secretProviders []SecretProvider
+}
+
+func (l *configLoader) errorf(format string, args ...any) {
+	l.errs = append(l.errs, fmt.Errorf(format, args...))
+}
+
+func (l *configLoader) value(name string) string {
+	l.used[name] = true
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
-	return UsagePricing{InputCachePerMillion: inputCache, InputMissPerMillion: inputMiss, OutputPerMillion: output}, nil
+	return l.file[name]
 }
 
-func getOptionalString(name, fallback string) string {
-	value := os.Getenv(name)
+func (l *configLoader) required(name string) string {
+	value := l.value(name)
+	if value == "" {
+		l.errorf("%s is required", name)
+	}
+	return value
+}
+
+func (l *configLoader) optional(name, fallback string) string {
+	value := l.value(name)
 	if value == "" {
 		return fallback
 	}
 	return value
 }
 
-func getOptionalPositiveInt(name string, fallback int) (int, error) {
-	value := os.Getenv(name)
+func (l *configLoader) positiveInt(name string, fallback int) int {
+	value := l.value(name)
 	if value == "" {
-		return fallback, nil
+		return fallback
 	}
 	parsed, err := strconv.Atoi(value)
 	if err != nil || parsed <= 0 {
-		return 0, fmt.Errorf("%s must be a positive integer", name)
+		l.errorf("%s must be a positive integer", name)
+		return fallback
 	}
-	return parsed, nil
+	return parsed
 }
-func getOptionalInt(name string, fallback int) (int, error) {
-	value := os.Getenv(name)
+
+func (l *configLoader) nonNegativeInt(name string, fallback int) int {
+	value := l.value(name)
 	if value == "" {
-		return fallback, nil
+		return fallback
 	}
 	parsed, err := strconv.Atoi(value)
 	if err != nil || parsed < 0 {
-		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+		l.errorf("%s must be a non-negative integer", name)
+		return fallback
 	}
-	return parsed, nil
+	return parsed
 }
 
-func getOptionalFloat(name string, fallback float64) (float64, error) {
-	value := os.Getenv(name)
+func (l *configLoader) nonNegativeFloat(name string, fallback float64) float64 {
+	value := l.value(name)
 	if value == "" {
-		return fallback, nil
+		return fallback
 	}
 	parsed, err := strconv.ParseFloat(value, 64)
 	if err != nil || parsed < 0 {
-		return 0, fmt.Errorf("%s must be a non-negative number", name)
+		l.errorf("%s must be a non-negative number", name)
+		return fallback
+	}
+	return parsed
+}
+
+func (l *configLoader) positiveDuration(name string, fallback time.Duration) time.Duration {
+	value := l.value(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		l.errorf("%s must be a positive duration such as 30s or 5m", name)
+		return fallback
+	}
+	return parsed
+}
+
+func (l *configLoader) nonNegativeDuration(name string, fallback time.Duration) time.Duration {
+	value := l.value(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		l.errorf("%s must be a non-negative duration such as 0s or 5s", name)
+		return fallback
+	}
+	return parsed
+}
+
+func (l *configLoader) boolean(name string, fallback bool) bool {
+	value := l.value(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		l.errorf("%s must be true or false", name)
+		return fallback
+	}
+	return parsed
+}
+
+func (l *configLoader) oneOf(name, fallback string, allowed ...string) string {
+	value := strings.ToLower(strings.TrimSpace(l.value(name)))
+	if value == "" {
+		return fallback
+	}
+	if !slices.Contains(allowed, value) {
+		l.errorf("%s must be one of %s", name, strings.Join(allowed, ", "))
+		return fallback
+	}
+	return value
+}
+
+func (l *configLoader) list(name string) []string {
+	var items []string
+	for item := range strings.SplitSeq(l.value(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *configLoader) unknownFileSettings() []string {
+	var unknown []string
+	for name := range l.file {
+		if !l.used[name] && name != "CONFIG_FILE" {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// readConfigFile reads a YAML or TOML file and flattens it into setting names.
+// Nested keys are joined with underscores, so llm: {model: x} sets LLM_MODEL.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	raw := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %q; use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	settings := map[string]string{}
+	flattenConfigValue("", raw, settings)
+	return settings, nil
+}
+
+func flattenConfigValue(prefix string, value any, settings map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if prefix != "" {
+				name = prefix + "_" + name
+			}
+			flattenConfigValue(name, child, settings)
+		}
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		settings[prefix] = strings.Join(items, ",")
+	case nil:
+		settings[prefix] = ""
+	default:
+		settings[prefix] = fmt.Sprint(v)
 	}
-	return parsed, nil
 }
 
 func buildDatabaseURL(dbUser, dbPassword, dbHost, dbPort, dbName, dbSSLMode string) string {
@@ -214,3 +738,86 @@ func buildDatabaseURL(dbUser, dbPassword, dbHost, dbPort, dbName, dbSSLMode stri
 
 	return u.String()
 }
+
+func configSummary(c *Config) []string {
+	lines := []string{
+		fmt.Sprintf("BLUESKY_HOST=%s", c.BlueskyHost),
+		fmt.Sprintf("BLUESKY_WRITE_POINTS_PER_HOUR=%d", c.BlueskyWriteBudget.PointsPerHour),
+		fmt.Sprintf("BLUESKY_WRITE_POINTS_PER_DAY=%d", c.BlueskyWriteBudget.PointsPerDay),
+		fmt.Sprintf("BOT_HANDLE=%s", c.BotHandle),
+		fmt.Sprintf("LLM_PROVIDER=%s", c.ChatModel.Provider),
+		fmt.Sprintf("LLM_MODEL=%s", c.ChatModel.Model),
+		fmt.Sprintf("LLM_TIMEOUT=%s", c.ChatModel.Timeout),
+		fmt.Sprintf("LLM_STREAMING=%t", c.LLMStreaming),
+		fmt.Sprintf("MAX_THREAD_POSTS=%d", c.MaxThreadPosts),
+		fmt.Sprintf("THREAD_LENGTH_STRATEGY=%s", c.ThreadLengthStrategy),
+		fmt.Sprintf("FULL_TEXT_BASE_URL=%s", c.FullTextBaseURL),
+		fmt.Sprintf("THREAD_MARKER_STYLE=%s", c.ThreadMarkerStyle),
+		fmt.Sprintf("SIGNATURE_TEMPLATE=%q", signatureSummary(c.Disclosure.Signature)),
+		fmt.Sprintf("DISCLOSURE_MODE=%s", c.Disclosure.Mode),
+		fmt.Sprintf("DISCLOSURE_LABEL=%s", c.Disclosure.Label),
+		fmt.Sprintf("DISCLOSURE_POLICY=%s", c.Disclosure.Policy),
+		fmt.Sprintf("QUOTE_POLICY=%s", c.QuotePolicy),
+		fmt.Sprintf("AUTHOR_DELETE=%t", c.AuthorDelete),
+		fmt.Sprintf("LLM_DAILY_SPENDING_LIMIT=%g", c.DailySpendingLimit),
+		fmt.Sprintf("LLM_WEEKLY_SPENDING_LIMIT=%g", c.WeeklySpendingLimit),
+		fmt.Sprintf("LLM_MONTHLY_SPENDING_LIMIT=%g", c.MonthlySpendingLimit),
+		fmt.Sprintf("BUDGET_TIMEZONE=%s", c.SpendingLimits().location()),
+		fmt.Sprintf("BUDGET_WINDOW=%s", c.BudgetWindow),
+		fmt.Sprintf("SPENDING_ALERT_THRESHOLDS=%s", formatThresholds(c.Alerts.Thresholds)),
+		fmt.Sprintf("ALERT_NOTIFIER=%s", c.Alerts.Notifier),
+		fmt.Sprintf("LLM_REQUESTS_PER_MINUTE=%d", c.LLMRequestsPerMinute),
+		fmt.Sprintf("INGESTOR_INTERVAL=%s", c.IngestorInterval),
+		fmt.Sprintf("WORKER_INTERVAL=%s", c.WorkerInterval),
+		fmt.Sprintf("REPLY_SENDER_INTERVAL=%s", c.ReplySenderInterval),
+		fmt.Sprintf("STALE_CHECK_INTERVAL=%s", c.StaleCheckInterval),
+		fmt.Sprintf("STALE_THRESHOLD=%s", c.StaleThreshold),
+		fmt.Sprintf("SOURCE_CHECK_INTERVAL=%s", c.SourceCheckInterval),
+		fmt.Sprintf("DELETE_ORPHANED_REPLIES=%t", c.DeleteOrphanedReplies),
+		fmt.Sprintf("ORPHANED_REPLY_WINDOW=%s", c.OrphanedReplyWindow),
+		fmt.Sprintf("DM_ENABLED=%t", c.DMEnabled),
+		fmt.Sprintf("DM_CONTEXT_MESSAGES=%d", c.DMContextMessages),
+		fmt.Sprintf("LLM_TOOLS=%s", strings.Join(c.Tools.Enabled, ",")),
+		fmt.Sprintf("LLM_TOOL_MAX_ITERATIONS=%d", c.Tools.MaxIterations),
+		fmt.Sprintf("SEARCH_URL=%s", c.Tools.SearchURL),
+		fmt.Sprintf("KB_ENABLED=%t", c.KnowledgeBase.Enabled),
+		fmt.Sprintf("KB_INDEX=%s", c.KnowledgeBase.Index),
+		fmt.Sprintf("KB_TOP_K=%d", c.KnowledgeBase.TopK),
+		fmt.Sprintf("KB_MIN_SCORE=%g", c.KnowledgeBase.MinScore),
+		fmt.Sprintf("KB_CHUNK_SIZE=%d", c.KnowledgeBase.ChunkSize),
+		fmt.Sprintf("EMBEDDING_MODEL=%s", c.Embedding.Model),
+		fmt.Sprintf("MEMORY_ENABLED=%t", c.Memory.Enabled),
+		fmt.Sprintf("MEMORY_RETENTION=%s", c.Memory.Retention),
+		fmt.Sprintf("MEMORY_SUMMARY_LENGTH=%d", c.Memory.SummaryLength),
+		fmt.Sprintf("GUARDRAIL_INJECTION_CHECK=%t", c.Guardrails.InjectionCheck),
+		fmt.Sprintf("GUARDRAIL_BANNED_TOPICS=%d entries", len(c.Guardrails.BannedTopics)),
+		fmt.Sprintf("GUARDRAIL_MODERATION_MODEL=%s", c.Guardrails.ModerationModel),
+		fmt.Sprintf("GUARDRAIL_PII=%s", c.Guardrails.PII),
+		fmt.Sprintf("GUARDRAIL_HUMAN_CLAIM=%s", c.Guardrails.HumanClaim),
+		fmt.Sprintf("GUARDRAIL_BLOCKED_WORDS=%d entries", len(c.Guardrails.BlockedWords)),
+		fmt.Sprintf("GUARDRAIL_BLOCKED_WORDS_ACTION=%s", c.Guardrails.BlockedWordsAction),
+		fmt.Sprintf("GUARDRAIL_BLOCKED_DOMAINS=%s", strings.Join(c.Guardrails.BlockedDomains, ",")),
+		fmt.Sprintf("GUARDRAIL_BLOCKED_DOMAINS_ACTION=%s", c.Guardrails.BlockedDomainsAction),
+		fmt.Sprintf("GUARDRAIL_MAX_REGENERATIONS=%d", c.Guardrails.MaxRegenerations),
+		fmt.Sprintf("APPROVAL_REQUIRED=%t", c.Approval.Required),
+		fmt.Sprintf("APPROVAL_TRUSTED_AUTHORS=%d entries", len(c.Approval.TrustedAuthors)),
+		fmt.Sprintf("APPROVAL_MAX_RISK=%g", c.Approval.MaxRisk),
+		fmt.Sprintf("APPROVAL_TIMEOUT=%s", c.Approval.Timeout),
+		fmt.Sprintf("APPROVAL_TIMEOUT_ACTION=%s", c.Approval.TimeoutAction),
+		fmt.Sprintf("MAX_RETRIES=%d", c.MaxRetries),
+		fmt.Sprintf("RETRY_BACKOFF_BASE=%s", c.RetryBackoffBase),
+		fmt.Sprintf("RETRY_BACKOFF_MAX=%s", c.RetryBackoffMax),
+		fmt.Sprintf("BLOCKED_AUTHORS=%d entries", len(c.BlockedAuthors)),
+		fmt.Sprintf("CIRCUIT_BREAKER_FAILURES=%d", c.CircuitBreaker.Failures),
+		fmt.Sprintf("CIRCUIT_BREAKER_OPEN_DURATION=%s", c.CircuitBreaker.OpenDuration),
+		fmt.Sprintf("CIRCUIT_BREAKER_SILENT=%t", c.CircuitBreaker.Silent),
+	}
+	return lines
+}
+
+func signatureSummary(signature *SignatureTemplate) string {
+	if signature == nil {
+		return "none"
+	}
+	return signature.String()
+}
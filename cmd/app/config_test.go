@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestBuildDatabaseURLEscapesCredentials(t *testing.T) {
 	got := buildDatabaseURL("reply@bot", "pa:ss/word?", "localhost", "5432", "reply db", "disable")
@@ -10,3 +17,317 @@ func TestBuildDatabaseURLEscapesCredentials(t *testing.T) {
 		t.Fatalf("buildDatabaseURL() = %q; want %q", got, want)
 	}
 }
+
+func setRequiredConfigEnv(t *testing.T) {
+	t.Helper()
+	for name, value := range map[string]string{
+		"DB_USER":            "replybot",
+		"DB_PASSWORD":        "secret",
+		"DB_HOST":            "localhost",
+		"DB_PORT":            "5432",
+		"DB_NAME":            "replybot",
+		"DB_SSLMODE":         "disable",
+		"BLUESKY_IDENTIFIER": "bot.test",
+		"BLUESKY_PASSWORD":   "app-password",
+		"BLUESKY_HOST":       "https://bsky.social",
+		"BOT_HANDLE":         "@bot.test",
+		"LLM_API_KEY":        "key",
+		"LLM_MODEL":          "test-model",
+	} {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("BOT_HANDLE", "")
+	t.Setenv("MAX_RETRIES", "zero")
+	t.Setenv("WORKER_INTERVAL", "-5s")
+	t.Setenv("PROMPT_TEMPLATE", "{{.Missing}}")
+
+	_, err := loadConfigFile("")
+	if err == nil {
+		t.Fatal("loadConfigFile() error = nil; want validation errors")
+	}
+
+	for _, want := range []string{"BOT_HANDLE is required", "MAX_RETRIES must be a positive integer", "WORKER_INTERVAL must be a positive duration", "PROMPT_TEMPLATE is invalid"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigValidatesThreadLengthStrategy(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("THREAD_LENGTH_STRATEGY", "link")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "requires FULL_TEXT_BASE_URL and STATUS_LISTEN_ADDR") {
+		t.Fatalf("loadConfigFile() error = %v; want missing full-text settings", err)
+	}
+
+	t.Setenv("THREAD_LENGTH_STRATEGY", "shorten")
+	_, err = loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "THREAD_LENGTH_STRATEGY must be one of truncate, summarize, link") {
+		t.Fatalf("loadConfigFile() error = %v; want unknown strategy", err)
+	}
+
+	t.Setenv("THREAD_LENGTH_STRATEGY", "Summarize")
+	config, err := loadConfigFile("")
+	if err != nil || config.ThreadLengthStrategy != lengthStrategySummarize {
+		t.Fatalf("loadConfigFile() = %v, %v; want summarize", config, err)
+	}
+}
+
+func TestLoadConfigRejectsReplyPolicy(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("REPLY_POLICY", "author")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "REPLY_POLICY=author is not supported") {
+		t.Fatalf("loadConfigFile() error = %v; want unsupported reply policy", err)
+	}
+
+	t.Setenv("REPLY_POLICY", "anyone")
+	if _, err := loadConfigFile(""); err != nil {
+		t.Fatalf("loadConfigFile() error = %v; want REPLY_POLICY=anyone accepted", err)
+	}
+}
+
+func TestLoadConfigTools(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("LLM_TOOLS", "calculator, browser")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), `LLM_TOOLS contains unknown tool "browser"`) {
+		t.Fatalf("loadConfigFile() error = %v; want unknown tool", err)
+	}
+
+	t.Setenv("LLM_TOOLS", "Calculator,web_search")
+	_, err = loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "LLM_TOOLS=web_search requires SEARCH_URL") {
+		t.Fatalf("loadConfigFile() error = %v; want missing search URL", err)
+	}
+
+	t.Setenv("SEARCH_URL", "https://search.example")
+	config, err := loadConfigFile("")
+	if err != nil || !config.Tools.enabled(toolCalculator) || !config.Tools.enabled(toolWebSearch) || config.Tools.MaxIterations != 3 {
+		t.Fatalf("loadConfigFile() = %+v, %v; want calculator and web_search", config, err)
+	}
+}
+
+func TestLoadConfigKnowledgeBase(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("KB_ENABLED", "true")
+	t.Setenv("PROMPT_TEMPLATE", "Answer: {{.Message}}")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "KB_ENABLED requires EMBEDDING_MODEL") ||
+		!strings.Contains(err.Error(), "KB_ENABLED requires a PROMPT_TEMPLATE that includes {{.Knowledge}}") {
+		t.Fatalf("loadConfigFile() error = %v; want missing model and template errors", err)
+	}
+
+	t.Setenv("EMBEDDING_MODEL", "text-embedding-3-small")
+	t.Setenv("PROMPT_TEMPLATE", "")
+	config, err := loadConfigFile("")
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if config.Embedding.APIKey != config.ChatModel.APIKey || config.KnowledgeBase.Index != kbIndexMemory || config.KnowledgeBase.TopK != 4 {
+		t.Fatalf("loadConfigFile() = %+v, %+v; want defaults and the LLM API key", config.Embedding, config.KnowledgeBase)
+	}
+}
+
+func TestLoadConfigMemoryRequiresTemplate(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("MEMORY_ENABLED", "true")
+	t.Setenv("PROMPT_TEMPLATE", "Answer: {{.Message}}")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "MEMORY_ENABLED requires a PROMPT_TEMPLATE that includes {{.Memory}}") {
+		t.Fatalf("loadConfigFile() error = %v; want template error", err)
+	}
+}
+
+func TestLoadConfigGuardrails(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("GUARDRAIL_PII", "Redact")
+	t.Setenv("GUARDRAIL_BLOCKED_DOMAINS", "bad.example, worse.example")
+
+	config, err := loadConfigFile("")
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	guardrails := config.Guardrails
+	if guardrails.PII != guardrailRedact || guardrails.BlockedWordsAction != guardrailRegenerate || guardrails.RefusalText != defaultRefusalText {
+		t.Fatalf("guardrails = %+v; want configured values and defaults", guardrails)
+	}
+	if !slices.Equal(guardrails.BlockedDomains, []string{"bad.example", "worse.example"}) {
+		t.Fatalf("BlockedDomains = %v", guardrails.BlockedDomains)
+	}
+
+	t.Setenv("GUARDRAIL_HUMAN_CLAIM", "refuse")
+	_, err = loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "GUARDRAIL_HUMAN_CLAIM must be one of off, redact, regenerate, block") {
+		t.Fatalf("loadConfigFile() error = %v; want invalid action", err)
+	}
+}
+
+func TestLoadConfigApprovalMaxRiskRequiresModeration(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("APPROVAL_MAX_RISK", "0.2")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "APPROVAL_MAX_RISK requires GUARDRAIL_MODERATION_MODEL") {
+		t.Fatalf("loadConfigFile() error = %v; want moderation model error", err)
+	}
+
+	t.Setenv("GUARDRAIL_MODERATION_MODEL", "omni-moderation-latest")
+	config, err := loadConfigFile("")
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if config.Approval.MaxRisk != 0.2 || config.Approval.Timeout != 24*time.Hour || config.Approval.TimeoutAction != approvalTimeoutReject {
+		t.Fatalf("approval = %+v", config.Approval)
+	}
+}
+
+func TestLoadConfigSpendingAlerts(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("ALERT_NOTIFIER", "smtp")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "ALERT_NOTIFIER=smtp requires ALERT_SMTP_FROM and ALERT_SMTP_TO") {
+		t.Fatalf("loadConfigFile() error = %v; want SMTP error", err)
+	}
+
+	t.Setenv("ALERT_SMTP_FROM", "bot@example.com")
+	t.Setenv("ALERT_SMTP_TO", "ops@example.com")
+	t.Setenv("SPENDING_ALERT_THRESHOLDS", "90, 25,90")
+	config, err := loadConfigFile("")
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	if !slices.Equal(config.Alerts.Thresholds, []int{25, 90}) || config.Alerts.SMTPAddr != "localhost:25" {
+		t.Fatalf("alerts = %+v", config.Alerts)
+	}
+
+	t.Setenv("SPENDING_ALERT_THRESHOLDS", "off")
+	config, err = loadConfigFile("")
+	if err != nil || len(config.Alerts.Thresholds) != 0 {
+		t.Fatalf("loadConfigFile() = %+v, %v; want alerts off", config.Alerts, err)
+	}
+}
+
+func TestLoadConfigBudgetTimezone(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("BUDGET_TIMEZONE", "Europe/Nowhere")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "BUDGET_TIMEZONE must be an IANA timezone name") {
+		t.Fatalf("loadConfigFile() error = %v; want timezone error", err)
+	}
+
+	t.Setenv("BUDGET_TIMEZONE", "Europe/Zurich")
+	t.Setenv("BUDGET_WINDOW", "rolling")
+	config, err := loadConfigFile("")
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	limits := config.SpendingLimits()
+	if limits.location().String() != "Europe/Zurich" || !limits.Rolling {
+		t.Fatalf("spending limits = %+v", limits)
+	}
+}
+
+func TestLoadConfigDisclosure(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("DISCLOSURE_MODE", "label")
+	t.Setenv("DISCLOSURE_LABEL", "Generated By AI")
+
+	_, err := loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "DISCLOSURE_LABEL must consist of lowercase letters and hyphens") {
+		t.Fatalf("loadConfigFile() error = %v; want invalid label", err)
+	}
+
+	t.Setenv("DISCLOSURE_MODE", "text")
+	t.Setenv("SIGNATURE_TEMPLATE", "none")
+	t.Setenv("DISCLOSURE_POLICY", "guaranteed")
+	_, err = loadConfigFile("")
+	if err == nil || !strings.Contains(err.Error(), "DISCLOSURE_POLICY=guaranteed requires") {
+		t.Fatalf("loadConfigFile() error = %v; want nothing to guarantee", err)
+	}
+
+	t.Setenv("DISCLOSURE_POLICY", "")
+	config, err := loadConfigFile("")
+	if err != nil || config.Disclosure.Signature != nil {
+		t.Fatalf("loadConfigFile() = %+v, %v; want no signature", config, err)
+	}
+}
+
+func TestLoadConfigFileLayeredUnderEnvironment(t *testing.T) {
+	setRequiredConfigEnv(t)
+	t.Setenv("LLM_MODEL", "env-model")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+llm:
+  model: file-model
+  timeout: 90s
+worker_interval: 2s
+blocked_authors:
+  - spam.example
+  - did:plc:abuse
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+
+	if config.ChatModel.Model != "env-model" {
+		t.Errorf("model = %q; want environment value", config.ChatModel.Model)
+	}
+	if config.ChatModel.Timeout != 90*time.Second || config.WorkerInterval != 2*time.Second {
+		t.Errorf("timeout = %s, worker interval = %s", config.ChatModel.Timeout, config.WorkerInterval)
+	}
+	if !config.IsBlockedAuthor("did:plc:other", "spam.example") || !config.IsBlockedAuthor("did:plc:abuse", "x") {
+		t.Errorf("blocked authors = %v", config.BlockedAuthors)
+	}
+}
+
+func TestLoadConfigFileRejectsUnknownSettings(t *testing.T) {
+	setRequiredConfigEnv(t)
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[llm]\nmodle = \"typo\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadConfigFile(path)
+	if err == nil || !strings.Contains(err.Error(), "LLM_MODLE") {
+		t.Fatalf("loadConfigFile() error = %v; want unknown setting LLM_MODLE", err)
+	}
+}
+
+func TestWithReloadedSettingsKeepsRestartOnlySettings(t *testing.T) {
+	current := &Config{BotHandle: "@bot.test", WorkerInterval: time.Second, MaxRetries: 3, DailySpendingLimit: 1}
+	next := &Config{BotHandle: "@other.test", WorkerInterval: time.Minute, MaxRetries: 5, DailySpendingLimit: 2, BlockedAuthors: []string{"spam.example"}}
+
+	merged := current.WithReloadedSettings(next)
+
+	if merged.BotHandle != "@bot.test" || merged.WorkerInterval != time.Second {
+		t.Errorf("restart-only settings changed: %+v", merged)
+	}
+	if merged.MaxRetries != 5 || merged.DailySpendingLimit != 2 || len(merged.BlockedAuthors) != 1 {
+		t.Errorf("reloadable settings not applied: %+v", merged)
+	}
+
+	changes := current.RestartRequiredChanges(next)
+	if !slices.Contains(changes, "BOT_HANDLE") || !slices.Contains(changes, "WORKER_INTERVAL") {
+		t.Errorf("restart required changes = %v", changes)
+	}
+}
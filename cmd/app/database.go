@@ -13,24 +13,44 @@ import (
 )
 
 func initDatabase(databaseURL string, logger *slog.Logger) (*pgxpool.Pool, error) {
+	pool, err := openDatabase(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runMigrations(databaseURL, logger); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	logger.Info("Database initialized successfully")
+	return pool, nil
+}
+
+func openDatabase(databaseURL string) (*pgxpool.Pool, error) {
 	pool, err := pgxpool.New(context.Background(), databaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create connection pool: %w", err)
 	}
 
 	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	if err := runMigrations(databaseURL, logger); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
-	}
-
-	logger.Info("Database initialized successfully")
 	return pool, nil
 }
 
 func runMigrations(databaseURL string, logger *slog.Logger) error {
+	if err := runMigrationCommand(context.Background(), databaseURL, "up", logger); err != nil {
+		return err
+	}
+
+	logger.Info("Migrations applied successfully")
+	return nil
+}
+
+func runMigrationCommand(ctx context.Context, databaseURL, command string, logger *slog.Logger) error {
 	db, err := sql.Open("pgx", databaseURL)
 	if err != nil {
 		return fmt.Errorf("failed to open database for migrations: %w", err)
@@ -47,10 +67,9 @@ func runMigrations(databaseURL string, logger *slog.Logger) error {
 
 	goose.SetBaseFS(database.MigrationFS)
 
-	if err := goose.Up(db, "migration"); err != nil {
-		return fmt.Errorf("failed to apply migrations: %w", err)
+	if err := goose.RunContext(ctx, command, db, "migration"); err != nil {
+		return fmt.Errorf("failed to run migration command %q: %w", command, err)
 	}
 
-	logger.Info("Migrations applied successfully")
 	return nil
 }
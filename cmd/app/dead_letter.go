@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	stageGenerate = "generate"
+	stageSend     = "send"
+)
+
+type queueAttempt struct {
+	Stage      string    `json:"stage"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error"`
+}
+
+// recordAttempt appends a failed attempt to the queue row so that a later
+// dead letter carries the complete error history.
+func (b *Bot) recordAttempt(messageID int64, stage string, startedAt time.Time, errorMsg string) {
+	attempt, err := json.Marshal(queueAttempt{
+		Stage:      stage,
+		StartedAt:  startedAt.UTC(),
+		FinishedAt: time.Now().UTC(),
+		Error:      errorMsg,
+	})
+	if err != nil {
+		b.logger.Error("Failed to encode attempt", "message_id", messageID, "error", err)
+		return
+	}
+
+	if err := b.queries.AppendMessageAttempt(b.ctx, database.AppendMessageAttemptParams{
+		Attempt: attempt,
+		ID:      messageID,
+	}); err != nil {
+		b.logger.Error("Failed to record attempt",
+			"message_id", messageID,
+			"error", err)
+	}
+}
+
+// deadLetter copies an exhausted queue row into the dead-letter table. The
+// caller still decides what happens to the queue row itself. answered records
+// that the author got a reply anyway, the fallback or some posts of a thread,
+// so that a replay does not answer the post a second time by accident.
+func (b *Bot) deadLetter(messageID int64, stage, lastError string, answered bool) error {
+	deadLetterID, err := b.queries.DeadLetterQueueMessage(b.ctx, database.DeadLetterQueueMessageParams{
+		Stage:     stage,
+		LastError: &lastError,
+		Answered:  answered,
+		QueueID:   messageID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move message %d to dead-letter table: %w", messageID, err)
+	}
+
+	b.logger.Warn("Moved message to dead-letter table",
+		"message_id", messageID,
+		"dead_letter_id", deadLetterID,
+		"stage", stage,
+		"answered", answered)
+	return nil
+}
+
+// dropWithoutFallback dead-letters a message and removes it from the queue
+// without replying. It is used instead of the fallback reply while the LLM
+// circuit breaker is open and CIRCUIT_BREAKER_SILENT is enabled.
+func (b *Bot) dropWithoutFallback(messageID int64, lastError string) error {
+	if err := b.deadLetter(messageID, stageGenerate, lastError, false); err != nil {
+		return fmt.Errorf("failed to dead-letter message without fallback: %w", err)
+	}
+	if err := b.queries.DeleteMessageFromQueue(b.ctx, messageID); err != nil {
+		return fmt.Errorf("failed to delete dead-lettered message from queue: %w", err)
+	}
+	b.logger.Info("Skipped fallback reply while LLM circuit breaker is open", "message_id", messageID)
+	return nil
+}
+
+func (b *Bot) suppressFallback() bool {
+	return b.currentConfig().CircuitBreaker.Silent && b.circuitBreaker.IsOpen()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	channelPost = "post"
+	channelDM   = "dm"
+)
+
+// dmMessageGraphemes is the maximum length of a chat message.
+const dmMessageGraphemes = 1000
+
+// dmHistoryFetchLimit is the maximum number of messages
+// chat.bsky.convo.getMessages returns per call.
+const dmHistoryFetchLimit = 100
+
+// dmMessageURI identifies a chat message in the message_uri columns, which
+// hold AT URIs for posts.
+func dmMessageURI(convoID, messageID string) string {
+	return "chat:" + convoID + "/" + messageID
+}
+
+// ingestDirectMessages queues the newest message of every unread direct
+// conversation. Earlier unread messages reach the model as conversation
+// context.
+func (b *Bot) ingestDirectMessages() error {
+	convos, err := b.bluesky.ListUnreadConvos(b.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list conversations: %w", err)
+	}
+
+	for _, convo := range convos {
+		if err := b.ingestConvo(convo); err != nil {
+			b.logger.Error("Error processing conversation for queue",
+				"convo_id", convo.Id,
+				"error", err)
+		}
+	}
+	return nil
+}
+
+func (b *Bot) ingestConvo(convo *chat.ConvoDefs_ConvoView) error {
+	var message *chat.ConvoDefs_MessageView
+	if convo.LastMessage != nil {
+		message = convo.LastMessage.ConvoDefs_MessageView
+	}
+	if message == nil || message.Sender == nil {
+		return b.bluesky.UpdateConvoRead(b.ctx, convo.Id, "")
+	}
+
+	selfDID, err := b.bluesky.SelfDID(b.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the DID of the bot account: %w", err)
+	}
+	// The newest message is the bot's own reply, so there is nothing to answer.
+	if message.Sender.Did != selfDID {
+		if err := b.queueDirectMessage(convo, message); err != nil {
+			return err
+		}
+	}
+	if err := b.bluesky.UpdateConvoRead(b.ctx, convo.Id, message.Id); err != nil {
+		return fmt.Errorf("failed to mark conversation as read: %w", err)
+	}
+	return nil
+}
+
+func (b *Bot) queueDirectMessage(convo *chat.ConvoDefs_ConvoView, message *chat.ConvoDefs_MessageView) error {
+	authorDID := message.Sender.Did
+	authorHandle := authorDID
+	for _, member := range convo.Members {
+		if member.Did == authorDID {
+			authorHandle = member.Handle
+		}
+	}
+
+	if b.currentConfig().IsBlockedAuthor(authorDID, authorHandle) {
+		b.logger.Info("Ignoring direct message from blocked author", "author_handle", authorHandle)
+		return nil
+	}
+
+	text := strings.TrimSpace(message.Text)
+	if text == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode direct message: %w", err)
+	}
+
+	_, err = b.queries.InsertMessage(b.ctx, database.InsertMessageParams{
+		MessageUri:   dmMessageURI(convo.Id, message.Id),
+		MessageCid:   message.Rev,
+		AuthorDid:    authorDID,
+		AuthorHandle: authorHandle,
+		MessageText:  text,
+		Notification: payload,
+		Channel:      channelDM,
+		ConvoID:      &convo.Id,
+	})
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to insert direct message into queue: %w", err)
+	}
+	return nil
+}
+
+// conversationContext returns up to DM_CONTEXT_MESSAGES messages that precede
+// a direct message, oldest first. Messages from the author become user turns
+// and the bot's messages assistant turns. Without a conversation, or when the
+// messages cannot be loaded, the reply is generated without context.
+func (b *Bot) conversationContext(message database.ClaimNextMessageRow) []*schema.Message {
+	limit := b.currentConfig().DMContextMessages
+	if message.Channel != channelDM || message.ConvoID == nil || limit == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+	messages, err := b.bluesky.GetConvoMessages(ctx, *message.ConvoID, dmHistoryFetchLimit)
+	if err != nil {
+		b.logger.Warn("Failed to load conversation context",
+			"message_id", message.ID,
+			"error", err)
+		return nil
+	}
+
+	var history []*schema.Message
+	found := false
+	for _, previous := range messages {
+		if !found {
+			found = dmMessageURI(*message.ConvoID, previous.Id) == message.MessageUri
+			continue
+		}
+		if strings.TrimSpace(previous.Text) == "" || previous.Sender == nil {
+			continue
+		}
+		role := schema.User
+		if previous.Sender.Did != message.AuthorDid {
+			role = schema.Assistant
+		}
+		history = append(history, &schema.Message{Role: role, Content: previous.Text})
+		if len(history) == limit {
+			break
+		}
+	}
+	slices.Reverse(history)
+	return history
+}
+
+// sendDirectMessage sends chunks as consecutive messages to the conversation
+// of the message. On failure it returns the messages that were sent before.
+func (b *Bot) sendDirectMessage(message database.GetReadyToSendMessagesRow, chunks []string) (sentReply, error) {
+	if message.ConvoID == nil {
+		return sentReply{}, fmt.Errorf("direct message ID %d has no conversation", message.ID)
+	}
+	convoID := *message.ConvoID
+
+	var sent sentReply
+	for i, chunk := range chunks {
+		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+		messageID, err := b.bluesky.SendChatMessage(ctx, convoID, chunk)
+		cancel()
+
+		if err != nil && len(chunks) == 1 {
+			return sent, err
+		}
+		if err != nil {
+			return sent, fmt.Errorf("failed to send message %d/%d: %w", i+1, len(chunks), err)
+		}
+
+		uri := dmMessageURI(convoID, messageID)
+		if i == 0 {
+			sent.URI = uri
+		}
+		sent.PostURIs = append(sent.PostURIs, uri)
+
+		if i < len(chunks)-1 && !b.pause(b.currentConfig().ThreadChunkPause) {
+			return sent, b.ctx.Err()
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/cloudwego/eino/schema"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func directConvo(id, text string) *chat.ConvoDefs_ConvoView {
+	return &chat.ConvoDefs_ConvoView{
+		Id: id,
+		Members: []*chat.ActorDefs_ProfileViewBasic{
+			{Did: "did:plc:bot", Handle: "bot.test"},
+			{Did: "did:plc:alice", Handle: "alice.test"},
+		},
+		LastMessage: &chat.ConvoDefs_ConvoView_LastMessage{
+			ConvoDefs_MessageView: &chat.ConvoDefs_MessageView{
+				Id:     "m2",
+				Rev:    "rev-2",
+				Sender: &chat.ConvoDefs_MessageViewSender{Did: "did:plc:alice"},
+				Text:   text,
+			},
+		},
+		UnreadCount: 2,
+	}
+}
+
+func chatMessage(id, sender, text string) *chat.ConvoDefs_MessageView {
+	return &chat.ConvoDefs_MessageView{
+		Id:     id,
+		Sender: &chat.ConvoDefs_MessageViewSender{Did: sender},
+		Text:   text,
+	}
+}
+
+func TestIngestDirectMessagesQueuesNewestMessage(t *testing.T) {
+	bot := newTestBot(3)
+	bot.bluesky.convos = []*chat.ConvoDefs_ConvoView{directConvo("c1", " What is Go? ")}
+
+	if err := bot.ingestDirectMessages(); err != nil {
+		t.Fatalf("ingestDirectMessages() error = %v", err)
+	}
+
+	if len(bot.queries.inserted) != 1 {
+		t.Fatalf("inserted %d messages; want 1", len(bot.queries.inserted))
+	}
+	inserted := bot.queries.inserted[0]
+	if inserted.Channel != channelDM || inserted.ConvoID == nil || *inserted.ConvoID != "c1" {
+		t.Fatalf("channel = %q, convo = %v; want dm in c1", inserted.Channel, inserted.ConvoID)
+	}
+	if inserted.MessageUri != "chat:c1/m2" || inserted.AuthorHandle != "alice.test" || inserted.MessageText != "What is Go?" {
+		t.Fatalf("inserted = %+v", inserted)
+	}
+	if len(bot.bluesky.readConvos) != 1 || bot.bluesky.readConvos[0] != "c1" {
+		t.Fatalf("read conversations = %v; want c1", bot.bluesky.readConvos)
+	}
+}
+
+func TestIngestDirectMessagesSkipsBlockedAuthor(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.BlockedAuthors = []string{"alice.test"}
+	bot.config.Store(config)
+	bot.bluesky.convos = []*chat.ConvoDefs_ConvoView{directConvo("c1", "hello")}
+
+	if err := bot.ingestDirectMessages(); err != nil {
+		t.Fatalf("ingestDirectMessages() error = %v", err)
+	}
+
+	if len(bot.queries.inserted) != 0 {
+		t.Fatalf("inserted %d messages; want none", len(bot.queries.inserted))
+	}
+	if len(bot.bluesky.readConvos) != 1 {
+		t.Fatalf("read conversations = %v; want the conversation marked as read", bot.bluesky.readConvos)
+	}
+}
+
+func TestIngestDirectMessagesSkipsOwnMessage(t *testing.T) {
+	bot := newTestBot(3)
+	convo := directConvo("c1", "Go is a programming language.")
+	convo.LastMessage.ConvoDefs_MessageView.Sender.Did = "did:plc:bot"
+	bot.bluesky.convos = []*chat.ConvoDefs_ConvoView{convo}
+
+	if err := bot.ingestDirectMessages(); err != nil {
+		t.Fatalf("ingestDirectMessages() error = %v", err)
+	}
+
+	if len(bot.queries.inserted) != 0 {
+		t.Fatalf("inserted %d messages; want the bot's own message skipped", len(bot.queries.inserted))
+	}
+	if len(bot.bluesky.readConvos) != 1 || bot.bluesky.readConvos[0] != "c1" {
+		t.Fatalf("read conversations = %v; want c1", bot.bluesky.readConvos)
+	}
+}
+
+func TestGenerateDirectMessageReplyIncludesConversation(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.DMContextMessages = 2
+	bot.config.Store(config)
+	bot.bluesky.convoMessages = map[string][]*chat.ConvoDefs_MessageView{
+		"c1": {
+			chatMessage("m4", "did:plc:alice", "newer"),
+			chatMessage("m3", "did:plc:alice", "and Rust?"),
+			chatMessage("m2", "did:plc:bot", "Go is a language."),
+			chatMessage("m1", "did:plc:alice", "What is Go?"),
+			chatMessage("m0", "did:plc:alice", "hi"),
+		},
+	}
+	bot.queries.claimable = []database.ClaimNextMessageRow{{
+		ID:          1,
+		MessageUri:  "chat:c1/m3",
+		AuthorDid:   "did:plc:alice",
+		MessageText: "and Rust?",
+		Channel:     channelDM,
+		ConvoID:     new("c1"),
+	}}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	input := bot.model.inputs[0]
+	if len(input) != 3 {
+		t.Fatalf("model input has %d messages; want 2 context messages and the prompt", len(input))
+	}
+	if input[0].Role != schema.User || input[0].Content != "What is Go?" {
+		t.Fatalf("input[0] = %+v; want the author's earlier message", input[0])
+	}
+	if input[1].Role != schema.Assistant || input[1].Content != "Go is a language." {
+		t.Fatalf("input[1] = %+v; want the bot's reply", input[1])
+	}
+}
+
+func TestSendPendingRepliesSendsDirectMessage(t *testing.T) {
+	bot := newTestBot(3)
+	message := readyMessage(1, "Hello!", 0)
+	message.MessageUri = "chat:c1/m1"
+	message.Channel = channelDM
+	message.ConvoID = new("c1")
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{message}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.bluesky.posts) != 0 {
+		t.Fatalf("created %d posts; want none", len(bot.bluesky.posts))
+	}
+	want := sentChatMessage{ConvoID: "c1", Text: "Hello!\nAI: test-model"}
+	if len(bot.bluesky.chatMessages) != 1 || bot.bluesky.chatMessages[0] != want {
+		t.Fatalf("chat messages = %+v; want %+v", bot.bluesky.chatMessages, want)
+	}
+	history := bot.queries.history[0]
+	if history.Channel != channelDM || *history.ReplyUri != "chat:c1/sent-1" {
+		t.Fatalf("history channel = %q, reply = %q", history.Channel, *history.ReplyUri)
+	}
+}
+
+func TestDeleteReplyRejectsDirectMessages(t *testing.T) {
+	bot := newTestBot(3)
+	entry := database.MessageHistory{ID: 1, Channel: channelDM, ReplyUri: new("chat:c1/sent-1")}
+
+	if _, err := deleteReply(bot.ctx, bot.bluesky, bot.queries, entry, "operator"); err == nil {
+		t.Fatal("deleteReply() error = nil; want an error for a direct message")
+	}
+	if len(bot.bluesky.deletedPosts) != 0 {
+		t.Fatalf("deleted posts = %v; want none", bot.bluesky.deletedPosts)
+	}
+}
+
+type sentChatMessage struct {
+	ConvoID string
+	Text    string
+}
+
+func (f *fakeBluesky) ListUnreadConvos(context.Context) ([]*chat.ConvoDefs_ConvoView, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.convos, nil
+}
+
+func (f *fakeBluesky) GetConvoMessages(_ context.Context, convoID string, limit int64) ([]*chat.ConvoDefs_MessageView, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	messages := f.convoMessages[convoID]
+	return messages[:min(int(limit), len(messages))], nil
+}
+
+func (f *fakeBluesky) SelfDID(context.Context) (string, error) {
+	return "did:plc:bot", nil
+}
+
+func (f *fakeBluesky) UpdateConvoRead(_ context.Context, convoID, _ string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readConvos = append(f.readConvos, convoID)
+	return nil
+}
+
+func (f *fakeBluesky) SendChatMessage(_ context.Context, convoID, text string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chatMessages = append(f.chatMessages, sentChatMessage{ConvoID: convoID, Text: text})
+	return fmt.Sprintf("sent-%d", len(f.chatMessages)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+const defaultSignatureTemplate = "AI: {{.Model}}"
+
+const (
+	disclosureText  = "text"
+	disclosureLabel = "label"
+	disclosureBoth  = "both"
+)
+
+const (
+	disclosureBestEffort = "best_effort"
+	disclosureGuaranteed = "guaranteed"
+)
+
+// labelValuePattern follows the syntax for custom label values: lowercase
+// ASCII letters and hyphens.
+var labelValuePattern = regexp.MustCompile(`^[a-z-]{1,128}$`)
+
+type DisclosureConfig struct {
+	// Signature is nil when replies carry no text signature.
+	Signature *SignatureTemplate
+	Mode      string
+	Label     string
+	Policy    string
+}
+
+func (d DisclosureConfig) usesText() bool {
+	return d.Signature != nil && (d.Mode == disclosureText || d.Mode == disclosureBoth)
+}
+
+func (d DisclosureConfig) usesLabel() bool {
+	return d.Mode == disclosureLabel || d.Mode == disclosureBoth
+}
+
+type SignatureTemplate struct {
+	text     string
+	template *template.Template
+}
+
+type SignatureData struct {
+	Model string
+}
+
+func NewSignatureTemplate(text string) (*SignatureTemplate, error) {
+	tmpl, err := template.New("signature").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := &SignatureTemplate{text: text, template: tmpl}
+	if _, err := signature.Render(SignatureData{Model: "test"}); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+func (s *SignatureTemplate) Render(data SignatureData) (string, error) {
+	var builder strings.Builder
+	if err := s.template.Execute(&builder, data); err != nil {
+		return "", fmt.Errorf("failed to render signature: %w", err)
+	}
+	return strings.TrimSpace(builder.String()), nil
+}
+
+func (s *SignatureTemplate) String() string {
+	return s.text
+}
+
+func selfLabels(value string) *bsky.FeedPost_Labels {
+	return &bsky.FeedPost_Labels{
+		LabelDefs_SelfLabels: &atproto.LabelDefs_SelfLabels{
+			Values: []*atproto.LabelDefs_SelfLabel{{Val: value}},
+		},
+	}
+}
+
+// replyChunks splits a reply into the texts of the posts to send. The
+// signature goes on its own line below the reply when it fits. Otherwise it is
+// dropped, or with guaranteed set, posted as a separate final part.
+func replyChunks(responseText, signature string, style MarkerStyle, guaranteed bool) []string {
+	return chunkReply(responseText, signature, singlePostGraphemes, threadChunkGraphemes, style, guaranteed)
+}
+
+// chunkReply is replyChunks for messages of at most single graphemes, split
+// into chunks of at most chunk graphemes when longer.
+func chunkReply(responseText, signature string, single, chunk int, style MarkerStyle, guaranteed bool) []string {
+	responseText = strings.TrimSpace(responseText)
+	chunks := []string{responseText}
+	if countGraphemes(responseText) > single {
+		chunks = splitTextIntoChunks(responseText, chunk, style)
+	}
+	if signature == "" {
+		return chunks
+	}
+
+	last := chunks[len(chunks)-1] + "\n" + signature
+	if countGraphemes(last) <= single {
+		chunks[len(chunks)-1] = last
+		return chunks
+	}
+	if !guaranteed {
+		return chunks
+	}
+	return splitWithFinalPart(responseText, signature, chunk, style)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino-ext/libs/acl/openai"
+	"github.com/cloudwego/eino/callbacks"
+	"github.com/cloudwego/eino/components"
+	"github.com/cloudwego/eino/components/embedding"
+)
+
+type EmbeddingConfig struct {
+	Provider   string
+	APIKey     string
+	BaseURL    string
+	Model      string
+	Dimensions int
+	Timeout    time.Duration
+}
+
+func NewEmbedder(ctx context.Context, config EmbeddingConfig) (embedding.Embedder, error) {
+	provider := strings.ToLower(strings.TrimSpace(config.Provider))
+	if provider == "" {
+		provider = "openai"
+	}
+
+	switch provider {
+	case "openai", "openai-compatible":
+		embeddingConfig := &openai.EmbeddingConfig{
+			APIKey:     config.APIKey,
+			BaseURL:    config.BaseURL,
+			Model:      config.Model,
+			HTTPClient: &http.Client{Timeout: config.Timeout},
+		}
+		if config.Dimensions > 0 {
+			embeddingConfig.Dimensions = &config.Dimensions
+		}
+		return openai.NewEmbeddingClient(ctx, embeddingConfig)
+	default:
+		return nil, fmt.Errorf("unsupported EMBEDDING_PROVIDER %q", config.Provider)
+	}
+}
+
+// embedTexts embeds texts and returns the number of tokens the provider
+// charged. Eino reports the token usage of embeddings only to callbacks; when
+// the provider reports none, the tokens are estimated like LLM prompts.
+func embedTexts(ctx context.Context, embedder embedding.Embedder, texts []string) ([][]float32, int, error) {
+	var usage *embedding.TokenUsage
+	handler := callbacks.NewHandlerBuilder().
+		OnEndFn(func(ctx context.Context, _ *callbacks.RunInfo, output callbacks.CallbackOutput) context.Context {
+			if out := embedding.ConvCallbackOutput(output); out != nil && out.TokenUsage != nil {
+				usage = out.TokenUsage
+			}
+			return ctx
+		}).
+		Build()
+	ctx = callbacks.InitCallbacks(ctx, &callbacks.RunInfo{Component: components.ComponentOfEmbedding}, handler)
+
+	vectors, err := embedder.EmbedStrings(ctx, texts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(vectors) != len(texts) {
+		return nil, 0, fmt.Errorf("embedding model returned %d vectors for %d texts", len(vectors), len(texts))
+	}
+
+	embeddings := make([][]float32, len(vectors))
+	for i, vector := range vectors {
+		embeddings[i] = make([]float32, len(vector))
+		for j, value := range vector {
+			embeddings[i][j] = float32(value)
+		}
+	}
+
+	tokens := estimateTokens(strings.Join(texts, "\n"))
+	if usage != nil && usage.PromptTokens > 0 {
+		tokens = usage.PromptTokens
+	}
+	return embeddings, tokens, nil
+}
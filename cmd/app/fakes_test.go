@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/api/chat"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+type fakeQuerier struct {
+	database.Querier
+
+	mu                sync.Mutex
+	claimable         []database.ClaimNextMessageRow
+	readyToSend       []database.GetReadyToSendMessagesRow
+	staleMessages     []database.GetStaleProcessingMessagesRow
+	inserted          []database.InsertMessageParams
+	llmResponses      []database.UpdateMessageWithLLMResponseParams
+	failed            []database.UpdateMessageFailedParams
+	sendFailed        []database.UpdateReadyToSendMessageFailedParams
+	deferred          []database.UpdateMessageDeferredWithNoticeParams
+	noticesSent       []int64
+	resetStale        []int64
+	deleted           []int64
+	history           []database.InsertMessageHistoryParams
+	queue             []database.MessageQueue
+	historyRows       []database.MessageHistory
+	attempts          []database.AppendMessageAttemptParams
+	deadLettered      []database.DeadLetterQueueMessageParams
+	deadLetters       []database.DeadLetter
+	replayed          []database.ReplayDeadLetterParams
+	released          []database.ReleaseMessageParams
+	fullTextPages     []database.InsertFullTextPageParams
+	cancelled         []database.CancelQueueMessageParams
+	toolCalls         []database.InsertToolCallParams
+	kbDocuments       []database.KbDocument
+	kbPassages        []database.KbPassage
+	kbWrites          int64
+	userMemories      map[string]database.UserMemory
+	verdicts          map[int64][]guardrailVerdict
+	approvalRequests  []database.SubmitMessageForApprovalParams
+	spendingAlerts    []database.InsertSpendingAlertParams
+	insertHistoryErr  error
+	getReadyToSendErr error
+}
+
+func (q *fakeQuerier) ClaimNextMessage(context.Context) (database.ClaimNextMessageRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.claimable) == 0 {
+		return database.ClaimNextMessageRow{}, pgx.ErrNoRows
+	}
+	message := q.claimable[0]
+	q.claimable = q.claimable[1:]
+	return message, nil
+}
+
+func (q *fakeQuerier) InsertMessage(_ context.Context, arg database.InsertMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, existing := range q.inserted {
+		if existing.MessageUri == arg.MessageUri {
+			return 0, pgx.ErrNoRows
+		}
+	}
+	q.inserted = append(q.inserted, arg)
+	return int64(len(q.inserted)), nil
+}
+
+func (q *fakeQuerier) GetReadyToSendMessages(_ context.Context, limit int32) ([]database.GetReadyToSendMessagesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.getReadyToSendErr != nil {
+		return nil, q.getReadyToSendErr
+	}
+	messages := q.readyToSend
+	if len(messages) > int(limit) {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (q *fakeQuerier) GetStaleProcessingMessages(context.Context, pgtype.Timestamptz) ([]database.GetStaleProcessingMessagesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.staleMessages, nil
+}
+
+func (q *fakeQuerier) UpdateMessageWithLLMResponse(_ context.Context, arg database.UpdateMessageWithLLMResponseParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.llmResponses = append(q.llmResponses, arg)
+	return nil
+}
+
+func (q *fakeQuerier) UpdateMessageFailed(_ context.Context, arg database.UpdateMessageFailedParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failed = append(q.failed, arg)
+	return nil
+}
+
+func (q *fakeQuerier) UpdateReadyToSendMessageFailed(_ context.Context, arg database.UpdateReadyToSendMessageFailedParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sendFailed = append(q.sendFailed, arg)
+	return nil
+}
+
+func (q *fakeQuerier) UpdateMessageDeferredWithNotice(_ context.Context, arg database.UpdateMessageDeferredWithNoticeParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deferred = append(q.deferred, arg)
+	return nil
+}
+
+func (q *fakeQuerier) MarkDeferredNoticeSent(_ context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.noticesSent = append(q.noticesSent, id)
+	return nil
+}
+
+func (q *fakeQuerier) ResetStaleMessage(_ context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.resetStale = append(q.resetStale, id)
+	return nil
+}
+
+func (q *fakeQuerier) DeleteMessageFromQueue(_ context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deleted = append(q.deleted, id)
+	return nil
+}
+
+func (q *fakeQuerier) InsertMessageHistory(_ context.Context, arg database.InsertMessageHistoryParams) (database.MessageHistory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.insertHistoryErr != nil {
+		return database.MessageHistory{}, q.insertHistoryErr
+	}
+	q.history = append(q.history, arg)
+	return database.MessageHistory{ID: int64(len(q.history)), Status: arg.Status}, nil
+}
+
+type fakeBluesky struct {
+	mu            sync.Mutex
+	notifications []*bsky.NotificationListNotifications_Notification
+	seen          int
+	writeWaits    int
+	posts         []*bsky.FeedPost
+	createErrs    []error
+	postgates     []*bsky.FeedPostgate
+	deletedPosts  []string
+	// sourceCIDs lists the posts GetPosts finds, by URI.
+	sourceCIDs map[string]string
+	// hiddenPosts lists posts GetPosts leaves out although their record
+	// still exists.
+	hiddenPosts map[string]bool
+	handles     map[string]string
+	threads     map[string]*bsky.FeedGetPostThread_Output
+	profiles    map[string]*bsky.ActorDefs_ProfileViewDetailed
+	convos      []*chat.ConvoDefs_ConvoView
+	// convoMessages lists the messages of each conversation, newest first.
+	convoMessages map[string][]*chat.ConvoDefs_MessageView
+	readConvos    []string
+	chatMessages  []sentChatMessage
+}
+
+func (f *fakeBluesky) ListNotifications(_ context.Context, cursor string, _ int64, _ []string) (*bsky.NotificationListNotifications_Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cursor != "" {
+		return &bsky.NotificationListNotifications_Output{}, nil
+	}
+	return &bsky.NotificationListNotifications_Output{Notifications: f.notifications}, nil
+}
+
+func (f *fakeBluesky) UpdateSeen(context.Context, time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seen++
+	return nil
+}
+
+func (f *fakeBluesky) WaitForWrite(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeWaits++
+	return nil
+}
+
+func (f *fakeBluesky) CreatePost(_ context.Context, post *bsky.FeedPost) (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.createErrs) > 0 {
+		err := f.createErrs[0]
+		f.createErrs = f.createErrs[1:]
+		if err != nil {
+			return "", "", err
+		}
+	}
+	f.posts = append(f.posts, post)
+	n := len(f.posts)
+	return fmt.Sprintf("at://did:plc:bot/app.bsky.feed.post/%d", n), fmt.Sprintf("cid-%d", n), nil
+}
+
+func (f *fakeBluesky) ResolveHandle(_ context.Context, handle string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	did, ok := f.handles[handle]
+	if !ok {
+		return "", fmt.Errorf("unable to resolve handle %q", handle)
+	}
+	return did, nil
+}
+
+func (f *fakeBluesky) GetPostThread(_ context.Context, uri string, _ int64) (*bsky.FeedGetPostThread_Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	thread, ok := f.threads[uri]
+	if !ok {
+		return nil, fmt.Errorf("post not found: %s", uri)
+	}
+	return thread, nil
+}
+
+type fakeChatModel struct {
+	mu        sync.Mutex
+	responses []*schema.Message
+	errs      []error
+	calls     int
+	inputs    [][]*schema.Message
+	tools     []*schema.ToolInfo
+	// toolChoices records the tool choice of every call, nil when unset.
+	toolChoices []*schema.ToolChoice
+	// streamChunkSize splits streamed responses into chunks of this many
+	// bytes; the response metadata arrives with the last chunk.
+	streamChunkSize int
+	streamed        int
+}
+
+func (m *fakeChatModel) Generate(_ context.Context, input []*schema.Message, opts ...model.Option) (*schema.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	m.inputs = append(m.inputs, slices.Clone(input))
+	m.toolChoices = append(m.toolChoices, model.GetCommonOptions(nil, opts...).ToolChoice)
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(m.responses) == 0 {
+		return schema.AssistantMessage("ok", nil), nil
+	}
+	resp := m.responses[0]
+	m.responses = m.responses[1:]
+	return resp, nil
+}
+
+func (m *fakeChatModel) WithTools(tools []*schema.ToolInfo) (model.ToolCallingChatModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tools = tools
+	return m, nil
+}
+
+func (m *fakeChatModel) Stream(ctx context.Context, input []*schema.Message, opts ...model.Option) (*schema.StreamReader[*schema.Message], error) {
+	resp, err := m.Generate(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	chunkSize := m.streamChunkSize
+	m.mu.Unlock()
+	if chunkSize <= 0 {
+		return schema.StreamReaderFromArray([]*schema.Message{resp}), nil
+	}
+
+	reader, writer := schema.Pipe[*schema.Message](0)
+	go func() {
+		defer writer.Close()
+		content := resp.Content
+		for len(content) > 0 {
+			size := min(chunkSize, len(content))
+			chunk := schema.AssistantMessage(content[:size], nil)
+			content = content[size:]
+			if len(content) == 0 {
+				chunk.ResponseMeta = resp.ResponseMeta
+			}
+			if writer.Send(chunk, nil) {
+				return
+			}
+			m.mu.Lock()
+			m.streamed++
+			m.mu.Unlock()
+		}
+	}()
+	return reader, nil
+}
+
+type testBot struct {
+	*Bot
+	queries *fakeQuerier
+	bluesky *fakeBluesky
+	model   *fakeChatModel
+}
+
+func newTestBot(maxRetries int) *testBot {
+	queries := &fakeQuerier{}
+	bluesky := &fakeBluesky{sourceCIDs: map[string]string{"at://did:plc:alice/app.bsky.feed.post/1": "cid-parent"}}
+	chatModel := &fakeChatModel{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	bot := NewBot(testConfig(maxRetries), queries, bluesky, chatModel, nil, nil, nil, logger)
+
+	return &testBot{Bot: bot, queries: queries, bluesky: bluesky, model: chatModel}
+}
+
+func testConfig(maxRetries int) *Config {
+	prompt, err := NewPromptTemplate(defaultPromptTemplate)
+	if err != nil {
+		panic(err)
+	}
+	signature, err := NewSignatureTemplate(defaultSignatureTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return &Config{
+		BotHandle:            "@bot.test",
+		ReplyBatchSize:       10,
+		StaleThreshold:       5 * time.Minute,
+		MaxRetries:           maxRetries,
+		RetryBackoffBase:     30 * time.Second,
+		RetryBackoffMax:      30 * time.Minute,
+		ChatModel:            ChatModelConfig{Model: "test-model", MaxOutputTokens: 100},
+		Prompt:               prompt,
+		ThreadLengthStrategy: lengthStrategyTruncate,
+		ThreadMarkerStyle:    MarkerClassic,
+		Disclosure: DisclosureConfig{
+			Signature: signature,
+			Mode:      disclosureText,
+			Label:     "ai-generated",
+			Policy:    disclosureBestEffort,
+		},
+	}
+}
+
+func timestamptz(t time.Time) pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: t, Valid: true}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	guardrailStageInput  = "input"
+	guardrailStageOutput = "output"
+)
+
+// Guardrail actions. Input checks pass or refuse; output checks pass, redact,
+// regenerate or block. off disables an output check.
+const (
+	guardrailOff        = "off"
+	guardrailPass       = "pass"
+	guardrailRefuse     = "refuse"
+	guardrailRedact     = "redact"
+	guardrailRegenerate = "regenerate"
+	guardrailBlock      = "block"
+	guardrailError      = "error"
+)
+
+var guardrailActions = []string{guardrailOff, guardrailRedact, guardrailRegenerate, guardrailBlock}
+
+const (
+	checkInjection      = "injection"
+	checkBannedTopics   = "banned_topics"
+	checkModeration     = "moderation"
+	checkPII            = "pii"
+	checkBlockedWords   = "blocked_words"
+	checkBlockedDomains = "blocked_domains"
+	checkHumanClaim     = "human_claim"
+)
+
+const defaultRefusalText = "Sorry, I can't help with that."
+
+const redactedSpan = "[redacted]"
+
+type GuardrailConfig struct {
+	InjectionCheck       bool
+	BannedTopics         []string
+	ModerationModel      string
+	PII                  string
+	HumanClaim           string
+	BlockedWords         []string
+	BlockedWordsAction   string
+	BlockedDomains       []string
+	BlockedDomainsAction string
+	MaxRegenerations     int
+	RefusalText          string
+}
+
+// guardrailVerdict is the result of one check. The verdicts of a message are
+// appended to the guardrail_verdicts column of its queue row.
+type guardrailVerdict struct {
+	Stage   string    `json:"stage"`
+	Check   string    `json:"check"`
+	Action  string    `json:"action"`
+	Reason  string    `json:"reason,omitempty"`
+	Attempt int       `json:"attempt,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// GuardrailBlockedError is returned when an output check blocks the reply.
+type GuardrailBlockedError struct {
+	Check  string
+	Reason string
+}
+
+func (e *GuardrailBlockedError) Error() string {
+	return fmt.Sprintf("reply blocked by %s guardrail: %s", e.Check, e.Reason)
+}
+
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(?:ignore|disregard|forget|override)\s+(?:all\s+|any\s+|the\s+|your\s+|of\s+)*(?:previous|prior|above|earlier|preceding|system|original)\s+(?:instructions|prompts?|rules|directions|messages)`),
+	regexp.MustCompile(`(?i)\b(?:reveal|show|print|repeat|output|leak)\s+(?:me\s+)?(?:your|the)\s+(?:system\s+|initial\s+|hidden\s+|original\s+)?(?:prompt|instructions)`),
+	regexp.MustCompile(`(?i)\b(?:developer|god|jailbreak)\s+mode\b|\bjailbr(?:eak|oken)\b`),
+	regexp.MustCompile(`(?i)\bnew\s+(?:system\s+)?instructions\s*:`),
+	regexp.MustCompile(`(?im)^\s*(?:system|assistant)\s*:`),
+	regexp.MustCompile(`<\|(?:im_start|im_end|system|endoftext)\|>|\[/?(?:INST|SYS)\]`),
+}
+
+var humanClaimPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bI(?:'m|’m| am)\s+(?:a\s+)?(?:real\s+)?(?:human(?:\s+being)?|person)\b`),
+	regexp.MustCompile(`(?i)\bI(?:'m|’m| am)\s+not\s+(?:an?\s+)?(?:bot|AI|robot|machine|chatbot|language\s+model)\b`),
+}
+
+var (
+	emailPattern  = regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)
+	numberPattern = regexp.MustCompile(`\+?\d[\d ()./-]{7,}\d`)
+	ibanPattern   = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`)
+	domainPattern = regexp.MustCompile(`(?i)\b(?:https?://)?(?:[a-z0-9-]+\.)+[a-z]{2,}(?::\d+)?(?:/\S*)?`)
+)
+
+// guardrailMatch is a part of a reply that failed a check.
+type guardrailMatch struct {
+	start, end int
+	reason     string
+}
+
+type outputCheck struct {
+	name   string
+	action string
+	find   func(text string) []guardrailMatch
+}
+
+// checkInput runs the input checks on the message before any LLM request is
+// made and reports whether the message is refused. The free heuristics run
+// first; the moderation model only sees messages that passed them. A failing
+// moderation request lets the message pass.
+func (b *Bot) checkInput(message database.ClaimNextMessageRow) bool {
+	config := b.currentConfig().Guardrails
+	var verdicts []guardrailVerdict
+	defer func() { b.recordGuardrailVerdicts(message.ID, verdicts) }()
+
+	refuse := func(check, reason string) bool {
+		verdicts = append(verdicts, newGuardrailVerdict(guardrailStageInput, check, guardrailRefuse, reason, 0))
+		b.logger.Info("Refused message by input guardrail",
+			"message_id", message.ID,
+			"check", check,
+			"reason", reason)
+		return true
+	}
+	pass := func(check string) {
+		verdicts = append(verdicts, newGuardrailVerdict(guardrailStageInput, check, guardrailPass, "", 0))
+	}
+
+	if config.InjectionCheck {
+		if match := findInjection(message.MessageText); match != "" {
+			return refuse(checkInjection, fmt.Sprintf("matched %q", truncateText(match, 60)))
+		}
+		pass(checkInjection)
+	}
+
+	if len(config.BannedTopics) > 0 {
+		if topic := findPhrase(message.MessageText, config.BannedTopics); topic != "" {
+			return refuse(checkBannedTopics, fmt.Sprintf("mentions %q", topic))
+		}
+		pass(checkBannedTopics)
+	}
+
+	if moderator := b.moderationProvider(); moderator != nil {
+		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+		result, err := moderator.Moderate(ctx, config.ModerationModel, message.MessageText)
+		cancel()
+		switch {
+		case err != nil:
+			b.logger.Warn("Moderation request failed, letting the message pass",
+				"message_id", message.ID,
+				"error", err)
+			verdicts = append(verdicts, newGuardrailVerdict(guardrailStageInput, checkModeration, guardrailError, err.Error(), 0))
+		case result.Flagged:
+			return refuse(checkModeration, "flagged: "+strings.Join(result.Categories, ", "))
+		default:
+			pass(checkModeration)
+		}
+	}
+	return false
+}
+
+// checkOutput runs the output checks on a generated reply. It returns the
+// reply with redactions applied, or the reason to generate it again. A check
+// that asks for more than GUARDRAIL_MAX_REGENERATIONS regenerations blocks the
+// reply with a GuardrailBlockedError.
+func (b *Bot) checkOutput(messageID int64, text string, attempt int) (string, string, error) {
+	config := b.currentConfig().Guardrails
+	var verdicts []guardrailVerdict
+	defer func() { b.recordGuardrailVerdicts(messageID, verdicts) }()
+
+	for _, check := range outputChecks(config) {
+		matches := check.find(text)
+		if len(matches) == 0 {
+			verdicts = append(verdicts, newGuardrailVerdict(guardrailStageOutput, check.name, guardrailPass, "", attempt))
+			continue
+		}
+
+		reason := matchReasons(matches)
+		action := check.action
+		if action == guardrailRegenerate && attempt >= config.MaxRegenerations {
+			action = guardrailBlock
+			reason += fmt.Sprintf(" after %d regenerations", config.MaxRegenerations)
+		}
+		verdicts = append(verdicts, newGuardrailVerdict(guardrailStageOutput, check.name, action, reason, attempt))
+		b.logger.Info("Output guardrail triggered",
+			"message_id", messageID,
+			"check", check.name,
+			"action", action,
+			"reason", reason)
+
+		switch action {
+		case guardrailRedact:
+			text = redactMatches(text, matches)
+		case guardrailRegenerate:
+			return "", fmt.Sprintf("%s: %s", check.name, reason), nil
+		case guardrailBlock:
+			return "", "", &GuardrailBlockedError{Check: check.name, Reason: reason}
+		}
+	}
+	return text, "", nil
+}
+
+// refuseMessage answers the message with GUARDRAIL_REFUSAL_TEXT instead of an
+// LLM response.
+func (b *Bot) refuseMessage(message database.ClaimNextMessageRow) error {
+	if err := b.queries.UpdateMessageWithLLMResponse(b.ctx, database.UpdateMessageWithLLMResponseParams{
+		ID:          message.ID,
+		LlmResponse: new(b.currentConfig().Guardrails.RefusalText),
+	}); err != nil {
+		return fmt.Errorf("failed to update message with refusal: %w", err)
+	}
+	return nil
+}
+
+func (b *Bot) recordGuardrailVerdicts(messageID int64, verdicts []guardrailVerdict) {
+	if len(verdicts) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(verdicts)
+	if err != nil {
+		b.logger.Error("Failed to encode guardrail verdicts", "message_id", messageID, "error", err)
+		return
+	}
+	if err := b.queries.AppendGuardrailVerdicts(b.ctx, database.AppendGuardrailVerdictsParams{
+		Verdicts: encoded,
+		ID:       messageID,
+	}); err != nil {
+		b.logger.Error("Failed to record guardrail verdicts",
+			"message_id", messageID,
+			"error", err)
+	}
+}
+
+func newGuardrailVerdict(stage, check, action, reason string, attempt int) guardrailVerdict {
+	return guardrailVerdict{
+		Stage:   stage,
+		Check:   check,
+		Action:  action,
+		Reason:  reason,
+		Attempt: attempt,
+		At:      time.Now().UTC(),
+	}
+}
+
+func outputChecks(config GuardrailConfig) []outputCheck {
+	var checks []outputCheck
+	if config.PII != guardrailOff && config.PII != "" {
+		checks = append(checks, outputCheck{name: checkPII, action: config.PII, find: findPII})
+	}
+	if len(config.BlockedWords) > 0 && config.BlockedWordsAction != guardrailOff {
+		words := config.BlockedWords
+		checks = append(checks, outputCheck{name: checkBlockedWords, action: config.BlockedWordsAction, find: func(text string) []guardrailMatch {
+			return findPhrases(text, words, "blocked word")
+		}})
+	}
+	if len(config.BlockedDomains) > 0 && config.BlockedDomainsAction != guardrailOff {
+		domains := config.BlockedDomains
+		checks = append(checks, outputCheck{name: checkBlockedDomains, action: config.BlockedDomainsAction, find: func(text string) []guardrailMatch {
+			return findBlockedDomains(text, domains)
+		}})
+	}
+	if config.HumanClaim != guardrailOff && config.HumanClaim != "" {
+		checks = append(checks, outputCheck{name: checkHumanClaim, action: config.HumanClaim, find: findHumanClaims})
+	}
+	return checks
+}
+
+func findInjection(text string) string {
+	for _, pattern := range injectionPatterns {
+		if match := pattern.FindString(text); match != "" {
+			return strings.TrimSpace(match)
+		}
+	}
+	return ""
+}
+
+// findPhrase returns the first phrase that occurs in text as whole words,
+// ignoring case.
+func findPhrase(text string, phrases []string) string {
+	if matches := findPhrases(text, phrases, ""); len(matches) > 0 {
+		return text[matches[0].start:matches[0].end]
+	}
+	return ""
+}
+
+func findPhrases(text string, phrases []string, reason string) []guardrailMatch {
+	var matches []guardrailMatch
+	for _, phrase := range phrases {
+		pattern, err := regexp.Compile(`(?i)(?:^|\b)` + regexp.QuoteMeta(phrase) + `(?:\b|$)`)
+		if err != nil {
+			continue
+		}
+		for _, loc := range pattern.FindAllStringIndex(text, -1) {
+			matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: reason})
+		}
+	}
+	return matches
+}
+
+func findPII(text string) []guardrailMatch {
+	var matches []guardrailMatch
+	for _, loc := range emailPattern.FindAllStringIndex(text, -1) {
+		matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "email address"})
+	}
+	for _, loc := range ibanPattern.FindAllStringIndex(text, -1) {
+		matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "IBAN"})
+	}
+	for _, loc := range numberPattern.FindAllStringIndex(text, -1) {
+		digits := digitsOf(text[loc[0]:loc[1]])
+		switch {
+		case len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits):
+			matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "payment card number"})
+		case len(digits) >= 9 && len(digits) <= 15:
+			matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "phone number"})
+		}
+	}
+	return matches
+}
+
+// findBlockedDomains finds links and bare domain names that point to one of
+// domains or their subdomains.
+func findBlockedDomains(text string, domains []string) []guardrailMatch {
+	var matches []guardrailMatch
+	for _, loc := range domainPattern.FindAllStringIndex(text, -1) {
+		candidate := text[loc[0]:loc[1]]
+		if !strings.Contains(candidate, "://") {
+			candidate = "http://" + candidate
+		}
+		u, err := url.Parse(candidate)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if slices.ContainsFunc(domains, func(domain string) bool {
+			domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+			return host == domain || strings.HasSuffix(host, "."+domain)
+		}) {
+			matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "link to " + host})
+		}
+	}
+	return matches
+}
+
+func findHumanClaims(text string) []guardrailMatch {
+	var matches []guardrailMatch
+	for _, pattern := range humanClaimPatterns {
+		for _, loc := range pattern.FindAllStringIndex(text, -1) {
+			matches = append(matches, guardrailMatch{start: loc[0], end: loc[1], reason: "claims to be human"})
+		}
+	}
+	return matches
+}
+
+// redactMatches replaces the matched parts of text. Overlapping matches are
+// merged.
+func redactMatches(text string, matches []guardrailMatch) string {
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+	var builder strings.Builder
+	last := 0
+	for _, match := range matches {
+		if match.end <= last {
+			continue
+		}
+		if match.start >= last {
+			builder.WriteString(text[last:match.start])
+			builder.WriteString(redactedSpan)
+		}
+		last = match.end
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+func matchReasons(matches []guardrailMatch) string {
+	var reasons []string
+	for _, match := range matches {
+		if match.reason != "" && !slices.Contains(reasons, match.reason) {
+			reasons = append(reasons, match.reason)
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+func digitsOf(text string) string {
+	var digits strings.Builder
+	for _, r := range text {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	return digits.String()
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Moderator classifies a message with a moderation model.
+type Moderator interface {
+	Moderate(ctx context.Context, model, text string) (ModerationResult, error)
+}
+
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string
+	// Score is the highest category score, between 0 and 1.
+	Score float64
+}
+
+// OpenAIModeration calls the moderations endpoint of the OpenAI API.
+type OpenAIModeration struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewOpenAIModeration(baseURL, apiKey string, client *http.Client) *OpenAIModeration {
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	return &OpenAIModeration{baseURL: strings.TrimRight(baseURL, "/"), apiKey: apiKey, client: client}
+}
+
+func (m *OpenAIModeration) Moderate(ctx context.Context, model, text string) (ModerationResult, error) {
+	body, err := json.Marshal(map[string]string{"model": model, "input": text})
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/moderations", bytes.NewReader(body))
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ModerationResult{}, fmt.Errorf("moderation returned status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Results []struct {
+			Flagged        bool               `json:"flagged"`
+			Categories     map[string]bool    `json:"categories"`
+			CategoryScores map[string]float64 `json:"category_scores"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return ModerationResult{}, fmt.Errorf("failed to decode moderation result: %w", err)
+	}
+	if len(out.Results) == 0 {
+		return ModerationResult{}, fmt.Errorf("moderation returned no result")
+	}
+
+	result := ModerationResult{Flagged: out.Results[0].Flagged}
+	for category, flagged := range out.Results[0].Categories {
+		if flagged {
+			result.Categories = append(result.Categories, category)
+		}
+	}
+	sort.Strings(result.Categories)
+	for _, score := range out.Results[0].CategoryScores {
+		result.Score = max(result.Score, score)
+	}
+	return result, nil
+}
+
+// moderationProvider returns the moderator of the input checks, or nil when
+// GUARDRAIL_MODERATION_MODEL is not set.
+func (b *Bot) moderationProvider() Moderator {
+	config := b.currentConfig()
+	if config.Guardrails.ModerationModel == "" {
+		return nil
+	}
+	if b.moderator != nil {
+		return b.moderator
+	}
+	return NewOpenAIModeration(config.ChatModel.BaseURL, config.ChatModel.APIKey, &http.Client{Timeout: 30 * time.Second})
+}
+
+// regenerationPrompt asks the model for a new reply after an output check
+// rejected the previous one.
+func regenerationPrompt(rejection string) string {
+	return fmt.Sprintf("Your previous reply was rejected (%s). Write a new reply to the same message that avoids this. Reply with the new text only.", rejection)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -12,15 +13,13 @@ import (
 	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
 )
 
-func (b *Bot) runIngestor(config *Config) {
+func (b *Bot) runIngestor() {
 	b.logger.Info("Starting ingestor...")
 
-	ticker := time.NewTicker(config.IngestorInterval)
+	ticker := time.NewTicker(b.currentConfig().IngestorInterval)
 	defer ticker.Stop()
 
-	if err := b.ingestNotifications(config); err != nil {
-		b.logger.Error("Error ingesting notifications", "error", err)
-	}
+	b.ingest()
 
 	for {
 		select {
@@ -28,20 +27,24 @@ func (b *Bot) runIngestor(config *Config) {
 			b.logger.Info("Ingestor shutting down...")
 			return
 		case <-ticker.C:
-			if err := b.ingestNotifications(config); err != nil {
-				b.logger.Error("Error ingesting notifications", "error", err)
-			}
+			b.ingest()
 		}
 	}
 }
 
-func (b *Bot) ingestNotifications(config *Config) error {
-	authClient, _, err := b.createAuthenticatedBlueskyClient(config)
-	if err != nil {
-		return fmt.Errorf("failed to create authenticated client: %w", err)
+func (b *Bot) ingest() {
+	if err := b.ingestNotifications(); err != nil {
+		b.logger.Error("Error ingesting notifications", "error", err)
 	}
+	if b.currentConfig().DMEnabled {
+		if err := b.ingestDirectMessages(); err != nil {
+			b.logger.Error("Error ingesting direct messages", "error", err)
+		}
+	}
+}
 
-	notifications, err := b.checkNotifications(authClient)
+func (b *Bot) ingestNotifications() error {
+	notifications, err := b.checkNotifications()
 	if err != nil {
 		return fmt.Errorf("failed to check notifications: %w", err)
 	}
@@ -61,23 +64,40 @@ func (b *Bot) processNotificationForQueue(notif *bsky.NotificationListNotificati
 		return fmt.Errorf("notification record is not a FeedPost")
 	}
 
-	if !strings.Contains(feedPost.Text, b.botHandle) {
+	if notif.Reason == "reply" {
+		return b.handleReplyNotification(notif, feedPost)
+	}
+
+	config := b.currentConfig()
+	if !strings.Contains(feedPost.Text, config.BotHandle) {
+		return nil
+	}
+
+	if config.IsBlockedAuthor(notif.Author.Did, notif.Author.Handle) {
+		b.logger.Info("Ignoring mention from blocked author", "author_handle", notif.Author.Handle)
 		return nil
 	}
 
-	cleanedText := strings.ReplaceAll(feedPost.Text, b.botHandle, "")
+	cleanedText := strings.ReplaceAll(feedPost.Text, config.BotHandle, "")
 	cleanedText = strings.TrimSpace(cleanedText)
 
 	if cleanedText == "" {
 		return nil
 	}
 
-	_, err := b.queries.InsertMessage(b.ctx, database.InsertMessageParams{
+	payload, err := json.Marshal(notif)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	_, err = b.queries.InsertMessage(b.ctx, database.InsertMessageParams{
 		MessageUri:   notif.Uri,
 		MessageCid:   notif.Cid,
 		AuthorDid:    notif.Author.Did,
 		AuthorHandle: notif.Author.Handle,
 		MessageText:  cleanedText,
+		Notification: payload,
+		Channel:      channelPost,
 	})
 
 	if err != nil {
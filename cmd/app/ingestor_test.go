@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/lex/util"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func mentionNotification(uri, text string, isRead bool) *bsky.NotificationListNotifications_Notification {
+	return &bsky.NotificationListNotifications_Notification{
+		Uri:    uri,
+		Cid:    "cid-" + uri,
+		IsRead: isRead,
+		Author: &bsky.ActorDefs_ProfileView{Did: "did:plc:alice", Handle: "alice.test"},
+		Record: &util.LexiconTypeDecoder{Val: &bsky.FeedPost{Text: text}},
+	}
+}
+
+func TestIngestNotificationsQueuesUnreadMentions(t *testing.T) {
+	bot := newTestBot(3)
+	bot.bluesky.notifications = []*bsky.NotificationListNotifications_Notification{
+		mentionNotification("at://1", "@bot.test what is Go?", false),
+		mentionNotification("at://2", "@bot.test", false),
+		mentionNotification("at://3", "no mention here", false),
+		mentionNotification("at://4", "@bot.test already read", true),
+	}
+
+	if err := bot.ingestNotifications(); err != nil {
+		t.Fatalf("ingestNotifications() error = %v", err)
+	}
+
+	if len(bot.queries.inserted) != 1 {
+		t.Fatalf("queued %d messages; want 1: %+v", len(bot.queries.inserted), bot.queries.inserted)
+	}
+	if got := bot.queries.inserted[0]; got.MessageUri != "at://1" || got.MessageText != "what is Go?" {
+		t.Fatalf("queued message = %+v", got)
+	}
+	if bot.bluesky.seen != 1 {
+		t.Fatalf("UpdateSeen called %d times; want 1", bot.bluesky.seen)
+	}
+}
+
+func TestIngestNotificationsSkipsBlockedAuthors(t *testing.T) {
+	bot := newTestBot(3)
+	config := *bot.currentConfig()
+	config.BlockedAuthors = []string{"@alice.test"}
+	bot.config.Store(&config)
+	bot.bluesky.notifications = []*bsky.NotificationListNotifications_Notification{
+		mentionNotification("at://1", "@bot.test hello", false),
+	}
+
+	if err := bot.ingestNotifications(); err != nil {
+		t.Fatalf("ingestNotifications() error = %v", err)
+	}
+
+	if len(bot.queries.inserted) != 0 {
+		t.Fatalf("queued %d messages from a blocked author; want 0", len(bot.queries.inserted))
+	}
+}
+
+func TestIngestNotificationsDeletesReplyOnAuthorRequest(t *testing.T) {
+	bot := newTestBot(3)
+	config := *bot.currentConfig()
+	config.AuthorDelete = true
+	bot.config.Store(&config)
+	bot.queries.historyRows = []database.MessageHistory{{
+		ID:            7,
+		AuthorDid:     "did:plc:alice",
+		ReplyUri:      new("at://did:plc:bot/app.bsky.feed.post/a"),
+		ReplyPostUris: []string{"at://did:plc:bot/app.bsky.feed.post/a", "at://did:plc:bot/app.bsky.feed.post/b"},
+	}}
+
+	reply := func(uri, did, text string) *bsky.NotificationListNotifications_Notification {
+		notif := mentionNotification(uri, text, false)
+		notif.Reason = "reply"
+		notif.Author.Did = did
+		notif.Record.Val.(*bsky.FeedPost).Reply = &bsky.FeedPost_ReplyRef{
+			Parent: &atproto.RepoStrongRef{Uri: "at://did:plc:bot/app.bsky.feed.post/b"},
+		}
+		return notif
+	}
+	bot.bluesky.notifications = []*bsky.NotificationListNotifications_Notification{
+		reply("at://1", "did:plc:mallory", "delete"),
+		reply("at://2", "did:plc:alice", "thanks!"),
+	}
+	if err := bot.ingestNotifications(); err != nil {
+		t.Fatalf("ingestNotifications() error = %v", err)
+	}
+	if len(bot.bluesky.deletedPosts) != 0 || len(bot.queries.inserted) != 0 {
+		t.Fatalf("deleted %v, queued %d; want neither", bot.bluesky.deletedPosts, len(bot.queries.inserted))
+	}
+
+	bot.bluesky.notifications = []*bsky.NotificationListNotifications_Notification{
+		reply("at://3", "did:plc:alice", " Delete "),
+	}
+	if err := bot.ingestNotifications(); err != nil {
+		t.Fatalf("ingestNotifications() error = %v", err)
+	}
+	if len(bot.bluesky.deletedPosts) != 2 {
+		t.Fatalf("deleted posts = %v; want both posts of the reply", bot.bluesky.deletedPosts)
+	}
+	if entry := bot.queries.historyRows[0]; entry.Status != "deleted" || *entry.DeletedBy != "did:plc:alice" {
+		t.Fatalf("history entry = %+v; want deleted by the author", entry)
+	}
+}
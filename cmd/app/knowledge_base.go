@@ -0,0 +1,404 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudwego/eino/components/embedding"
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	kbIndexMemory   = "memory"
+	kbIndexPgvector = "pgvector"
+)
+
+// embeddingBatchSize is the number of passages embedded per request.
+const embeddingBatchSize = 64
+
+type KnowledgeBaseConfig struct {
+	Enabled   bool
+	Index     string
+	TopK      int
+	MinScore  float64
+	ChunkSize int
+}
+
+type KnowledgePassage struct {
+	ID      int64
+	Source  string
+	Title   string
+	Heading string
+	Content string
+	Score   float64
+}
+
+// KnowledgeIndex finds the passages most similar to a query embedding.
+type KnowledgeIndex interface {
+	Search(ctx context.Context, query []float32, limit int) ([]KnowledgePassage, error)
+}
+
+// KnowledgeBase stores documents as embedded passages and retrieves the
+// passages that are relevant to a message.
+type KnowledgeBase struct {
+	queries        database.Querier
+	embedder       embedding.Embedder
+	embeddingModel string
+	index          KnowledgeIndex
+	spending       *SpendingLimiter
+}
+
+func NewKnowledgeBase(queries database.Querier, embedder embedding.Embedder, embeddingModel, index string, spending *SpendingLimiter) *KnowledgeBase {
+	kb := &KnowledgeBase{
+		queries:        queries,
+		embedder:       embedder,
+		embeddingModel: embeddingModel,
+		spending:       spending,
+	}
+	if index == kbIndexPgvector {
+		kb.index = &pgvectorKnowledgeIndex{queries: queries}
+	} else {
+		kb.index = &memoryKnowledgeIndex{queries: queries}
+	}
+	return kb
+}
+
+// Retrieve returns up to topK passages with a cosine similarity of at least
+// minScore to text, the most similar first.
+func (k *KnowledgeBase) Retrieve(ctx context.Context, text string, topK int, minScore float64) ([]KnowledgePassage, error) {
+	vectors, tokens, err := embedTexts(ctx, k.embedder, []string{text})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed message: %w", err)
+	}
+	if err := k.spending.RecordEmbedding(ctx, time.Now(), tokens); err != nil {
+		return nil, err
+	}
+
+	passages, err := k.index.Search(ctx, vectors[0], topK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search knowledge base: %w", err)
+	}
+	return slices.DeleteFunc(passages, func(p KnowledgePassage) bool {
+		return p.Score < minScore
+	}), nil
+}
+
+// Ingest splits content into passages, embeds them and replaces the stored
+// passages of source. Documents whose content and embedding model did not
+// change are skipped; changed reports whether the document was embedded.
+func (k *KnowledgeBase) Ingest(ctx context.Context, source, content string, chunkSize int) (passages int, changed bool, err error) {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+
+	existing, err := k.queries.GetKBDocumentBySource(ctx, source)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, fmt.Errorf("failed to load document: %w", err)
+	}
+	if err == nil && existing.ContentHash == hash && existing.EmbeddingModel == k.embeddingModel {
+		return 0, false, nil
+	}
+
+	title := documentTitle(source, content)
+	chunks := chunkDocument(content, chunkSize)
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = passageLabel(title, chunk.Heading) + "\n\n" + chunk.Content
+	}
+
+	var embeddings [][]float32
+	for batch := range slices.Chunk(texts, embeddingBatchSize) {
+		vectors, tokens, err := embedTexts(ctx, k.embedder, batch)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to embed passages: %w", err)
+		}
+		if err := k.spending.RecordEmbedding(ctx, time.Now(), tokens); err != nil {
+			return 0, false, err
+		}
+		embeddings = append(embeddings, vectors...)
+	}
+
+	// The content hash is stored after the passages, so that an interrupted
+	// ingest is repeated on the next run.
+	params := database.UpsertKBDocumentParams{Source: source, Title: title, EmbeddingModel: k.embeddingModel}
+	documentID, err := k.queries.UpsertKBDocument(ctx, params)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to store document: %w", err)
+	}
+	if err := k.queries.DeleteKBPassages(ctx, documentID); err != nil {
+		return 0, false, fmt.Errorf("failed to delete old passages: %w", err)
+	}
+	for i, chunk := range chunks {
+		if err := k.queries.InsertKBPassage(ctx, database.InsertKBPassageParams{
+			DocumentID: documentID,
+			Ordinal:    int32(i),
+			Heading:    chunk.Heading,
+			Content:    chunk.Content,
+			Embedding:  embeddings[i],
+		}); err != nil {
+			return 0, false, fmt.Errorf("failed to store passage: %w", err)
+		}
+	}
+	params.ContentHash = hash
+	if _, err := k.queries.UpsertKBDocument(ctx, params); err != nil {
+		return 0, false, fmt.Errorf("failed to store document: %w", err)
+	}
+	return len(chunks), true, nil
+}
+
+// formatKnowledge numbers passages for the prompt so that the model can cite
+// them.
+func formatKnowledge(passages []KnowledgePassage) string {
+	var builder strings.Builder
+	for i, passage := range passages {
+		fmt.Fprintf(&builder, "[%d] %s\n%s\n\n", i+1, passageLabel(passage.Title, passage.Heading), passage.Content)
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+// passageLabel names a passage by its document title and heading path. The
+// path usually starts with the title itself.
+func passageLabel(title, heading string) string {
+	heading = strings.TrimPrefix(heading, title+" > ")
+	if heading == "" || heading == title {
+		return title
+	}
+	return title + " > " + heading
+}
+
+type documentChunk struct {
+	Heading string
+	Content string
+}
+
+// documentTitle returns the first level one Markdown heading, or the file name
+// of source without its extension.
+func documentTitle(source, content string) string {
+	for line := range strings.Lines(content) {
+		if title, ok := strings.CutPrefix(strings.TrimSpace(line), "# "); ok && strings.TrimSpace(title) != "" {
+			return strings.TrimSpace(title)
+		}
+	}
+	base := filepath.Base(source)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// chunkDocument splits Markdown or plain text into passages of at most
+// maxRunes runes. Passages do not cross headings and are split between
+// paragraphs where possible. Each passage carries the path of the headings it
+// is under.
+func chunkDocument(content string, maxRunes int) []documentChunk {
+	var chunks []documentChunk
+	var headings []string
+	var paragraphs []string
+	var paragraph strings.Builder
+	inFence := false
+
+	flushParagraph := func() {
+		if text := strings.TrimSpace(paragraph.String()); text != "" {
+			paragraphs = append(paragraphs, text)
+		}
+		paragraph.Reset()
+	}
+	flushSection := func() {
+		flushParagraph()
+		heading := strings.Join(headings, " > ")
+		for _, text := range packParagraphs(paragraphs, maxRunes) {
+			chunks = append(chunks, documentChunk{Heading: heading, Content: text})
+		}
+		paragraphs = nil
+	}
+
+	for line := range strings.Lines(content) {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if !inFence {
+			if level, title, ok := markdownHeading(trimmed); ok {
+				flushSection()
+				headings = append(headings[:min(level-1, len(headings))], title)
+				continue
+			}
+			if trimmed == "" {
+				flushParagraph()
+				continue
+			}
+		}
+		paragraph.WriteString(line)
+	}
+	flushSection()
+	return chunks
+}
+
+func markdownHeading(line string) (int, string, bool) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0, "", false
+	}
+	title := strings.TrimSpace(strings.TrimRight(line[level:], "#"))
+	return level, title, title != ""
+}
+
+// packParagraphs joins consecutive paragraphs into texts of at most maxRunes
+// runes and splits longer paragraphs between words.
+func packParagraphs(paragraphs []string, maxRunes int) []string {
+	var texts []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			texts = append(texts, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, paragraph := range paragraphs {
+		for _, part := range splitRunes(paragraph, maxRunes) {
+			if current.Len() > 0 && utf8.RuneCountInString(current.String())+2+utf8.RuneCountInString(part) > maxRunes {
+				flush()
+			}
+			if current.Len() > 0 {
+				current.WriteString("\n\n")
+			}
+			current.WriteString(part)
+		}
+	}
+	flush()
+	return texts
+}
+
+func splitRunes(text string, maxRunes int) []string {
+	var parts []string
+	for utf8.RuneCountInString(text) > maxRunes {
+		runes := []rune(text)
+		cut := maxRunes
+		for i := maxRunes; i > maxRunes/2; i-- {
+			if runes[i] == ' ' || runes[i] == '\n' {
+				cut = i
+				break
+			}
+		}
+		parts = append(parts, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// memoryKnowledgeIndex searches all passages in memory. It reloads them when
+// a document was added, changed or removed, and suits knowledge bases of up
+// to some ten thousand passages without any database extension.
+type memoryKnowledgeIndex struct {
+	queries database.Querier
+
+	mu       sync.Mutex
+	revision *database.GetKBRevisionRow
+	passages []database.ListKBPassagesRow
+	norms    []float64
+}
+
+func (m *memoryKnowledgeIndex) Search(ctx context.Context, query []float32, limit int) ([]KnowledgePassage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	queryNorm := vectorNorm(query)
+	var results []KnowledgePassage
+	for i, passage := range m.passages {
+		if len(passage.Embedding) != len(query) || m.norms[i] == 0 || queryNorm == 0 {
+			continue
+		}
+		var dot float64
+		for j, value := range query {
+			dot += float64(value) * float64(passage.Embedding[j])
+		}
+		results = append(results, KnowledgePassage{
+			ID:      passage.ID,
+			Source:  passage.Source,
+			Title:   passage.Title,
+			Heading: passage.Heading,
+			Content: passage.Content,
+			Score:   dot / (queryNorm * m.norms[i]),
+		})
+	}
+
+	slices.SortStableFunc(results, func(a, b KnowledgePassage) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	return results[:min(limit, len(results))], nil
+}
+
+func (m *memoryKnowledgeIndex) refresh(ctx context.Context) error {
+	revision, err := m.queries.GetKBRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if m.revision != nil && *m.revision == revision {
+		return nil
+	}
+
+	passages, err := m.queries.ListKBPassages(ctx)
+	if err != nil {
+		return err
+	}
+	m.passages = passages
+	m.norms = make([]float64, len(passages))
+	for i, passage := range passages {
+		m.norms[i] = vectorNorm(passage.Embedding)
+	}
+	m.revision = &revision
+	return nil
+}
+
+func vectorNorm(vector []float32) float64 {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	return math.Sqrt(sum)
+}
+
+// pgvectorKnowledgeIndex lets PostgreSQL rank the passages with the cosine
+// distance of the pgvector extension.
+type pgvectorKnowledgeIndex struct {
+	queries database.Querier
+}
+
+func (p *pgvectorKnowledgeIndex) Search(ctx context.Context, query []float32, limit int) ([]KnowledgePassage, error) {
+	rows, err := p.queries.SearchKBPassages(ctx, database.SearchKBPassagesParams{Query: query, RowLimit: int32(limit)})
+	if err != nil {
+		return nil, err
+	}
+	passages := make([]KnowledgePassage, len(rows))
+	for i, row := range rows {
+		passages[i] = KnowledgePassage{
+			ID:      row.ID,
+			Source:  row.Source,
+			Title:   row.Title,
+			Heading: row.Heading,
+			Content: row.Content,
+			Score:   row.Score,
+		}
+	}
+	return passages, nil
+}
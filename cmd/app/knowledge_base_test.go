@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/cloudwego/eino/components/embedding"
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const testGuide = `# Widget Guide
+
+Widgets make your day better.
+
+## Installation
+
+Run the widget installer and restart your computer.
+
+` + "```sh\n# not a heading\nwidget install\n```" + `
+
+## Pricing
+
+Widgets cost 5 euros per month. Teams get a discount.
+`
+
+func TestChunkDocument(t *testing.T) {
+	chunks := chunkDocument(testGuide, 1000)
+
+	if len(chunks) != 3 {
+		t.Fatalf("chunkDocument() returned %d chunks; want 3: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Heading != "Widget Guide" || chunks[0].Content != "Widgets make your day better." {
+		t.Fatalf("chunks[0] = %+v", chunks[0])
+	}
+	if chunks[1].Heading != "Widget Guide > Installation" || !strings.Contains(chunks[1].Content, "# not a heading") {
+		t.Fatalf("chunks[1] = %+v; want the code block in the installation section", chunks[1])
+	}
+	if label := passageLabel("Widget Guide", chunks[2].Heading); label != "Widget Guide > Pricing" {
+		t.Fatalf("passageLabel() = %q", label)
+	}
+}
+
+func TestChunkDocumentSplitsLongSections(t *testing.T) {
+	text := strings.Repeat("alpha beta gamma delta. ", 30) + "\n\n" + strings.Repeat("one two three. ", 10)
+
+	chunks := chunkDocument(text, 200)
+
+	if len(chunks) < 4 {
+		t.Fatalf("chunkDocument() returned %d chunks; want the section split", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if n := len([]rune(chunk.Content)); n > 200 {
+			t.Fatalf("chunk has %d runes; want at most 200", n)
+		}
+		if strings.HasPrefix(chunk.Content, " ") || strings.HasSuffix(chunk.Content, " ") {
+			t.Fatalf("chunk %q is not split between words", chunk.Content)
+		}
+	}
+}
+
+func TestKnowledgeBaseIngestSkipsUnchangedDocuments(t *testing.T) {
+	queries := &fakeQuerier{}
+	embedder := &fakeEmbedder{}
+	kb := NewKnowledgeBase(queries, embedder, "embed-1", kbIndexMemory, nil)
+	ctx := context.Background()
+
+	passages, changed, err := kb.Ingest(ctx, "docs/guide.md", testGuide, 1000)
+	if err != nil || !changed || passages != 3 {
+		t.Fatalf("Ingest() = %d, %t, %v; want 3 new passages", passages, changed, err)
+	}
+	if queries.kbDocuments[0].Title != "Widget Guide" || queries.kbDocuments[0].ContentHash == "" {
+		t.Fatalf("stored document = %+v", queries.kbDocuments[0])
+	}
+
+	if _, changed, err := kb.Ingest(ctx, "docs/guide.md", testGuide, 1000); err != nil || changed {
+		t.Fatalf("second Ingest() changed = %t, %v; want unchanged", changed, err)
+	}
+	if len(embedder.texts) != 3 {
+		t.Fatalf("embedded %d texts; want 3", len(embedder.texts))
+	}
+
+	kb.embeddingModel = "embed-2"
+	if _, changed, err := kb.Ingest(ctx, "docs/guide.md", testGuide, 1000); err != nil || !changed {
+		t.Fatalf("Ingest() with new model changed = %t, %v; want embedded again", changed, err)
+	}
+	if len(queries.kbPassages) != 3 {
+		t.Fatalf("stored %d passages; want old passages replaced", len(queries.kbPassages))
+	}
+}
+
+func TestProcessNextMessageAddsKnowledgeToPrompt(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.KnowledgeBase = KnowledgeBaseConfig{Enabled: true, Index: kbIndexMemory, TopK: 1, MinScore: 0.1}
+	bot.config.Store(config)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1, EmbeddingPerMillion: 1000}, SpendingLimits{Daily: 1})
+	bot.knowledge = NewKnowledgeBase(bot.queries, &fakeEmbedder{}, "embed-1", kbIndexMemory, nil)
+	if _, _, err := bot.knowledge.Ingest(context.Background(), "docs/guide.md", testGuide, 1000); err != nil {
+		t.Fatalf("Ingest() error = %v", err)
+	}
+	bot.knowledge.spending = bot.spendingLimiter
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "How much do widgets cost per month?"}}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	prompt := bot.model.inputs[0][0].Content
+	if !strings.Contains(prompt, "[1] Widget Guide > Pricing\nWidgets cost 5 euros per month.") {
+		t.Fatalf("prompt = %q; want the pricing passage", prompt)
+	}
+	if strings.Contains(prompt, "[2]") {
+		t.Fatalf("prompt = %q; want only KB_TOP_K passages", prompt)
+	}
+
+	// The 35 byte message embedding is estimated at 9 tokens, 9000 micros at
+	// 1000 per million tokens.
+	usage := store.usage[usageDate(time.Now(), time.UTC)]
+	if usage.SpentMicros <= 9_000 {
+		t.Fatalf("daily usage = %+v; want the embedding charged in addition to the completion", usage)
+	}
+}
+
+func TestMemoryKnowledgeIndexReloadsChangedDocuments(t *testing.T) {
+	queries := &fakeQuerier{}
+	kb := NewKnowledgeBase(queries, &fakeEmbedder{}, "embed-1", kbIndexMemory, nil)
+	ctx := context.Background()
+
+	if _, _, err := kb.Ingest(ctx, "a.txt", "Widgets are blue.", 1000); err != nil {
+		t.Fatalf("Ingest() error = %v", err)
+	}
+	passages, err := kb.Retrieve(ctx, "what color are widgets", 5, 0)
+	if err != nil || len(passages) != 1 {
+		t.Fatalf("Retrieve() = %+v, %v; want one passage", passages, err)
+	}
+
+	if _, _, err := kb.Ingest(ctx, "b.txt", "Gadgets are red.", 1000); err != nil {
+		t.Fatalf("Ingest() error = %v", err)
+	}
+	passages, err = kb.Retrieve(ctx, "what color are gadgets", 5, 0)
+	if err != nil || len(passages) != 2 || passages[0].Source != "b.txt" {
+		t.Fatalf("Retrieve() = %+v, %v; want the new document first", passages, err)
+	}
+}
+
+func (q *fakeQuerier) GetKBDocumentBySource(_ context.Context, source string) (database.KbDocument, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, document := range q.kbDocuments {
+		if document.Source == source {
+			return document, nil
+		}
+	}
+	return database.KbDocument{}, pgx.ErrNoRows
+}
+
+func (q *fakeQuerier) UpsertKBDocument(_ context.Context, arg database.UpsertKBDocumentParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Every write moves the revision forward, like NOW() in separate
+	// transactions.
+	q.kbWrites++
+	updatedAt := timestamptz(time.Unix(q.kbWrites, 0))
+	for i, document := range q.kbDocuments {
+		if document.Source == arg.Source {
+			q.kbDocuments[i].Title = arg.Title
+			q.kbDocuments[i].ContentHash = arg.ContentHash
+			q.kbDocuments[i].EmbeddingModel = arg.EmbeddingModel
+			q.kbDocuments[i].UpdatedAt = updatedAt
+			return document.ID, nil
+		}
+	}
+	id := int64(len(q.kbDocuments) + 1)
+	q.kbDocuments = append(q.kbDocuments, database.KbDocument{
+		ID:             id,
+		Source:         arg.Source,
+		Title:          arg.Title,
+		ContentHash:    arg.ContentHash,
+		EmbeddingModel: arg.EmbeddingModel,
+		UpdatedAt:      updatedAt,
+	})
+	return id, nil
+}
+
+func (q *fakeQuerier) DeleteKBPassages(_ context.Context, documentID int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.kbPassages = slices.DeleteFunc(q.kbPassages, func(p database.KbPassage) bool {
+		return p.DocumentID == documentID
+	})
+	return nil
+}
+
+func (q *fakeQuerier) InsertKBPassage(_ context.Context, arg database.InsertKBPassageParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.kbPassages = append(q.kbPassages, database.KbPassage{
+		ID:         int64(len(q.kbPassages) + 1),
+		DocumentID: arg.DocumentID,
+		Ordinal:    arg.Ordinal,
+		Heading:    arg.Heading,
+		Content:    arg.Content,
+		Embedding:  arg.Embedding,
+	})
+	return nil
+}
+
+func (q *fakeQuerier) GetKBRevision(context.Context) (database.GetKBRevisionRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	revision := database.GetKBRevisionRow{Documents: int64(len(q.kbDocuments))}
+	for _, document := range q.kbDocuments {
+		if document.UpdatedAt.Time.After(revision.UpdatedAt.Time) {
+			revision.UpdatedAt = document.UpdatedAt
+		}
+	}
+	return revision, nil
+}
+
+func (q *fakeQuerier) ListKBPassages(context.Context) ([]database.ListKBPassagesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.ListKBPassagesRow
+	for _, passage := range q.kbPassages {
+		for _, document := range q.kbDocuments {
+			if document.ID == passage.DocumentID {
+				rows = append(rows, database.ListKBPassagesRow{
+					ID:        passage.ID,
+					Source:    document.Source,
+					Title:     document.Title,
+					Heading:   passage.Heading,
+					Content:   passage.Content,
+					Embedding: passage.Embedding,
+				})
+			}
+		}
+	}
+	return rows, nil
+}
+
+// fakeEmbedder embeds texts as word counts hashed into 64 dimensions, so that
+// texts sharing words are similar.
+type fakeEmbedder struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (e *fakeEmbedder) EmbedStrings(_ context.Context, texts []string, _ ...embedding.Option) ([][]float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.texts = append(e.texts, texts...)
+	vectors := make([][]float64, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float64, 64)
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			hash := fnv.New32a()
+			hash.Write([]byte(word))
+			vectors[i][hash.Sum32()%64]++
+		}
+	}
+	return vectors, nil
+}
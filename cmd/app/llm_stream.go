@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+)
+
+// completeLLM runs the chat model. With LLM_STREAMING enabled the completion
+// is read as a stream. When long replies are truncated anyway, the request is
+// cancelled as soon as the text needs more than MAX_THREAD_POSTS posts, so the
+// model stops generating tokens nobody will read.
+func (b *Bot) completeLLM(messages []*schema.Message, opts ...model.Option) (*schema.Message, bool, error) {
+	config := b.currentConfig()
+	if !config.LLMStreaming {
+		resp, err := b.chatModel.Generate(b.ctx, messages, opts...)
+		return resp, false, err
+	}
+
+	maxPosts := 0
+	if config.ThreadLengthStrategy == lengthStrategyTruncate {
+		maxPosts = config.MaxThreadPosts
+	}
+	return b.streamLLMResponse(messages, maxPosts, config.ThreadMarkerStyle, opts...)
+}
+
+func (b *Bot) streamLLMResponse(messages []*schema.Message, maxPosts int, style MarkerStyle, opts ...model.Option) (*schema.Message, bool, error) {
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+
+	stream, err := b.chatModel.Stream(ctx, messages, opts...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer stream.Close()
+
+	var chunks []*schema.Message
+	var text strings.Builder
+	// Splitting the whole text into posts again for every chunk would be
+	// quadratic in the reply length, so the posts are only counted again once
+	// the room left in the last post could be used up.
+	graphemes, nextCheck := 0, singlePostGraphemes
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		chunks = append(chunks, chunk)
+		chunkText := extractText(chunk)
+		text.WriteString(chunkText)
+		graphemes += countGraphemes(chunkText)
+
+		if maxPosts > 0 && graphemes > nextCheck {
+			posts, room := threadPostRoom(text.String(), style)
+			if posts > maxPosts {
+				resp, err := schema.ConcatMessages(chunks)
+				if err != nil {
+					return nil, false, fmt.Errorf("failed to concatenate streamed response: %w", err)
+				}
+				return resp, true, nil
+			}
+			nextCheck = graphemes + room
+		}
+	}
+
+	if len(chunks) == 0 {
+		return nil, false, errors.New("received empty response stream from model")
+	}
+	resp, err := schema.ConcatMessages(chunks)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to concatenate streamed response: %w", err)
+	}
+	return resp, false, nil
+}
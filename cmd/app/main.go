@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	_ "time/tzdata"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
 )
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	if len(os.Args) > 1 && os.Args[1] != "run" {
+		runCommandAndExit(os.Args[1:])
+		return
+	}
+
+	logger := slog.New(NewRedactingHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
-	}))
+	})))
 	slog.SetDefault(logger)
 
 	config, err := LoadConfig()
@@ -33,14 +43,70 @@ func main() {
 		os.Exit(1)
 	}
 
-	spendingLimiter := NewSpendingLimiter(pool, config.UsagePricing, config.DailySpendingLimit)
+	if err := checkVocabularies(config.ChatModel.Model); err != nil {
+		logger.Error("Failed to load tokenizer vocabularies", "error", err)
+		os.Exit(1)
+	}
+	spendingLimiter := NewSpendingLimiter(NewPostgresSpendingStore(pool), config.UsagePricing, config.SpendingLimits())
+	logger.Info("Counting prompt tokens", "model", config.ChatModel.Model, "tokenizer", tokenizerForModel(config.ChatModel.Model).Name())
 	requestLimiter := NewRequestLimiter(config.LLMRequestsPerMinute)
-	bot := NewBot(pool, chatModel, config.ChatModel.Model, config.ChatModel.MaxOutputTokens, spendingLimiter, requestLimiter, config.BotHandle, config.MaxRetries, logger)
+	blueskyClient := NewBlueskyClient(config.BlueskyHost, config.BlueskyIdentifier, config.BlueskyPassword, config.BlueskyWriteBudget, logger)
+	queries := database.New(pool)
+
+	var knowledge *KnowledgeBase
+	if config.KnowledgeBase.Enabled {
+		embedder, err := NewEmbedder(context.Background(), config.Embedding)
+		if err != nil {
+			logger.Error("Failed to initialize embedding model", "error", err)
+			os.Exit(1)
+		}
+		knowledge = NewKnowledgeBase(queries, embedder, config.Embedding.Model, config.KnowledgeBase.Index, spendingLimiter)
+	}
+
+	bot := NewBot(config, queries, blueskyClient, chatModel, spendingLimiter, requestLimiter, knowledge, logger)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	bot.Start(config)
-	<-sigChan
-	bot.Stop()
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	bot.Start()
+	for {
+		select {
+		case <-reloadChan:
+			reloadConfig(bot, logger)
+		case <-sigChan:
+			bot.Stop()
+			return
+		}
+	}
+}
+
+func reloadConfig(bot *Bot, logger *slog.Logger) {
+	logger.Info("Reloading configuration")
+
+	config, err := LoadConfig()
+	if err != nil {
+		logger.Error("Failed to reload configuration, keeping current settings", "error", err)
+		return
+	}
+
+	bot.Reload(config)
+}
+
+func runCommandAndExit(args []string) {
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelWarn,
+	})))
+	slog.SetDefault(logger)
+
+	if err := runCommand(context.Background(), args, os.Stdout, os.Stderr, logger); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, RedactSecrets(err.Error()))
+			os.Exit(2)
+		}
+		logger.Error("Command failed", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const forgetCommand = "forget me"
+
+const forgetConfirmationText = "Done. I have forgotten our previous conversations."
+
+// memoryExchangeBatch is the maximum number of exchanges folded into a
+// summary with one LLM call. Older exchanges are folded first, the rest
+// with the next message of the user.
+const memoryExchangeBatch = 20
+
+// memorySweepInterval is how often expired memories are deleted.
+const memorySweepInterval = time.Hour
+
+type MemoryConfig struct {
+	Enabled       bool
+	Retention     time.Duration
+	SummaryLength int
+}
+
+// isForgetCommand reports whether text asks the bot to forget the author,
+// ignoring case and trailing punctuation.
+func isForgetCommand(text string) bool {
+	text = strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	return strings.TrimRight(text, ".!") == forgetCommand
+}
+
+// forgetAuthor wipes the memory of the message author and answers with a
+// confirmation instead of an LLM response. Exchanges received before are
+// never summarized again.
+func (b *Bot) forgetAuthor(message database.ClaimNextMessageRow) error {
+	if err := b.queries.ForgetUserMemory(b.ctx, message.AuthorDid); err != nil {
+		return fmt.Errorf("failed to forget user memory: %w", err)
+	}
+	if err := b.queries.UpdateMessageWithLLMResponse(b.ctx, database.UpdateMessageWithLLMResponseParams{
+		ID:          message.ID,
+		LlmResponse: new(forgetConfirmationText),
+	}); err != nil {
+		return fmt.Errorf("failed to update message with forget confirmation: %w", err)
+	}
+
+	b.logger.Info("Forgot user memory on request of the author",
+		"message_id", message.ID,
+		"author_did", message.AuthorDid)
+	return nil
+}
+
+// userMemory returns the summary of earlier exchanges with the message
+// author. Exchanges completed since the summary was written are folded into
+// it first. When that fails, the previous summary is used.
+func (b *Bot) userMemory(message database.ClaimNextMessageRow) string {
+	config := b.currentConfig().Memory
+	if !config.Enabled {
+		return ""
+	}
+
+	memory, err := b.queries.GetUserMemory(b.ctx, message.AuthorDid)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		b.logger.Warn("Failed to load user memory",
+			"message_id", message.ID,
+			"error", err)
+		return ""
+	}
+
+	exchanges, err := b.queries.ListMemoryExchanges(b.ctx, database.ListMemoryExchangesParams{
+		AuthorDid:   message.AuthorDid,
+		AfterID:     memory.LastHistoryID,
+		Since:       pgtype.Timestamptz{Time: time.Now().Add(-config.Retention), Valid: true},
+		ForgottenAt: memory.ForgottenAt,
+		RowLimit:    memoryExchangeBatch,
+	})
+	if err != nil {
+		b.logger.Warn("Failed to load exchanges for user memory",
+			"message_id", message.ID,
+			"error", err)
+		return memory.Summary
+	}
+	if len(exchanges) == 0 {
+		return memory.Summary
+	}
+
+	summary := memory.Summary
+	if relevant := memoryExchanges(exchanges); len(relevant) > 0 {
+		summary, err = b.summarizeExchanges(message.ID, memory.Summary, relevant, config.SummaryLength)
+		if err != nil {
+			b.logger.Warn("Failed to update user memory, using the previous summary",
+				"message_id", message.ID,
+				"error", err)
+			return memory.Summary
+		}
+	}
+
+	if err := b.queries.UpsertUserMemory(b.ctx, database.UpsertUserMemoryParams{
+		AuthorDid:     message.AuthorDid,
+		Summary:       summary,
+		LastHistoryID: exchanges[len(exchanges)-1].ID,
+	}); err != nil {
+		b.logger.Warn("Failed to store user memory",
+			"message_id", message.ID,
+			"error", err)
+	}
+	return summary
+}
+
+// summarizeExchanges asks the model to fold exchanges into the previous
+// summary while the queue item messageID is answered.
+func (b *Bot) summarizeExchanges(messageID int64, previous string, exchanges []database.ListMemoryExchangesRow, maxLength int) (string, error) {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "You keep notes about a user of a Bluesky bot. Update the notes with the new conversations below. "+
+		"Keep facts about the user, their interests and preferences and open questions that help in later conversations. "+
+		"Drop small talk and everything the user asked to forget. "+
+		"The notes must be at most %d characters long. Respond with the updated notes only.\n\n", maxLength)
+	builder.WriteString("Current notes:\n")
+	if previous == "" {
+		builder.WriteString("(none)\n")
+	} else {
+		builder.WriteString(previous + "\n")
+	}
+	builder.WriteString("\nNew conversations:\n")
+	for _, exchange := range exchanges {
+		fmt.Fprintf(&builder, "\nUser: %s\nBot: %s\n", exchange.MessageText, exchange.LlmResponse)
+	}
+
+	messages := []*schema.Message{{Role: schema.User, Content: builder.String()}}
+	resp, _, err := b.llmRoundTrip(messageID, b.currentModelName(), messages, func() (*schema.Message, bool, error) {
+		resp, err := b.chatModel.Generate(b.ctx, messages)
+		return resp, false, err
+	})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(extractText(resp))
+	if summary == "" {
+		return "", errors.New("received empty memory summary from model")
+	}
+	return splitRunes(summary, maxLength)[0], nil
+}
+
+// memoryExchanges drops the forget requests, which the history keeps like any
+// other exchange.
+func memoryExchanges(exchanges []database.ListMemoryExchangesRow) []database.ListMemoryExchangesRow {
+	var relevant []database.ListMemoryExchangesRow
+	for _, exchange := range exchanges {
+		if !isForgetCommand(exchange.MessageText) {
+			relevant = append(relevant, exchange)
+		}
+	}
+	return relevant
+}
+
+func (b *Bot) runMemorySweeper() {
+	b.logger.Info("Starting user memory sweeper...")
+
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+
+	b.sweepMemories()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.logger.Info("User memory sweeper shutting down...")
+			return
+		case <-ticker.C:
+			b.sweepMemories()
+		}
+	}
+}
+
+// sweepMemories deletes the memories that were not updated within
+// MEMORY_RETENTION.
+func (b *Bot) sweepMemories() {
+	cutoff := time.Now().Add(-b.currentConfig().Memory.Retention)
+	deleted, err := b.queries.DeleteExpiredUserMemories(b.ctx, pgtype.Timestamptz{Time: cutoff, Valid: true})
+	if err != nil {
+		b.logger.Error("Error deleting expired user memories", "error", err)
+		return
+	}
+	if deleted > 0 {
+		b.logger.Info("Deleted expired user memories", "count", deleted)
+	}
+}
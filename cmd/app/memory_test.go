@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const aliceDID = "did:plc:alice"
+
+func newMemoryTestBot() *testBot {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.Memory = MemoryConfig{Enabled: true, Retention: 24 * time.Hour, SummaryLength: 200}
+	bot.config.Store(config)
+	return bot
+}
+
+func memoryHistoryEntry(id int64, did, text, response string, completedAt time.Time) database.MessageHistory {
+	return database.MessageHistory{
+		ID:          id,
+		AuthorDid:   did,
+		MessageText: text,
+		LlmResponse: response,
+		Status:      "completed",
+		ReceivedAt:  timestamptz(completedAt.Add(-time.Minute)),
+		CompletedAt: timestamptz(completedAt),
+	}
+}
+
+func TestIsForgetCommand(t *testing.T) {
+	for _, text := range []string{"forget me", "Forget me!", "  FORGET   me. "} {
+		if !isForgetCommand(text) {
+			t.Fatalf("isForgetCommand(%q) = false; want true", text)
+		}
+	}
+	for _, text := range []string{"forget me not", "please forget me", "forget"} {
+		if isForgetCommand(text) {
+			t.Fatalf("isForgetCommand(%q) = true; want false", text)
+		}
+	}
+}
+
+func TestProcessNextMessageAddsUserMemoryToPrompt(t *testing.T) {
+	bot := newMemoryTestBot()
+	now := time.Now()
+	bot.queries.userMemories = map[string]database.UserMemory{
+		aliceDID: {AuthorDid: aliceDID, Summary: "Alice likes Go.", LastHistoryID: 1},
+	}
+	bot.queries.historyRows = []database.MessageHistory{
+		memoryHistoryEntry(1, aliceDID, "what is go", "A language.", now.Add(-2*time.Hour)),
+		memoryHistoryEntry(2, "did:plc:bob", "I am Bob", "Hi Bob.", now.Add(-time.Hour)),
+		memoryHistoryEntry(3, aliceDID, "what about rust", "Also a language.", now.Add(-time.Hour)),
+		memoryHistoryEntry(4, aliceDID, "old question", "Old answer.", now.Add(-48*time.Hour)),
+	}
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, AuthorDid: aliceDID, MessageText: "which one is faster?"}}
+	bot.model.responses = []*schema.Message{
+		schema.AssistantMessage("Alice likes Go and asked about Rust.", nil),
+		schema.AssistantMessage("It depends.", nil),
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	summaryPrompt := bot.model.inputs[0][0].Content
+	if !strings.Contains(summaryPrompt, "Current notes:\nAlice likes Go.") || !strings.Contains(summaryPrompt, "User: what about rust\nBot: Also a language.") {
+		t.Fatalf("summary prompt = %q; want the notes and the new exchange", summaryPrompt)
+	}
+	if strings.Contains(summaryPrompt, "Bob") || strings.Contains(summaryPrompt, "old question") || strings.Contains(summaryPrompt, "what is go") {
+		t.Fatalf("summary prompt = %q; want only new exchanges of the author within the retention", summaryPrompt)
+	}
+
+	prompt := bot.model.inputs[1][0].Content
+	if !strings.Contains(prompt, "Alice likes Go and asked about Rust.") {
+		t.Fatalf("prompt = %q; want the updated memory", prompt)
+	}
+	if memory := bot.queries.userMemories[aliceDID]; memory.LastHistoryID != 3 || memory.Summary != "Alice likes Go and asked about Rust." {
+		t.Fatalf("stored memory = %+v", memory)
+	}
+}
+
+func TestProcessNextMessageForgetsAuthor(t *testing.T) {
+	bot := newMemoryTestBot()
+	now := time.Now()
+	bot.queries.userMemories = map[string]database.UserMemory{
+		aliceDID: {AuthorDid: aliceDID, Summary: "Alice likes Go."},
+	}
+	bot.queries.historyRows = []database.MessageHistory{
+		memoryHistoryEntry(1, aliceDID, "what is go", "A language.", now.Add(-time.Hour)),
+	}
+	bot.queries.claimable = []database.ClaimNextMessageRow{
+		{ID: 1, AuthorDid: aliceDID, MessageText: "Forget me!"},
+		{ID: 2, AuthorDid: aliceDID, MessageText: "hello again"},
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+	if bot.model.calls != 0 {
+		t.Fatalf("model called %d times; want no LLM call for a forget request", bot.model.calls)
+	}
+	if got := *bot.queries.llmResponses[0].LlmResponse; got != forgetConfirmationText {
+		t.Fatalf("response = %q; want the forget confirmation", got)
+	}
+	if memory := bot.queries.userMemories[aliceDID]; memory.Summary != "" || !memory.ForgottenAt.Valid {
+		t.Fatalf("memory = %+v; want it wiped", memory)
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+	if bot.model.calls != 1 {
+		t.Fatalf("model called %d times; want exchanges before the forget request not summarized again", bot.model.calls)
+	}
+	if prompt := bot.model.inputs[0][0].Content; strings.Contains(prompt, "notes from earlier conversations") {
+		t.Fatalf("prompt = %q; want no memory", prompt)
+	}
+}
+
+func TestSweepMemoriesDeletesExpiredMemories(t *testing.T) {
+	bot := newMemoryTestBot()
+	bot.queries.userMemories = map[string]database.UserMemory{
+		aliceDID:      {AuthorDid: aliceDID, Summary: "old", UpdatedAt: timestamptz(time.Now().Add(-48 * time.Hour))},
+		"did:plc:bob": {AuthorDid: "did:plc:bob", Summary: "recent", UpdatedAt: timestamptz(time.Now().Add(-time.Hour))},
+	}
+
+	bot.sweepMemories()
+
+	if _, ok := bot.queries.userMemories[aliceDID]; ok {
+		t.Fatal("expired memory was not deleted")
+	}
+	if _, ok := bot.queries.userMemories["did:plc:bob"]; !ok {
+		t.Fatal("recent memory was deleted")
+	}
+}
+
+func (q *fakeQuerier) GetUserMemory(_ context.Context, authorDid string) (database.UserMemory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	memory, ok := q.userMemories[authorDid]
+	if !ok {
+		return database.UserMemory{}, pgx.ErrNoRows
+	}
+	return memory, nil
+}
+
+func (q *fakeQuerier) ListMemoryExchanges(_ context.Context, arg database.ListMemoryExchangesParams) ([]database.ListMemoryExchangesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.ListMemoryExchangesRow
+	for _, entry := range q.historyRows {
+		if entry.AuthorDid != arg.AuthorDid || entry.Status != "completed" || entry.ID <= arg.AfterID ||
+			entry.CompletedAt.Time.Before(arg.Since.Time) ||
+			(arg.ForgottenAt.Valid && !entry.ReceivedAt.Time.After(arg.ForgottenAt.Time)) {
+			continue
+		}
+		rows = append(rows, database.ListMemoryExchangesRow{ID: entry.ID, MessageText: entry.MessageText, LlmResponse: entry.LlmResponse})
+		if len(rows) == int(arg.RowLimit) {
+			break
+		}
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) UpsertUserMemory(_ context.Context, arg database.UpsertUserMemoryParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userMemories == nil {
+		q.userMemories = map[string]database.UserMemory{}
+	}
+	memory := q.userMemories[arg.AuthorDid]
+	memory.AuthorDid = arg.AuthorDid
+	memory.Summary = arg.Summary
+	memory.LastHistoryID = arg.LastHistoryID
+	memory.UpdatedAt = timestamptz(time.Now())
+	q.userMemories[arg.AuthorDid] = memory
+	return nil
+}
+
+func (q *fakeQuerier) ForgetUserMemory(_ context.Context, authorDid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.userMemories == nil {
+		q.userMemories = map[string]database.UserMemory{}
+	}
+	memory := q.userMemories[authorDid]
+	memory.AuthorDid = authorDid
+	memory.Summary = ""
+	memory.ForgottenAt = timestamptz(time.Now())
+	memory.UpdatedAt = timestamptz(time.Now())
+	q.userMemories[authorDid] = memory
+	return nil
+}
+
+func (q *fakeQuerier) DeleteExpiredUserMemories(_ context.Context, updatedBefore pgtype.Timestamptz) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var deleted int64
+	for did, memory := range q.userMemories {
+		if memory.UpdatedAt.Time.Before(updatedBefore.Time) {
+			delete(q.userMemories, did)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const defaultPromptTemplate = `You are a helpful AI assistant responding to a message on Bluesky (microblogging social media service).
+Please provide a thoughtful, engaging, and helpful response to the following user message.
+Keep your response concise and appropriate for social media (maximum 500 characters).
+
+{{- if .Memory}}
+
+Your notes from earlier conversations with this user:
+
+{{.Memory}}
+
+Use them where they help, but do not repeat them back to the user.
+{{- end}}
+
+{{- if .Knowledge}}
+
+Relevant passages from our knowledge base:
+
+{{.Knowledge}}
+
+Base your answer on these passages where they apply and do not contradict them. When you use a passage, name its document title as the source, for example "(Source: Installation Guide)".
+{{- end}}
+
+User message:
+{{.Message}}
+`
+
+type PromptTemplate struct {
+	text     string
+	template *template.Template
+}
+
+type PromptData struct {
+	Message string
+	// Knowledge holds the numbered knowledge base passages retrieved for the
+	// message, or is empty.
+	Knowledge string
+	// Memory holds the summary of earlier exchanges with the author, or is
+	// empty.
+	Memory string
+}
+
+func NewPromptTemplate(text string) (*PromptTemplate, error) {
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	prompt := &PromptTemplate{text: text, template: tmpl}
+	if _, err := prompt.Render(PromptData{Message: "test"}); err != nil {
+		return nil, err
+	}
+	return prompt, nil
+}
+
+func (p *PromptTemplate) Render(data PromptData) (string, error) {
+	var builder strings.Builder
+	if err := p.template.Execute(&builder, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt: %w", err)
+	}
+	return builder.String(), nil
+}
+
+// UsesKnowledge reports whether the template includes {{.Knowledge}}.
+func (p *PromptTemplate) UsesKnowledge() bool {
+	return strings.Contains(p.text, ".Knowledge")
+}
+
+// UsesMemory reports whether the template includes {{.Memory}}.
+func (p *PromptTemplate) UsesMemory() bool {
+	return strings.Contains(p.text, ".Memory")
+}
+
+func (p *PromptTemplate) String() string {
+	return p.text
+}
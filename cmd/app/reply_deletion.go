@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const deleteCommand = "delete"
+
+// deleteReply deletes every post of the reply recorded in entry, last post
+// first, and marks the history entry as deleted by deletedBy. Entries written
+// before the post URIs were stored only know their first post.
+func deleteReply(ctx context.Context, client BlueskyClient, queries database.Querier, entry database.MessageHistory, deletedBy string) (int, error) {
+	if entry.DeletedAt.Valid {
+		return 0, fmt.Errorf("reply of history entry %d was already deleted", entry.ID)
+	}
+	if entry.Channel == channelDM {
+		return 0, fmt.Errorf("history entry %d is a direct message reply, which cannot be deleted", entry.ID)
+	}
+
+	postURIs := entry.ReplyPostUris
+	if len(postURIs) == 0 && entry.ReplyUri != nil {
+		postURIs = []string{*entry.ReplyUri}
+	}
+	if len(postURIs) == 0 {
+		return 0, fmt.Errorf("history entry %d has no reply posts", entry.ID)
+	}
+
+	deleted := 0
+	for i := len(postURIs) - 1; i >= 0; i-- {
+		if err := client.DeletePost(ctx, postURIs[i]); err != nil {
+			return deleted, fmt.Errorf("failed to delete post %s: %w", postURIs[i], err)
+		}
+		deleted++
+	}
+
+	if _, err := queries.MarkMessageHistoryDeleted(ctx, database.MarkMessageHistoryDeletedParams{
+		ID:        entry.ID,
+		DeletedBy: &deletedBy,
+	}); err != nil {
+		return deleted, fmt.Errorf("deleted %d posts but failed to update history entry %d: %w", deleted, entry.ID, err)
+	}
+	return deleted, nil
+}
+
+// handleReplyNotification deletes the bot's reply when the author of the
+// original message answers it with "delete" and AUTHOR_DELETE is enabled.
+// Other replies to the bot are ignored.
+func (b *Bot) handleReplyNotification(notif *bsky.NotificationListNotifications_Notification, feedPost *bsky.FeedPost) error {
+	config := b.currentConfig()
+	if !config.AuthorDelete || feedPost.Reply == nil || feedPost.Reply.Parent == nil {
+		return nil
+	}
+	command := strings.TrimSpace(strings.ReplaceAll(feedPost.Text, config.BotHandle, ""))
+	if !strings.EqualFold(command, deleteCommand) {
+		return nil
+	}
+
+	entry, err := b.queries.GetMessageHistoryByReplyPost(b.ctx, feedPost.Reply.Parent.Uri)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up reply %s: %w", feedPost.Reply.Parent.Uri, err)
+	}
+	if entry.AuthorDid != notif.Author.Did {
+		b.logger.Info("Ignoring delete request from someone other than the original author",
+			"history_id", entry.ID,
+			"author_handle", notif.Author.Handle)
+		return nil
+	}
+	if entry.DeletedAt.Valid {
+		return nil
+	}
+
+	deleted, err := deleteReply(b.ctx, b.bluesky, b.queries, entry, notif.Author.Did)
+	if err != nil {
+		return err
+	}
+	b.logger.Info("Deleted reply on request of the author",
+		"history_id", entry.ID,
+		"posts", deleted)
+	return nil
+}
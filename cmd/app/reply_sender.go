@@ -3,23 +3,37 @@ package main
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
-	"github.com/bluesky-social/indigo/lex/util"
-	"github.com/bluesky-social/indigo/xrpc"
 
 	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
 )
 
-func (b *Bot) runReplySender(config *Config) {
+const (
+	singlePostGraphemes  = 300
+	threadChunkGraphemes = 280
+)
+
+const (
+	quotePolicyAnyone = "anyone"
+	quotePolicyNobody = "nobody"
+
+	// replyPolicyAnyone is the only supported REPLY_POLICY: threadgates
+	// apply to root posts, and the bot only posts replies.
+	replyPolicyAnyone = "anyone"
+)
+
+func (b *Bot) runReplySender() {
 	b.logger.Info("Starting reply sender...")
 
-	ticker := time.NewTicker(config.ReplySenderInterval)
+	ticker := time.NewTicker(b.currentConfig().ReplySenderInterval)
 	defer ticker.Stop()
 
-	if err := b.sendPendingReplies(config); err != nil {
+	if err := b.sendPendingReplies(); err != nil {
 		b.logger.Error("Error sending pending replies", "error", err)
 	}
 
@@ -29,15 +43,15 @@ func (b *Bot) runReplySender(config *Config) {
 			b.logger.Info("Reply sender shutting down...")
 			return
 		case <-ticker.C:
-			if err := b.sendPendingReplies(config); err != nil {
+			if err := b.sendPendingReplies(); err != nil {
 				b.logger.Error("Error sending pending replies", "error", err)
 			}
 		}
 	}
 }
 
-func (b *Bot) sendPendingReplies(config *Config) error {
-	messages, err := b.queries.GetReadyToSendMessages(b.ctx, 10)
+func (b *Bot) sendPendingReplies() error {
+	messages, err := b.queries.GetReadyToSendMessages(b.ctx, int32(b.currentConfig().ReplyBatchSize))
 	if err != nil {
 		return fmt.Errorf("failed to get ready to send messages: %w", err)
 	}
@@ -46,11 +60,6 @@ func (b *Bot) sendPendingReplies(config *Config) error {
 		return nil
 	}
 
-	authClient, auth, err := b.createAuthenticatedBlueskyClient(config)
-	if err != nil {
-		return fmt.Errorf("failed to create authenticated client: %w", err)
-	}
-
 	for _, message := range messages {
 		select {
 		case <-b.ctx.Done():
@@ -59,28 +68,43 @@ func (b *Bot) sendPendingReplies(config *Config) error {
 		default:
 		}
 
-		replyURI, replyCID, err := b.sendReply(authClient, auth, message)
+		if problem := b.checkSourcePost(message); problem != "" {
+			b.cancelQueuedMessage(message.ID, problem)
+			continue
+		}
+
+		startedAt := time.Now()
+		sent, err := b.sendReply(message)
+		if err != nil && b.ctx.Err() != nil {
+			b.logger.Info("Reply sender cancelled while sending", "message_id", message.ID)
+			return nil
+		}
+		if err != nil && isRateLimitedError(err) {
+			// The pacer has seen the reset time; leave the message ready to
+			// send and stop the batch instead of spending a retry.
+			b.logger.Warn("Bluesky rate limit reached, postponing remaining replies",
+				"message_id", message.ID,
+				"error", err)
+			return nil
+		}
 		if err != nil {
 			b.logger.Error("Failed to send reply",
 				"message_id", message.ID,
 				"error", err)
 
-			b.handleReplySendFailure(message, replyURI, replyCID, err)
+			b.handleReplySendFailure(message, startedAt, sent, err)
 		} else {
 			b.logger.Info("Successfully sent reply", "message_id", message.ID)
 			if message.SpendingNoticeSent && message.DeferredUntil.Valid {
 				b.markDeferredNoticeSent(message)
 			} else {
-				b.finalizeMessage(message, replyURI, replyCID, "completed", nil)
+				b.finalizeMessage(message, sent, "completed", message.LastError)
 			}
 		}
 
-		select {
-		case <-b.ctx.Done():
-			b.logger.Info("Reply sender cancelled during sleep")
+		if !b.pause(b.currentConfig().ReplyPause) {
+			b.logger.Info("Reply sender cancelled during pause")
 			return nil
-		case <-time.After(5 * time.Second):
-			// continue
 		}
 	}
 
@@ -99,9 +123,11 @@ func (b *Bot) markDeferredNoticeSent(message database.GetReadyToSendMessagesRow)
 		"message_id", message.ID,
 		"deferred_until", message.DeferredUntil.Time.Format(time.RFC3339))
 }
-func (b *Bot) handleReplySendFailure(message database.GetReadyToSendMessagesRow, replyURI, replyCID string, err error) {
+func (b *Bot) handleReplySendFailure(message database.GetReadyToSendMessagesRow, startedAt time.Time, sent sentReply, err error) {
 	errorMsg := err.Error()
-	maxRetries := int32(b.maxRetries)
+	b.recordAttempt(message.ID, stageSend, startedAt, errorMsg)
+
+	maxRetries := int32(b.currentConfig().MaxRetries)
 	if updateErr := b.queries.UpdateReadyToSendMessageFailed(b.ctx, database.UpdateReadyToSendMessageFailedParams{
 		ID:         message.ID,
 		RetryCount: maxRetries,
@@ -112,103 +138,77 @@ func (b *Bot) handleReplySendFailure(message database.GetReadyToSendMessagesRow,
 	}
 
 	currentRetryCount := message.RetryCount
-	if currentRetryCount+1 >= int32(b.maxRetries) {
-		b.finalizeMessage(message, replyURI, replyCID, "failed", &errorMsg)
+	if currentRetryCount+1 >= maxRetries {
+		if err := b.deadLetter(message.ID, stageSend, errorMsg, len(sent.PostURIs) > 0); err != nil {
+			b.logger.Error("Failed to dead-letter message",
+				"message_id", message.ID,
+				"error", err)
+		}
+		b.finalizeMessage(message, sent, "failed", &errorMsg)
 	}
 }
 
-func (b *Bot) sendReply(authClient *xrpc.Client, auth *atproto.ServerCreateSession_Output, message database.GetReadyToSendMessagesRow) (string, string, error) {
+// sentReply identifies the posts of a reply. URI and CID belong to the first
+// post; PostURIs lists every post that was created, in thread order.
+type sentReply struct {
+	URI      string
+	CID      string
+	PostURIs []string
+}
+
+func (b *Bot) sendReply(message database.GetReadyToSendMessagesRow) (sentReply, error) {
 	var responseText string
 	if message.LlmResponse != nil {
 		responseText = *message.LlmResponse
 	} else {
-		return "", "", fmt.Errorf("no LLM response available for message ID %d", message.ID)
+		return sentReply{}, fmt.Errorf("no LLM response available for message ID %d", message.ID)
 	}
 
+	config := b.currentConfig()
+	disclosure := config.Disclosure
+
+	// Only generated replies are disclosed; fallback and notice texts carry
+	// no model name.
 	var signature string
+	var labels *bsky.FeedPost_Labels
+	dm := message.Channel == channelDM
 	if message.ModelName != nil && *message.ModelName != "" {
-		signature = fmt.Sprintf("\nAI: %s", *message.ModelName)
-	}
-
-	fullText := responseText
-	if signature != "" {
-		fullText += signature
-	}
-
-	const maxGraphemes = 300
-	graphemeCount := countGraphemes(fullText)
-
-	if graphemeCount <= maxGraphemes {
-		return b.sendSinglePost(authClient, auth, message, fullText)
-	}
-
-	if signature != "" && countGraphemes(responseText) <= maxGraphemes {
-		return b.sendSinglePost(authClient, auth, message, responseText)
-	}
-
-	return b.sendThreadedReply(authClient, auth, message, responseText, signature)
-}
-
-func (b *Bot) sendSinglePost(authClient *xrpc.Client, auth *atproto.ServerCreateSession_Output, message database.GetReadyToSendMessagesRow, text string) (string, string, error) {
-	replyRecord := bsky.FeedPost{
-		Text:      text,
-		CreatedAt: time.Now().UTC().Format(time.RFC3339),
-		Reply: &bsky.FeedPost_ReplyRef{
-			Root: &atproto.RepoStrongRef{
-				Uri: message.MessageUri,
-				Cid: message.MessageCid,
-			},
-			Parent: &atproto.RepoStrongRef{
-				Uri: message.MessageUri,
-				Cid: message.MessageCid,
-			},
-		},
+		if disclosure.usesText() {
+			rendered, err := disclosure.Signature.Render(SignatureData{Model: *message.ModelName})
+			if err != nil {
+				return sentReply{}, err
+			}
+			signature = rendered
+		}
+		if disclosure.usesLabel() && !dm {
+			labels = selfLabels(disclosure.Label)
+		}
 	}
 
-	encodedRecord := &util.LexiconTypeDecoder{Val: &replyRecord}
-
-	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
-	defer cancel()
-
-	resp, err := atproto.RepoCreateRecord(
-		ctx,
-		authClient,
-		&atproto.RepoCreateRecord_Input{
-			Repo:       auth.Did,
-			Collection: "app.bsky.feed.post",
-			Record:     encodedRecord,
-		},
-	)
-
-	if err != nil {
-		return "", "", err
+	guaranteed := disclosure.Policy == disclosureGuaranteed
+	if dm {
+		chunks := chunkReply(responseText, signature, dmMessageGraphemes, dmMessageGraphemes, MarkerNone, guaranteed)
+		return b.sendDirectMessage(message, chunks)
 	}
-
-	return resp.Uri, resp.Cid, nil
+	chunks := replyChunks(responseText, signature, config.ThreadMarkerStyle, guaranteed)
+	return b.sendThread(message, chunks, labels)
 }
 
-func (b *Bot) sendThreadedReply(authClient *xrpc.Client, auth *atproto.ServerCreateSession_Output, message database.GetReadyToSendMessagesRow, responseText, signature string) (string, string, error) {
-	const maxGraphemes = 280
-
-	chunks := splitTextIntoChunks(responseText, maxGraphemes)
-
-	if signature != "" {
-		lastChunk := chunks[len(chunks)-1]
-		if countGraphemes(lastChunk+signature) <= 300 {
-			chunks[len(chunks)-1] = lastChunk + signature
-		}
-	}
-
+// sendThread posts chunks as a chain of replies to the message. On failure it
+// returns the posts that were created before.
+func (b *Bot) sendThread(message database.GetReadyToSendMessagesRow, chunks []string, labels *bsky.FeedPost_Labels) (sentReply, error) {
 	rootURI := message.MessageUri
 	rootCID := message.MessageCid
 	parentURI := message.MessageUri
 	parentCID := message.MessageCid
 
-	var firstPostURI, firstPostCID string
+	var sent sentReply
 
 	for i, chunk := range chunks {
 		replyRecord := bsky.FeedPost{
 			Text:      chunk,
+			Facets:    linkFacets(chunk),
+			Labels:    labels,
 			CreatedAt: time.Now().UTC().Format(time.RFC3339),
 			Reply: &bsky.FeedPost_ReplyRef{
 				Root: &atproto.RepoStrongRef{
@@ -222,48 +222,110 @@ func (b *Bot) sendThreadedReply(authClient *xrpc.Client, auth *atproto.ServerCre
 			},
 		}
 
-		encodedRecord := &util.LexiconTypeDecoder{Val: &replyRecord}
-
+		// The pacer decides the spacing between posts; the wait is outside
+		// the request timeout because it can last until a window resets.
+		if err := b.bluesky.WaitForWrite(b.ctx); err != nil {
+			return sent, err
+		}
 		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
-		resp, err := atproto.RepoCreateRecord(
-			ctx,
-			authClient,
-			&atproto.RepoCreateRecord_Input{
-				Repo:       auth.Did,
-				Collection: "app.bsky.feed.post",
-				Record:     encodedRecord,
-			},
-		)
+		postURI, postCID, err := b.bluesky.CreatePost(ctx, &replyRecord)
 		cancel()
 
+		if err != nil && len(chunks) == 1 {
+			return sent, err
+		}
 		if err != nil {
-			return firstPostURI, firstPostCID, fmt.Errorf("failed to send chunk %d/%d: %w", i+1, len(chunks), err)
+			return sent, fmt.Errorf("failed to send chunk %d/%d: %w", i+1, len(chunks), err)
 		}
 
-		b.logger.Info("Sent reply chunk",
-			"message_id", message.ID,
-			"chunk", i+1,
-			"total", len(chunks),
-			"graphemes", countGraphemes(chunk))
+		b.gatePost(message, postURI)
+
+		if len(chunks) > 1 {
+			b.logger.Info("Sent reply chunk",
+				"message_id", message.ID,
+				"chunk", i+1,
+				"total", len(chunks),
+				"graphemes", countGraphemes(chunk))
+		}
 
 		if i == 0 {
-			firstPostURI = resp.Uri
-			firstPostCID = resp.Cid
+			sent.URI = postURI
+			sent.CID = postCID
 		}
+		sent.PostURIs = append(sent.PostURIs, postURI)
 
-		parentURI = resp.Uri
-		parentCID = resp.Cid
+		parentURI = postURI
+		parentCID = postCID
 
-		if i < len(chunks)-1 {
-			time.Sleep(1 * time.Second)
+		if i < len(chunks)-1 && !b.pause(b.currentConfig().ThreadChunkPause) {
+			return sent, b.ctx.Err()
 		}
 	}
 
-	return firstPostURI, firstPostCID, nil
+	return sent, nil
+}
+
+// pause waits for d on top of the pacing of the Bluesky client and reports
+// false when the bot shuts down first.
+func (b *Bot) pause(d time.Duration) bool {
+	if d <= 0 {
+		return b.ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-b.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// gatePost adds the postgate record that QUOTE_POLICY asks for. A failure is
+// only logged because the post itself already exists.
+func (b *Bot) gatePost(message database.GetReadyToSendMessagesRow, postURI string) {
+	if b.currentConfig().QuotePolicy != quotePolicyNobody {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+	err := b.bluesky.CreatePostgate(ctx, &bsky.FeedPostgate{
+		Post:      postURI,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		EmbeddingRules: []*bsky.FeedPostgate_EmbeddingRules_Elem{
+			{FeedPostgate_DisableRule: &bsky.FeedPostgate_DisableRule{}},
+		},
+	})
+	if err != nil {
+		b.logger.Warn("Failed to create postgate",
+			"message_id", message.ID,
+			"post_uri", postURI,
+			"error", err)
+	}
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s]+`)
+
+// linkFacets marks the URLs in text as links. Bluesky clients only render
+// links that are declared as facets with UTF-8 byte offsets.
+func linkFacets(text string) []*bsky.RichtextFacet {
+	var facets []*bsky.RichtextFacet
+	for _, match := range urlPattern.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+		end = start + len(strings.TrimRight(text[start:end], ".,;:!?)\"'"))
+		facets = append(facets, &bsky.RichtextFacet{
+			Index: &bsky.RichtextFacet_ByteSlice{ByteStart: int64(start), ByteEnd: int64(end)},
+			Features: []*bsky.RichtextFacet_Features_Elem{
+				{RichtextFacet_Link: &bsky.RichtextFacet_Link{Uri: text[start:end]}},
+			},
+		})
+	}
+	return facets
 }
 
-func (b *Bot) finalizeMessage(message database.GetReadyToSendMessagesRow, replyURI, replyCID, status string, errorMessage *string) {
-	if histErr := b.insertMessageHistory(message, replyURI, replyCID, status, errorMessage); histErr != nil {
+func (b *Bot) finalizeMessage(message database.GetReadyToSendMessagesRow, sent sentReply, status string, errorMessage *string) {
+	if histErr := b.insertMessageHistory(message, sent, status, errorMessage); histErr != nil {
 		b.logger.Error("Failed to insert message into history",
 			"message_id", message.ID,
 			"status", status,
@@ -281,20 +343,20 @@ func (b *Bot) finalizeMessage(message database.GetReadyToSendMessagesRow, replyU
 	}
 }
 
-func (b *Bot) insertMessageHistory(message database.GetReadyToSendMessagesRow, replyURI, replyCID, status string, errorMessage *string) error {
+func (b *Bot) insertMessageHistory(message database.GetReadyToSendMessagesRow, sent sentReply, status string, errorMessage *string) error {
 	llmResponse := ""
 	if message.LlmResponse != nil {
 		llmResponse = *message.LlmResponse
 	}
 
 	var replyURIPtr *string
-	if replyURI != "" {
-		replyURIPtr = &replyURI
+	if sent.URI != "" {
+		replyURIPtr = &sent.URI
 	}
 
 	var replyCIDPtr *string
-	if replyCID != "" {
-		replyCIDPtr = &replyCID
+	if sent.CID != "" {
+		replyCIDPtr = &sent.CID
 	}
 
 	_, err := b.queries.InsertMessageHistory(b.ctx, database.InsertMessageHistoryParams{
@@ -312,6 +374,13 @@ func (b *Bot) insertMessageHistory(message database.GetReadyToSendMessagesRow, r
 		ModelName:           message.ModelName,
 		ReceivedAt:          message.CreatedAt,
 		ProcessingStartedAt: message.ProcessingStartedAt,
+		LengthStrategy:      message.LengthStrategy,
+		ReplyPostUris:       sent.PostURIs,
+		Channel:             message.Channel,
+		ConvoID:             message.ConvoID,
+		GuardrailVerdicts:   message.GuardrailVerdicts,
+		ReviewedBy:          message.ReviewedBy,
+		ReviewedAt:          message.ReviewedAt,
 	})
 
 	return err
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/jackc/pgx/v5"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func readyMessage(id int64, response string, retryCount int32) database.GetReadyToSendMessagesRow {
+	return database.GetReadyToSendMessagesRow{
+		ID:          id,
+		MessageUri:  "at://did:plc:alice/app.bsky.feed.post/1",
+		MessageCid:  "cid-parent",
+		AuthorDid:   "did:plc:alice",
+		MessageText: "hello",
+		LlmResponse: &response,
+		ModelName:   new("test-model"),
+		RetryCount:  retryCount,
+		CreatedAt:   timestamptz(time.Now()),
+	}
+}
+
+func TestSendPendingRepliesCompletesMessage(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.bluesky.posts) != 1 {
+		t.Fatalf("created %d posts; want 1", len(bot.bluesky.posts))
+	}
+	post := bot.bluesky.posts[0]
+	if post.Text != "Hello!\nAI: test-model" {
+		t.Fatalf("post text = %q", post.Text)
+	}
+	if post.Reply.Parent.Uri != "at://did:plc:alice/app.bsky.feed.post/1" {
+		t.Fatalf("reply parent = %q", post.Reply.Parent.Uri)
+	}
+	if len(bot.queries.history) != 1 || bot.queries.history[0].Status != "completed" {
+		t.Fatalf("history = %+v", bot.queries.history)
+	}
+	if len(bot.queries.deleted) != 1 || bot.queries.deleted[0] != 1 {
+		t.Fatalf("deleted = %v; want [1]", bot.queries.deleted)
+	}
+}
+
+func TestSendPendingRepliesRetriesFailedSend(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+	bot.bluesky.createErrs = []error{errors.New("network down")}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.queries.sendFailed) != 1 || bot.queries.sendFailed[0].ID != 1 {
+		t.Fatalf("send failures = %+v", bot.queries.sendFailed)
+	}
+	if len(bot.queries.history) != 0 || len(bot.queries.deleted) != 0 {
+		t.Fatalf("message finalized before retries were exhausted: history=%+v deleted=%v", bot.queries.history, bot.queries.deleted)
+	}
+}
+
+func TestSendPendingRepliesFinalizesAfterMaxRetries(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 2)}
+	bot.bluesky.createErrs = []error{errors.New("network down")}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.queries.history) != 1 {
+		t.Fatalf("history = %+v; want one entry", bot.queries.history)
+	}
+	entry := bot.queries.history[0]
+	if entry.Status != "failed" || entry.ErrorMessage == nil || *entry.ErrorMessage != "network down" {
+		t.Fatalf("history entry = %+v", entry)
+	}
+	if len(bot.queries.deadLettered) != 1 || bot.queries.deadLettered[0].Stage != stageSend || bot.queries.deadLettered[0].QueueID != 1 || bot.queries.deadLettered[0].Answered {
+		t.Fatalf("dead letters = %+v; want unanswered send dead letter for message 1", bot.queries.deadLettered)
+	}
+	if len(bot.queries.attempts) != 1 || !strings.Contains(string(bot.queries.attempts[0].Attempt), `"error":"network down"`) {
+		t.Fatalf("attempts = %+v; want recorded send attempt", bot.queries.attempts)
+	}
+}
+
+func TestSendPendingRepliesKeepsQueueItemWhenHistoryFails(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+	bot.queries.insertHistoryErr = errors.New("database down")
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.queries.deleted) != 0 {
+		t.Fatalf("deleted = %v; want none", bot.queries.deleted)
+	}
+}
+
+func TestSendPendingRepliesMarksDeferredNotice(t *testing.T) {
+	bot := newTestBot(3)
+	message := readyMessage(4, "I've reached my daily LLM budget.", 0)
+	message.ModelName = nil
+	message.SpendingNoticeSent = true
+	message.DeferredUntil = timestamptz(time.Now().Add(time.Hour))
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{message}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.queries.noticesSent) != 1 || bot.queries.noticesSent[0] != 4 {
+		t.Fatalf("notices sent = %v; want [4]", bot.queries.noticesSent)
+	}
+	if len(bot.queries.history) != 0 {
+		t.Fatalf("history = %+v; want none", bot.queries.history)
+	}
+}
+
+func TestReplyChunksKeepsGuaranteedSignature(t *testing.T) {
+	response := strings.Repeat("a", 295)
+
+	chunks := replyChunks(response, "AI: test-model", MarkerClassic, false)
+	if len(chunks) != 1 || chunks[0] != response {
+		t.Fatalf("best effort chunks = %q; want the reply without signature", chunks)
+	}
+
+	chunks = replyChunks(response, "AI: test-model", MarkerClassic, true)
+	if len(chunks) < 2 || !strings.HasSuffix(chunks[len(chunks)-1], "AI: test-model") {
+		t.Fatalf("guaranteed chunks = %q; want the signature in a final part", chunks)
+	}
+	total := len(chunks)
+	for i, chunk := range chunks {
+		if countGraphemes(chunk) > singlePostGraphemes {
+			t.Errorf("chunk %d has %d graphemes", i+1, countGraphemes(chunk))
+		}
+		if marker := fmt.Sprintf("%d/%d)", i+1, total); !strings.Contains(chunk, marker) {
+			t.Errorf("chunk %d = %q; want marker %q", i+1, chunk, marker)
+		}
+	}
+}
+
+func TestSendReplyUsesSignatureTemplateAndSelfLabel(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	signature, err := NewSignatureTemplate("Written by {{.Model}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Disclosure = DisclosureConfig{Signature: signature, Mode: disclosureBoth, Label: "ai-generated", Policy: disclosureBestEffort}
+	bot.config.Store(config)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	post := bot.bluesky.posts[0]
+	if post.Text != "Hello!\nWritten by test-model" {
+		t.Fatalf("post text = %q", post.Text)
+	}
+	if post.Labels == nil || post.Labels.LabelDefs_SelfLabels == nil ||
+		len(post.Labels.LabelDefs_SelfLabels.Values) != 1 || post.Labels.LabelDefs_SelfLabels.Values[0].Val != "ai-generated" {
+		t.Fatalf("post labels = %+v; want ai-generated self-label", post.Labels)
+	}
+}
+
+func TestSendReplyLabelOnlyOmitsSignature(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.Disclosure.Mode = disclosureLabel
+	bot.config.Store(config)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	post := bot.bluesky.posts[0]
+	if post.Text != "Hello!" || post.Labels == nil {
+		t.Fatalf("post = %q, labels %+v; want labelled reply without signature", post.Text, post.Labels)
+	}
+}
+
+func TestSendThreadedReplyChainsPosts(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, strings.Repeat("word ", 150), 0)}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	posts := bot.bluesky.posts
+	if len(posts) < 2 {
+		t.Fatalf("created %d posts; want a thread", len(posts))
+	}
+	for i, post := range posts {
+		if post.Reply.Root.Uri != "at://did:plc:alice/app.bsky.feed.post/1" {
+			t.Errorf("post %d root = %q", i, post.Reply.Root.Uri)
+		}
+		if want := fmt.Sprintf("cid-%d", i); i > 0 && post.Reply.Parent.Cid != want {
+			t.Errorf("post %d parent cid = %q", i, post.Reply.Parent.Cid)
+		}
+	}
+
+	if bot.bluesky.writeWaits != len(posts) {
+		t.Fatalf("waited for the pacer %d times; want once per post (%d)", bot.bluesky.writeWaits, len(posts))
+	}
+
+	entry := bot.queries.history[0]
+	if entry.ReplyUri == nil || *entry.ReplyUri != "at://did:plc:bot/app.bsky.feed.post/1" {
+		t.Fatalf("history reply uri = %v; want first post", entry.ReplyUri)
+	}
+	if len(entry.ReplyPostUris) != len(posts) {
+		t.Fatalf("history post uris = %v; want all %d posts", entry.ReplyPostUris, len(posts))
+	}
+}
+
+func TestSendThreadedReplyGatesQuotesOfEveryPost(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.QuotePolicy = quotePolicyNobody
+	bot.config.Store(config)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, strings.Repeat("word ", 150), 0)}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.bluesky.postgates) != len(bot.bluesky.posts) {
+		t.Fatalf("created %d postgates for %d posts", len(bot.bluesky.postgates), len(bot.bluesky.posts))
+	}
+	for i, gate := range bot.bluesky.postgates {
+		if want := fmt.Sprintf("at://did:plc:bot/app.bsky.feed.post/%d", i+1); gate.Post != want {
+			t.Errorf("postgate %d post = %q; want %q", i, gate.Post, want)
+		}
+		if len(gate.EmbeddingRules) != 1 || gate.EmbeddingRules[0].FeedPostgate_DisableRule == nil {
+			t.Errorf("postgate %d rules = %+v; want disable rule", i, gate.EmbeddingRules)
+		}
+	}
+}
+
+func TestSendThreadedReplyStopsOnChunkFailure(t *testing.T) {
+	bot := newTestBot(1)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, strings.Repeat("word ", 150), 0)}
+	bot.bluesky.createErrs = []error{nil, errors.New("rate limited")}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.bluesky.posts) != 1 {
+		t.Fatalf("created %d posts; want 1", len(bot.bluesky.posts))
+	}
+	entry := bot.queries.history[0]
+	if entry.Status != "failed" || entry.ReplyUri == nil {
+		t.Fatalf("history entry = %+v; want failed with partial reply uri", entry)
+	}
+}
+
+func TestSendPendingRepliesPostponesWhenRateLimited(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{
+		readyMessage(1, "Hello!", 0),
+		readyMessage(2, "Hi!", 0),
+	}
+	bot.bluesky.createErrs = []error{&xrpc.Error{StatusCode: http.StatusTooManyRequests}}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	if len(bot.queries.sendFailed) != 0 || len(bot.queries.attempts) != 0 {
+		t.Fatalf("rate-limited send counted as failure: failed=%+v attempts=%v", bot.queries.sendFailed, bot.queries.attempts)
+	}
+	if len(bot.bluesky.posts) != 0 || len(bot.queries.history) != 0 {
+		t.Fatalf("batch continued after rate limit: posts=%d history=%+v", len(bot.bluesky.posts), bot.queries.history)
+	}
+}
+
+func TestSendPendingRepliesStopsPausingOnShutdown(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.ThreadChunkPause = time.Hour
+	bot.config.Store(config)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, strings.Repeat("word ", 150), 0)}
+
+	time.AfterFunc(10*time.Millisecond, bot.cancel)
+	done := make(chan error, 1)
+	go func() { done <- bot.sendPendingReplies() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("sendPendingReplies() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendPendingReplies() kept pausing after shutdown")
+	}
+
+	if len(bot.bluesky.posts) != 1 || len(bot.queries.sendFailed) != 0 {
+		t.Fatalf("posts = %d, send failures = %+v; want the thread interrupted without a failure", len(bot.bluesky.posts), bot.queries.sendFailed)
+	}
+}
+
+func TestSendPendingRepliesAddsLinkFacets(t *testing.T) {
+	bot := newTestBot(3)
+	message := readyMessage(1, "Too long to post.\n\nFull answer: https://bot.example.com/replies/ABC.", 0)
+	message.LengthStrategy = new(lengthStrategyLink)
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{message}
+
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+
+	post := bot.bluesky.posts[0]
+	if len(post.Facets) != 1 {
+		t.Fatalf("facets = %+v; want one link", post.Facets)
+	}
+	facet := post.Facets[0]
+	link := post.Text[facet.Index.ByteStart:facet.Index.ByteEnd]
+	if link != "https://bot.example.com/replies/ABC" || facet.Features[0].RichtextFacet_Link.Uri != link {
+		t.Fatalf("link facet covers %q", link)
+	}
+	if got := bot.queries.history[0].LengthStrategy; got == nil || *got != lengthStrategyLink {
+		t.Fatalf("history length strategy = %v; want link", got)
+	}
+}
+
+func TestStatusHandlerServesFullTextPages(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.fullTextPages = []database.InsertFullTextPageParams{{Token: "ABC", Text: "The whole answer."}}
+
+	rec := httptest.NewRecorder()
+	bot.statusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/replies/ABC", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "The whole answer." {
+		t.Fatalf("page response = %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	bot.statusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/replies/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("missing page status = %d; want 404", rec.Code)
+	}
+}
+
+func (q *fakeQuerier) InsertFullTextPage(_ context.Context, arg database.InsertFullTextPageParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.fullTextPages = append(q.fullTextPages, arg)
+	return nil
+}
+
+func (q *fakeQuerier) GetFullTextPage(_ context.Context, token string) (database.FullTextPage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, page := range q.fullTextPages {
+		if page.Token == token {
+			return database.FullTextPage{Token: page.Token, MessageUri: page.MessageUri, Text: page.Text}, nil
+		}
+	}
+	return database.FullTextPage{}, pgx.ErrNoRows
+}
+
+func (f *fakeBluesky) CreatePostgate(_ context.Context, gate *bsky.FeedPostgate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.postgates = append(f.postgates, gate)
+	return nil
+}
@@ -2,52 +2,73 @@ package main
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
 type RequestLimiter struct {
+	mu                sync.Mutex
 	requestsPerMinute int
-	tokens            chan struct{}
+	tokens            float64
+	lastRefill        time.Time
 }
 
 func NewRequestLimiter(requestsPerMinute int) *RequestLimiter {
-	if requestsPerMinute <= 0 {
-		return &RequestLimiter{}
-	}
+	limiter := &RequestLimiter{}
+	limiter.SetRequestsPerMinute(requestsPerMinute)
+	return limiter
+}
+
+func (l *RequestLimiter) SetRequestsPerMinute(requestsPerMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	limiter := &RequestLimiter{
-		requestsPerMinute: requestsPerMinute,
-		tokens:            make(chan struct{}, requestsPerMinute),
+	if requestsPerMinute == l.requestsPerMinute {
+		return
 	}
-	for range requestsPerMinute {
-		limiter.tokens <- struct{}{}
+	if l.requestsPerMinute <= 0 || l.tokens > float64(requestsPerMinute) {
+		l.tokens = float64(max(requestsPerMinute, 0))
 	}
-	go limiter.refill()
-	return limiter
+	l.requestsPerMinute = requestsPerMinute
+	l.lastRefill = time.Now()
 }
 
 func (l *RequestLimiter) Wait(ctx context.Context) error {
-	if l == nil || l.requestsPerMinute <= 0 {
+	if l == nil {
 		return nil
 	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-l.tokens:
-		return nil
+	for {
+		wait, ok := l.take(time.Now())
+		if ok {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
 }
 
-func (l *RequestLimiter) refill() {
+func (l *RequestLimiter) take(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.requestsPerMinute <= 0 {
+		return 0, true
+	}
+
 	interval := time.Minute / time.Duration(l.requestsPerMinute)
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	l.tokens = min(l.tokens+float64(now.Sub(l.lastRefill))/float64(interval), float64(l.requestsPerMinute))
+	l.lastRefill = now
 
-	for range ticker.C {
-		select {
-		case l.tokens <- struct{}{}:
-		default:
-		}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
 	}
+	return time.Duration((1 - l.tokens) * float64(interval)), false
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/meguminnnnnnnnn/go-openai"
+)
+
+type LLMErrorClass string
+
+const (
+	LLMErrorRateLimited    LLMErrorClass = "rate_limited"
+	LLMErrorTimeout        LLMErrorClass = "timeout"
+	LLMErrorServer         LLMErrorClass = "server_error"
+	LLMErrorAuth           LLMErrorClass = "auth"
+	LLMErrorContentFilter  LLMErrorClass = "content_filter"
+	LLMErrorInvalidRequest LLMErrorClass = "invalid_request"
+	LLMErrorUnknown        LLMErrorClass = "unknown"
+)
+
+var errContentFiltered = errors.New("response blocked by content filter")
+
+// Retryable reports whether another attempt can succeed without operator
+// action. Authentication problems, rejected requests and filtered content fail
+// the same way every time.
+func (c LLMErrorClass) Retryable() bool {
+	switch c {
+	case LLMErrorAuth, LLMErrorContentFilter, LLMErrorInvalidRequest:
+		return false
+	default:
+		return true
+	}
+}
+
+// ProviderFailure reports whether the error says something about the health of
+// the provider rather than about the single request.
+func (c LLMErrorClass) ProviderFailure() bool {
+	return c != LLMErrorContentFilter && c != LLMErrorInvalidRequest
+}
+
+func classifyLLMError(err error) LLMErrorClass {
+	if errors.Is(err, errContentFiltered) {
+		return LLMErrorContentFilter
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == "content_filter" || apiErr.Code == "content_policy_violation" ||
+			(apiErr.InnerError != nil && apiErr.InnerError.Code == "ResponsibleAIPolicyViolation") {
+			return LLMErrorContentFilter
+		}
+		return classifyHTTPStatus(apiErr.HTTPStatusCode)
+	}
+
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return classifyHTTPStatus(requestErr.HTTPStatusCode)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return LLMErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return LLMErrorTimeout
+	}
+
+	return LLMErrorUnknown
+}
+
+func classifyHTTPStatus(statusCode int) LLMErrorClass {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return LLMErrorRateLimited
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return LLMErrorAuth
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return LLMErrorTimeout
+	case statusCode >= 500:
+		return LLMErrorServer
+	case statusCode >= 400:
+		return LLMErrorInvalidRequest
+	default:
+		return LLMErrorUnknown
+	}
+}
+
+// retryDelay returns the wait before the next attempt after retryCount failed
+// attempts: base doubled per attempt, capped at maxDelay, with the upper half
+// randomized so that items failing together do not retry together.
+func retryDelay(base, maxDelay time.Duration, retryCount int32) time.Duration {
+	delay := maxDelay
+	if retryCount < 32 {
+		if d := base << retryCount; d > 0 && d < maxDelay {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
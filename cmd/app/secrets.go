@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redactedText = "[REDACTED]"
+
+// SecretProvider resolves secret settings from an external store. Lookup
+// returns false when the provider has no value for the setting.
+type SecretProvider interface {
+	Name() string
+	Lookup(ctx context.Context, name string) (string, bool, error)
+}
+
+// CredentialsDirectoryProvider reads secrets from systemd credentials
+// (LoadCredential=) or any directory holding one file per secret. File names
+// are the lower-case setting names, for example db_password.
+type CredentialsDirectoryProvider struct {
+	dir string
+}
+
+func NewCredentialsDirectoryProvider(dir string) *CredentialsDirectoryProvider {
+	return &CredentialsDirectoryProvider{dir: dir}
+}
+
+func (p *CredentialsDirectoryProvider) Name() string {
+	return "credentials directory"
+}
+
+func (p *CredentialsDirectoryProvider) Lookup(_ context.Context, name string) (string, bool, error) {
+	value, err := readSecretFile(filepath.Join(p.dir, strings.ToLower(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// VaultProvider reads secrets from a single key/value secret of a
+// Vault-compatible HTTP API. Both KV version 1 and 2 responses are supported.
+// The keys inside the secret are the setting names, for example LLM_API_KEY.
+type VaultProvider struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+
+	once   sync.Once
+	values map[string]string
+	err    error
+}
+
+func NewVaultProvider(addr, token, path string) *VaultProvider {
+	return &VaultProvider{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *VaultProvider) Name() string {
+	return "vault"
+}
+
+func (p *VaultProvider) Lookup(ctx context.Context, name string) (string, bool, error) {
+	p.once.Do(func() {
+		p.values, p.err = p.fetch(ctx)
+	})
+	if p.err != nil {
+		return "", false, p.err
+	}
+	value, ok := p.values[name]
+	return value, ok, nil
+}
+
+func (p *VaultProvider) fetch(ctx context.Context) (map[string]string, error) {
+	endpoint, err := url.JoinPath(p.addr, "v1", p.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault address: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets from vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read secrets from vault: %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response: %w", err)
+	}
+
+	data := body.Data
+	if nested, ok := body.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return nil, fmt.Errorf("failed to decode vault KV v2 data: %w", err)
+		}
+	}
+
+	values := make(map[string]string, len(data))
+	for key, raw := range data {
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// secret resolves a secret setting. A value set directly wins, then a NAME_FILE
+// path (Docker secrets), then the configured secret providers in order.
+func (l *configLoader) secret(name string) string {
+	value := l.value(name)
+	if path := l.value(name + "_FILE"); path != "" {
+		if value != "" {
+			l.errorf("%s and %s_FILE must not both be set", name, name)
+		} else {
+			fileValue, err := readSecretFile(path)
+			if err != nil {
+				l.errorf("failed to read %s_FILE: %v", name, err)
+			}
+			value = fileValue
+		}
+	}
+
+	if value == "" {
+		for _, provider := range l.secretProviders {
+			providerValue, ok, err := provider.Lookup(context.Background(), name)
+			if err != nil {
+				l.errorf("failed to look up %s in %s: %v", name, provider.Name(), err)
+				break
+			}
+			if ok && providerValue != "" {
+				value = providerValue
+				break
+			}
+		}
+	}
+
+	RegisterSecret(value)
+	return value
+}
+
+func (l *configLoader) loadSecretProviders() {
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		l.secretProviders = append(l.secretProviders, NewCredentialsDirectoryProvider(dir))
+	}
+
+	switch provider := l.value("SECRETS_PROVIDER"); provider {
+	case "":
+	case "vault":
+		addr := l.required("VAULT_ADDR")
+		path := l.required("VAULT_SECRET_PATH")
+		token := l.secret("VAULT_TOKEN")
+		if token == "" {
+			l.errorf("VAULT_TOKEN or VAULT_TOKEN_FILE is required when SECRETS_PROVIDER is vault")
+			return
+		}
+		l.secretProviders = append(l.secretProviders, NewVaultProvider(addr, token, path))
+	default:
+		l.errorf("unsupported SECRETS_PROVIDER %q", provider)
+	}
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Redactor replaces registered secret values in text.
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+var secretRedactor = &Redactor{}
+
+func RegisterSecret(secret string) {
+	secretRedactor.Add(secret)
+}
+
+func RedactSecrets(text string) string {
+	return secretRedactor.Redact(text)
+}
+
+func (r *Redactor) Add(secret string) {
+	if len(secret) < 4 {
+		return
+	}
+
+	variants := []string{secret, url.QueryEscape(secret), url.PathEscape(secret)}
+	if userinfo := url.UserPassword("", secret).String(); len(userinfo) > 1 {
+		variants = append(variants, userinfo[1:])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, variant := range variants {
+		if !slices.Contains(r.secrets, variant) {
+			r.secrets = append(r.secrets, variant)
+		}
+	}
+	slices.SortFunc(r.secrets, func(a, b string) int { return len(b) - len(a) })
+}
+
+func (r *Redactor) Redact(text string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		if strings.Contains(text, secret) {
+			text = strings.ReplaceAll(text, secret, redactedText)
+		}
+	}
+	return text
+}
+
+// RedactingHandler removes registered secrets from log messages and attributes
+// before passing records to the wrapped handler.
+type RedactingHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func NewRedactingHandler(next slog.Handler) *RedactingHandler {
+	return &RedactingHandler{next: next, redactor: secretRedactor}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redactAttr(attr)
+	}
+	return &RedactingHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *RedactingHandler) redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.redactor.Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, child := range group {
+			redacted[i] = h.redactAttr(child)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		// Structs, maps and slices are formatted too, so that a secret in a
+		// field cannot reach the output through the handler's own encoding.
+		// Values without secrets keep their structured encoding.
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, h.redactor.Redact(v.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, h.redactor.Redact(v.String()))
+		case []byte:
+			return slog.String(attr.Key, h.redactor.Redact(string(v)))
+		default:
+			formatted := fmt.Sprint(v)
+			if redacted := h.redactor.Redact(formatted); redacted != formatted {
+				return slog.String(attr.Key, redacted)
+			}
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+// getPostsBatchSize is the maximum number of URIs app.bsky.feed.getPosts
+// accepts per call.
+const getPostsBatchSize = 25
+
+const (
+	sourceDeletedText = "source post was deleted"
+	sourceEditedText  = "source post was edited"
+)
+
+func (b *Bot) runSourceSweeper() {
+	b.logger.Info("Starting source post sweeper...")
+
+	ticker := time.NewTicker(b.currentConfig().SourceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			b.logger.Info("Source post sweeper shutting down...")
+			return
+		case <-ticker.C:
+			if err := b.sweepSources(); err != nil {
+				b.logger.Error("Error checking source posts", "error", err)
+			}
+		}
+	}
+}
+
+// sweepSources cancels queued messages whose post was deleted or edited and,
+// with DELETE_ORPHANED_REPLIES, deletes recent replies whose post was deleted.
+func (b *Bot) sweepSources() error {
+	sources, err := b.queries.ListQueueSources(b.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list queued source posts: %w", err)
+	}
+	if len(sources) > 0 {
+		uris := make([]string, len(sources))
+		for i, source := range sources {
+			uris[i] = source.MessageUri
+		}
+		cids, err := b.sourceCIDs(uris)
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			if problem := b.sourceProblem(cids, source.MessageUri, source.MessageCid); problem != "" {
+				b.cancelQueuedMessage(source.ID, problem)
+			}
+		}
+	}
+
+	config := b.currentConfig()
+	if !config.DeleteOrphanedReplies {
+		return nil
+	}
+	return b.deleteOrphanedReplies(time.Now().Add(-config.OrphanedReplyWindow))
+}
+
+func (b *Bot) deleteOrphanedReplies(since time.Time) error {
+	entries, err := b.queries.ListRepliesCompletedSince(b.ctx, pgtype.Timestamptz{Time: since, Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to list recent replies: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	uris := make([]string, len(entries))
+	for i, entry := range entries {
+		uris[i] = entry.MessageUri
+	}
+	cids, err := b.sourceCIDs(uris)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if _, ok := cids[entry.MessageUri]; ok {
+			continue
+		}
+		deleted, err := b.sourceDeleted(entry.MessageUri)
+		if err != nil {
+			b.logger.Warn("Failed to check whether source post was deleted",
+				"history_id", entry.ID,
+				"error", err)
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		posts, err := deleteReply(b.ctx, b.bluesky, b.queries, entry, "sweeper")
+		if err != nil {
+			b.logger.Error("Failed to delete reply to a deleted post",
+				"history_id", entry.ID,
+				"error", err)
+			continue
+		}
+		b.logger.Info("Deleted reply to a deleted post",
+			"history_id", entry.ID,
+			"posts", posts)
+	}
+	return nil
+}
+
+// checkSourcePost reports why a reply to the message must not be sent, or ""
+// when its post is unchanged. If the post cannot be looked up the reply is
+// sent anyway. Direct messages have no post to check.
+func (b *Bot) checkSourcePost(message database.GetReadyToSendMessagesRow) string {
+	if message.Channel == channelDM {
+		return ""
+	}
+	cids, err := b.sourceCIDs([]string{message.MessageUri})
+	if err != nil {
+		b.logger.Warn("Failed to check source post before sending",
+			"message_id", message.ID,
+			"error", err)
+		return ""
+	}
+	return b.sourceProblem(cids, message.MessageUri, message.MessageCid)
+}
+
+// sourceCIDs returns the current CID of every post in uris that still exists.
+func (b *Bot) sourceCIDs(uris []string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+
+	posts, err := b.bluesky.GetPosts(ctx, uris)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up source posts: %w", err)
+	}
+	cids := make(map[string]string, len(posts))
+	for _, post := range posts {
+		cids[post.Uri] = post.Cid
+	}
+	return cids, nil
+}
+
+// sourceProblem compares the post at uri with the CID the message was queued
+// with. A post missing from cids only counts as deleted once its record is
+// confirmed to be gone; if that cannot be checked the post is left alone.
+func (b *Bot) sourceProblem(cids map[string]string, uri, cid string) string {
+	if current, ok := cids[uri]; ok {
+		if current != cid {
+			return sourceEditedText
+		}
+		return ""
+	}
+	deleted, err := b.sourceDeleted(uri)
+	if err != nil {
+		b.logger.Warn("Failed to check whether source post was deleted",
+			"uri", uri,
+			"error", err)
+		return ""
+	}
+	if !deleted {
+		return ""
+	}
+	return sourceDeletedText
+}
+
+// sourceDeleted reports whether the record of a post is gone. getPosts also
+// leaves out posts of authors who block the bot, were deactivated or were
+// taken down, so its answer alone does not prove a deletion.
+func (b *Bot) sourceDeleted(uri string) (bool, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+
+	exists, err := b.bluesky.RecordExists(ctx, uri)
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+func (b *Bot) cancelQueuedMessage(messageID int64, reason string) {
+	cancelled, err := b.queries.CancelQueueMessage(b.ctx, database.CancelQueueMessageParams{
+		ID:     messageID,
+		Reason: &reason,
+	})
+	if err != nil {
+		b.logger.Error("Failed to cancel queued message",
+			"message_id", messageID,
+			"error", err)
+		return
+	}
+	if cancelled > 0 {
+		b.logger.Info("Cancelled queued message", "message_id", messageID, "reason", reason)
+	}
+}
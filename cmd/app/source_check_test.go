@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func TestSendPendingRepliesCancelsWhenSourceChanged(t *testing.T) {
+	tests := []struct {
+		name       string
+		sourceCIDs map[string]string
+		want       string
+	}{
+		{name: "deleted", sourceCIDs: map[string]string{}, want: sourceDeletedText},
+		{name: "edited", sourceCIDs: map[string]string{"at://did:plc:alice/app.bsky.feed.post/1": "cid-edited"}, want: sourceEditedText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bot := newTestBot(3)
+			bot.bluesky.sourceCIDs = tt.sourceCIDs
+			bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(1, "Hello!", 0)}
+
+			if err := bot.sendPendingReplies(); err != nil {
+				t.Fatalf("sendPendingReplies() error = %v", err)
+			}
+
+			if len(bot.bluesky.posts) != 0 {
+				t.Fatalf("created %d posts; want none", len(bot.bluesky.posts))
+			}
+			if len(bot.queries.cancelled) != 1 || bot.queries.cancelled[0].ID != 1 || *bot.queries.cancelled[0].Reason != tt.want {
+				t.Fatalf("cancelled = %+v; want message 1 with %q", bot.queries.cancelled, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepSourcesCancelsQueueAndDeletesOrphanedReplies(t *testing.T) {
+	bot := newTestBot(3)
+	bot.bluesky.sourceCIDs = map[string]string{
+		"at://did:plc:alice/app.bsky.feed.post/1": "cid-1",
+		"at://did:plc:alice/app.bsky.feed.post/3": "cid-3",
+	}
+	bot.queries.queue = []database.MessageQueue{
+		{ID: 1, Status: "pending", MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", MessageCid: "cid-1"},
+		{ID: 2, Status: "pending", MessageUri: "at://did:plc:alice/app.bsky.feed.post/2", MessageCid: "cid-2"},
+		{ID: 4, Status: "processing", MessageUri: "at://did:plc:alice/app.bsky.feed.post/4", MessageCid: "cid-4"},
+	}
+	bot.queries.historyRows = []database.MessageHistory{
+		{ID: 10, MessageUri: "at://did:plc:alice/app.bsky.feed.post/3", ReplyUri: new("at://did:plc:bot/app.bsky.feed.post/a"), CompletedAt: timestamptz(time.Now())},
+		{ID: 11, MessageUri: "at://did:plc:alice/app.bsky.feed.post/5", ReplyUri: new("at://did:plc:bot/app.bsky.feed.post/b"), CompletedAt: timestamptz(time.Now())},
+	}
+
+	if err := bot.sweepSources(); err != nil {
+		t.Fatalf("sweepSources() error = %v", err)
+	}
+	if len(bot.queries.cancelled) != 1 || bot.queries.cancelled[0].ID != 2 {
+		t.Fatalf("cancelled = %+v; want message 2", bot.queries.cancelled)
+	}
+	if len(bot.bluesky.deletedPosts) != 0 {
+		t.Fatalf("deleted posts = %v; want none while DELETE_ORPHANED_REPLIES is off", bot.bluesky.deletedPosts)
+	}
+
+	config := testConfig(3)
+	config.DeleteOrphanedReplies = true
+	config.OrphanedReplyWindow = time.Hour
+	bot.config.Store(config)
+	if err := bot.sweepSources(); err != nil {
+		t.Fatalf("sweepSources() error = %v", err)
+	}
+	if len(bot.bluesky.deletedPosts) != 1 || bot.bluesky.deletedPosts[0] != "at://did:plc:bot/app.bsky.feed.post/b" {
+		t.Fatalf("deleted posts = %v; want the reply to the deleted post", bot.bluesky.deletedPosts)
+	}
+	if entry := bot.queries.historyRows[1]; entry.Status != "deleted" || *entry.DeletedBy != "sweeper" {
+		t.Fatalf("history entry = %+v; want deleted by sweeper", entry)
+	}
+}
+
+func TestDeleteOrphanedRepliesKeepsRepliesToHiddenPosts(t *testing.T) {
+	bot := newTestBot(3)
+	bot.bluesky.hiddenPosts = map[string]bool{"at://did:plc:alice/app.bsky.feed.post/1": true}
+	bot.queries.historyRows = []database.MessageHistory{
+		{ID: 10, MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", ReplyUri: new("at://did:plc:bot/app.bsky.feed.post/a"), CompletedAt: timestamptz(time.Now())},
+	}
+
+	if err := bot.deleteOrphanedReplies(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("deleteOrphanedReplies() error = %v", err)
+	}
+	if len(bot.bluesky.deletedPosts) != 0 || bot.queries.historyRows[0].Status == "deleted" {
+		t.Fatalf("deleted posts = %v; want the reply kept while the source record exists", bot.bluesky.deletedPosts)
+	}
+}
+
+func TestSourceChecksKeepMessagesForHiddenPosts(t *testing.T) {
+	bot := newTestBot(3)
+	bot.bluesky.sourceCIDs = map[string]string{}
+	bot.bluesky.hiddenPosts = map[string]bool{"at://did:plc:alice/app.bsky.feed.post/1": true}
+	bot.queries.queue = []database.MessageQueue{
+		{ID: 1, Status: "pending", MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", MessageCid: "cid-1"},
+	}
+	bot.queries.readyToSend = []database.GetReadyToSendMessagesRow{readyMessage(2, "Hello!", 0)}
+
+	if err := bot.sweepSources(); err != nil {
+		t.Fatalf("sweepSources() error = %v", err)
+	}
+	if err := bot.sendPendingReplies(); err != nil {
+		t.Fatalf("sendPendingReplies() error = %v", err)
+	}
+	if len(bot.queries.cancelled) != 0 {
+		t.Fatalf("cancelled = %+v; want none while the source record exists", bot.queries.cancelled)
+	}
+	if len(bot.bluesky.posts) != 1 {
+		t.Fatalf("created %d posts; want the reply sent", len(bot.bluesky.posts))
+	}
+}
+
+func (f *fakeBluesky) GetPosts(_ context.Context, uris []string) ([]*bsky.FeedDefs_PostView, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var posts []*bsky.FeedDefs_PostView
+	for _, uri := range uris {
+		if cid, ok := f.sourceCIDs[uri]; ok {
+			posts = append(posts, &bsky.FeedDefs_PostView{Uri: uri, Cid: cid})
+		}
+	}
+	return posts, nil
+}
+
+func (f *fakeBluesky) RecordExists(_ context.Context, uri string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, visible := f.sourceCIDs[uri]
+	return visible || f.hiddenPosts[uri], nil
+}
+
+func (q *fakeQuerier) CancelQueueMessage(_ context.Context, arg database.CancelQueueMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cancelled = append(q.cancelled, arg)
+	q.queue = slices.DeleteFunc(q.queue, func(message database.MessageQueue) bool {
+		return message.ID == arg.ID && message.Status != "processing"
+	})
+	return 1, nil
+}
+
+func (q *fakeQuerier) ListQueueSources(context.Context) ([]database.ListQueueSourcesRow, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.ListQueueSourcesRow
+	for _, message := range q.queue {
+		if message.Status != "processing" && message.Channel != channelDM {
+			rows = append(rows, database.ListQueueSourcesRow{ID: message.ID, MessageUri: message.MessageUri, MessageCid: message.MessageCid})
+		}
+	}
+	return rows, nil
+}
+
+func (q *fakeQuerier) ListRepliesCompletedSince(_ context.Context, since pgtype.Timestamptz) ([]database.MessageHistory, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var rows []database.MessageHistory
+	for _, entry := range q.historyRows {
+		if !entry.DeletedAt.Valid && entry.ReplyUri != nil && entry.Channel != channelDM && !entry.CompletedAt.Time.Before(since.Time) {
+			rows = append(rows, entry)
+		}
+	}
+	return rows, nil
+}
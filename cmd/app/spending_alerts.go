@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	notifierLog     = "log"
+	notifierWebhook = "webhook"
+	notifierSMTP    = "smtp"
+)
+
+type AlertConfig struct {
+	Thresholds []int
+	Notifier   string
+	WebhookURL string
+	SMTPAddr   string
+	SMTPFrom   string
+	SMTPTo     []string
+}
+
+// SpendingAlert is sent once per budget period when the spend crosses one of
+// SPENDING_ALERT_THRESHOLDS.
+type SpendingAlert struct {
+	Period          string    `json:"period"`
+	PeriodStart     string    `json:"period_start"`
+	Threshold       int       `json:"threshold"`
+	SpentMicros     int64     `json:"spent_micros"`
+	LimitMicros     int64     `json:"limit_micros"`
+	ProjectedMicros int64     `json:"projected_micros"`
+	ResetAt         time.Time `json:"reset_at"`
+}
+
+func (a SpendingAlert) Message() string {
+	return fmt.Sprintf("LLM %s spending reached %d%% of the budget: %s of %s spent, %s projected by the reset at %s.",
+		a.Period, a.Threshold,
+		formatMicros(a.SpentMicros), formatMicros(a.LimitMicros), formatMicros(a.ProjectedMicros),
+		a.ResetAt.Format(time.RFC3339))
+}
+
+// Notifier delivers spending alerts to the operator.
+type Notifier interface {
+	Notify(ctx context.Context, alert SpendingAlert) error
+}
+
+type LogNotifier struct {
+	logger *slog.Logger
+}
+
+func (n LogNotifier) Notify(_ context.Context, alert SpendingAlert) error {
+	n.logger.Warn(alert.Message(),
+		"period", alert.Period,
+		"threshold", alert.Threshold,
+		"spent_micros", alert.SpentMicros,
+		"limit_micros", alert.LimitMicros,
+		"projected_micros", alert.ProjectedMicros)
+	return nil
+}
+
+// WebhookNotifier posts the alert as JSON with the message in a text field,
+// which chat webhooks such as Slack display as is.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string, client *http.Client) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: client}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert SpendingAlert) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		SpendingAlert
+	}{Text: alert.Message(), SpendingAlert: alert})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTPNotifier sends the alert through an SMTP relay without authentication,
+// usually the local mail server.
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+func NewSMTPNotifier(addr, from string, to []string) *SMTPNotifier {
+	return &SMTPNotifier{addr: addr, from: from, to: to}
+}
+
+func (n *SMTPNotifier) Notify(_ context.Context, alert SpendingAlert) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: LLM %s spending at %d%%\r\n", alert.Period, alert.Threshold)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", alert.Message())
+	return smtp.SendMail(n.addr, nil, n.from, n.to, []byte(msg.String()))
+}
+
+// alertNotifier returns the notifier of ALERT_NOTIFIER.
+func (b *Bot) alertNotifier() Notifier {
+	if b.notifier != nil {
+		return b.notifier
+	}
+	config := b.currentConfig().Alerts
+	switch config.Notifier {
+	case notifierWebhook:
+		return NewWebhookNotifier(config.WebhookURL, &http.Client{Timeout: 10 * time.Second})
+	case notifierSMTP:
+		return NewSMTPNotifier(config.SMTPAddr, config.SMTPFrom, config.SMTPTo)
+	default:
+		return LogNotifier{logger: b.logger}
+	}
+}
+
+// checkSpendingAlerts records every threshold the spend of a budget period
+// has crossed and notifies the highest one that was not recorded before.
+// Recording before notifying means that an alert is sent at most once, even
+// when several workers finalize spend at the same time.
+func (b *Bot) checkSpendingAlerts() {
+	thresholds := b.currentConfig().Alerts.Thresholds
+	if len(thresholds) == 0 {
+		return
+	}
+
+	now := time.Now()
+	statuses, err := b.spendingLimiter.Statuses(b.ctx, now)
+	if err != nil {
+		b.logger.Error("Error checking spending alerts", "error", err)
+		return
+	}
+
+	var forecast *SpendingForecast
+	for _, status := range statuses {
+		if status.LimitMicros <= 0 {
+			continue
+		}
+		periodStart, err := parseUsageDate(status.PeriodStart)
+		if err != nil {
+			b.logger.Error("Error checking spending alerts", "error", err)
+			return
+		}
+		percent := status.SpentMicros * 100 / status.LimitMicros
+		alert := SpendingAlert{}
+		for _, threshold := range thresholds {
+			if int64(threshold) > percent {
+				break
+			}
+			inserted, err := b.queries.InsertSpendingAlert(b.ctx, database.InsertSpendingAlertParams{
+				Period:      status.Period,
+				PeriodStart: periodStart,
+				Threshold:   int32(threshold),
+			})
+			if err != nil {
+				b.logger.Error("Error recording spending alert",
+					"period", status.Period,
+					"threshold", threshold,
+					"error", err)
+				return
+			}
+			if inserted > 0 {
+				alert.Threshold = threshold
+			}
+		}
+		if alert.Threshold == 0 {
+			continue
+		}
+
+		if forecast == nil {
+			projected, err := b.spendingLimiter.Forecast(b.ctx, now)
+			if err != nil {
+				b.logger.Warn("Failed to forecast LLM spend", "error", err)
+			}
+			forecast = &projected
+		}
+		alert.Period = status.Period
+		alert.PeriodStart = status.PeriodStart
+		alert.SpentMicros = status.SpentMicros
+		alert.LimitMicros = status.LimitMicros
+		alert.ProjectedMicros = forecast.projected(status.Period)
+		alert.ResetAt = status.ResetAt
+
+		if err := b.alertNotifier().Notify(b.ctx, alert); err != nil {
+			b.logger.Error("Error sending spending alert",
+				"period", alert.Period,
+				"threshold", alert.Threshold,
+				"error", err)
+		}
+	}
+}
+
+func (f SpendingForecast) projected(period string) int64 {
+	switch period {
+	case budgetWeekly:
+		return f.EndOfWeekMicros
+	case budgetMonthly:
+		return f.EndOfMonthMicros
+	default:
+		return f.EndOfDayMicros
+	}
+}
+
+func formatThresholds(thresholds []int) string {
+	if len(thresholds) == 0 {
+		return "off"
+	}
+	items := make([]string, len(thresholds))
+	for i, threshold := range thresholds {
+		items[i] = strconv.Itoa(threshold)
+	}
+	return strings.Join(items, ",")
+}
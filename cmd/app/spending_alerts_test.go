@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func TestCheckSpendingAlertsNotifiesOncePerThreshold(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.Alerts.Thresholds = []int{50, 80, 100}
+	bot.config.Store(config)
+	notifier := &fakeNotifier{}
+	bot.notifier = notifier
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1, Monthly: 10})
+
+	today := usageDate(time.Now(), time.UTC)
+	store.usage[today] = DailyUsage{SpentMicros: 850_000}
+	bot.checkSpendingAlerts()
+	bot.checkSpendingAlerts()
+
+	if len(notifier.alerts) != 1 {
+		t.Fatalf("alerts = %+v; want one", notifier.alerts)
+	}
+	alert := notifier.alerts[0]
+	if alert.Period != budgetDaily || alert.Threshold != 80 || alert.ProjectedMicros < alert.SpentMicros {
+		t.Fatalf("alert = %+v; want the daily 80%% alert", alert)
+	}
+	if len(bot.queries.spendingAlerts) != 2 {
+		t.Fatalf("recorded alerts = %+v; want 50 and 80", bot.queries.spendingAlerts)
+	}
+
+	store.usage[today] = DailyUsage{SpentMicros: 1_000_000}
+	bot.checkSpendingAlerts()
+	if len(notifier.alerts) != 2 || notifier.alerts[1].Threshold != 100 {
+		t.Fatalf("alerts = %+v; want the 100%% alert", notifier.alerts)
+	}
+}
+
+func TestProcessNextMessageSendsSpendingAlert(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.Alerts.Thresholds = []int{50}
+	bot.config.Store(config)
+	notifier := &fakeNotifier{}
+	bot.notifier = notifier
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 0.001})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "hello"}}
+	bot.model.responses = []*schema.Message{{
+		Role:         schema.Assistant,
+		Content:      "Hi!",
+		ResponseMeta: &schema.ResponseMeta{Usage: &schema.TokenUsage{PromptTokens: 300, CompletionTokens: 300}},
+	}}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+	if len(notifier.alerts) != 1 || !strings.Contains(notifier.alerts[0].Message(), "daily spending reached 50%") {
+		t.Fatalf("alerts = %+v; want the daily 50%% alert", notifier.alerts)
+	}
+}
+
+func (q *fakeQuerier) InsertSpendingAlert(_ context.Context, arg database.InsertSpendingAlertParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if slices.Contains(q.spendingAlerts, arg) {
+		return 0, nil
+	}
+	q.spendingAlerts = append(q.spendingAlerts, arg)
+	return 1, nil
+}
+
+type fakeNotifier struct {
+	alerts []SpendingAlert
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, alert SpendingAlert) error {
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
@@ -2,14 +2,12 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/cloudwego/eino/schema"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const microsPerUnit = 1_000_000
@@ -18,128 +16,288 @@ type UsagePricing struct {
 	InputCachePerMillion float64
 	InputMissPerMillion  float64
 	OutputPerMillion     float64
+	EmbeddingPerMillion  float64
 }
 
 func (p UsagePricing) Total() float64 {
 	return p.InputCachePerMillion + p.InputMissPerMillion + p.OutputPerMillion
 }
 
+const (
+	budgetDaily   = "daily"
+	budgetWeekly  = "weekly"
+	budgetMonthly = "monthly"
+)
+
+const (
+	budgetWindowCalendar = "calendar"
+	budgetWindowRolling  = "rolling"
+)
+
+// recentRateDays is the number of days before today whose average spend is
+// used to project the spend of the current periods.
+const recentRateDays = 7
+
+// SpendingLimits are the LLM budgets in currency units. A limit of zero is not
+// enforced.
+type SpendingLimits struct {
+	Daily   float64
+	Weekly  float64
+	Monthly float64
+	// Location is the timezone whose midnight starts a budget day. Nil
+	// means UTC.
+	Location *time.Location
+	// Rolling enforces the budgets over the last 24 hours, 7 days and 30
+	// days instead of the calendar day, week and month.
+	Rolling bool
+}
+
+func (l SpendingLimits) location() *time.Location {
+	if l.Location == nil {
+		return time.UTC
+	}
+	return l.Location
+}
+
+// Budget is a spending limit over the usage dates From to To, inclusive, or
+// for a rolling window over the hourly usage since Since.
+type Budget struct {
+	Period      string
+	From        string
+	To          string
+	Window      time.Duration
+	Since       time.Time
+	LimitMicros int64
+	ResetAt     time.Time
+}
+
+func (b Budget) rolling() bool {
+	return b.Window > 0
+}
+
 type SpendingLimiter struct {
-	pool             *pgxpool.Pool
-	pricing          UsagePricing
-	dailyLimitMicros int64
+	store   SpendingStore
+	tokens  *TokenEstimator
+	mu      sync.RWMutex
+	pricing UsagePricing
+	limits  SpendingLimits
 }
 
 type SpendingStatus struct {
+	Period         string
+	Rolling        bool
 	SpentMicros    int64
 	ReservedMicros int64
 	LimitMicros    int64
-	ResetAt        time.Time
+	// PeriodStart is the usage date of the first day of the calendar
+	// period, also for rolling windows.
+	PeriodStart string
+	ResetAt     time.Time
+}
+
+// SpendingForecast projects the spend at the end of the current day, week and
+// month from the average daily spend of the last days.
+type SpendingForecast struct {
+	DailyRateMicros  int64
+	EndOfDayMicros   int64
+	EndOfWeekMicros  int64
+	EndOfMonthMicros int64
 }
 
 type SpendingReservation struct {
+	// ID is the reservation row in the store and MessageID the queue item the
+	// request is made for, 0 when it is not made for one.
+	ID        int64
+	MessageID int64
 	UsageDate string
+	UsageHour time.Time
 	Micros    int64
+	// Model and InputTokens are the model of the request and the uncalibrated
+	// token count of its prompt, compared with the reported usage.
+	Model       string
+	InputTokens int
 }
 
 func (r SpendingReservation) IsValid() bool {
 	return r.UsageDate != "" && r.Micros > 0
 }
 
-func NewSpendingLimiter(pool *pgxpool.Pool, pricing UsagePricing, dailyLimit float64) *SpendingLimiter {
+func NewSpendingLimiter(store SpendingStore, pricing UsagePricing, limits SpendingLimits) *SpendingLimiter {
 	return &SpendingLimiter{
-		pool:             pool,
-		pricing:          pricing,
-		dailyLimitMicros: currencyToMicros(dailyLimit),
+		store:   store,
+		tokens:  NewTokenEstimator(),
+		pricing: pricing,
+		limits:  limits,
 	}
 }
 
+func (s *SpendingLimiter) Update(pricing UsagePricing, limits SpendingLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pricing = pricing
+	s.limits = limits
+}
+
 func (s *SpendingLimiter) IsEnabled() bool {
-	return s != nil && s.dailyLimitMicros > 0
+	return s != nil && len(s.budgets(time.Now())) > 0
 }
 
-func (s *SpendingLimiter) CurrentStatus(ctx context.Context, now time.Time) (SpendingStatus, error) {
-	status := SpendingStatus{LimitMicros: s.dailyLimitMicros, ResetAt: nextDailyResetUTC(now)}
-	if !s.IsEnabled() {
-		return status, nil
-	}
+func (s *SpendingLimiter) currentLimits() SpendingLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
 
-	usageDate := usageDate(now)
-	err := s.pool.QueryRow(ctx, `
-SELECT estimated_spend_micros, reserved_spend_micros
-FROM llm_usage_daily
-WHERE usage_date = $1`, usageDate).Scan(&status.SpentMicros, &status.ReservedMicros)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return status, nil
+// budgets returns the enforced budgets for the periods that contain now.
+func (s *SpendingLimiter) budgets(now time.Time) []Budget {
+	limits := s.currentLimits()
+	loc := limits.location()
+
+	var budgets []Budget
+	for _, budget := range []struct {
+		period string
+		limit  float64
+	}{
+		{budgetDaily, limits.Daily},
+		{budgetWeekly, limits.Weekly},
+		{budgetMonthly, limits.Monthly},
+	} {
+		if budget.limit <= 0 {
+			continue
+		}
+		start, reset := periodBounds(budget.period, now, loc)
+		b := Budget{
+			Period:      budget.period,
+			From:        usageDate(start, loc),
+			To:          usageDate(reset.AddDate(0, 0, -1), loc),
+			LimitMicros: currencyToMicros(budget.limit),
+			ResetAt:     reset,
+		}
+		if limits.Rolling {
+			b.Window = rollingWindow(budget.period)
+			b.Since = usageHour(now).Add(-b.Window + time.Hour)
 		}
-		return status, fmt.Errorf("failed to load LLM daily usage: %w", err)
+		budgets = append(budgets, b)
 	}
+	return budgets
+}
 
-	return status, nil
+// Statuses returns the spend of every enforced budget.
+func (s *SpendingLimiter) Statuses(ctx context.Context, now time.Time) ([]SpendingStatus, error) {
+	budgets := s.budgets(now)
+	statuses := make([]SpendingStatus, len(budgets))
+	for i, budget := range budgets {
+		usage, err := s.store.BudgetUsage(ctx, budget)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load LLM %s usage: %w", budget.Period, err)
+		}
+		statuses[i] = budget.status(usage)
+		// A rolling budget resets once it is below the limit again.
+		excess := statuses[i].CommittedAndReservedMicros() - budget.LimitMicros + 1
+		if err := s.resolveRollingReset(ctx, budget, &statuses[i], excess, now); err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
 }
 
+// LimitReached reports whether one of the budgets is used up and returns the
+// status of that budget.
 func (s *SpendingLimiter) LimitReached(ctx context.Context, now time.Time) (SpendingStatus, bool, error) {
-	status, err := s.CurrentStatus(ctx, now)
-	if err != nil || !s.IsEnabled() {
-		return status, false, err
+	statuses, err := s.Statuses(ctx, now)
+	if err != nil {
+		return SpendingStatus{}, false, err
 	}
-	return status, status.CommittedAndReservedMicros() >= status.LimitMicros, nil
+	for _, status := range statuses {
+		if status.CommittedAndReservedMicros() >= status.LimitMicros {
+			return status, true, nil
+		}
+	}
+	return tightestStatus(statuses), false, nil
 }
 
-func (s *SpendingLimiter) Reserve(ctx context.Context, now time.Time, prompt string, maxOutputTokens int) (SpendingReservation, SpendingStatus, bool, error) {
-	status := SpendingStatus{LimitMicros: s.dailyLimitMicros, ResetAt: nextDailyResetUTC(now)}
-	if !s.IsEnabled() {
-		return SpendingReservation{}, status, true, nil
+// Reserve reserves the spend of a request to model against all budgets. The
+// prompt tokens are counted with the tokenizer of the model and calibrated by
+// the usage reported for earlier requests. When one of the budgets cannot take
+// the reservation, the status of that budget is returned. Otherwise the status
+// of the budget with the least headroom is returned.
+func (s *SpendingLimiter) Reserve(ctx context.Context, now time.Time, messageID int64, model, prompt string, maxOutputTokens int) (SpendingReservation, SpendingStatus, bool, error) {
+	budgets := s.budgets(now)
+	if len(budgets) == 0 {
+		return SpendingReservation{}, SpendingStatus{ResetAt: s.nextDailyReset(now)}, true, nil
 	}
 
-	inputTokens := estimateTokens(prompt)
-	reservationMicros := s.calculateSpendMicros(0, inputTokens, maxOutputTokens)
-	date := usageDate(now)
+	inputTokens := s.tokens.Count(model, prompt)
+	reservation := SpendingReservation{
+		MessageID:   messageID,
+		UsageDate:   usageDate(now, s.currentLimits().location()),
+		UsageHour:   usageHour(now),
+		Micros:      s.calculateSpendMicros(0, s.tokens.Calibrate(model, inputTokens), maxOutputTokens),
+		Model:       model,
+		InputTokens: inputTokens,
+	}
 
-	tx, err := s.pool.Begin(ctx)
+	usages, id, err := s.store.ReserveSpend(ctx, reservation, budgets)
+	statuses := make([]SpendingStatus, len(usages))
+	for i, usage := range usages {
+		statuses[i] = budgets[i].status(usage)
+	}
 	if err != nil {
-		return SpendingReservation{}, status, false, fmt.Errorf("failed to begin spending reservation: %w", err)
+		return SpendingReservation{}, tightestStatus(statuses), false, err
 	}
-	defer tx.Rollback(ctx)
-
-	if _, err := tx.Exec(ctx, `
-INSERT INTO llm_usage_daily (usage_date)
-VALUES ($1)
-ON CONFLICT (usage_date) DO NOTHING`, date); err != nil {
-		return SpendingReservation{}, status, false, fmt.Errorf("failed to initialize LLM daily usage: %w", err)
+	if id == 0 {
+		for i, status := range statuses {
+			excess := status.CommittedAndReservedMicros() + reservation.Micros - status.LimitMicros
+			if excess <= 0 {
+				continue
+			}
+			if err := s.resolveRollingReset(ctx, budgets[i], &status, excess, now); err != nil {
+				return SpendingReservation{}, status, false, err
+			}
+			return SpendingReservation{}, status, false, nil
+		}
+		return SpendingReservation{}, tightestStatus(statuses), false, nil
 	}
 
-	if err := tx.QueryRow(ctx, `
-SELECT estimated_spend_micros, reserved_spend_micros
-FROM llm_usage_daily
-WHERE usage_date = $1
-FOR UPDATE`, date).Scan(&status.SpentMicros, &status.ReservedMicros); err != nil {
-		return SpendingReservation{}, status, false, fmt.Errorf("failed to lock LLM daily usage: %w", err)
-	}
+	reservation.ID = id
+	return reservation, tightestStatus(statuses), true, nil
+}
 
-	if status.CommittedAndReservedMicros()+reservationMicros > status.LimitMicros {
-		return SpendingReservation{}, status, false, nil
+// Release drops a reservation whose request failed without charging it.
+func (s *SpendingLimiter) Release(ctx context.Context, reservation SpendingReservation) error {
+	if !reservation.IsValid() || reservation.ID == 0 {
+		return nil
 	}
-
-	if _, err := tx.Exec(ctx, `
-UPDATE llm_usage_daily
-SET reserved_spend_micros = reserved_spend_micros + $2,
-    updated_at = NOW()
-WHERE usage_date = $1`, date, reservationMicros); err != nil {
-		return SpendingReservation{}, status, false, fmt.Errorf("failed to reserve LLM spend: %w", err)
+	if _, err := s.store.ReleaseSpend(ctx, reservation.ID); err != nil {
+		return fmt.Errorf("failed to release LLM usage reservation: %w", err)
 	}
+	return nil
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return SpendingReservation{}, status, false, fmt.Errorf("failed to commit spending reservation: %w", err)
+// ExpireReservations drops the reservations made more than timeout before now.
+// A request cannot take longer than the LLM timeout, so such reservations were
+// orphaned by a crash or an unhandled error path.
+func (s *SpendingLimiter) ExpireReservations(ctx context.Context, now time.Time, timeout time.Duration) ([]SpendingReservation, error) {
+	if timeout <= 0 {
+		return nil, nil
 	}
-
-	status.ReservedMicros += reservationMicros
-	return SpendingReservation{UsageDate: date, Micros: reservationMicros}, status, true, nil
+	expired, err := s.store.ExpireReservations(ctx, now.Add(-timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire LLM usage reservations: %w", err)
+	}
+	return expired, nil
 }
 
+// FinalizeReservation replaces the reservation with the cost of usage and
+// returns the spend of the day the reservation was made on.
 func (s *SpendingLimiter) FinalizeReservation(ctx context.Context, reservation SpendingReservation, usage *schema.TokenUsage) (SpendingStatus, error) {
-	status := SpendingStatus{LimitMicros: s.dailyLimitMicros, ResetAt: nextDailyResetUTC(time.Now())}
+	limits := s.currentLimits()
+	status := SpendingStatus{
+		Period:      budgetDaily,
+		LimitMicros: currencyToMicros(limits.Daily),
+		PeriodStart: reservation.UsageDate,
+		ResetAt:     s.nextDailyReset(time.Now()),
+	}
 	if !s.IsEnabled() || !reservation.IsValid() || usage == nil {
 		return status, nil
 	}
@@ -147,29 +305,165 @@ func (s *SpendingLimiter) FinalizeReservation(ctx context.Context, reservation S
 	cachedInput := max(usage.PromptTokenDetails.CachedTokens, 0)
 	missInput := max(usage.PromptTokens-cachedInput, 0)
 	output := max(usage.CompletionTokens, 0)
-	actualMicros := s.calculateSpendMicros(cachedInput, missInput, output)
-
-	err := s.pool.QueryRow(ctx, `
-UPDATE llm_usage_daily
-SET
-    input_cache_tokens = input_cache_tokens + $2,
-    input_miss_tokens = input_miss_tokens + $3,
-    output_tokens = output_tokens + $4,
-    estimated_spend_micros = estimated_spend_micros + $5,
-    reserved_spend_micros = GREATEST(reserved_spend_micros - $6, 0),
-    updated_at = NOW()
-WHERE usage_date = $1
-RETURNING estimated_spend_micros, reserved_spend_micros`, reservation.UsageDate, cachedInput, missInput, output, actualMicros, reservation.Micros).Scan(&status.SpentMicros, &status.ReservedMicros)
+	charge := UsageCharge{
+		InputCacheTokens: cachedInput,
+		InputMissTokens:  missInput,
+		OutputTokens:     output,
+		SpendMicros:      s.calculateSpendMicros(cachedInput, missInput, output),
+	}
+
+	daily, err := s.store.FinalizeSpend(ctx, reservation, charge)
 	if err != nil {
 		return status, fmt.Errorf("failed to finalize LLM usage reservation: %w", err)
 	}
+	status.SpentMicros = daily.SpentMicros
+	status.ReservedMicros = daily.ReservedMicros
 
 	return status, nil
 }
 
-func (s *SpendingLimiter) EstimateUsage(prompt, response string) *schema.TokenUsage {
-	promptTokens := estimateTokens(prompt)
-	completionTokens := estimateTokens(response)
+// Forecast projects the spend of the current periods. The daily rate is the
+// average spend of the last recentRateDays days with usage; without any, the
+// spend of today so far is extrapolated.
+func (s *SpendingLimiter) Forecast(ctx context.Context, now time.Time) (SpendingForecast, error) {
+	loc := s.currentLimits().location()
+	dayStart, dayEnd := periodBounds(budgetDaily, now, loc)
+	weekStart, weekEnd := periodBounds(budgetWeekly, now, loc)
+	monthStart, monthEnd := periodBounds(budgetMonthly, now, loc)
+	rateStart := dayStart.AddDate(0, 0, -recentRateDays)
+
+	from := rateStart
+	for _, start := range []time.Time{weekStart, monthStart} {
+		if start.Before(from) {
+			from = start
+		}
+	}
+	today := usageDate(dayStart, loc)
+	usage, err := s.store.UsageByDate(ctx, usageDate(from, loc), today)
+	if err != nil {
+		return SpendingForecast{}, fmt.Errorf("failed to load LLM usage: %w", err)
+	}
+
+	spentSince := func(start time.Time) int64 {
+		var spent int64
+		for date, day := range usage {
+			if date >= usageDate(start, loc) {
+				spent += day.SpentMicros
+			}
+		}
+		return spent
+	}
+
+	todaySpent := usage[today].SpentMicros
+	var recent int64
+	var days int
+	for date, day := range usage {
+		if date >= usageDate(rateStart, loc) && date < today {
+			recent += day.SpentMicros
+			days++
+		}
+	}
+	var rate float64
+	if days > 0 {
+		rate = float64(recent) / float64(days)
+	} else {
+		elapsed := max(now.Sub(dayStart), time.Hour)
+		rate = float64(todaySpent) / elapsed.Hours() * 24
+	}
+
+	project := func(spent int64, end time.Time) int64 {
+		remaining := max(end.Sub(now).Hours()/24, 0)
+		return spent + int64(math.Round(rate*remaining))
+	}
+	return SpendingForecast{
+		DailyRateMicros:  int64(math.Round(rate)),
+		EndOfDayMicros:   project(todaySpent, dayEnd),
+		EndOfWeekMicros:  project(spentSince(weekStart), weekEnd),
+		EndOfMonthMicros: project(spentSince(monthStart), monthEnd),
+	}, nil
+}
+
+// resolveRollingReset sets the reset of a rolling budget to the time at which
+// enough spend has left the window for excess micros to fit.
+func (s *SpendingLimiter) resolveRollingReset(ctx context.Context, budget Budget, status *SpendingStatus, excess int64, now time.Time) error {
+	if !budget.rolling() {
+		return nil
+	}
+	hours, err := s.store.HourlyUsage(ctx, budget.Since)
+	if err != nil {
+		return fmt.Errorf("failed to load LLM hourly usage: %w", err)
+	}
+	status.ResetAt = rollingReset(hours, budget.Window, excess, now)
+	return nil
+}
+
+func (s *SpendingLimiter) nextDailyReset(now time.Time) time.Time {
+	_, reset := periodBounds(budgetDaily, now, s.currentLimits().location())
+	return reset
+}
+
+func (b Budget) status(usage DailyUsage) SpendingStatus {
+	return SpendingStatus{
+		Period:         b.Period,
+		Rolling:        b.rolling(),
+		SpentMicros:    usage.SpentMicros,
+		ReservedMicros: usage.ReservedMicros,
+		LimitMicros:    b.LimitMicros,
+		PeriodStart:    b.From,
+		ResetAt:        b.ResetAt,
+	}
+}
+
+// tightestStatus returns the status with the least headroom.
+func tightestStatus(statuses []SpendingStatus) SpendingStatus {
+	var tightest SpendingStatus
+	for i, status := range statuses {
+		if i == 0 || status.LimitMicros-status.CommittedAndReservedMicros() < tightest.LimitMicros-tightest.CommittedAndReservedMicros() {
+			tightest = status
+		}
+	}
+	return tightest
+}
+
+// RecordEmbedding charges embedding tokens to the day of now. Embeddings are
+// small and cheap compared to completions, so they are not reserved in
+// advance.
+func (s *SpendingLimiter) RecordEmbedding(ctx context.Context, now time.Time, tokens int) error {
+	if !s.IsEnabled() || tokens <= 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	spend := float64(tokens) * s.pricing.EmbeddingPerMillion / 1_000_000
+	loc := s.limits.location()
+	s.mu.RUnlock()
+
+	charge := UsageCharge{EmbeddingTokens: tokens, SpendMicros: currencyToMicros(spend)}
+	if _, err := s.store.AddSpend(ctx, usageDate(now, loc), usageHour(now), charge); err != nil {
+		return fmt.Errorf("failed to record embedding usage: %w", err)
+	}
+	return nil
+}
+
+// ObserveUsage calibrates the prompt token estimates of the model of
+// reservation with the usage the provider reported.
+func (s *SpendingLimiter) ObserveUsage(reservation SpendingReservation, usage *schema.TokenUsage) {
+	if usage == nil {
+		return
+	}
+	s.tokens.Observe(reservation.Model, reservation.InputTokens, usage.PromptTokens)
+}
+
+// TokenizerStatus returns the calibration of the prompt token estimates.
+func (s *SpendingLimiter) TokenizerStatus() []TokenizerStatus {
+	return s.tokens.Status()
+}
+
+// EstimateUsage estimates the usage of a request to model when the provider
+// reported none.
+func (s *SpendingLimiter) EstimateUsage(model, prompt, response string) *schema.TokenUsage {
+	promptTokens := s.tokens.Estimate(model, prompt)
+	completionTokens := s.tokens.Count(model, response)
 	return &schema.TokenUsage{
 		PromptTokens:     promptTokens,
 		CompletionTokens: completionTokens,
@@ -178,6 +472,8 @@ func (s *SpendingLimiter) EstimateUsage(prompt, response string) *schema.TokenUs
 }
 
 func (s *SpendingLimiter) calculateSpendMicros(inputCacheTokens, inputMissTokens, outputTokens int) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	spend := (float64(inputCacheTokens)*s.pricing.InputCachePerMillion +
 		float64(inputMissTokens)*s.pricing.InputMissPerMillion +
 		float64(outputTokens)*s.pricing.OutputPerMillion) / 1_000_000
@@ -195,26 +491,78 @@ func currencyToMicros(amount float64) int64 {
 	return int64(math.Ceil(amount * microsPerUnit))
 }
 
-func nextDailyResetUTC(now time.Time) time.Time {
-	utc := now.UTC()
-	return time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+// periodBounds returns the start of the day, week or month in loc that
+// contains now and the start of the next one. Weeks start on Monday. The
+// bounds are local midnights, so a day is 23 or 25 hours long when the clocks
+// change.
+func periodBounds(period string, now time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := now.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	switch period {
+	case budgetWeekly:
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	case budgetMonthly:
+		start := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
 }
 
-func usageDate(t time.Time) string {
-	return t.UTC().Format("2006-01-02")
+// rollingWindow returns the length of the rolling window of a budget period.
+func rollingWindow(period string) time.Duration {
+	switch period {
+	case budgetWeekly:
+		return 7 * 24 * time.Hour
+	case budgetMonthly:
+		return 30 * 24 * time.Hour
+	default:
+		return 24 * time.Hour
+	}
 }
 
-func hoursUntil(t time.Time, now time.Time) int {
-	d := t.Sub(now.UTC())
-	if d <= 0 {
-		return 0
+func rollingWindowName(period string) string {
+	switch period {
+	case budgetWeekly:
+		return "7 days"
+	case budgetMonthly:
+		return "30 days"
+	default:
+		return "24 hours"
 	}
-	return int(math.Ceil(d.Hours()))
 }
 
-func estimateTokens(text string) int {
-	if text == "" {
+// rollingReset returns the time at which enough of the hourly spend has left
+// a rolling window for excess micros to fit. Without an excess it is the time
+// the oldest spend leaves the window.
+func rollingReset(hours []HourlyUsage, window time.Duration, excess int64, now time.Time) time.Time {
+	for _, hour := range hours {
+		excess -= hour.SpentMicros + hour.ReservedMicros
+		if excess <= 0 {
+			return hour.Hour.Add(window)
+		}
+	}
+	return usageHour(now).Add(window)
+}
+
+// usageDate returns the date of t in loc, the key of the daily usage rows.
+func usageDate(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(time.DateOnly)
+}
+
+// usageHour returns the start of the UTC hour of t, the key of the hourly usage
+// rows.
+func usageHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+// hoursUntil rounds the time until t up to whole hours. It works on instants,
+// so a reset across a DST change counts the hours that actually pass.
+func hoursUntil(t time.Time, now time.Time) int {
+	d := t.Sub(now)
+	if d <= 0 {
 		return 0
 	}
-	return max(len([]byte(text)), 1)
+	return int(math.Ceil(d.Hours()))
 }
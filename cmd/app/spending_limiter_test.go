@@ -0,0 +1,464 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+)
+
+func TestSpendingLimiterReserveAndFinalize(t *testing.T) {
+	store := newFakeSpendingStore()
+	limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 2}, SpendingLimits{Daily: 1})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	reservation, status, allowed, err := limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+	if err != nil || !allowed {
+		t.Fatalf("Reserve() allowed = %v, err = %v", allowed, err)
+	}
+	// 2 prompt tokens at 1/M, four bytes per token, plus 100 output tokens
+	// at 2/M.
+	if reservation.Micros != 202 || status.ReservedMicros != 202 {
+		t.Fatalf("reservation = %+v, status = %+v", reservation, status)
+	}
+
+	status, err = limiter.FinalizeReservation(context.Background(), reservation, &schema.TokenUsage{PromptTokens: 5, CompletionTokens: 10})
+	if err != nil {
+		t.Fatalf("FinalizeReservation() error = %v", err)
+	}
+	if status.SpentMicros != 25 || status.ReservedMicros != 0 {
+		t.Fatalf("status after finalize = %+v", status)
+	}
+}
+
+func TestSpendingLimiterReleasesReservation(t *testing.T) {
+	store := newFakeSpendingStore()
+	limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 2}, SpendingLimits{Daily: 1})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	reservation, _, _, err := limiter.Reserve(context.Background(), now, 42, "test-model", "hello", 100)
+	if err != nil || reservation.ID == 0 || reservation.MessageID != 42 {
+		t.Fatalf("Reserve() = %+v, %v; want a reservation row for message 42", reservation, err)
+	}
+	if err := limiter.Release(context.Background(), reservation); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if usage := store.usage[reservation.UsageDate]; usage.SpentMicros != 0 || usage.ReservedMicros != 0 {
+		t.Fatalf("usage after release = %+v", usage)
+	}
+
+	// Finalizing a reservation that already expired still charges the usage.
+	reservation, _, _, err = limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	expired, err := limiter.ExpireReservations(context.Background(), time.Now().Add(time.Minute), time.Second)
+	if err != nil || len(expired) != 1 || expired[0].ID != reservation.ID {
+		t.Fatalf("ExpireReservations() = %+v, %v", expired, err)
+	}
+	status, err := limiter.FinalizeReservation(context.Background(), reservation, &schema.TokenUsage{PromptTokens: 5, CompletionTokens: 10})
+	if err != nil || status.SpentMicros != 25 || status.ReservedMicros != 0 {
+		t.Fatalf("FinalizeReservation() = %+v, %v", status, err)
+	}
+}
+
+func TestSpendingLimiterCalibratesPromptTokens(t *testing.T) {
+	store := newFakeSpendingStore()
+	limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1}, SpendingLimits{Daily: 1})
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	prompt := strings.Repeat("word ", 20)
+
+	reservation, _, _, err := limiter.Reserve(context.Background(), now, 0, "test-model", prompt, 1)
+	if err != nil || reservation.InputTokens != 25 || reservation.Micros != 25 {
+		t.Fatalf("Reserve() = %+v, %v; want 25 counted prompt tokens", reservation, err)
+	}
+	// The provider counted 30 prompt tokens, the chat format included.
+	limiter.ObserveUsage(reservation, &schema.TokenUsage{PromptTokens: 30})
+
+	reservation, _, _, err = limiter.Reserve(context.Background(), now, 0, "test-model", prompt, 1)
+	if err != nil || reservation.InputTokens != 25 || reservation.Micros != 30 {
+		t.Fatalf("Reserve() = %+v, %v; want 30 calibrated prompt tokens", reservation, err)
+	}
+	reservation, _, _, err = limiter.Reserve(context.Background(), now, 0, "other-model", prompt, 1)
+	if err != nil || reservation.Micros != 25 {
+		t.Fatalf("Reserve() = %+v, %v; want other models uncalibrated", reservation, err)
+	}
+	status := limiter.TokenizerStatus()
+	if len(status) != 1 || status[0].Model != "test-model" || status[0].Ratio != 1.2 || status[0].Tokenizer != fallbackTokenizer {
+		t.Fatalf("TokenizerStatus() = %+v", status)
+	}
+}
+
+func TestSpendingLimiterRefusesReservationOverLimit(t *testing.T) {
+	store := newFakeSpendingStore()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.usage[usageDate(now, time.UTC)] = DailyUsage{SpentMicros: 999_900}
+	limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 2}, SpendingLimits{Daily: 1})
+
+	_, status, allowed, err := limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if allowed {
+		t.Fatal("Reserve() allowed = true; want false")
+	}
+	if !status.ResetAt.Equal(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("reset at = %v", status.ResetAt)
+	}
+}
+
+func TestSpendingLimiterDisabled(t *testing.T) {
+	limiter := NewSpendingLimiter(nil, UsagePricing{}, SpendingLimits{})
+
+	reservation, _, allowed, err := limiter.Reserve(context.Background(), time.Now(), 0, "test-model", "hello", 100)
+	if err != nil || !allowed || reservation.IsValid() {
+		t.Fatalf("Reserve() = %+v, %v, %v; want unlimited", reservation, allowed, err)
+	}
+}
+
+func TestSpendingLimiterEnforcesWeeklyAndMonthlyBudgets(t *testing.T) {
+	// Wednesday; the week started on Monday 2026-03-02.
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		limits SpendingLimits
+		usage  map[string]DailyUsage
+		period string
+		reset  time.Time
+	}{
+		{
+			name:   "weekly",
+			limits: SpendingLimits{Daily: 1, Weekly: 1.8, Monthly: 10},
+			usage:  map[string]DailyUsage{"2026-03-01": {SpentMicros: 900_000}, "2026-03-02": {SpentMicros: 900_000}, "2026-03-03": {SpentMicros: 900_000}},
+			period: budgetWeekly,
+			reset:  time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "monthly",
+			limits: SpendingLimits{Daily: 1, Monthly: 2},
+			usage:  map[string]DailyUsage{"2026-02-28": {SpentMicros: 900_000}, "2026-03-01": {SpentMicros: 900_000}, "2026-03-02": {SpentMicros: 900_000}, "2026-03-03": {SpentMicros: 200_000}},
+			period: budgetMonthly,
+			reset:  time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newFakeSpendingStore()
+			store.usage = test.usage
+			limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 2}, test.limits)
+
+			_, status, allowed, err := limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+			if err != nil || allowed {
+				t.Fatalf("Reserve() allowed = %v, err = %v; want refused", allowed, err)
+			}
+			if status.Period != test.period || !status.ResetAt.Equal(test.reset) {
+				t.Fatalf("status = %+v; want the %s budget resetting at %v", status, test.period, test.reset)
+			}
+			status, reached, err := limiter.LimitReached(context.Background(), now)
+			if err != nil || !reached || status.Period != test.period {
+				t.Fatalf("LimitReached() = %+v, %v, %v; want the %s budget reached", status, reached, err, test.period)
+			}
+		})
+	}
+}
+
+func TestPeriodBounds(t *testing.T) {
+	tests := []struct {
+		period string
+		now    time.Time
+		start  string
+		reset  string
+	}{
+		{budgetDaily, time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC), "2026-12-31", "2027-01-01"},
+		{budgetWeekly, time.Date(2026, 3, 8, 10, 0, 0, 0, time.UTC), "2026-03-02", "2026-03-09"},
+		{budgetWeekly, time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC), "2026-03-09", "2026-03-16"},
+		{budgetMonthly, time.Date(2028, 2, 29, 8, 0, 0, 0, time.UTC), "2028-02-01", "2028-03-01"},
+	}
+	for _, test := range tests {
+		start, reset := periodBounds(test.period, test.now, time.UTC)
+		if usageDate(start, time.UTC) != test.start || usageDate(reset, time.UTC) != test.reset {
+			t.Fatalf("periodBounds(%s, %v) = %v, %v; want %s, %s", test.period, test.now, start, reset, test.start, test.reset)
+		}
+	}
+}
+
+func TestPeriodBoundsAcrossDSTTransitions(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatalf("LoadLocation() error = %v", err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("LoadLocation() error = %v", err)
+	}
+	tests := []struct {
+		name  string
+		loc   *time.Location
+		now   time.Time
+		date  string
+		reset time.Time
+		hours int
+	}{
+		{"zurich before midnight in utc", zurich, time.Date(2026, 3, 1, 23, 30, 0, 0, time.UTC), "2026-03-02", time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC), 24},
+		{"zurich spring forward", zurich, time.Date(2026, 3, 28, 23, 0, 0, 0, time.UTC), "2026-03-29", time.Date(2026, 3, 29, 22, 0, 0, 0, time.UTC), 23},
+		{"zurich fall back", zurich, time.Date(2026, 10, 24, 22, 0, 0, 0, time.UTC), "2026-10-25", time.Date(2026, 10, 25, 23, 0, 0, 0, time.UTC), 25},
+		{"new york spring forward", newYork, time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC), "2026-03-08", time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC), 23},
+		{"new york fall back", newYork, time.Date(2026, 11, 1, 4, 0, 0, 0, time.UTC), "2026-11-01", time.Date(2026, 11, 2, 5, 0, 0, 0, time.UTC), 25},
+		{"utc", time.UTC, time.Date(2026, 3, 29, 0, 0, 0, 0, time.UTC), "2026-03-29", time.Date(2026, 3, 30, 0, 0, 0, 0, time.UTC), 24},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := usageDate(test.now, test.loc); got != test.date {
+				t.Fatalf("usageDate() = %s; want %s", got, test.date)
+			}
+			_, reset := periodBounds(budgetDaily, test.now, test.loc)
+			if !reset.Equal(test.reset) {
+				t.Fatalf("daily reset = %v; want %v", reset, test.reset)
+			}
+			if got := hoursUntil(reset, test.now); got != test.hours {
+				t.Fatalf("hoursUntil() = %d; want %d", got, test.hours)
+			}
+		})
+	}
+}
+
+func TestPeriodBoundsWeekAndMonthInTimezone(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatalf("LoadLocation() error = %v", err)
+	}
+	// Monday 2026-03-30 00:30 in Zurich is still Sunday in UTC.
+	now := time.Date(2026, 3, 29, 22, 30, 0, 0, time.UTC)
+	start, reset := periodBounds(budgetWeekly, now, zurich)
+	if !start.Equal(time.Date(2026, 3, 29, 22, 0, 0, 0, time.UTC)) || !reset.Equal(time.Date(2026, 4, 5, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("weekly bounds = %v, %v", start, reset)
+	}
+	// The March month in Zurich starts in winter time and ends in summer time.
+	now = time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	start, reset = periodBounds(budgetMonthly, now, zurich)
+	if !start.Equal(time.Date(2026, 2, 28, 23, 0, 0, 0, time.UTC)) || !reset.Equal(time.Date(2026, 3, 31, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("monthly bounds = %v, %v", start, reset)
+	}
+}
+
+func TestSpendingLimiterRollingWindow(t *testing.T) {
+	store := newFakeSpendingStore()
+	now := time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC)
+	// Spend from yesterday afternoon that leaves the window at 15:00 and
+	// 18:00 today, and an older hour already outside of it.
+	store.hourly[time.Date(2026, 3, 1, 11, 0, 0, 0, time.UTC)] = DailyUsage{SpentMicros: 900_000}
+	store.hourly[time.Date(2026, 3, 1, 15, 0, 0, 0, time.UTC)] = DailyUsage{SpentMicros: 600_000}
+	store.hourly[time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC)] = DailyUsage{SpentMicros: 399_900}
+	limiter := NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 2}, SpendingLimits{Daily: 1, Rolling: true})
+
+	_, status, allowed, err := limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+	if err != nil || allowed {
+		t.Fatalf("Reserve() allowed = %v, err = %v; want refused", allowed, err)
+	}
+	if !status.Rolling || status.SpentMicros != 999_900 {
+		t.Fatalf("status = %+v; want 999_900 spent in the rolling window", status)
+	}
+	if want := time.Date(2026, 3, 2, 15, 0, 0, 0, time.UTC); !status.ResetAt.Equal(want) {
+		t.Fatalf("reset = %v; want %v", status.ResetAt, want)
+	}
+
+	now = time.Date(2026, 3, 2, 15, 5, 0, 0, time.UTC)
+	reservation, _, allowed, err := limiter.Reserve(context.Background(), now, 0, "test-model", "hello", 100)
+	if err != nil || !allowed {
+		t.Fatalf("Reserve() allowed = %v, err = %v; want allowed after the oldest spend left the window", allowed, err)
+	}
+	if !reservation.UsageHour.Equal(time.Date(2026, 3, 2, 15, 0, 0, 0, time.UTC)) {
+		t.Fatalf("reservation = %+v", reservation)
+	}
+}
+
+func TestSpendingLimiterForecast(t *testing.T) {
+	// Tuesday 2026-03-03 at 06:00, a quarter into the day.
+	now := time.Date(2026, 3, 3, 6, 0, 0, 0, time.UTC)
+
+	store := newFakeSpendingStore()
+	store.usage["2026-03-03"] = DailyUsage{SpentMicros: 100_000}
+	limiter := NewSpendingLimiter(store, UsagePricing{OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	forecast, err := limiter.Forecast(context.Background(), now)
+	if err != nil {
+		t.Fatalf("Forecast() error = %v", err)
+	}
+	// Without history, today's spend is extrapolated to 400_000 per day.
+	if forecast.DailyRateMicros != 400_000 || forecast.EndOfDayMicros != 400_000 {
+		t.Fatalf("forecast without history = %+v", forecast)
+	}
+
+	store.usage["2026-03-01"] = DailyUsage{SpentMicros: 200_000}
+	store.usage["2026-03-02"] = DailyUsage{SpentMicros: 400_000}
+	forecast, err = limiter.Forecast(context.Background(), now)
+	if err != nil {
+		t.Fatalf("Forecast() error = %v", err)
+	}
+	// The rate is the average of the previous days, 300_000 per day.
+	want := SpendingForecast{
+		DailyRateMicros:  300_000,
+		EndOfDayMicros:   100_000 + 225_000,
+		EndOfWeekMicros:  500_000 + 225_000 + 5*300_000,
+		EndOfMonthMicros: 700_000 + 225_000 + 28*300_000,
+	}
+	if forecast != want {
+		t.Fatalf("Forecast() = %+v; want %+v", forecast, want)
+	}
+}
+
+type fakeSpendingStore struct {
+	mu           sync.Mutex
+	usage        map[string]DailyUsage
+	hourly       map[time.Time]DailyUsage
+	reservations map[int64]fakeReservation
+	nextID       int64
+}
+
+type fakeReservation struct {
+	reservation SpendingReservation
+	createdAt   time.Time
+}
+
+func newFakeSpendingStore() *fakeSpendingStore {
+	return &fakeSpendingStore{
+		usage:        map[string]DailyUsage{},
+		hourly:       map[time.Time]DailyUsage{},
+		reservations: map[int64]fakeReservation{},
+	}
+}
+
+func (s *fakeSpendingStore) BudgetUsage(_ context.Context, budget Budget) (DailyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.budgetUsageLocked(budget), nil
+}
+
+func (s *fakeSpendingStore) HourlyUsage(_ context.Context, since time.Time) ([]HourlyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hours []HourlyUsage
+	for hour, usage := range s.hourly {
+		if !hour.Before(since) {
+			hours = append(hours, HourlyUsage{Hour: hour, SpentMicros: usage.SpentMicros, ReservedMicros: usage.ReservedMicros})
+		}
+	}
+	slices.SortFunc(hours, func(a, b HourlyUsage) int { return a.Hour.Compare(b.Hour) })
+	return hours, nil
+}
+
+func (s *fakeSpendingStore) UsageByDate(_ context.Context, fromDate, toDate string) (map[string]DailyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := map[string]DailyUsage{}
+	for date, day := range s.usage {
+		if date >= fromDate && date <= toDate {
+			usage[date] = day
+		}
+	}
+	return usage, nil
+}
+
+func (s *fakeSpendingStore) ReserveSpend(_ context.Context, reservation SpendingReservation, budgets []Budget) ([]DailyUsage, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usages := make([]DailyUsage, len(budgets))
+	allowed := true
+	for i, budget := range budgets {
+		usages[i] = s.budgetUsageLocked(budget)
+		if usages[i].SpentMicros+usages[i].ReservedMicros+reservation.Micros > budget.LimitMicros {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return usages, 0, nil
+	}
+	s.nextID++
+	reservation.ID = s.nextID
+	s.reservations[reservation.ID] = fakeReservation{reservation: reservation, createdAt: time.Now()}
+	s.addLocked(reservation.UsageDate, reservation.UsageHour, DailyUsage{ReservedMicros: reservation.Micros})
+	for i := range usages {
+		usages[i].ReservedMicros += reservation.Micros
+	}
+	return usages, reservation.ID, nil
+}
+
+func (s *fakeSpendingStore) FinalizeSpend(_ context.Context, reservation SpendingReservation, charge UsageCharge) (DailyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(reservation.ID)
+	return s.addLocked(reservation.UsageDate, reservation.UsageHour, DailyUsage{SpentMicros: charge.SpendMicros}), nil
+}
+
+func (s *fakeSpendingStore) ReleaseSpend(_ context.Context, reservationID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.releaseLocked(reservationID), nil
+}
+
+func (s *fakeSpendingStore) ExpireReservations(_ context.Context, createdBefore time.Time) ([]SpendingReservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []SpendingReservation
+	for id, open := range s.reservations {
+		if open.createdAt.Before(createdBefore) {
+			s.releaseLocked(id)
+			expired = append(expired, open.reservation)
+		}
+	}
+	slices.SortFunc(expired, func(a, b SpendingReservation) int { return cmp.Compare(a.ID, b.ID) })
+	return expired, nil
+}
+
+func (s *fakeSpendingStore) releaseLocked(id int64) bool {
+	open, ok := s.reservations[id]
+	if !ok {
+		return false
+	}
+	delete(s.reservations, id)
+	s.addLocked(open.reservation.UsageDate, open.reservation.UsageHour, DailyUsage{ReservedMicros: -open.reservation.Micros})
+	return true
+}
+
+func (s *fakeSpendingStore) AddSpend(_ context.Context, usageDate string, usageHour time.Time, charge UsageCharge) (DailyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addLocked(usageDate, usageHour, DailyUsage{SpentMicros: charge.SpendMicros}), nil
+}
+
+func (s *fakeSpendingStore) addLocked(usageDate string, usageHour time.Time, delta DailyUsage) DailyUsage {
+	hour := s.hourly[usageHour]
+	hour.SpentMicros += delta.SpentMicros
+	hour.ReservedMicros = max(hour.ReservedMicros+delta.ReservedMicros, 0)
+	s.hourly[usageHour] = hour
+
+	usage := s.usage[usageDate]
+	usage.SpentMicros += delta.SpentMicros
+	usage.ReservedMicros = max(usage.ReservedMicros+delta.ReservedMicros, 0)
+	s.usage[usageDate] = usage
+	return usage
+}
+
+func (s *fakeSpendingStore) budgetUsageLocked(budget Budget) DailyUsage {
+	var sum DailyUsage
+	if budget.rolling() {
+		for hour, usage := range s.hourly {
+			if !hour.Before(budget.Since) {
+				sum.SpentMicros += usage.SpentMicros
+				sum.ReservedMicros += usage.ReservedMicros
+			}
+		}
+		return sum
+	}
+	for date, day := range s.usage {
+		if date >= budget.From && date <= budget.To {
+			sum.SpentMicros += day.SpentMicros
+			sum.ReservedMicros += day.ReservedMicros
+		}
+	}
+	return sum
+}
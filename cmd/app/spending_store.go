@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+type DailyUsage struct {
+	SpentMicros    int64
+	ReservedMicros int64
+}
+
+type HourlyUsage struct {
+	Hour           time.Time
+	SpentMicros    int64
+	ReservedMicros int64
+}
+
+type UsageCharge struct {
+	InputCacheTokens int
+	InputMissTokens  int
+	OutputTokens     int
+	EmbeddingTokens  int
+	SpendMicros      int64
+}
+
+// SpendingStore persists the daily and hourly LLM usage counters and the open
+// spend reservations used by SpendingLimiter. Calendar budgets are summed from
+// the daily counters, rolling budgets from the hourly ones. Every reservation
+// is a row of its own until it is finalized, released or expired.
+type SpendingStore interface {
+	BudgetUsage(ctx context.Context, budget Budget) (DailyUsage, error)
+	HourlyUsage(ctx context.Context, since time.Time) ([]HourlyUsage, error)
+	UsageByDate(ctx context.Context, fromDate, toDate string) (map[string]DailyUsage, error)
+	ReserveSpend(ctx context.Context, reservation SpendingReservation, budgets []Budget) ([]DailyUsage, int64, error)
+	FinalizeSpend(ctx context.Context, reservation SpendingReservation, charge UsageCharge) (DailyUsage, error)
+	ReleaseSpend(ctx context.Context, reservationID int64) (bool, error)
+	ExpireReservations(ctx context.Context, createdBefore time.Time) ([]SpendingReservation, error)
+	AddSpend(ctx context.Context, usageDate string, usageHour time.Time, charge UsageCharge) (DailyUsage, error)
+}
+
+type PostgresSpendingStore struct {
+	pool    *pgxpool.Pool
+	queries *database.Queries
+}
+
+func NewPostgresSpendingStore(pool *pgxpool.Pool) *PostgresSpendingStore {
+	return &PostgresSpendingStore{pool: pool, queries: database.New(pool)}
+}
+
+func (s *PostgresSpendingStore) BudgetUsage(ctx context.Context, budget Budget) (DailyUsage, error) {
+	return budgetUsage(ctx, s.queries, budget)
+}
+
+func (s *PostgresSpendingStore) HourlyUsage(ctx context.Context, since time.Time) ([]HourlyUsage, error) {
+	return hourlyUsage(ctx, s.queries, since)
+}
+
+func (s *PostgresSpendingStore) UsageByDate(ctx context.Context, fromDate, toDate string) (map[string]DailyUsage, error) {
+	from, err := parseUsageDate(fromDate)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseUsageDate(toDate)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.queries.ListDailyUsage(ctx, database.ListDailyUsageParams{FromDate: from, ToDate: to})
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]DailyUsage, len(rows))
+	for _, row := range rows {
+		usage[row.UsageDate.Time.Format(time.DateOnly)] = DailyUsage{SpentMicros: row.EstimatedSpendMicros, ReservedMicros: row.ReservedSpendMicros}
+	}
+	return usage, nil
+}
+
+// ReserveSpend inserts a reservation row for the micros of reservation when
+// none of the budgets would be exceeded and returns its ID, or 0 when a budget
+// would be exceeded. The daily row of the reservation is locked so concurrent
+// reservations are serialized and the budget sums cannot change underneath.
+// The usage of every budget is returned in the order of budgets.
+func (s *PostgresSpendingStore) ReserveSpend(ctx context.Context, reservation SpendingReservation, budgets []Budget) ([]DailyUsage, int64, error) {
+	date, err := parseUsageDate(reservation.UsageDate)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin spending reservation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	queries := s.queries.WithTx(tx)
+
+	if err := queries.EnsureDailyUsage(ctx, date); err != nil {
+		return nil, 0, fmt.Errorf("failed to initialize LLM daily usage: %w", err)
+	}
+
+	if _, err := queries.LockDailyUsage(ctx, date); err != nil {
+		return nil, 0, fmt.Errorf("failed to lock LLM daily usage: %w", err)
+	}
+
+	usages := make([]DailyUsage, len(budgets))
+	allowed := true
+	for i, budget := range budgets {
+		usage, err := budgetUsage(ctx, queries, budget)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to load LLM %s usage: %w", budget.Period, err)
+		}
+		usages[i] = usage
+		if usage.SpentMicros+usage.ReservedMicros+reservation.Micros > budget.LimitMicros {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return usages, 0, nil
+	}
+
+	var messageID *int64
+	if reservation.MessageID > 0 {
+		messageID = &reservation.MessageID
+	}
+	id, err := queries.InsertSpendReservation(ctx, database.InsertSpendReservationParams{
+		UsageDate:    date,
+		UsageHour:    pgtype.Timestamptz{Time: reservation.UsageHour, Valid: true},
+		AmountMicros: reservation.Micros,
+		MessageID:    messageID,
+	})
+	if err != nil {
+		return usages, 0, fmt.Errorf("failed to reserve LLM spend: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return usages, 0, fmt.Errorf("failed to commit spending reservation: %w", err)
+	}
+
+	for i := range usages {
+		usages[i].ReservedMicros += reservation.Micros
+	}
+	return usages, id, nil
+}
+
+// ReleaseSpend deletes a reservation without charging it. It reports whether
+// the reservation was still open.
+func (s *PostgresSpendingStore) ReleaseSpend(ctx context.Context, reservationID int64) (bool, error) {
+	deleted, err := s.queries.DeleteSpendReservation(ctx, reservationID)
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+// ExpireReservations deletes the reservations created before createdBefore
+// and returns them.
+func (s *PostgresSpendingStore) ExpireReservations(ctx context.Context, createdBefore time.Time) ([]SpendingReservation, error) {
+	rows, err := s.queries.ExpireSpendReservations(ctx, pgtype.Timestamptz{Time: createdBefore, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	reservations := make([]SpendingReservation, len(rows))
+	for i, row := range rows {
+		reservations[i] = SpendingReservation{
+			ID:        row.ID,
+			UsageDate: row.UsageDate.Time.Format(time.DateOnly),
+			UsageHour: row.UsageHour.Time,
+			Micros:    row.AmountMicros,
+			MessageID: derefInt(row.MessageID),
+		}
+	}
+	return reservations, nil
+}
+
+// FinalizeSpend charges the day and hour of the reservation with charge and
+// deletes the reservation row. A reservation that already expired is charged
+// all the same.
+func (s *PostgresSpendingStore) FinalizeSpend(ctx context.Context, reservation SpendingReservation, charge UsageCharge) (DailyUsage, error) {
+	date, err := parseUsageDate(reservation.UsageDate)
+	if err != nil {
+		return DailyUsage{}, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return DailyUsage{}, fmt.Errorf("failed to begin spending finalization: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	queries := s.queries.WithTx(tx)
+
+	if _, err := queries.DeleteSpendReservation(ctx, reservation.ID); err != nil {
+		return DailyUsage{}, err
+	}
+	row, err := queries.FinalizeReservedSpend(ctx, database.FinalizeReservedSpendParams{
+		InputCacheTokens: int64(charge.InputCacheTokens),
+		InputMissTokens:  int64(charge.InputMissTokens),
+		OutputTokens:     int64(charge.OutputTokens),
+		SpendMicros:      charge.SpendMicros,
+		UsageDate:        date,
+	})
+	if err != nil {
+		return DailyUsage{}, err
+	}
+	if err := queries.AddHourlySpend(ctx, database.AddHourlySpendParams{
+		UsageHour:   pgtype.Timestamptz{Time: reservation.UsageHour, Valid: true},
+		SpendMicros: charge.SpendMicros,
+	}); err != nil {
+		return DailyUsage{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return DailyUsage{}, fmt.Errorf("failed to commit spending finalization: %w", err)
+	}
+	return DailyUsage{SpentMicros: row.EstimatedSpendMicros, ReservedMicros: row.ReservedSpendMicros}, nil
+}
+
+// AddSpend charges usage that was not reserved.
+func (s *PostgresSpendingStore) AddSpend(ctx context.Context, usageDate string, usageHour time.Time, charge UsageCharge) (DailyUsage, error) {
+	date, err := parseUsageDate(usageDate)
+	if err != nil {
+		return DailyUsage{}, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return DailyUsage{}, fmt.Errorf("failed to begin spending update: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	queries := s.queries.WithTx(tx)
+
+	row, err := queries.AddDailySpend(ctx, database.AddDailySpendParams{
+		UsageDate:       date,
+		EmbeddingTokens: int64(charge.EmbeddingTokens),
+		SpendMicros:     charge.SpendMicros,
+	})
+	if err != nil {
+		return DailyUsage{}, err
+	}
+	if err := queries.AddHourlySpend(ctx, database.AddHourlySpendParams{
+		UsageHour:   pgtype.Timestamptz{Time: usageHour, Valid: true},
+		SpendMicros: charge.SpendMicros,
+	}); err != nil {
+		return DailyUsage{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return DailyUsage{}, fmt.Errorf("failed to commit spending update: %w", err)
+	}
+	return DailyUsage{SpentMicros: row.EstimatedSpendMicros, ReservedMicros: row.ReservedSpendMicros}, nil
+}
+
+func budgetUsage(ctx context.Context, queries *database.Queries, budget Budget) (DailyUsage, error) {
+	if budget.rolling() {
+		hours, err := hourlyUsage(ctx, queries, budget.Since)
+		if err != nil {
+			return DailyUsage{}, err
+		}
+		var usage DailyUsage
+		for _, hour := range hours {
+			usage.SpentMicros += hour.SpentMicros
+			usage.ReservedMicros += hour.ReservedMicros
+		}
+		return usage, nil
+	}
+
+	from, err := parseUsageDate(budget.From)
+	if err != nil {
+		return DailyUsage{}, err
+	}
+	to, err := parseUsageDate(budget.To)
+	if err != nil {
+		return DailyUsage{}, err
+	}
+
+	row, err := queries.SumUsageBetween(ctx, database.SumUsageBetweenParams{FromDate: from, ToDate: to})
+	if err != nil {
+		return DailyUsage{}, err
+	}
+	return DailyUsage{SpentMicros: row.SpentMicros, ReservedMicros: row.ReservedMicros}, nil
+}
+
+func hourlyUsage(ctx context.Context, queries *database.Queries, since time.Time) ([]HourlyUsage, error) {
+	rows, err := queries.ListHourlyUsage(ctx, pgtype.Timestamptz{Time: since, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	hours := make([]HourlyUsage, len(rows))
+	for i, row := range rows {
+		hours[i] = HourlyUsage{Hour: row.UsageHour.Time, SpentMicros: row.EstimatedSpendMicros, ReservedMicros: row.ReservedSpendMicros}
+	}
+	return hours, nil
+}
+
+func parseUsageDate(usageDate string) (pgtype.Date, error) {
+	t, err := time.Parse(time.DateOnly, usageDate)
+	if err != nil {
+		return pgtype.Date{}, fmt.Errorf("invalid usage date %q: %w", usageDate, err)
+	}
+	return pgtype.Date{Time: t, Valid: true}, nil
+}
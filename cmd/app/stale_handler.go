@@ -4,18 +4,23 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgtype"
+
 	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
 )
 
+const staleErrorText = "processing did not finish within STALE_THRESHOLD"
+
 func (b *Bot) runStaleMessageHandler() {
 	b.logger.Info("Starting stale message handler...")
 
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(b.currentConfig().StaleCheckInterval)
 	defer ticker.Stop()
 
 	if err := b.handleStaleMessages(); err != nil {
 		b.logger.Error("Error handling stale messages", "error", err)
 	}
+	b.expireSpendReservations()
 
 	for {
 		select {
@@ -26,12 +31,17 @@ func (b *Bot) runStaleMessageHandler() {
 			if err := b.handleStaleMessages(); err != nil {
 				b.logger.Error("Error handling stale messages", "error", err)
 			}
+			b.expireSpendReservations()
 		}
 	}
 }
 
 func (b *Bot) handleStaleMessages() error {
-	staleMessages, err := b.queries.GetStaleProcessingMessages(b.ctx)
+	config := b.currentConfig()
+	staleMessages, err := b.queries.GetStaleProcessingMessages(b.ctx, pgtype.Timestamptz{
+		Time:  time.Now().Add(-config.StaleThreshold),
+		Valid: true,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to get stale processing messages: %w", err)
 	}
@@ -42,11 +52,24 @@ func (b *Bot) handleStaleMessages() error {
 			"retry_count", message.RetryCount)
 
 		currentRetryCount := message.RetryCount
+		b.recordAttempt(message.ID, stageGenerate, message.ProcessingStartedAt.Time, staleErrorText)
 
-		if currentRetryCount+1 >= int32(b.maxRetries) {
+		if currentRetryCount+1 >= int32(config.MaxRetries) {
+			if b.suppressFallback() {
+				if err := b.dropWithoutFallback(message.ID, staleErrorText); err != nil {
+					b.logger.Error("Failed to drop stale message", "message_id", message.ID, "error", err)
+				}
+				continue
+			}
+			if err := b.deadLetter(message.ID, stageGenerate, staleErrorText, true); err != nil {
+				b.logger.Error("Failed to dead-letter stale message, sending fallback response anyway",
+					"message_id", message.ID,
+					"error", err)
+			}
 			if err := b.queries.UpdateMessageWithLLMResponse(b.ctx, database.UpdateMessageWithLLMResponseParams{
 				ID:          message.ID,
 				LlmResponse: new(fallbackResponseText),
+				LastError:   new(staleErrorText),
 			}); err != nil {
 				b.logger.Error("Failed to update stale message with fallback response",
 					"message_id", message.ID,
@@ -68,3 +91,24 @@ func (b *Bot) handleStaleMessages() error {
 
 	return nil
 }
+
+// expireSpendReservations drops the spend reservations of LLM calls that
+// should have finished within LLM_TIMEOUT. They were orphaned by a crash or an
+// error path that did not release them and would otherwise block the budgets.
+func (b *Bot) expireSpendReservations() {
+	if b.spendingLimiter == nil || !b.spendingLimiter.IsEnabled() {
+		return
+	}
+	expired, err := b.spendingLimiter.ExpireReservations(b.ctx, time.Now(), b.currentConfig().ChatModel.Timeout)
+	if err != nil {
+		b.logger.Error("Error expiring LLM spend reservations", "error", err)
+		return
+	}
+	for _, reservation := range expired {
+		b.logger.Warn("Expired orphaned LLM spend reservation",
+			"reservation_id", reservation.ID,
+			"message_id", reservation.MessageID,
+			"usage_date", reservation.UsageDate,
+			"amount", formatMicros(reservation.Micros))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func TestHandleStaleMessages(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.staleMessages = []database.GetStaleProcessingMessagesRow{
+		{ID: 1, RetryCount: 0},
+		{ID: 2, RetryCount: 2},
+	}
+
+	if err := bot.handleStaleMessages(); err != nil {
+		t.Fatalf("handleStaleMessages() error = %v", err)
+	}
+
+	if len(bot.queries.resetStale) != 1 || bot.queries.resetStale[0] != 1 {
+		t.Fatalf("reset = %v; want [1]", bot.queries.resetStale)
+	}
+	if len(bot.queries.llmResponses) != 1 || bot.queries.llmResponses[0].ID != 2 || *bot.queries.llmResponses[0].LlmResponse != fallbackResponseText {
+		t.Fatalf("fallback responses = %+v", bot.queries.llmResponses)
+	}
+}
+
+func TestExpireSpendReservations(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.ChatModel.Timeout = time.Minute
+	bot.config.Store(config)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+
+	orphaned, _, _, err := bot.spendingLimiter.Reserve(context.Background(), time.Now(), 7, "test-model", "hello", 100)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	open, _, _, err := bot.spendingLimiter.Reserve(context.Background(), time.Now(), 8, "test-model", "hello", 100)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	expired := store.reservations[orphaned.ID]
+	expired.createdAt = time.Now().Add(-2 * time.Minute)
+	store.reservations[orphaned.ID] = expired
+
+	bot.expireSpendReservations()
+
+	if _, ok := store.reservations[orphaned.ID]; ok {
+		t.Fatal("orphaned reservation was not expired")
+	}
+	if _, ok := store.reservations[open.ID]; !ok {
+		t.Fatal("open reservation was expired")
+	}
+	if usage := store.usage[usageDate(time.Now(), time.UTC)]; usage.ReservedMicros != open.Micros {
+		t.Fatalf("reserved micros = %d; want %d", usage.ReservedMicros, open.Micros)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type BotStatus struct {
+	CircuitBreaker   CircuitSnapshot    `json:"circuit_breaker"`
+	BlueskyRateLimit *BlueskyRateStatus `json:"bluesky_rate_limit,omitempty"`
+	Tokenizers       []TokenizerStatus  `json:"tokenizers,omitempty"`
+}
+
+// rateLimitReporter is implemented by Bluesky clients that pace their calls.
+type rateLimitReporter interface {
+	RateLimitStatus() BlueskyRateStatus
+}
+
+func (b *Bot) Status() BotStatus {
+	status := BotStatus{
+		CircuitBreaker: b.circuitBreaker.Snapshot(),
+	}
+	if reporter, ok := b.bluesky.(rateLimitReporter); ok {
+		rateStatus := reporter.RateLimitStatus()
+		status.BlueskyRateLimit = &rateStatus
+	}
+	if b.spendingLimiter != nil {
+		status.Tokenizers = b.spendingLimiter.TokenizerStatus()
+	}
+	return status
+}
+
+func (b *Bot) statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(b.Status()); err != nil {
+			b.logger.Error("Failed to write status response", "error", err)
+		}
+	})
+	mux.HandleFunc("GET /replies/{token}", func(w http.ResponseWriter, r *http.Request) {
+		page, err := b.queries.GetFullTextPage(r.Context(), r.PathValue("token"))
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			b.logger.Error("Failed to load full-text page", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, page.Text)
+	})
+	return mux
+}
+
+// runStatusServer serves the bot status as JSON on STATUS_LISTEN_ADDR until
+// the bot is stopped.
+func (b *Bot) runStatusServer(addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           b.statusHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-b.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			b.logger.Error("Failed to shut down status server", "error", err)
+		}
+	}()
+
+	b.logger.Info("Starting status server...", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		b.logger.Error("Status server failed", "error", err)
+	}
+}
@@ -1,124 +1,247 @@
 package main
 
 import (
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/rivo/uniseg"
 )
 
+type MarkerStyle string
+
+const (
+	// MarkerClassic appends " (1/n)" to the first part and starts every other
+	// part with "...(i/n) ".
+	MarkerClassic MarkerStyle = "classic"
+	// MarkerSuffix appends " (i/n)" to every part.
+	MarkerSuffix MarkerStyle = "suffix"
+	// MarkerThread appends " 🧵i/n" to every part.
+	MarkerThread MarkerStyle = "thread"
+	MarkerNone   MarkerStyle = "none"
+)
+
+var markerStyles = []string{string(MarkerClassic), string(MarkerSuffix), string(MarkerThread), string(MarkerNone)}
+
+func (s MarkerStyle) decorate(chunk string, part, total int) string {
+	counter := strconv.Itoa(part) + "/" + strconv.Itoa(total)
+	switch s {
+	case MarkerNone:
+		return chunk
+	case MarkerSuffix:
+		return chunk + " (" + counter + ")"
+	case MarkerThread:
+		return chunk + " 🧵" + counter
+	default:
+		if part == 1 {
+			return chunk + " (" + counter + ")"
+		}
+		return "...(" + counter + ") " + chunk
+	}
+}
+
+func (s MarkerStyle) width(part, total int) int {
+	return countGraphemes(s.decorate("", part, total))
+}
+
+// Break priorities, from the least to the most preferred place to end a part.
+const (
+	breakWord = iota + 1
+	breakClause
+	breakSentence
+	breakParagraph
+)
+
+// minimumFill is the share of a part that must be used before a break of the
+// given priority is preferred over a later break of lower priority.
+var minimumFill = map[int]float64{
+	breakParagraph: 0.5,
+	breakSentence:  0.5,
+	breakClause:    0.6,
+}
+
+// protectedPattern matches spans that contain whitespace but must stay in one
+// part: fenced code blocks, inline code and numbers with space separated digit
+// groups. URLs, numbers and emoji contain no whitespace and are never split
+// unless a single one of them is longer than a whole part.
+var protectedPattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`|\\d{1,3}(?: \\d{3})+\\b")
+
 func countGraphemes(text string) int {
 	return uniseg.GraphemeClusterCount(text)
 }
 
-func splitTextIntoChunks(text string, maxGraphemes int) []string {
-	totalGraphemes := countGraphemes(text)
-
-	if totalGraphemes <= maxGraphemes {
+// splitTextIntoChunks splits text into parts of at most maxGraphemes graphemes
+// including the continuation marker. The marker width is computed from the
+// actual number of parts.
+func splitTextIntoChunks(text string, maxGraphemes int, style MarkerStyle) []string {
+	text = strings.TrimSpace(text)
+	if countGraphemes(text) <= maxGraphemes {
 		return []string{text}
 	}
+	return splitWithFinalPart(text, "", maxGraphemes, style)
+}
 
-	var chunks []string
-	remainingText := text
-	partNumber := 1
+// splitWithFinalPart splits text like splitTextIntoChunks and, unless final is
+// empty, appends final as a part of its own that is counted in the markers.
+func splitWithFinalPart(text, final string, maxGraphemes int, style MarkerStyle) []string {
+	extra := 0
+	if final != "" {
+		extra = 1
+	}
 
-	for len(remainingText) > 0 {
-		var reservedSpace int
-		if partNumber == 1 {
-			reservedSpace = 12
-		} else {
-			reservedSpace = 14
+	// More parts can only mean wider markers and therefore more parts, so
+	// starting at one and repeating until the count is stable converges.
+	total := 1 + extra
+	var parts []string
+	for range 10 {
+		parts, _ = splitParts(strings.TrimSpace(text), maxGraphemes, style, total, 0)
+		if len(parts)+extra == total {
+			break
 		}
+		total = len(parts) + extra
+	}
+	if final != "" {
+		parts = append(parts, final)
+	}
 
-		effectiveMax := max(maxGraphemes-reservedSpace, 50)
-		chunk := extractChunk(remainingText, effectiveMax)
-
-		if chunk == "" {
-			chunk = extractChunkForced(remainingText, effectiveMax)
-		}
+	marked := make([]string, len(parts))
+	for i, part := range parts {
+		marked[i] = style.decorate(part, i+1, len(parts))
+	}
+	return marked
+}
 
-		chunks = append(chunks, strings.TrimSpace(chunk))
-		remainingText = strings.TrimSpace(remainingText[len(chunk):])
-		partNumber++
+// truncateToPosts cuts text after the part that splitTextIntoChunks would put
+// into the first maxPosts posts. It reports whether anything was cut.
+func truncateToPosts(text string, maxGraphemes, maxPosts int, style MarkerStyle) (string, bool) {
+	text = strings.TrimSpace(text)
+	if maxPosts <= 0 || countGraphemes(text) <= maxGraphemes {
+		return text, false
 	}
 
-	return addContinuationMarkers(chunks)
+	_, rest := splitParts(text, maxGraphemes, style, maxPosts, maxPosts)
+	if rest == "" {
+		return text, false
+	}
+	return strings.TrimSpace(text[:len(text)-len(rest)]), true
 }
 
-func extractChunk(text string, maxGraphemes int) string {
-	if countGraphemes(text) <= maxGraphemes {
-		return text
+// splitParts splits text into unmarked parts, leaving room for the markers of
+// a thread with total parts. With limit > 0 it stops after limit parts and
+// returns the text that is left.
+func splitParts(text string, maxGraphemes int, style MarkerStyle, total, limit int) ([]string, string) {
+	var parts []string
+	remaining := text
+	for part := 1; remaining != "" && (limit <= 0 || part <= limit); part++ {
+		budget := max(maxGraphemes-style.width(part, total), 10)
+		chunk, rest := takeChunk(remaining, budget)
+		parts = append(parts, chunk)
+		remaining = rest
 	}
+	return parts, remaining
+}
 
-	gr := uniseg.NewGraphemes(text)
-	var builder strings.Builder
-	graphemeCount := 0
-	lastBreakPoint := 0
-	currentPos := 0
+type breakCandidate struct {
+	end       int // byte offset where the part ends
+	next      int // byte offset where the next part starts
+	graphemes int // graphemes before end
+	priority  int
+}
 
-	for gr.Next() {
-		graphemeCount++
-		runes := gr.Runes()
+// takeChunk returns the longest good first part of text with at most budget
+// graphemes and the rest of the text. Parts end at whitespace, preferring
+// paragraph, then sentence, then clause boundaries.
+func takeChunk(text string, budget int) (string, string) {
+	if countGraphemes(text) <= budget {
+		return strings.TrimSpace(text), ""
+	}
 
-		if graphemeCount <= maxGraphemes {
-			for _, r := range runes {
-				builder.WriteRune(r)
-			}
+	protected := protectedPattern.FindAllStringIndex(text, -1)
+	var candidates []breakCandidate
+	forcedEnd := len(text)
 
-			if len(runes) > 0 && (unicode.IsSpace(runes[0]) || unicode.IsPunct(runes[0])) {
-				lastBreakPoint = builder.Len()
-				currentPos = graphemeCount
+	gr := uniseg.NewGraphemes(text)
+	graphemes := 0
+	spaceStart, spaceGraphemes := -1, 0
+	for gr.Next() {
+		start, end := gr.Positions()
+		if graphemes == budget {
+			forcedEnd = start
+		}
+		if r, _ := utf8.DecodeRuneInString(text[start:end]); unicode.IsSpace(r) {
+			if spaceStart < 0 {
+				spaceStart, spaceGraphemes = start, graphemes
 			}
 		} else {
-			break
+			if spaceStart > 0 && !insideSpan(protected, spaceStart) {
+				candidates = append(candidates, breakCandidate{
+					end:       spaceStart,
+					next:      start,
+					graphemes: spaceGraphemes,
+					priority:  breakPriority(text, spaceStart, start),
+				})
+			}
+			spaceStart = -1
+			if graphemes >= budget {
+				break
+			}
 		}
+		graphemes++
 	}
 
-	result := builder.String()
-
-	if lastBreakPoint > 0 && float64(currentPos) > float64(maxGraphemes)*0.7 {
-		return result[:lastBreakPoint]
+	if candidate, ok := bestBreak(candidates, budget); ok {
+		return strings.TrimSpace(text[:candidate.end]), text[candidate.next:]
 	}
-
-	return result
+	return strings.TrimSpace(text[:forcedEnd]), strings.TrimLeftFunc(text[forcedEnd:], unicode.IsSpace)
 }
 
-func extractChunkForced(text string, maxGraphemes int) string {
-	gr := uniseg.NewGraphemes(text)
-	var builder strings.Builder
-	graphemeCount := 0
-
-	for gr.Next() {
-		if graphemeCount >= maxGraphemes {
-			break
-		}
-		runes := gr.Runes()
-		for _, r := range runes {
-			builder.WriteRune(r)
+func bestBreak(candidates []breakCandidate, budget int) (breakCandidate, bool) {
+	for _, priority := range []int{breakParagraph, breakSentence, breakClause} {
+		for i := len(candidates) - 1; i >= 0; i-- {
+			candidate := candidates[i]
+			if candidate.priority >= priority && float64(candidate.graphemes) >= float64(budget)*minimumFill[priority] {
+				return candidate, true
+			}
 		}
-		graphemeCount++
 	}
-
-	return builder.String()
+	if len(candidates) > 0 {
+		return candidates[len(candidates)-1], true
+	}
+	return breakCandidate{}, false
 }
 
-func addContinuationMarkers(chunks []string) []string {
-	if len(chunks) <= 1 {
-		return chunks
+// breakPriority classifies the whitespace text[spaceStart:next] by what comes
+// before it.
+func breakPriority(text string, spaceStart, next int) int {
+	space := text[spaceStart:next]
+	if strings.Count(space, "\n") >= 2 {
+		return breakParagraph
+	}
+	if strings.Contains(space, "\n") {
+		return breakSentence
 	}
 
-	total := len(chunks)
-	marked := make([]string, len(chunks))
+	before := strings.TrimRight(text[:spaceStart], `"')]”’»`)
+	if before == "" {
+		return breakWord
+	}
+	last, _ := utf8.DecodeLastRuneInString(before)
+	switch last {
+	case '.', '!', '?', '…', '。', '！', '？':
+		return breakSentence
+	case ',', ';', ':', '—', '–':
+		return breakClause
+	}
+	return breakWord
+}
 
-	for i, chunk := range chunks {
-		partNum := i + 1
-		if partNum == 1 {
-			marked[i] = strings.TrimSpace(chunk) + " (1/" + strconv.Itoa(total) + ")"
-			continue
+func insideSpan(spans [][]int, offset int) bool {
+	for _, span := range spans {
+		if offset > span[0] && offset < span[1] {
+			return true
 		}
-		marked[i] = "...(" + strconv.Itoa(partNum) + "/" + strconv.Itoa(total) + ") " + strings.TrimSpace(chunk)
 	}
-
-	return marked
+	return false
 }
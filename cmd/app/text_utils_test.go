@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"math/rand/v2"
 	"strings"
 	"testing"
+	"testing/quick"
 )
 
 func TestCountGraphemes(t *testing.T) {
@@ -58,7 +61,7 @@ func TestSplitTextIntoChunks(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			chunks := splitTextIntoChunks(tt.text, tt.maxGraphemes)
+			chunks := splitTextIntoChunks(tt.text, tt.maxGraphemes, MarkerClassic)
 
 			if len(chunks) < tt.minChunks || len(chunks) > tt.maxChunks {
 				t.Errorf("splitTextIntoChunks returned %d chunks; want between %d and %d",
@@ -86,7 +89,7 @@ Emojis like ` + "\U0001f468\u200d\U0001f469\u200d\U0001f467\u200d\U0001f466" + `
 be counted as a single grapheme. This ensures we don't split in the middle of an emoji or other
 multi-codepoint grapheme cluster.`
 
-	chunks := splitTextIntoChunks(longText, 300)
+	chunks := splitTextIntoChunks(longText, 300, MarkerClassic)
 
 	t.Logf("Split into %d chunks", len(chunks))
 	for i, chunk := range chunks {
@@ -101,3 +104,171 @@ multi-codepoint grapheme cluster.`
 		t.Error("Expected long text to be split into multiple chunks")
 	}
 }
+
+func TestSplitTextPrefersParagraphsThenSentencesThenClauses(t *testing.T) {
+	paragraph := strings.Repeat("Words in the first paragraph. ", 2) + "End of it.\n\n"
+	sentence := "Another sentence that goes on, and on, and on; with many clauses. "
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "paragraph",
+			text: paragraph + "Short one. " + strings.Repeat(sentence, 4),
+			want: strings.TrimSpace(paragraph),
+		},
+		{
+			name: "sentence",
+			text: strings.Repeat(sentence, 4),
+			want: strings.TrimSpace(sentence),
+		},
+		{
+			name: "clause",
+			text: strings.Repeat("going ", 11) + "on, " + strings.Repeat("and more ", 20) + "without a stop",
+			want: strings.Repeat("going ", 11) + "on,",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitTextIntoChunks(tt.text, 100, MarkerNone)
+			if len(chunks) < 2 {
+				t.Fatalf("got %d chunks; want at least 2", len(chunks))
+			}
+			if chunks[0] != tt.want {
+				t.Fatalf("first chunk = %q; want %q", chunks[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTextMarkerWidthFollowsPartCount(t *testing.T) {
+	text := strings.Repeat("word ", 600)
+	for _, style := range []MarkerStyle{MarkerClassic, MarkerSuffix, MarkerThread} {
+		chunks := splitTextIntoChunks(text, 60, style)
+		if len(chunks) < 10 {
+			t.Fatalf("%s: got %d chunks; want at least 10", style, len(chunks))
+		}
+		total := len(chunks)
+		for i, chunk := range chunks {
+			if graphemes := countGraphemes(chunk); graphemes > 60 {
+				t.Fatalf("%s: chunk %d has %d graphemes", style, i+1, graphemes)
+			}
+			if !strings.Contains(chunk, fmt.Sprintf("%d/%d", i+1, total)) {
+				t.Fatalf("%s: chunk %d = %q; want marker %d/%d", style, i+1, chunk, i+1, total)
+			}
+		}
+	}
+
+	if chunks := splitTextIntoChunks(text, 60, MarkerThread); !strings.HasSuffix(chunks[0], " 🧵1/"+fmt.Sprint(len(chunks))) {
+		t.Fatalf("thread marker = %q", chunks[0])
+	}
+	for _, chunk := range splitTextIntoChunks(text, 60, MarkerNone) {
+		if strings.Contains(chunk, "/") {
+			t.Fatalf("chunk %q has a marker; want none", chunk)
+		}
+	}
+}
+
+// unbreakableTokens must never be split across parts.
+var unbreakableTokens = []string{
+	"https://example.com/a/very/long/path?with=query&and=more#fragment",
+	"`go test ./... -run TestSplit`",
+	"3.14159",
+	"1 000 000",
+	"v1.31.1",
+	"\U0001f468\u200d\U0001f469\u200d\U0001f467\u200d\U0001f466",
+	"\U0001f1e9\U0001f1ea",
+	"\U0001f44d\U0001f3fd",
+}
+
+var fillerWords = []string{"the", "bot", "replies", "quickly", "Bluesky", "threads", "are", "split", "carefully"}
+
+func randomReply(r *rand.Rand) string {
+	var builder strings.Builder
+	for range 20 + r.IntN(200) {
+		if r.IntN(8) == 0 {
+			builder.WriteString(unbreakableTokens[r.IntN(len(unbreakableTokens))])
+		} else {
+			builder.WriteString(fillerWords[r.IntN(len(fillerWords))])
+		}
+		switch r.IntN(12) {
+		case 0:
+			builder.WriteString(". ")
+		case 1:
+			builder.WriteString(", ")
+		case 2:
+			builder.WriteString(".\n\n")
+		default:
+			builder.WriteString(" ")
+		}
+	}
+	return builder.String()
+}
+
+func stripMarker(chunk string, style MarkerStyle, part, total int) string {
+	marker := style.decorate("\x00", part, total)
+	prefix, suffix, _ := strings.Cut(marker, "\x00")
+	return strings.TrimSuffix(strings.TrimPrefix(chunk, prefix), suffix)
+}
+
+func TestSplitTextProperties(t *testing.T) {
+	styles := []MarkerStyle{MarkerClassic, MarkerSuffix, MarkerThread, MarkerNone}
+
+	property := func(seed uint64) bool {
+		r := rand.New(rand.NewPCG(seed, seed>>1))
+		text := randomReply(r)
+		maxGraphemes := 90 + r.IntN(220)
+		style := styles[r.IntN(len(styles))]
+
+		chunks := splitTextIntoChunks(text, maxGraphemes, style)
+		var rejoined []string
+		for i, chunk := range chunks {
+			if countGraphemes(chunk) > maxGraphemes {
+				t.Logf("seed %d: chunk %d has %d graphemes; max %d", seed, i+1, countGraphemes(chunk), maxGraphemes)
+				return false
+			}
+			if len(chunks) > 1 {
+				chunk = stripMarker(chunk, style, i+1, len(chunks))
+			}
+			for _, token := range unbreakableTokens {
+				if strings.Count(chunk, token) != strings.Count(chunk, token[:len(token)/2]) {
+					t.Logf("seed %d: chunk %d splits %q: %q", seed, i+1, token, chunk)
+					return false
+				}
+			}
+			rejoined = append(rejoined, chunk)
+		}
+
+		if strings.Join(strings.Fields(strings.Join(rejoined, " ")), " ") != strings.Join(strings.Fields(text), " ") {
+			t.Logf("seed %d: chunks do not add up to the original text", seed)
+			return false
+		}
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 300}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncateToPostsMatchesSplit(t *testing.T) {
+	property := func(seed uint64) bool {
+		r := rand.New(rand.NewPCG(seed, seed>>1))
+		text := randomReply(r)
+		maxPosts := 1 + r.IntN(3)
+
+		truncated, cut := truncateToPosts(text, threadChunkGraphemes, maxPosts, MarkerClassic)
+		chunks := splitTextIntoChunks(truncated, threadChunkGraphemes, MarkerClassic)
+		if len(chunks) > maxPosts {
+			t.Logf("seed %d: truncated text needs %d posts; max %d", seed, len(chunks), maxPosts)
+			return false
+		}
+		return cut == (len(strings.TrimSpace(truncated)) < len(strings.TrimSpace(text)))
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatal(err)
+	}
+}
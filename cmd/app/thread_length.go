@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/schema"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	lengthStrategyTruncate  = "truncate"
+	lengthStrategySummarize = "summarize"
+	lengthStrategyLink      = "link"
+)
+
+const fullTextLinkLabel = "Full answer: "
+
+// applyThreadLength shortens a reply that would need more than
+// MAX_THREAD_POSTS posts with THREAD_LENGTH_STRATEGY and returns the strategy
+// that was used, or nil when the reply already fits. Summarizing and linking
+// fall back to truncation when they fail.
+func (b *Bot) applyThreadLength(messageID int64, messageURI, text string, opts []model.Option) (string, *string) {
+	config := b.currentConfig()
+	maxPosts := config.MaxThreadPosts
+	style := config.ThreadMarkerStyle
+	if maxPosts <= 0 || threadPostCount(text, style) <= maxPosts {
+		return text, nil
+	}
+
+	switch config.ThreadLengthStrategy {
+	case lengthStrategySummarize:
+		summary, err := b.summarizeReply(messageID, text, maxPosts, opts)
+		if err == nil {
+			if threadPostCount(summary, style) > maxPosts {
+				summary = truncateReply(summary, maxPosts, style)
+			}
+			return summary, new(lengthStrategySummarize)
+		}
+		b.logger.Warn("Failed to summarize long reply, truncating instead", "error", err)
+	case lengthStrategyLink:
+		linked, err := b.linkFullText(messageURI, text, config.FullTextBaseURL)
+		if err == nil {
+			return linked, new(lengthStrategyLink)
+		}
+		b.logger.Warn("Failed to store full-text page, truncating instead", "error", err)
+	}
+
+	return truncateReply(text, maxPosts, style), new(lengthStrategyTruncate)
+}
+
+// summarizeReply asks the model to compress the reply to the queue item
+// messageID.
+func (b *Bot) summarizeReply(messageID int64, text string, maxPosts int, opts []model.Option) (string, error) {
+	maxGraphemes := singlePostGraphemes
+	if maxPosts > 1 {
+		maxGraphemes = maxPosts * (threadChunkGraphemes - 20)
+	}
+	prompt := fmt.Sprintf("Shorten the following reply so that it is at most %d characters long. "+
+		"Keep the language, the tone and the most important information. "+
+		"Respond with the shortened reply only.\n\n%s", maxGraphemes, text)
+
+	messages := []*schema.Message{{Role: schema.User, Content: prompt}}
+	resp, _, err := b.llmRoundTrip(messageID, b.optionsModelName(opts), messages, func() (*schema.Message, bool, error) {
+		resp, err := b.chatModel.Generate(b.ctx, messages, opts...)
+		return resp, false, err
+	})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(extractText(resp))
+	if summary == "" {
+		return "", errors.New("received empty summary from model")
+	}
+	return summary, nil
+}
+
+// linkFullText stores the complete reply as a page served by the HTTP server
+// and returns a single post with the start of the reply and a link to it.
+func (b *Bot) linkFullText(messageURI, text, baseURL string) (string, error) {
+	if baseURL == "" {
+		return "", errors.New("FULL_TEXT_BASE_URL is not set")
+	}
+
+	token := rand.Text()
+	if err := b.queries.InsertFullTextPage(b.ctx, database.InsertFullTextPageParams{
+		Token:      token,
+		MessageUri: messageURI,
+		Text:       text,
+	}); err != nil {
+		return "", fmt.Errorf("failed to insert full-text page: %w", err)
+	}
+
+	link := "\n\n" + fullTextLinkLabel + strings.TrimRight(baseURL, "/") + "/" + token
+	return shortenToFit(text, link, 1, MarkerNone), nil
+}
+
+// truncateReply cuts text at a sentence boundary, or at a word boundary when
+// no sentence ends in the last part, and marks the cut with an ellipsis.
+func truncateReply(text string, maxPosts int, style MarkerStyle) string {
+	return shortenToFit(text, "", maxPosts, style)
+}
+
+func shortenToFit(text, suffix string, maxPosts int, style MarkerStyle) string {
+	candidate, _ := truncateToPosts(text, threadChunkGraphemes, maxPosts, style)
+	candidate = cutAtSentence(candidate)
+	for candidate != "" {
+		result := withEllipsis(candidate) + suffix
+		if threadPostCount(result, style) <= maxPosts {
+			return result
+		}
+		candidate = dropLastWord(candidate)
+	}
+	return strings.TrimSpace(suffix)
+}
+
+func threadPostCount(text string, style MarkerStyle) int {
+	posts, _ := threadPostRoom(text, style)
+	return posts
+}
+
+// threadPostRoom returns the number of posts text needs and how many more
+// graphemes can be appended before it may need another one. Appended text
+// leaves the parts before the last one as they are, so only the room left in
+// the last part matters.
+func threadPostRoom(text string, style MarkerStyle) (int, int) {
+	graphemes := countGraphemes(text)
+	if graphemes <= singlePostGraphemes {
+		return 1, singlePostGraphemes - graphemes
+	}
+	chunks := splitTextIntoChunks(text, threadChunkGraphemes, style)
+	return len(chunks), max(threadChunkGraphemes-countGraphemes(chunks[len(chunks)-1]), 0)
+}
+
+// cutAtSentence returns text up to its last sentence end when that keeps at
+// least half of it, and otherwise drops the last, possibly partial, word.
+func cutAtSentence(text string) string {
+	text = strings.TrimSpace(text)
+	for i := len(text) - 1; i >= len(text)/2; i-- {
+		if isSentenceEnd(text[i]) && (i == len(text)-1 || text[i+1] == ' ' || text[i+1] == '\n') {
+			return text[:i+1]
+		}
+	}
+	return dropLastWord(text)
+}
+
+func dropLastWord(text string) string {
+	text = strings.TrimRightFunc(text, unicode.IsSpace)
+	i := strings.LastIndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimRight(text[:i], " \n\t,;:-")
+}
+
+func withEllipsis(text string) string {
+	if isSentenceEnd(text[len(text)-1]) {
+		return text + " …"
+	}
+	return text + "…"
+}
+
+func isSentenceEnd(c byte) bool {
+	return c == '.' || c == '!' || c == '?'
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// vocabFS holds the BPE vocabularies in the tiktoken format, one
+// <encoding>.tiktoken file per encoding. `task vocab:download` fetches them.
+//
+//go:embed vocab
+var vocabFS embed.FS
+
+// fallbackBytesPerToken approximates the tokens of models without a known
+// tokenizer. English text has about four bytes per token; other scripts have
+// fewer, which the calibration of TokenEstimator corrects.
+const fallbackBytesPerToken = 4
+
+const (
+	encodingCl100k    = "cl100k_base"
+	encodingO200k     = "o200k_base"
+	fallbackTokenizer = "bytes/4"
+)
+
+// Calibration bounds and the weight of a new sample in the moving average of
+// the ratio between reported and counted prompt tokens.
+const (
+	minTokenRatio    = 0.25
+	maxTokenRatio    = 4
+	tokenRatioWeight = 0.2
+)
+
+// Tokenizer counts the tokens a model sees for a text.
+type Tokenizer interface {
+	Name() string
+	CountTokens(text string) int
+}
+
+// bpeTokenizer implements the byte pair encodings of OpenAI models. The text is
+// split into pieces like the regular expression of the encoding does, and every
+// piece is merged into tokens by rank.
+type bpeTokenizer struct {
+	name  string
+	ranks map[string]int
+	piece func(text []rune, start int) int
+}
+
+func (t *bpeTokenizer) Name() string {
+	return t.name
+}
+
+func (t *bpeTokenizer) CountTokens(text string) int {
+	runes := []rune(text)
+	tokens := 0
+	for start := 0; start < len(runes); {
+		end := t.piece(runes, start)
+		tokens += t.countPiece([]byte(string(runes[start:end])))
+		start = end
+	}
+	return tokens
+}
+
+func (t *bpeTokenizer) countPiece(piece []byte) int {
+	if _, ok := t.ranks[string(piece)]; ok {
+		return 1
+	}
+	return len(bytePairMerge(t.ranks, piece)) - 1
+}
+
+// bytePairMerge repeatedly merges the adjacent parts of piece whose
+// concatenation has the lowest rank and returns the part boundaries.
+func bytePairMerge(ranks map[string]int, piece []byte) []int {
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		minRank, minIndex := math.MaxInt, -1
+		for i := 0; i < len(parts)-2; i++ {
+			if rank, ok := ranks[string(piece[parts[i]:parts[i+2]])]; ok && rank < minRank {
+				minRank, minIndex = rank, i
+			}
+		}
+		if minIndex < 0 {
+			break
+		}
+		parts = slices.Delete(parts, minIndex+1, minIndex+2)
+	}
+	return parts
+}
+
+// byteTokenizer estimates the tokens of models without a known tokenizer.
+type byteTokenizer struct{}
+
+func (byteTokenizer) Name() string {
+	return fallbackTokenizer
+}
+
+func (byteTokenizer) CountTokens(text string) int {
+	return estimateTokens(text)
+}
+
+var (
+	cl100kTokenizer = sync.OnceValues(func() (*bpeTokenizer, error) {
+		return loadBPETokenizer(vocabFS, encodingCl100k, cl100kPiece)
+	})
+	o200kTokenizer = sync.OnceValues(func() (*bpeTokenizer, error) {
+		return loadBPETokenizer(vocabFS, encodingO200k, o200kPiece)
+	})
+)
+
+// checkVocabularies loads the embedded vocabulary of every model that has a
+// BPE encoding. The bot refuses to start without it, because such a model
+// would silently fall back to the byte estimate. Other models need none.
+func checkVocabularies(models ...string) error {
+	for _, model := range models {
+		load := tokenizerLoader(model)
+		if load == nil {
+			continue
+		}
+		if _, err := load(); err != nil {
+			return fmt.Errorf("%s: %w; run `task vocab:download` and rebuild", model, err)
+		}
+	}
+	return nil
+}
+
+// tokenizerForModel returns the tokenizer of model. Models with an unknown
+// encoding get the byte estimate.
+func tokenizerForModel(model string) Tokenizer {
+	load := tokenizerLoader(model)
+	if load == nil {
+		return byteTokenizer{}
+	}
+	tokenizer, err := load()
+	if err != nil {
+		return byteTokenizer{}
+	}
+	return tokenizer
+}
+
+// tokenizerLoader returns the loader of the BPE tokenizer of model, or nil for
+// models without a known encoding.
+func tokenizerLoader(model string) func() (*bpeTokenizer, error) {
+	switch encodingForModel(model) {
+	case encodingO200k:
+		return o200kTokenizer
+	case encodingCl100k:
+		return cl100kTokenizer
+	default:
+		return nil
+	}
+}
+
+// encodingForModel returns the tiktoken encoding of an OpenAI model, or "" for
+// other models. A provider prefix such as "openai/" is ignored.
+func encodingForModel(model string) string {
+	name := strings.ToLower(strings.TrimSpace(model))
+	if _, after, ok := strings.Cut(name, "/"); ok {
+		name = after
+	}
+	for _, prefix := range []string{"gpt-5", "gpt-4.1", "gpt-4.5", "gpt-4o", "chatgpt-4o", "gpt-oss", "o1", "o3", "o4"} {
+		if strings.HasPrefix(name, prefix) {
+			return encodingO200k
+		}
+	}
+	for _, prefix := range []string{"gpt-4", "gpt-3.5", "text-embedding-3", "text-embedding-ada-002"} {
+		if strings.HasPrefix(name, prefix) {
+			return encodingCl100k
+		}
+	}
+	return ""
+}
+
+// loadBPETokenizer reads the vocabulary vocab/<encoding>.tiktoken of vocab.
+func loadBPETokenizer(vocab fs.FS, encoding string, piece func([]rune, int) int) (*bpeTokenizer, error) {
+	data, err := fs.ReadFile(vocab, "vocab/"+encoding+".tiktoken")
+	if err != nil {
+		return nil, fmt.Errorf("vocabulary %s is not embedded: %w", encoding, err)
+	}
+	ranks, err := parseTiktokenRanks(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vocabulary %s: %w", encoding, err)
+	}
+	return &bpeTokenizer{name: encoding, ranks: ranks, piece: piece}, nil
+}
+
+// parseTiktokenRanks reads a tiktoken vocabulary: one base64 encoded token and
+// its rank per line.
+func parseTiktokenRanks(r io.Reader) (map[string]int, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		encoded, rankText, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token %q: %w", encoded, err)
+		}
+		rank, err := strconv.Atoi(rankText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank %q: %w", rankText, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("vocabulary is empty")
+	}
+	return ranks, nil
+}
+
+// cl100kPiece returns the end of the piece starting at start, following
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func cl100kPiece(text []rune, start int) int {
+	if n := contractionLength(text, start); n > 0 {
+		return start + n
+	}
+	if isLetter(text[start]) {
+		return runEnd(text, start, isLetter)
+	}
+	if isWordPrefix(text[start]) && start+1 < len(text) && isLetter(text[start+1]) {
+		return runEnd(text, start+1, isLetter)
+	}
+	if end := numberEnd(text, start); end > start {
+		return end
+	}
+	if end := punctuationEnd(text, start, isNewline); end > start {
+		return end
+	}
+	return whitespaceEnd(text, start)
+}
+
+// o200kPiece returns the end of the piece starting at start, following
+//
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func o200kPiece(text []rune, start int) int {
+	words := []int{start}
+	if isWordPrefix(text[start]) {
+		words = []int{start + 1, start}
+	}
+	for _, word := range []func([]rune, int) int{lowerWordEnd, upperWordEnd} {
+		for _, wordStart := range words {
+			if end := word(text, wordStart); end > wordStart {
+				return end + contractionLength(text, end)
+			}
+		}
+	}
+	if end := numberEnd(text, start); end > start {
+		return end
+	}
+	if end := punctuationEnd(text, start, func(r rune) bool { return isNewline(r) || r == '/' }); end > start {
+		return end
+	}
+	return whitespaceEnd(text, start)
+}
+
+// lowerWordEnd matches [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+
+// and returns start when it does not match.
+func lowerWordEnd(text []rune, start int) int {
+	upper := runEnd(text, start, isUpperCase)
+	if lower := runEnd(text, upper, isLowerCase); lower > upper {
+		return lower
+	}
+	// The upper case run gives back its last character that also counts as
+	// lower case.
+	for i := upper - 1; i >= start; i-- {
+		if isLowerCase(text[i]) {
+			return i + 1
+		}
+	}
+	return start
+}
+
+// upperWordEnd matches [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*
+// and returns start when it does not match.
+func upperWordEnd(text []rune, start int) int {
+	upper := runEnd(text, start, isUpperCase)
+	if upper == start {
+		return start
+	}
+	return runEnd(text, upper, isLowerCase)
+}
+
+// contractionLength returns the length of the English contraction at start,
+// such as 's or 'll, or 0.
+func contractionLength(text []rune, start int) int {
+	if start >= len(text) || text[start] != '\'' || start+1 >= len(text) {
+		return 0
+	}
+	switch unicode.ToLower(text[start+1]) {
+	case 's', 't', 'm', 'd':
+		return 2
+	}
+	if start+2 < len(text) {
+		switch strings.ToLower(string(text[start+1 : start+3])) {
+		case "re", "ve", "ll":
+			return 3
+		}
+	}
+	return 0
+}
+
+// numberEnd matches \p{N}{1,3}.
+func numberEnd(text []rune, start int) int {
+	end := start
+	for end < len(text) && end-start < 3 && unicode.IsNumber(text[end]) {
+		end++
+	}
+	return end
+}
+
+// punctuationEnd matches ` ?[^\s\p{L}\p{N}]+` followed by the characters for
+// which trailing is true.
+func punctuationEnd(text []rune, start int, trailing func(rune) bool) int {
+	first := start
+	if text[first] == ' ' && first+1 < len(text) {
+		first++
+	}
+	if !isPunctuation(text[first]) {
+		return start
+	}
+	return runEnd(text, runEnd(text, first, isPunctuation), trailing)
+}
+
+// whitespaceEnd matches \s*[\r\n]+|\s+(?!\S)|\s+. A run of spaces before a
+// word leaves its last space to the word.
+func whitespaceEnd(text []rune, start int) int {
+	end := runEnd(text, start, unicode.IsSpace)
+	for i := end - 1; i >= start; i-- {
+		if isNewline(text[i]) {
+			return i + 1
+		}
+	}
+	if end == len(text) || end-start <= 1 {
+		return max(end, start+1)
+	}
+	return end - 1
+}
+
+func runEnd(text []rune, start int, match func(rune) bool) int {
+	end := start
+	for end < len(text) && match(text[end]) {
+		end++
+	}
+	return end
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r)
+}
+
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
+
+// isWordPrefix reports whether r may precede a word in the same piece.
+func isWordPrefix(r rune) bool {
+	return !isNewline(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isPunctuation(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isUpperCase(r rune) bool {
+	return unicode.IsUpper(r) || unicode.IsTitle(r) || unicode.In(r, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+func isLowerCase(r rune) bool {
+	return unicode.IsLower(r) || unicode.In(r, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// estimateTokens approximates the tokens of text without a tokenizer.
+func estimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	return max((len(text)+fallbackBytesPerToken-1)/fallbackBytesPerToken, 1)
+}
+
+type TokenizerStatus struct {
+	Model     string  `json:"model"`
+	Tokenizer string  `json:"tokenizer"`
+	Ratio     float64 `json:"ratio"`
+	Samples   int     `json:"samples"`
+}
+
+type tokenCalibration struct {
+	ratio   float64
+	samples int
+}
+
+// TokenEstimator counts prompt tokens with the tokenizer of the model and
+// scales the count by the observed ratio of the prompt tokens the provider
+// reported to the counted ones. The ratio covers what the local count cannot
+// see, such as the chat format and tool definitions, and the error of the byte
+// estimate for models without a tokenizer.
+type TokenEstimator struct {
+	mu           sync.Mutex
+	calibrations map[string]*tokenCalibration
+}
+
+func NewTokenEstimator() *TokenEstimator {
+	return &TokenEstimator{calibrations: map[string]*tokenCalibration{}}
+}
+
+// Count returns the uncalibrated token count of text.
+func (e *TokenEstimator) Count(model, text string) int {
+	return tokenizerForModel(model).CountTokens(text)
+}
+
+// Estimate returns the token count of text scaled by the ratio observed for
+// model.
+func (e *TokenEstimator) Estimate(model, text string) int {
+	return e.Calibrate(model, e.Count(model, text))
+}
+
+// Calibrate scales counted tokens by the ratio observed for model.
+func (e *TokenEstimator) Calibrate(model string, counted int) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	calibration, ok := e.calibrations[model]
+	if !ok || counted <= 0 {
+		return counted
+	}
+	return int(math.Ceil(float64(counted) * calibration.ratio))
+}
+
+// Observe records the prompt tokens the provider reported for a prompt of
+// counted tokens. The first sample sets the ratio, later ones move it by a
+// weighted average.
+func (e *TokenEstimator) Observe(model string, counted, reported int) {
+	if counted <= 0 || reported <= 0 {
+		return
+	}
+	ratio := min(max(float64(reported)/float64(counted), minTokenRatio), maxTokenRatio)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	calibration, ok := e.calibrations[model]
+	if !ok {
+		e.calibrations[model] = &tokenCalibration{ratio: ratio, samples: 1}
+		return
+	}
+	calibration.ratio += (ratio - calibration.ratio) * tokenRatioWeight
+	calibration.samples++
+}
+
+// Status returns the calibration of every model that reported usage.
+func (e *TokenEstimator) Status() []TokenizerStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make([]TokenizerStatus, 0, len(e.calibrations))
+	for model, calibration := range e.calibrations {
+		statuses = append(statuses, TokenizerStatus{
+			Model:     model,
+			Tokenizer: tokenizerForModel(model).Name(),
+			Ratio:     math.Round(calibration.ratio*1000) / 1000,
+			Samples:   calibration.samples,
+		})
+	}
+	slices.SortFunc(statuses, func(a, b TokenizerStatus) int { return strings.Compare(a.Model, b.Model) })
+	return statuses
+}
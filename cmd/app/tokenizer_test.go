@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func splitPieces(text string, piece func([]rune, int) int) []string {
+	runes := []rune(text)
+	var pieces []string
+	for start := 0; start < len(runes); {
+		end := piece(runes, start)
+		pieces = append(pieces, string(runes[start:end]))
+		start = end
+	}
+	return pieces
+}
+
+func TestCl100kPieces(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello world", []string{"Hello", " world"}},
+		{"I'm here  now", []string{"I", "'m", " here", " ", " now"}},
+		{"don't", []string{"don", "'t"}},
+		{"12345", []string{"123", "45"}},
+		{"Hi!!!\n\nok", []string{"Hi", "!!!\n\n", "ok"}},
+		{"a \n b", []string{"a", " \n", " b"}},
+		{"end  ", []string{"end", "  "}},
+		{"Grüße, 世界", []string{"Grüße", ",", " 世界"}},
+	}
+	for _, test := range tests {
+		if got := splitPieces(test.text, cl100kPiece); !slices.Equal(got, test.want) {
+			t.Fatalf("cl100k pieces of %q = %q; want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestO200kPieces(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"HelloWorld", []string{"Hello", "World"}},
+		{"ABCdef", []string{"ABCdef"}},
+		{"HELLO there", []string{"HELLO", " there"}},
+		{"don't", []string{"don't"}},
+		{"12345", []string{"123", "45"}},
+		{"x !?/\nnext", []string{"x", " !?/\n", "next"}},
+		{"a  b", []string{"a", " ", " b"}},
+	}
+	for _, test := range tests {
+		if got := splitPieces(test.text, o200kPiece); !slices.Equal(got, test.want) {
+			t.Fatalf("o200k pieces of %q = %q; want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestBPETokenizerMergesByRank(t *testing.T) {
+	var vocab strings.Builder
+	for rank, token := range []string{"h", "e", "l", "o", " ", "he", "ll", "hell", " w"} {
+		fmt.Fprintf(&vocab, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	ranks, err := parseTiktokenRanks(strings.NewReader(vocab.String()))
+	if err != nil {
+		t.Fatalf("parseTiktokenRanks() error = %v", err)
+	}
+	tokenizer := &bpeTokenizer{name: "test", ranks: ranks, piece: cl100kPiece}
+
+	// "hello" merges to "he", "ll" and then "hell", leaving "o"; " world"
+	// merges only " w" and keeps the unknown bytes.
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hell", 1},
+		{"hello", 2},
+		{"hello world", 2 + 5},
+	}
+	for _, test := range tests {
+		if got := tokenizer.CountTokens(test.text); got != test.want {
+			t.Fatalf("CountTokens(%q) = %d; want %d", test.text, got, test.want)
+		}
+	}
+}
+
+func TestLoadBPETokenizerCountsWithVocabularyFile(t *testing.T) {
+	var vocab strings.Builder
+	for rank, token := range []string{" ", "!", "a", "e", "g", "i", "k", "n", "o", "r", "s", "t",
+		"ik", "to", "en", "tok", "token", " is", " great"} {
+		fmt.Fprintf(&vocab, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	files := fstest.MapFS{"vocab/test_base.tiktoken": {Data: []byte(vocab.String())}}
+
+	tokenizer, err := loadBPETokenizer(files, "test_base", o200kPiece)
+	if err != nil {
+		t.Fatalf("loadBPETokenizer() error = %v", err)
+	}
+	// "tiktoken" merges "ik", "to", "en", "tok" and "token" into "t", "ik"
+	// and "token", the tokens of the published tiktoken example.
+	if got := tokenizer.CountTokens("tiktoken is great!"); got != 6 {
+		t.Fatalf("CountTokens() = %d; want 6", got)
+	}
+	if _, err := loadBPETokenizer(files, "missing_base", o200kPiece); err == nil || !strings.Contains(err.Error(), "not embedded") {
+		t.Fatalf("loadBPETokenizer() of missing vocabulary error = %v; want not embedded", err)
+	}
+}
+
+func TestCheckVocabulariesOnlyForModelsWithEncoding(t *testing.T) {
+	if err := checkVocabularies("llama3.2", "deepseek-chat"); err != nil {
+		t.Fatalf("checkVocabularies() of models without encoding error = %v", err)
+	}
+
+	err := checkVocabularies("gpt-4o-mini")
+	if _, statErr := fs.Stat(vocabFS, "vocab/"+encodingO200k+".tiktoken"); statErr != nil {
+		if err == nil || !strings.Contains(err.Error(), "task vocab:download") {
+			t.Fatalf("checkVocabularies() without vocabulary error = %v; want download hint", err)
+		}
+	} else if err != nil {
+		t.Fatalf("checkVocabularies() error = %v", err)
+	}
+}
+
+func TestParseTiktokenRanksRejectsInvalidLines(t *testing.T) {
+	for _, vocab := range []string{"", "aGk=\n", "!!! 1\n", "aGk= one\n"} {
+		if _, err := parseTiktokenRanks(strings.NewReader(vocab)); err == nil {
+			t.Fatalf("parseTiktokenRanks(%q) error = nil", vocab)
+		}
+	}
+}
+
+func TestEncodingForModel(t *testing.T) {
+	tests := map[string]string{
+		"gpt-5.4-mini":           encodingO200k,
+		"openai/gpt-4o-mini":     encodingO200k,
+		"o3-mini":                encodingO200k,
+		"gpt-4-turbo":            encodingCl100k,
+		"gpt-3.5-turbo":          encodingCl100k,
+		"text-embedding-3-small": encodingCl100k,
+		"deepseek-chat":          "",
+		"llama3.2":               "",
+	}
+	for model, want := range tests {
+		if got := encodingForModel(model); got != want {
+			t.Fatalf("encodingForModel(%q) = %q; want %q", model, got, want)
+		}
+	}
+	if got := tokenizerForModel("llama3.2").Name(); got != fallbackTokenizer {
+		t.Fatalf("tokenizer of unknown model = %s; want %s", got, fallbackTokenizer)
+	}
+}
+
+func TestTokenEstimatorObserve(t *testing.T) {
+	estimator := NewTokenEstimator()
+	if got := estimator.Calibrate("model", 100); got != 100 {
+		t.Fatalf("Calibrate() without samples = %d; want 100", got)
+	}
+
+	estimator.Observe("model", 100, 150)
+	if got := estimator.Calibrate("model", 100); got != 150 {
+		t.Fatalf("Calibrate() after first sample = %d; want 150", got)
+	}
+	// Later samples move the ratio by a fifth of the difference.
+	estimator.Observe("model", 100, 100)
+	if got := estimator.Calibrate("model", 100); got != 140 {
+		t.Fatalf("Calibrate() after second sample = %d; want 140", got)
+	}
+
+	// Ratios are bounded, and samples without tokens are ignored.
+	estimator.Observe("outlier", 1, 1000)
+	estimator.Observe("outlier", 0, 10)
+	if got := estimator.Calibrate("outlier", 10); got != 40 {
+		t.Fatalf("Calibrate() of outlier = %d; want 40", got)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/cloudwego/eino/components/model"
+	"github.com/cloudwego/eino/components/tool"
+	"github.com/cloudwego/eino/components/tool/utils"
+	"github.com/cloudwego/eino/schema"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+const (
+	toolFetchURL      = "fetch_url"
+	toolBlueskyLookup = "bluesky_lookup"
+	toolCalculator    = "calculator"
+	toolWebSearch     = "web_search"
+)
+
+var toolNames = []string{toolFetchURL, toolBlueskyLookup, toolCalculator, toolWebSearch}
+
+const (
+	// toolResultMaxBytes limits how much of a tool result is passed back to
+	// the model.
+	toolResultMaxBytes = 8000
+	fetchMaxBytes      = 1 << 20
+	searchResultLimit  = 5
+)
+
+type ToolsConfig struct {
+	Enabled       []string
+	MaxIterations int
+	SearchURL     string
+}
+
+func (t ToolsConfig) enabled(name string) bool {
+	return slices.Contains(t.Enabled, name)
+}
+
+// SearchProvider answers web_search tool calls.
+type SearchProvider interface {
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+}
+
+type SearchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"content"`
+}
+
+// toolSession holds the tools of one generation. URLs returned by web_search
+// may be fetched in later rounds in addition to the URLs of the message.
+type toolSession struct {
+	bot     *Bot
+	sources strings.Builder
+	tools   map[string]tool.InvokableTool
+	infos   []*schema.ToolInfo
+}
+
+func (b *Bot) newToolSession(message database.ClaimNextMessageRow) (*toolSession, error) {
+	config := b.currentConfig().Tools
+	session := &toolSession{bot: b, tools: map[string]tool.InvokableTool{}}
+	session.sources.WriteString(message.MessageText)
+
+	var tools []tool.InvokableTool
+	if config.enabled(toolFetchURL) {
+		tools = append(tools, session.fetchURLTool())
+	}
+	if config.enabled(toolBlueskyLookup) {
+		tools = append(tools, session.blueskyLookupTool())
+	}
+	if config.enabled(toolCalculator) {
+		tools = append(tools, calculatorTool())
+	}
+	if config.enabled(toolWebSearch) {
+		if search := b.searchProvider(); search != nil {
+			tools = append(tools, session.webSearchTool(search))
+		}
+	}
+
+	for _, t := range tools {
+		info, err := t.Info(b.ctx)
+		if err != nil {
+			return nil, err
+		}
+		session.tools[info.Name] = t
+		session.infos = append(session.infos, info)
+	}
+	return session, nil
+}
+
+// generateWithTools lets the model call tools for up to
+// LLM_TOOL_MAX_ITERATIONS rounds. Every round trip reserves its own spend.
+// After the last round the model has to answer without tools.
+func (b *Bot) generateWithTools(message database.ClaimNextMessageRow, chatModel model.ToolCallingChatModel, session *toolSession, messages []*schema.Message, opts []model.Option) (*schema.Message, error) {
+	bound, err := chatModel.WithTools(session.infos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind tools: %w", err)
+	}
+
+	maxRounds := b.currentConfig().Tools.MaxIterations
+	for round := 1; ; round++ {
+		callOpts := opts
+		if round > maxRounds {
+			callOpts = append(slices.Clone(opts), model.WithToolChoice(schema.ToolChoiceForbidden))
+		}
+		resp, _, err := b.llmRoundTrip(message.ID, b.optionsModelName(opts), messages, func() (*schema.Message, bool, error) {
+			resp, err := bound.Generate(b.ctx, messages, callOpts...)
+			return resp, false, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.ToolCalls) == 0 || round > maxRounds {
+			return resp, nil
+		}
+
+		messages = append(messages, resp)
+		for _, call := range resp.ToolCalls {
+			messages = append(messages, session.run(message, round, call))
+		}
+	}
+}
+
+// run executes a tool call and records it. Errors are passed to the model as
+// the result so that it can answer without the tool.
+func (s *toolSession) run(message database.ClaimNextMessageRow, round int, call schema.ToolCall) *schema.Message {
+	b := s.bot
+	startedAt := time.Now()
+
+	var result string
+	var err error
+	if t, ok := s.tools[call.Function.Name]; ok {
+		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+		result, err = t.InvokableRun(ctx, call.Function.Arguments)
+		cancel()
+	} else {
+		err = fmt.Errorf("unknown tool %q", call.Function.Name)
+	}
+	result = truncateBytes(result, toolResultMaxBytes)
+
+	params := database.InsertToolCallParams{
+		MessageUri: message.MessageUri,
+		Round:      int32(round),
+		CallID:     call.ID,
+		ToolName:   call.Function.Name,
+		Arguments:  call.Function.Arguments,
+		DurationMs: time.Since(startedAt).Milliseconds(),
+	}
+	if err != nil {
+		params.Error = new(err.Error())
+		result = "error: " + err.Error()
+	} else {
+		params.Result = &result
+	}
+	if insertErr := b.queries.InsertToolCall(b.ctx, params); insertErr != nil {
+		b.logger.Error("Failed to record tool call",
+			"message_id", message.ID,
+			"tool", call.Function.Name,
+			"error", insertErr)
+	}
+
+	b.logger.Info("Ran tool",
+		"message_id", message.ID,
+		"tool", call.Function.Name,
+		"round", round,
+		"failed", err != nil)
+	return schema.ToolMessage(result, call.ID, schema.WithToolName(call.Function.Name))
+}
+
+type fetchURLInput struct {
+	URL string `json:"url"`
+}
+
+func (s *toolSession) fetchURLTool() tool.InvokableTool {
+	return utils.NewTool(&schema.ToolInfo{
+		Name: toolFetchURL,
+		Desc: "Fetch a web page that is linked in the message or was found by web_search and return its text.",
+		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
+			"url": {Type: schema.String, Desc: "http or https URL of the page", Required: true},
+		}),
+	}, func(ctx context.Context, input fetchURLInput) (string, error) {
+		if !linkedIn(input.URL, s.sources.String()) {
+			return "", fmt.Errorf("%s is not linked in the message", input.URL)
+		}
+		return fetchPageText(ctx, s.bot.fetchClient, input.URL)
+	})
+}
+
+// linkedIn reports whether the host of rawURL appears in text. Bluesky
+// shortens the link text of long URLs, but the host stays visible.
+func linkedIn(rawURL, text string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+	return strings.Contains(strings.ToLower(text), host)
+}
+
+var (
+	titlePattern     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	invisiblePattern = regexp.MustCompile(`(?is)<(script|style|noscript|svg|head)[^>]*>.*?</(script|style|noscript|svg|head)>`)
+	tagPattern       = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacePattern     = regexp.MustCompile(`\s+`)
+)
+
+func fetchPageText(ctx context.Context, client *http.Client, pageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "bluesky-llm-replybot")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned status %d", pageURL, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, fetchMaxBytes))
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return htmlText(string(body)), nil
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json":
+		return string(body), nil
+	default:
+		return "", fmt.Errorf("unsupported content type %q", mediaType)
+	}
+}
+
+// htmlText reduces an HTML page to its title and visible text.
+func htmlText(page string) string {
+	var title string
+	if match := titlePattern.FindStringSubmatch(page); match != nil {
+		title = strings.TrimSpace(html.UnescapeString(match[1]))
+	}
+	text := invisiblePattern.ReplaceAllString(page, " ")
+	text = tagPattern.ReplaceAllString(text, " ")
+	text = strings.TrimSpace(spacePattern.ReplaceAllString(html.UnescapeString(text), " "))
+	if title == "" {
+		return text
+	}
+	return title + "\n\n" + text
+}
+
+// newFetchClient returns the HTTP client of fetch_url. It refuses to connect
+// to loopback, private and other non-public addresses, also after redirects,
+// so that links in posts cannot reach internal services.
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if addr, err := netip.ParseAddr(host); err != nil || !isPublicAddr(addr) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: 20 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(_ *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA address
+// registries that are not reachable on the public internet, or that translate
+// to addresses which may not be.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/96"),           // unspecified, loopback and IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// nat64Prefix is the well-known NAT64 prefix; its addresses embed an IPv4
+// address in the last four bytes.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// isPublicAddr reports whether addr is a public unicast address. IPv4-mapped
+// and NAT64 addresses are judged by the IPv4 address they carry.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	if nat64Prefix.Contains(addr) {
+		v6 := addr.As16()
+		addr = netip.AddrFrom4([4]byte(v6[12:]))
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+type blueskyLookupInput struct {
+	Target string `json:"target"`
+}
+
+func (s *toolSession) blueskyLookupTool() tool.InvokableTool {
+	return utils.NewTool(&schema.ToolInfo{
+		Name: toolBlueskyLookup,
+		Desc: "Look up a Bluesky profile by handle or DID, or a Bluesky post by at:// URI or bsky.app link.",
+		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
+			"target": {Type: schema.String, Desc: "handle, DID, at:// post URI or https://bsky.app post link", Required: true},
+		}),
+	}, func(ctx context.Context, input blueskyLookupInput) (string, error) {
+		return s.bot.lookupBluesky(ctx, input.Target)
+	})
+}
+
+var bskyAppPostPattern = regexp.MustCompile(`^https://bsky\.app/profile/([^/]+)/post/([^/?#]+)`)
+
+func (b *Bot) lookupBluesky(ctx context.Context, target string) (string, error) {
+	target = strings.TrimPrefix(strings.TrimSpace(target), "@")
+	if match := bskyAppPostPattern.FindStringSubmatch(target); match != nil {
+		target = "at://" + match[1] + "/app.bsky.feed.post/" + match[2]
+	}
+	if !strings.HasPrefix(target, "at://") {
+		return b.lookupProfile(ctx, target)
+	}
+
+	authority, rest, _ := strings.Cut(strings.TrimPrefix(target, "at://"), "/")
+	if !strings.HasPrefix(authority, "did:") {
+		did, err := b.bluesky.ResolveHandle(ctx, authority)
+		if err != nil {
+			return "", err
+		}
+		target = "at://" + did + "/" + rest
+	}
+
+	thread, err := b.bluesky.GetPostThread(ctx, target, 0)
+	if err != nil {
+		return "", err
+	}
+	if thread.Thread == nil || thread.Thread.FeedDefs_ThreadViewPost == nil || thread.Thread.FeedDefs_ThreadViewPost.Post == nil {
+		return "", fmt.Errorf("post %s is not available", target)
+	}
+	return formatPost(thread.Thread.FeedDefs_ThreadViewPost.Post), nil
+}
+
+func (b *Bot) lookupProfile(ctx context.Context, actor string) (string, error) {
+	profile, err := b.bluesky.GetProfile(ctx, actor)
+	if err != nil {
+		return "", err
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Handle: @%s\nDID: %s\n", profile.Handle, profile.Did)
+	if profile.DisplayName != nil && *profile.DisplayName != "" {
+		fmt.Fprintf(&builder, "Name: %s\n", *profile.DisplayName)
+	}
+	if profile.Description != nil && *profile.Description != "" {
+		fmt.Fprintf(&builder, "Description: %s\n", *profile.Description)
+	}
+	fmt.Fprintf(&builder, "Followers: %d\nFollowing: %d\nPosts: %d\n",
+		derefInt(profile.FollowersCount), derefInt(profile.FollowsCount), derefInt(profile.PostsCount))
+	return builder.String(), nil
+}
+
+func formatPost(post *bsky.FeedDefs_PostView) string {
+	var builder strings.Builder
+	if post.Author != nil {
+		fmt.Fprintf(&builder, "Author: @%s\n", post.Author.Handle)
+	}
+	if post.Record != nil {
+		if record, ok := post.Record.Val.(*bsky.FeedPost); ok {
+			fmt.Fprintf(&builder, "Posted: %s\nText: %s\n", record.CreatedAt, record.Text)
+		}
+	}
+	fmt.Fprintf(&builder, "Likes: %d\nReposts: %d\nReplies: %d\n",
+		derefInt(post.LikeCount), derefInt(post.RepostCount), derefInt(post.ReplyCount))
+	return builder.String()
+}
+
+func derefInt(value *int64) int64 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+type calculatorInput struct {
+	Expression string `json:"expression"`
+}
+
+func calculatorTool() tool.InvokableTool {
+	return utils.NewTool(&schema.ToolInfo{
+		Name: toolCalculator,
+		Desc: "Evaluate an arithmetic expression with + - * / % ^, parentheses, sqrt() and abs().",
+		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
+			"expression": {Type: schema.String, Desc: "the expression, for example (2 + 3) * 4^2", Required: true},
+		}),
+	}, func(_ context.Context, input calculatorInput) (string, error) {
+		value, err := evaluateExpression(input.Expression)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64), nil
+	})
+}
+
+type webSearchInput struct {
+	Query string `json:"query"`
+}
+
+func (s *toolSession) webSearchTool(search SearchProvider) tool.InvokableTool {
+	return utils.NewTool(&schema.ToolInfo{
+		Name: toolWebSearch,
+		Desc: "Search the web and return the titles, URLs and snippets of the top results.",
+		ParamsOneOf: schema.NewParamsOneOfByParams(map[string]*schema.ParameterInfo{
+			"query": {Type: schema.String, Desc: "the search query", Required: true},
+		}),
+	}, func(ctx context.Context, input webSearchInput) (string, error) {
+		results, err := search.Search(ctx, input.Query, searchResultLimit)
+		if err != nil {
+			return "", err
+		}
+		if len(results) == 0 {
+			return "No results.", nil
+		}
+
+		var builder strings.Builder
+		for i, result := range results {
+			fmt.Fprintf(&builder, "%d. %s\n%s\n%s\n\n", i+1, result.Title, result.URL, result.Snippet)
+			s.sources.WriteString("\n" + result.URL)
+		}
+		return builder.String(), nil
+	})
+}
+
+// SearXNGSearch searches with the JSON API of a SearXNG instance.
+type SearXNGSearch struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewSearXNGSearch(baseURL string, client *http.Client) *SearXNGSearch {
+	return &SearXNGSearch{baseURL: strings.TrimRight(baseURL, "/"), client: client}
+}
+
+func (s *SearXNGSearch) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		s.baseURL+"/search?format=json&q="+url.QueryEscape(query), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("search returned status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Results []SearchResult `json:"results"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, fetchMaxBytes)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode search results: %w", err)
+	}
+	return out.Results[:min(limit, len(out.Results))], nil
+}
+
+// searchProvider returns the provider of web_search, or nil when SEARCH_URL
+// is not set.
+func (b *Bot) searchProvider() SearchProvider {
+	if b.search != nil {
+		return b.search
+	}
+	if searchURL := b.currentConfig().Tools.SearchURL; searchURL != "" {
+		return NewSearXNGSearch(searchURL, &http.Client{Timeout: 20 * time.Second})
+	}
+	return nil
+}
+
+func truncateBytes(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+	cut := maxBytes
+	for cut > 0 && !isRuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
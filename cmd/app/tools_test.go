@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/cloudwego/eino/schema"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func toolCallResponse(id, name, arguments string) *schema.Message {
+	resp := schema.AssistantMessage("", []schema.ToolCall{{
+		ID:       id,
+		Function: schema.FunctionCall{Name: name, Arguments: arguments},
+	}})
+	resp.ResponseMeta = &schema.ResponseMeta{
+		Usage: &schema.TokenUsage{PromptTokens: 100, CompletionTokens: 100, TotalTokens: 200},
+	}
+	return resp
+}
+
+func newToolTestBot(tools ...string) *testBot {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.Tools = ToolsConfig{Enabled: tools, MaxIterations: 2}
+	bot.config.Store(config)
+	return bot
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2^2", -4},
+		{"(-2)^2", 4},
+		{"10 / 4", 2.5},
+		{"10 % 4", 2},
+		{"sqrt(16) + abs(-3)", 7},
+		{"1_000 * 1.5", 1500},
+		{"--3", 3},
+	}
+	for _, test := range tests {
+		got, err := evaluateExpression(test.expression)
+		if err != nil {
+			t.Fatalf("evaluateExpression(%q) error = %v", test.expression, err)
+		}
+		if got != test.want {
+			t.Fatalf("evaluateExpression(%q) = %g; want %g", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateExpressionRejectsInvalidInput(t *testing.T) {
+	for _, expression := range []string{"", "1 +", "1 / 0", "5 % 0", "(1 + 2", "1 2", "foo(1)", "sqrt(-1)", "pi", strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200)} {
+		if _, err := evaluateExpression(expression); err == nil {
+			t.Fatalf("evaluateExpression(%q) error = nil; want error", expression)
+		}
+	}
+}
+
+func TestProcessNextMessageRunsToolsAndRecordsCalls(t *testing.T) {
+	bot := newToolTestBot(toolCalculator)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", MessageText: "what is 6 * 7?"}}
+	answer := schema.AssistantMessage("It is 42.", nil)
+	answer.ResponseMeta = &schema.ResponseMeta{
+		Usage: &schema.TokenUsage{PromptTokens: 100, CompletionTokens: 100, TotalTokens: 200},
+	}
+	bot.model.responses = []*schema.Message{
+		toolCallResponse("call-1", toolCalculator, `{"expression":"6 * 7"}`),
+		answer,
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if got := *bot.queries.llmResponses[0].LlmResponse; got != "It is 42." {
+		t.Fatalf("stored response = %q", got)
+	}
+	if len(bot.model.tools) != 1 || bot.model.tools[0].Name != toolCalculator {
+		t.Fatalf("bound tools = %+v; want calculator", bot.model.tools)
+	}
+	second := bot.model.inputs[1]
+	last := second[len(second)-1]
+	if last.Role != schema.Tool || last.ToolCallID != "call-1" || last.Content != "42" {
+		t.Fatalf("tool message = %+v; want calculator result", last)
+	}
+
+	if len(bot.queries.toolCalls) != 1 {
+		t.Fatalf("recorded %d tool calls; want 1", len(bot.queries.toolCalls))
+	}
+	call := bot.queries.toolCalls[0]
+	if call.MessageUri != "at://did:plc:alice/app.bsky.feed.post/1" || call.Round != 1 || call.ToolName != toolCalculator || call.Result == nil || *call.Result != "42" {
+		t.Fatalf("recorded tool call = %+v", call)
+	}
+
+	usage := store.usage[usageDate(time.Now(), time.UTC)]
+	if usage.SpentMicros != 400 || usage.ReservedMicros != 0 {
+		t.Fatalf("daily usage = %+v; want both round trips charged and nothing reserved", usage)
+	}
+}
+
+func TestProcessNextMessageForbidsToolsAfterMaxIterations(t *testing.T) {
+	bot := newToolTestBot(toolCalculator)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "count"}}
+	bot.model.responses = []*schema.Message{
+		toolCallResponse("call-1", toolCalculator, `{"expression":"1 + 1"}`),
+		toolCallResponse("call-2", toolCalculator, `{"expression":"2 + 1"}`),
+		schema.AssistantMessage("Done.", nil),
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if bot.model.calls != 3 {
+		t.Fatalf("model called %d times; want 3", bot.model.calls)
+	}
+	if bot.model.toolChoices[1] != nil || bot.model.toolChoices[2] == nil || *bot.model.toolChoices[2] != schema.ToolChoiceForbidden {
+		t.Fatalf("tool choices = %v; want tools forbidden only in the last round", bot.model.toolChoices)
+	}
+	if len(bot.queries.toolCalls) != 2 {
+		t.Fatalf("recorded %d tool calls; want 2", len(bot.queries.toolCalls))
+	}
+}
+
+func TestToolErrorIsPassedToModel(t *testing.T) {
+	bot := newToolTestBot(toolFetchURL)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "summarize https://example.com/article"}}
+	bot.model.responses = []*schema.Message{
+		toolCallResponse("call-1", toolFetchURL, `{"url":"http://169.254.169.254/latest/meta-data"}`),
+		schema.AssistantMessage("I cannot open that link.", nil),
+	}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	call := bot.queries.toolCalls[0]
+	if call.Error == nil || !strings.Contains(*call.Error, "not linked in the message") || call.Result != nil {
+		t.Fatalf("recorded tool call = %+v; want unlinked URL error", call)
+	}
+	second := bot.model.inputs[1]
+	if last := second[len(second)-1]; !strings.HasPrefix(last.Content, "error: ") {
+		t.Fatalf("tool message = %q; want error passed to the model", last.Content)
+	}
+}
+
+func TestFetchURLToolReturnsPageText(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Go &amp; Rust</title><style>p{}</style></head>
+<body><script>alert(1)</script><p>Both are   <b>fast</b>.</p></body></html>`)
+	}))
+	defer server.Close()
+
+	bot := newToolTestBot(toolFetchURL)
+	bot.fetchClient = server.Client()
+	session, err := bot.newToolSession(database.ClaimNextMessageRow{MessageText: "look at " + server.URL})
+	if err != nil {
+		t.Fatalf("newToolSession() error = %v", err)
+	}
+
+	got, err := session.tools[toolFetchURL].InvokableRun(context.Background(), fmt.Sprintf(`{"url":%q}`, server.URL+"/page"))
+	if err != nil {
+		t.Fatalf("fetch_url error = %v", err)
+	}
+	if got != "Go & Rust\n\nBoth are fast ." {
+		t.Fatalf("fetch_url = %q", got)
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.215.14":            true,
+		"2606:4700:4700::1111":     true,
+		"64:ff9b::5db8:d70e":       true,
+		"10.1.2.3":                 false,
+		"100.64.0.1":               false,
+		"100.127.255.254":          false,
+		"127.0.0.1":                false,
+		"169.254.169.254":          false,
+		"192.168.1.1":              false,
+		"198.18.0.1":               false,
+		"198.19.255.255":           false,
+		"0.0.0.0":                  false,
+		"255.255.255.255":          false,
+		"::1":                      false,
+		"::":                       false,
+		"::ffff:127.0.0.1":         false,
+		"::ffff:10.0.0.1":          false,
+		"::ffff:100.64.0.1":        false,
+		"::127.0.0.1":              false,
+		"64:ff9b::7f00:1":          false,
+		"64:ff9b::a9fe:a9fe":       false,
+		"64:ff9b:1::a00:1":         false,
+		"2002:7f00:1::1":           false,
+		"2001:0:4136:e378::1":      false,
+		"fd00::1":                  false,
+		"fe80::1%eth0":             false,
+		"ff02::1":                  false,
+		"2001:db8::1":              false,
+		"::ffff:93.184.215.14":     true,
+		"2a00:1450:4001:81b::200e": true,
+	}
+	for address, want := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(address)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v; want %v", address, got, want)
+		}
+	}
+}
+
+func TestFetchClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "internal")
+	}))
+	defer server.Close()
+
+	_, err := fetchPageText(context.Background(), newFetchClient(), server.URL)
+	if err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Fatalf("fetchPageText() error = %v; want non-public address error", err)
+	}
+}
+
+func (q *fakeQuerier) InsertToolCall(_ context.Context, arg database.InsertToolCallParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.toolCalls = append(q.toolCalls, arg)
+	return nil
+}
+
+func (q *fakeQuerier) ListToolCalls(_ context.Context, messageUri string) ([]database.ToolCall, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var calls []database.ToolCall
+	for i, call := range q.toolCalls {
+		if call.MessageUri == messageUri {
+			calls = append(calls, database.ToolCall{
+				ID:         int64(i + 1),
+				MessageUri: call.MessageUri,
+				Round:      call.Round,
+				CallID:     call.CallID,
+				ToolName:   call.ToolName,
+				Arguments:  call.Arguments,
+				Result:     call.Result,
+				Error:      call.Error,
+				DurationMs: call.DurationMs,
+			})
+		}
+	}
+	return calls, nil
+}
+
+func (f *fakeBluesky) GetProfile(_ context.Context, actor string) (*bsky.ActorDefs_ProfileViewDetailed, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	profile, ok := f.profiles[actor]
+	if !ok {
+		return nil, fmt.Errorf("profile not found: %s", actor)
+	}
+	return profile, nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/cloudwego/eino/components/model"
 	"github.com/cloudwego/eino/schema"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
@@ -14,10 +18,10 @@ import (
 
 const fallbackResponseText = "I apologize, but I'm unable to generate a response at this time. Please try again later."
 
-func (b *Bot) runWorker(config *Config) {
+func (b *Bot) runWorker() {
 	b.logger.Info("Starting worker...")
 
-	ticker := time.NewTicker(config.WorkerInterval)
+	ticker := time.NewTicker(b.currentConfig().WorkerInterval)
 	defer ticker.Stop()
 
 	b.processNextMessageAndLog()
@@ -40,6 +44,11 @@ func (b *Bot) processNextMessageAndLog() {
 }
 
 func (b *Bot) processNextMessage() error {
+	if !b.circuitBreaker.Allow(time.Now()) {
+		return nil
+	}
+	defer b.circuitBreaker.ReleaseProbe()
+
 	message, err := b.queries.ClaimNextMessage(b.ctx)
 	if err != nil {
 		return err
@@ -49,20 +58,44 @@ func (b *Bot) processNextMessage() error {
 		"message_id", message.ID,
 		"author_handle", message.AuthorHandle)
 
-	response, modelName, err := b.generateLLMResponse(message.MessageText)
+	if b.currentConfig().Memory.Enabled && isForgetCommand(message.MessageText) {
+		return b.forgetAuthor(message)
+	}
+
+	if b.checkInput(message) {
+		return b.refuseMessage(message)
+	}
+
+	startedAt := time.Now()
+	reply, err := b.generateLLMResponse(message)
 	if err != nil {
 		var spendingErr *SpendingLimitExceededError
 		if errors.As(err, &spendingErr) {
 			return b.deferAfterSpendingLimit(message.ID, spendingErr.Status)
 		}
-		return b.handleLLMGenerationError(message, err)
+		var blockedErr *GuardrailBlockedError
+		if errors.As(err, &blockedErr) {
+			return b.refuseMessage(message)
+		}
+		return b.handleLLMGenerationError(message, startedAt, err)
 	}
 
-	if err := b.queries.UpdateMessageWithLLMResponse(b.ctx, database.UpdateMessageWithLLMResponseParams{
-		ID:          message.ID,
-		LlmResponse: &response,
-		ModelName:   &modelName,
-	}); err != nil {
+	reviewer, approved := b.autoApprove(message, reply.Text)
+	if !approved {
+		return b.submitForApproval(message.ID, reply)
+	}
+
+	params := database.UpdateMessageWithLLMResponseParams{
+		ID:             message.ID,
+		LlmResponse:    &reply.Text,
+		ModelName:      &reply.ModelName,
+		LengthStrategy: reply.LengthStrategy,
+		ReviewedBy:     optionalString(reviewer),
+	}
+	if reviewer != "" {
+		params.ReviewedAt = pgtype.Timestamptz{Time: time.Now(), Valid: true}
+	}
+	if err := b.queries.UpdateMessageWithLLMResponse(b.ctx, params); err != nil {
 		return fmt.Errorf("failed to update message with LLM response: %w", err)
 	}
 
@@ -84,8 +117,9 @@ func (b *Bot) deferAfterSpendingLimit(messageID int64, status SpendingStatus) er
 		return fmt.Errorf("failed to defer message after spending limit reached: %w", err)
 	}
 
-	b.logger.Info("Deferred message until daily spending reset",
+	b.logger.Info("Deferred message until spending reset",
 		"message_id", messageID,
+		"period", status.Period,
 		"reset_at", status.ResetAt.Format(time.RFC3339),
 		"spent_micros", status.SpentMicros,
 		"reserved_micros", status.ReservedMicros,
@@ -94,32 +128,64 @@ func (b *Bot) deferAfterSpendingLimit(messageID int64, status SpendingStatus) er
 	return nil
 }
 func spendingLimitNotice(status SpendingStatus, now time.Time) string {
+	period := cmp.Or(status.Period, budgetDaily)
 	hours := hoursUntil(status.ResetAt, now)
-	if hours == 1 {
-		return "I've reached my daily LLM budget. Your message will be processed after the daily reset in about 1 hour."
+	wait := fmt.Sprintf("%d hours", hours)
+	switch {
+	case hours == 1:
+		wait = "1 hour"
+	case hours > 48:
+		wait = fmt.Sprintf("%d days", (hours+23)/24)
+	}
+	if status.Rolling {
+		return fmt.Sprintf("I've reached my LLM budget for the last %s. Your message will be processed in about %s.", rollingWindowName(period), wait)
 	}
-	return fmt.Sprintf("I've reached my daily LLM budget. Your message will be processed after the daily reset in about %d hours.", hours)
+	return fmt.Sprintf("I've reached my %s LLM budget. Your message will be processed after the %s reset in about %s.", period, period, wait)
 }
 
-func (b *Bot) handleLLMGenerationError(message database.ClaimNextMessageRow, err error) error {
-	errorMsg := err.Error()
-	currentRetryCount := message.RetryCount
+func (b *Bot) handleLLMGenerationError(message database.ClaimNextMessageRow, startedAt time.Time, err error) error {
+	class := classifyLLMError(err)
+	errorMsg := fmt.Sprintf("%s: %v", class, err)
+	b.recordAttempt(message.ID, stageGenerate, startedAt, errorMsg)
 
-	if currentRetryCount+1 >= int32(b.maxRetries) {
-		return b.handleMaxRetriesReached(message)
+	if class.ProviderFailure() && b.circuitBreaker.IsOpen() {
+		return b.releaseWhileCircuitOpen(message, errorMsg, err)
+	}
+
+	if !class.Retryable() {
+		b.logger.Warn("LLM error is not retryable, sending fallback response",
+			"message_id", message.ID,
+			"error_class", class,
+			"error", err)
+		return b.handleMaxRetriesReached(message, errorMsg)
 	}
 
-	return b.handleRetryableFailure(message, errorMsg, err)
+	if message.RetryCount+1 >= int32(b.currentConfig().MaxRetries) {
+		return b.handleMaxRetriesReached(message, errorMsg)
+	}
+
+	return b.handleRetryableFailure(message, class, errorMsg, err)
 }
 
-func (b *Bot) handleMaxRetriesReached(message database.ClaimNextMessageRow) error {
+func (b *Bot) handleMaxRetriesReached(message database.ClaimNextMessageRow, errorMsg string) error {
 	b.logger.Warn("Max retries reached for message, sending fallback response",
 		"message_id", message.ID,
 		"retry_count", message.RetryCount)
 
+	if b.suppressFallback() {
+		return b.dropWithoutFallback(message.ID, errorMsg)
+	}
+
+	if err := b.deadLetter(message.ID, stageGenerate, errorMsg, true); err != nil {
+		b.logger.Error("Failed to dead-letter message, sending fallback response anyway",
+			"message_id", message.ID,
+			"error", err)
+	}
+
 	if updateErr := b.queries.UpdateMessageWithLLMResponse(b.ctx, database.UpdateMessageWithLLMResponseParams{
 		ID:          message.ID,
 		LlmResponse: new(fallbackResponseText),
+		LastError:   &errorMsg,
 	}); updateErr != nil {
 		b.logger.Error("Failed to update message with fallback response",
 			"message_id", message.ID,
@@ -131,81 +197,261 @@ func (b *Bot) handleMaxRetriesReached(message database.ClaimNextMessageRow) erro
 	return nil
 }
 
+// releaseWhileCircuitOpen puts the message back to pending without counting
+// the attempt, so that a provider outage does not use up its retries.
+func (b *Bot) releaseWhileCircuitOpen(message database.ClaimNextMessageRow, errorMsg string, originalErr error) error {
+	if err := b.queries.ReleaseMessage(b.ctx, database.ReleaseMessageParams{
+		ID:        message.ID,
+		LastError: &errorMsg,
+	}); err != nil {
+		b.logger.Error("Failed to release message after LLM circuit breaker opened",
+			"message_id", message.ID,
+			"error", err)
+	}
+
+	b.logger.Info("Released message while LLM circuit breaker is open", "message_id", message.ID)
+	return fmt.Errorf("failed to generate LLM response: %w", originalErr)
+}
+
 //go:fix inline
 func stringPtr(s string) *string {
 	return new(s)
 }
 
-func (b *Bot) handleRetryableFailure(message database.ClaimNextMessageRow, errorMsg string, originalErr error) error {
-	maxRetries := int32(b.maxRetries)
+func (b *Bot) handleRetryableFailure(message database.ClaimNextMessageRow, class LLMErrorClass, errorMsg string, originalErr error) error {
+	config := b.currentConfig()
+	nextAttemptAt := time.Now().Add(retryDelay(config.RetryBackoffBase, config.RetryBackoffMax, message.RetryCount))
 	if updateErr := b.queries.UpdateMessageFailed(b.ctx, database.UpdateMessageFailedParams{
-		ID:         message.ID,
-		RetryCount: maxRetries,
+		ID:            message.ID,
+		RetryCount:    int32(config.MaxRetries),
+		NextAttemptAt: pgtype.Timestamptz{Time: nextAttemptAt, Valid: true},
+		LastError:     &errorMsg,
 	}); updateErr != nil {
 		b.logger.Error("Failed to update message as failed",
 			"message_id", message.ID,
 			"error", updateErr)
 	}
+
+	b.logger.Info("Scheduled retry for message",
+		"message_id", message.ID,
+		"error_class", class,
+		"next_attempt_at", nextAttemptAt.Format(time.RFC3339))
 	return fmt.Errorf("failed to generate LLM response: %w", originalErr)
 }
 
-func (b *Bot) generateLLMResponse(userMessage string) (string, string, error) {
-	prompt := fmt.Sprintf(`You are a helpful AI assistant responding to a message on Bluesky (microblogging social media service).
-Please provide a thoughtful, engaging, and helpful response to the following user message.
-Keep your response concise and appropriate for social media (maximum 500 characters).
-
-User message:
-%s
-`, userMessage)
+type llmReply struct {
+	Text           string
+	ModelName      string
+	LengthStrategy *string
+}
 
-	messages := []*schema.Message{
-		{Role: schema.User, Content: prompt},
+func (b *Bot) generateLLMResponse(message database.ClaimNextMessageRow) (llmReply, error) {
+	prompt, err := b.currentConfig().Prompt.Render(PromptData{
+		Message:   message.MessageText,
+		Knowledge: b.retrieveKnowledge(message),
+		Memory:    b.userMemory(message),
+	})
+	if err != nil {
+		return llmReply{}, err
 	}
 
+	messages := append(b.conversationContext(message), &schema.Message{Role: schema.User, Content: prompt})
+
 	modelName := b.currentModelName()
+	var opts []model.Option
+	if message.ModelOverride != nil && *message.ModelOverride != "" {
+		modelName = *message.ModelOverride
+		opts = append(opts, model.WithModel(modelName))
+	}
 	b.logger.Info("Attempting to generate response", "model", modelName)
 
+	session, chatModel := b.toolSession(message)
+	var responseText string
+	var cutOff bool
+	for attempt := 0; ; attempt++ {
+		var resp *schema.Message
+		if session != nil {
+			resp, err = b.generateWithTools(message, chatModel, session, messages, opts)
+		} else {
+			resp, cutOff, err = b.llmRoundTrip(message.ID, modelName, messages, func() (*schema.Message, bool, error) {
+				return b.completeLLM(messages, opts...)
+			})
+		}
+		if err != nil {
+			return llmReply{}, err
+		}
+
+		generated := extractText(resp)
+		if generated == "" {
+			if resp.ResponseMeta != nil && resp.ResponseMeta.FinishReason == "content_filter" {
+				return llmReply{}, errContentFiltered
+			}
+			return llmReply{}, fmt.Errorf("received empty response from model")
+		}
+
+		checked, rejection, err := b.checkOutput(message.ID, generated, attempt)
+		if err != nil {
+			return llmReply{}, err
+		}
+		if rejection == "" {
+			responseText = checked
+			break
+		}
+		messages = append(messages,
+			schema.AssistantMessage(generated, nil),
+			&schema.Message{Role: schema.User, Content: regenerationPrompt(rejection)})
+	}
+	if cutOff {
+		b.logger.Info("Stopped LLM stream at maximum thread length",
+			"model", modelName,
+			"max_thread_posts", b.currentConfig().MaxThreadPosts,
+			"graphemes", countGraphemes(responseText))
+	}
+
+	// Direct messages are not threads, so the thread length limit does not
+	// apply to them.
+	if message.Channel == channelDM {
+		return llmReply{Text: responseText, ModelName: modelName}, nil
+	}
+	text, lengthStrategy := b.applyThreadLength(message.ID, message.MessageUri, responseText, opts)
+	return llmReply{Text: text, ModelName: modelName, LengthStrategy: lengthStrategy}, nil
+}
+
+// retrieveKnowledge returns the knowledge base passages for the message,
+// formatted for the prompt. Without a knowledge base, or when retrieval fails,
+// the reply is generated without passages.
+func (b *Bot) retrieveKnowledge(message database.ClaimNextMessageRow) string {
+	config := b.currentConfig().KnowledgeBase
+	if b.knowledge == nil || !config.Enabled {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+	defer cancel()
+	passages, err := b.knowledge.Retrieve(ctx, message.MessageText, config.TopK, config.MinScore)
+	if err != nil {
+		b.logger.Warn("Failed to retrieve knowledge base passages",
+			"message_id", message.ID,
+			"error", err)
+		return ""
+	}
+
+	ids := make([]int64, len(passages))
+	for i, passage := range passages {
+		ids[i] = passage.ID
+	}
+	b.logger.Info("Retrieved knowledge base passages",
+		"message_id", message.ID,
+		"passage_ids", ids)
+	return formatKnowledge(passages)
+}
+
+// llmRoundTrip runs one call to the model named modelName for the queue item
+// messageID. Every call waits for a request slot and reserves its own spend,
+// which is finalized with the reported usage once the model answered and
+// released when the call failed.
+func (b *Bot) llmRoundTrip(messageID int64, modelName string, messages []*schema.Message, call func() (*schema.Message, bool, error)) (*schema.Message, bool, error) {
 	if err := b.waitForLLMRequestSlot(); err != nil {
-		return "", "", err
+		return nil, false, err
 	}
 
-	reservation, status, allowed, err := b.reserveLLMSpend(prompt)
+	input := messagesText(messages)
+	reservation, status, allowed, err := b.reserveLLMSpend(messageID, modelName, input)
 	if err != nil {
-		return "", "", err
+		return nil, false, err
 	}
 	if !allowed {
-		return "", "", &SpendingLimitExceededError{Status: status}
+		return nil, false, &SpendingLimitExceededError{Status: status}
 	}
 
-	resp, err := b.chatModel.Generate(b.ctx, messages)
+	resp, cutOff, err := call()
 	if err != nil {
-		return "", "", err
+		b.releaseLLMSpend(reservation)
+		if classifyLLMError(err).ProviderFailure() {
+			b.circuitBreaker.RecordFailure(time.Now())
+		} else {
+			b.circuitBreaker.RecordSuccess()
+		}
+		return nil, false, err
 	}
+	b.circuitBreaker.RecordSuccess()
 
-	responseText := extractText(resp)
-	if responseText == "" {
-		return "", "", fmt.Errorf("received empty response from model")
+	if err := b.finalizeLLMSpend(reservation, input, resp, messagesText([]*schema.Message{resp})); err != nil {
+		return nil, false, err
 	}
+	return resp, cutOff, nil
+}
 
-	if reservation.IsValid() {
-		usage := usageFromResponse(resp)
-		if usage == nil {
-			usage = b.spendingLimiter.EstimateUsage(prompt, responseText)
-		}
-		status, err := b.spendingLimiter.FinalizeReservation(b.ctx, reservation, usage)
-		if err != nil {
-			return "", "", err
+// toolSession returns the tools for message and the model to call them, or
+// nil when no tools are enabled or the model cannot call tools.
+func (b *Bot) toolSession(message database.ClaimNextMessageRow) (*toolSession, model.ToolCallingChatModel) {
+	if len(b.currentConfig().Tools.Enabled) == 0 {
+		return nil, nil
+	}
+	chatModel, ok := b.chatModel.(model.ToolCallingChatModel)
+	if !ok {
+		b.logger.Warn("Chat model does not support tool calling, generating without tools")
+		return nil, nil
+	}
+	session, err := b.newToolSession(message)
+	if err != nil {
+		b.logger.Warn("Failed to prepare tools, generating without tools", "error", err)
+		return nil, nil
+	}
+	if len(session.infos) == 0 {
+		return nil, nil
+	}
+	return session, chatModel
+}
+
+// messagesText joins the contents and tool call arguments of messages for
+// spend estimates.
+func messagesText(messages []*schema.Message) string {
+	var contents []string
+	for _, message := range messages {
+		if message == nil {
+			continue
 		}
-		if status.CommittedAndReservedMicros() >= status.LimitMicros {
-			b.logger.Warn("Daily LLM spending limit reached",
-				"spent_micros", status.SpentMicros,
-				"reserved_micros", status.ReservedMicros,
-				"limit_micros", status.LimitMicros,
-				"reset_at", status.ResetAt.Format(time.RFC3339))
+		contents = append(contents, message.Content)
+		for _, call := range message.ToolCalls {
+			contents = append(contents, call.Function.Name+" "+call.Function.Arguments)
 		}
 	}
+	return strings.Join(contents, "\n")
+}
+
+// finalizeLLMSpend replaces the reservation with the cost of the reported
+// usage, or with an estimate when the provider reported none. Reported usage
+// also calibrates the token estimates of later reservations.
+func (b *Bot) finalizeLLMSpend(reservation SpendingReservation, input string, resp *schema.Message, responseText string) error {
+	if !reservation.IsValid() {
+		return nil
+	}
 
-	return responseText, modelName, nil
+	usage := usageFromResponse(resp)
+	if usage == nil {
+		usage = b.spendingLimiter.EstimateUsage(reservation.Model, input, responseText)
+	} else {
+		b.spendingLimiter.ObserveUsage(reservation, usage)
+	}
+	if _, err := b.spendingLimiter.FinalizeReservation(b.ctx, reservation, usage); err != nil {
+		return err
+	}
+	b.checkSpendingAlerts()
+	return nil
+}
+
+// releaseLLMSpend drops the reservation of a failed call. A reservation that
+// cannot be released is left to expire after the LLM timeout.
+func (b *Bot) releaseLLMSpend(reservation SpendingReservation) {
+	if !reservation.IsValid() {
+		return
+	}
+	if err := b.spendingLimiter.Release(b.ctx, reservation); err != nil {
+		b.logger.Warn("Failed to release LLM spend reservation",
+			"reservation_id", reservation.ID,
+			"error", err)
+	}
 }
 
 type SpendingLimitExceededError struct {
@@ -213,21 +459,22 @@ type SpendingLimitExceededError struct {
 }
 
 func (e *SpendingLimitExceededError) Error() string {
-	return "daily LLM spending limit reached"
+	return fmt.Sprintf("%s LLM spending limit reached", cmp.Or(e.Status.Period, budgetDaily))
 }
 
-func (b *Bot) reserveLLMSpend(prompt string) (SpendingReservation, SpendingStatus, bool, error) {
+func (b *Bot) reserveLLMSpend(messageID int64, modelName, prompt string) (SpendingReservation, SpendingStatus, bool, error) {
 	if b.spendingLimiter == nil || !b.spendingLimiter.IsEnabled() {
 		return SpendingReservation{}, SpendingStatus{}, true, nil
 	}
-	return b.spendingLimiter.Reserve(b.ctx, time.Now(), prompt, b.chatModelMaxOutputTokens())
+	return b.spendingLimiter.Reserve(b.ctx, time.Now(), messageID, modelName, prompt, b.chatModelMaxOutputTokens())
 }
 
 func (b *Bot) chatModelMaxOutputTokens() int {
-	if b.maxOutputTokens <= 0 {
+	maxOutputTokens := b.currentConfig().ChatModel.MaxOutputTokens
+	if maxOutputTokens <= 0 {
 		return 1
 	}
-	return b.maxOutputTokens
+	return maxOutputTokens
 }
 
 func (b *Bot) waitForLLMRequestSlot() error {
@@ -245,5 +492,14 @@ func usageFromResponse(resp *schema.Message) *schema.TokenUsage {
 }
 
 func (b *Bot) currentModelName() string {
-	return b.llmModelName
+	return b.currentConfig().ChatModel.Model
+}
+
+// optionsModelName returns the model that opts select, the configured one
+// unless they override it.
+func (b *Bot) optionsModelName(opts []model.Option) string {
+	if options := model.GetCommonOptions(nil, opts...); options.Model != nil && *options.Model != "" {
+		return *options.Model
+	}
+	return b.currentModelName()
 }
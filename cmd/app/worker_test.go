@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/eino/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/meguminnnnnnnnn/go-openai"
+
+	database "github.com/ralscha/bluesky_llm_replybot/internal/database/generated"
+)
+
+func TestProcessNextMessageStoresResponse(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, AuthorHandle: "alice.test", MessageText: "hello"}}
+	bot.model.responses = []*schema.Message{schema.AssistantMessage("Hi there!", nil)}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if len(bot.queries.llmResponses) != 1 {
+		t.Fatalf("stored %d responses; want 1", len(bot.queries.llmResponses))
+	}
+	got := bot.queries.llmResponses[0]
+	if got.ID != 1 || *got.LlmResponse != "Hi there!" || *got.ModelName != "test-model" {
+		t.Fatalf("stored response = %+v", got)
+	}
+}
+
+func TestProcessNextMessageWithEmptyQueue(t *testing.T) {
+	bot := newTestBot(3)
+
+	if err := bot.processNextMessage(); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("processNextMessage() error = %v; want pgx.ErrNoRows", err)
+	}
+	if bot.model.calls != 0 {
+		t.Fatalf("model called %d times; want 0", bot.model.calls)
+	}
+}
+
+func TestProcessNextMessageRetriesFailedGeneration(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 7, MessageText: "hello", RetryCount: 1}}
+	bot.model.errs = []error{errors.New("provider unavailable")}
+
+	if err := bot.processNextMessage(); err == nil {
+		t.Fatal("processNextMessage() error = nil; want generation error")
+	}
+
+	if len(bot.queries.failed) != 1 || bot.queries.failed[0].ID != 7 || bot.queries.failed[0].RetryCount != 3 {
+		t.Fatalf("failed updates = %+v", bot.queries.failed)
+	}
+	failed := bot.queries.failed[0]
+	if failed.LastError == nil || *failed.LastError != "unknown: provider unavailable" {
+		t.Fatalf("last error = %v; want classified error text", failed.LastError)
+	}
+	if delay := time.Until(failed.NextAttemptAt.Time); delay < 29*time.Second || delay > 61*time.Second {
+		t.Fatalf("next attempt in %s; want backoff between 30s and 60s", delay)
+	}
+	if len(bot.queries.llmResponses) != 0 {
+		t.Fatalf("stored %d responses; want 0", len(bot.queries.llmResponses))
+	}
+}
+
+func TestProcessNextMessageSkipsRetriesForPermanentErrors(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 7, MessageText: "hello"}}
+	bot.model.errs = []error{fmt.Errorf("failed to create chat completion: %w", &openai.APIError{HTTPStatusCode: 401, Message: "invalid api key"})}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if len(bot.queries.failed) != 0 {
+		t.Fatalf("failed updates = %+v; want none", bot.queries.failed)
+	}
+	if len(bot.queries.llmResponses) != 1 || *bot.queries.llmResponses[0].LlmResponse != fallbackResponseText {
+		t.Fatalf("stored responses = %+v; want fallback", bot.queries.llmResponses)
+	}
+	if lastError := bot.queries.llmResponses[0].LastError; lastError == nil || !strings.HasPrefix(*lastError, "auth: ") {
+		t.Fatalf("last error = %v; want auth error", lastError)
+	}
+}
+
+func TestClassifyLLMError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want LLMErrorClass
+	}{
+		{&openai.APIError{HTTPStatusCode: 429}, LLMErrorRateLimited},
+		{&openai.RequestError{HTTPStatusCode: 503}, LLMErrorServer},
+		{&openai.APIError{HTTPStatusCode: 403}, LLMErrorAuth},
+		{&openai.APIError{HTTPStatusCode: 400, Code: "content_policy_violation"}, LLMErrorContentFilter},
+		{&openai.APIError{HTTPStatusCode: 400}, LLMErrorInvalidRequest},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), LLMErrorTimeout},
+		{errContentFiltered, LLMErrorContentFilter},
+		{errors.New("connection reset"), LLMErrorUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := classifyLLMError(tt.err); got != tt.want {
+			t.Errorf("classifyLLMError(%v) = %s; want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelayGrowsAndCaps(t *testing.T) {
+	for retryCount, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		for range 20 {
+			got := retryDelay(10*time.Second, time.Minute, int32(retryCount))
+			if got < want/2 || got > want {
+				t.Fatalf("retryDelay(retry %d) = %s; want between %s and %s", retryCount, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestProcessNextMessageUsesFallbackAfterMaxRetries(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 7, MessageText: "hello", RetryCount: 2}}
+	bot.model.errs = []error{errors.New("provider unavailable")}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if len(bot.queries.failed) != 0 {
+		t.Fatalf("failed updates = %+v; want none", bot.queries.failed)
+	}
+	if len(bot.queries.llmResponses) != 1 || *bot.queries.llmResponses[0].LlmResponse != fallbackResponseText {
+		t.Fatalf("stored responses = %+v; want fallback", bot.queries.llmResponses)
+	}
+	if len(bot.queries.deadLettered) != 1 || bot.queries.deadLettered[0].Stage != stageGenerate || !bot.queries.deadLettered[0].Answered {
+		t.Fatalf("dead letters = %+v; want answered generate dead letter", bot.queries.deadLettered)
+	}
+}
+
+func TestProcessNextMessageUsesModelOverride(t *testing.T) {
+	bot := newTestBot(3)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 3, MessageText: "hello", ModelOverride: new("other-model")}}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+	if len(bot.queries.llmResponses) != 1 || *bot.queries.llmResponses[0].ModelName != "other-model" {
+		t.Fatalf("stored responses = %+v; want other-model", bot.queries.llmResponses)
+	}
+}
+
+func TestProcessNextMessageDefersWhenSpendingLimitReached(t *testing.T) {
+	bot := newTestBot(3)
+	store := newFakeSpendingStore()
+	store.usage[usageDate(time.Now(), time.UTC)] = DailyUsage{SpentMicros: 1_000_000}
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 3, MessageText: "hello"}}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if bot.model.calls != 0 {
+		t.Fatalf("model called %d times; want 0", bot.model.calls)
+	}
+	if len(bot.queries.deferred) != 1 || bot.queries.deferred[0].ID != 3 || !bot.queries.deferred[0].DeferredUntil.Valid {
+		t.Fatalf("deferred updates = %+v", bot.queries.deferred)
+	}
+}
+
+func TestProcessNextMessageReleasesSpendOnLLMError(t *testing.T) {
+	bot := newTestBot(3)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 3, MessageText: "hello"}}
+	bot.model.errs = []error{errors.New("provider unavailable")}
+
+	if err := bot.processNextMessage(); err == nil {
+		t.Fatal("processNextMessage() error = nil; want generation error")
+	}
+
+	usage := store.usage[usageDate(time.Now(), time.UTC)]
+	if usage.SpentMicros != 0 || usage.ReservedMicros != 0 || len(store.reservations) != 0 {
+		t.Fatalf("daily usage = %+v, open reservations = %d; want the reservation released", usage, len(store.reservations))
+	}
+}
+
+func TestSpendingLimitNotice(t *testing.T) {
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status SpendingStatus
+		want   string
+	}{
+		{SpendingStatus{Period: budgetDaily, ResetAt: now.Add(30 * time.Minute)}, "my daily LLM budget. Your message will be processed after the daily reset in about 1 hour."},
+		{SpendingStatus{Period: budgetWeekly, ResetAt: now.Add(36 * time.Hour)}, "after the weekly reset in about 36 hours."},
+		{SpendingStatus{Period: budgetMonthly, ResetAt: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)}, "after the monthly reset in about 28 days."},
+		{SpendingStatus{Period: budgetDaily, Rolling: true, ResetAt: now.Add(3 * time.Hour)}, "my LLM budget for the last 24 hours. Your message will be processed in about 3 hours."},
+	}
+	for _, test := range tests {
+		if got := spendingLimitNotice(test.status, now); !strings.HasSuffix(got, test.want) {
+			t.Fatalf("spendingLimitNotice(%s) = %q; want suffix %q", test.status.Period, got, test.want)
+		}
+	}
+}
+
+func TestProcessNextMessageStreamsAndCutsOffAtThreadLength(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.LLMStreaming = true
+	config.MaxThreadPosts = 2
+	config.ThreadLengthStrategy = lengthStrategyTruncate
+	bot.config.Store(config)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "hello"}}
+	bot.model.streamChunkSize = 20
+	bot.model.responses = []*schema.Message{schema.AssistantMessage(strings.Repeat("word ", 400), nil)}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if len(bot.queries.llmResponses) != 1 {
+		t.Fatalf("stored %d responses; want 1", len(bot.queries.llmResponses))
+	}
+	response := *bot.queries.llmResponses[0].LlmResponse
+	if posts := threadPostCount(response, MarkerClassic); posts != 2 {
+		t.Fatalf("stored response needs %d posts; want 2", posts)
+	}
+	bot.model.mu.Lock()
+	streamed := bot.model.streamed
+	bot.model.mu.Unlock()
+	if streamed >= 100 {
+		t.Fatalf("read %d of 100 stream chunks; want early cutoff", streamed)
+	}
+}
+
+func TestStreamLLMResponseCutsOffAtFirstChunkOverThreadLength(t *testing.T) {
+	texts := []string{
+		strings.Repeat("word ", 400),
+		strings.Repeat("A sentence with some words in it. ", 60),
+		strings.Repeat("Paragraph text that goes on.\n\nSee https://example.com/a/very/long/path/to/a/page for details. ", 20),
+		strings.Repeat("Grüße 👋🏽 aus Zürich, ", 80),
+	}
+	for _, maxPosts := range []int{1, 2, 3} {
+		for _, long := range texts {
+			bot := newTestBot(3)
+			bot.model.streamChunkSize = 7
+			bot.model.responses = []*schema.Message{schema.AssistantMessage(long, nil)}
+
+			resp, cutOff, err := bot.streamLLMResponse(nil, maxPosts, MarkerClassic)
+			if err != nil || !cutOff {
+				t.Fatalf("streamLLMResponse() cutOff = %v, err = %v; want cutoff", cutOff, err)
+			}
+			// The first chunk boundary at which the text needs too many posts.
+			want := ""
+			for end := 7; ; end += 7 {
+				if threadPostCount(long[:min(end, len(long))], MarkerClassic) > maxPosts {
+					want = long[:min(end, len(long))]
+					break
+				}
+			}
+			if resp.Content != want {
+				t.Fatalf("max %d posts: cut off after %d bytes; want %d", maxPosts, len(resp.Content), len(want))
+			}
+		}
+	}
+}
+
+func TestProcessNextMessageFinalizesSpendFromStreamedUsage(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.LLMStreaming = true
+	bot.config.Store(config)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "hello"}}
+	bot.model.streamChunkSize = 4
+	resp := schema.AssistantMessage("Streamed reply", nil)
+	resp.ResponseMeta = &schema.ResponseMeta{
+		Usage: &schema.TokenUsage{PromptTokens: 1000, CompletionTokens: 3000, TotalTokens: 4000},
+	}
+	bot.model.responses = []*schema.Message{resp}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if got := *bot.queries.llmResponses[0].LlmResponse; got != "Streamed reply" {
+		t.Fatalf("stored response = %q", got)
+	}
+	usage := store.usage[usageDate(time.Now(), time.UTC)]
+	if usage.SpentMicros != 4000 || usage.ReservedMicros != 0 {
+		t.Fatalf("daily usage = %+v; want 4000 spent micros and nothing reserved", usage)
+	}
+}
+
+func TestSummarizeReplyFailureCountsForCircuitBreaker(t *testing.T) {
+	bot := newTestBot(3)
+	bot.circuitBreaker.Update(1, time.Hour)
+	config := testConfig(3)
+	config.MaxThreadPosts = 2
+	config.ThreadLengthStrategy = lengthStrategySummarize
+	bot.config.Store(config)
+	store := newFakeSpendingStore()
+	bot.spendingLimiter = NewSpendingLimiter(store, UsagePricing{InputMissPerMillion: 1, OutputPerMillion: 1}, SpendingLimits{Daily: 1})
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "hello"}}
+	bot.model.responses = []*schema.Message{schema.AssistantMessage(strings.Repeat("This sentence is part of a long answer. ", 40), nil)}
+	bot.model.errs = []error{nil, errors.New("provider unavailable")}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	if stored := bot.queries.llmResponses[0]; *stored.LengthStrategy != lengthStrategyTruncate {
+		t.Fatalf("length strategy = %s; want truncate after failed summary", *stored.LengthStrategy)
+	}
+	if !bot.circuitBreaker.IsOpen() {
+		t.Fatal("circuit breaker closed; want the failed summary call recorded")
+	}
+	if len(store.reservations) != 0 {
+		t.Fatalf("open reservations = %d; want the summary reservation released", len(store.reservations))
+	}
+}
+
+func TestTruncateReply(t *testing.T) {
+	long := strings.Repeat("This sentence is part of a long answer. ", 40)
+	for maxPosts := 1; maxPosts <= 3; maxPosts++ {
+		got := truncateReply(long, maxPosts, MarkerClassic)
+		if !strings.HasSuffix(got, ". …") {
+			t.Fatalf("truncateReply(long, %d) = %q; want sentence boundary and ellipsis", maxPosts, got)
+		}
+		if !strings.HasPrefix(long, strings.TrimSuffix(got, " …")) {
+			t.Fatalf("truncateReply(long, %d) is not a prefix of the reply", maxPosts)
+		}
+		if posts := threadPostCount(got, MarkerClassic); posts > maxPosts {
+			t.Fatalf("truncateReply(long, %d) needs %d posts", maxPosts, posts)
+		}
+	}
+
+	words := strings.Repeat("word ", 200)
+	if got := truncateReply(words, 1, MarkerClassic); !strings.HasSuffix(got, "word…") || threadPostCount(got, MarkerClassic) != 1 {
+		t.Fatalf("truncateReply(words, 1, MarkerClassic) = %q; want word boundary and ellipsis", got)
+	}
+}
+
+func TestProcessNextMessageRecordsLengthStrategy(t *testing.T) {
+	long := strings.Repeat("This sentence is part of a long answer. ", 40)
+
+	tests := []struct {
+		strategy  string
+		responses []*schema.Message
+		wantCalls int
+		check     func(t *testing.T, bot *testBot, text string)
+	}{
+		{
+			strategy:  lengthStrategyTruncate,
+			responses: []*schema.Message{schema.AssistantMessage(long, nil)},
+			wantCalls: 1,
+			check: func(t *testing.T, _ *testBot, text string) {
+				if !strings.HasSuffix(text, "…") || threadPostCount(text, MarkerClassic) > 2 {
+					t.Fatalf("truncated reply = %q", text)
+				}
+			},
+		},
+		{
+			strategy: lengthStrategySummarize,
+			responses: []*schema.Message{
+				schema.AssistantMessage(long, nil),
+				schema.AssistantMessage("A short summary.", nil),
+			},
+			wantCalls: 2,
+			check: func(t *testing.T, _ *testBot, text string) {
+				if text != "A short summary." {
+					t.Fatalf("summarized reply = %q", text)
+				}
+			},
+		},
+		{
+			strategy:  lengthStrategyLink,
+			responses: []*schema.Message{schema.AssistantMessage(long, nil)},
+			wantCalls: 1,
+			check: func(t *testing.T, bot *testBot, text string) {
+				if len(bot.queries.fullTextPages) != 1 {
+					t.Fatalf("stored %d full-text pages; want 1", len(bot.queries.fullTextPages))
+				}
+				page := bot.queries.fullTextPages[0]
+				if page.Text != long || page.MessageUri != "at://did:plc:alice/app.bsky.feed.post/1" {
+					t.Fatalf("full-text page = %+v", page)
+				}
+				if !strings.HasSuffix(text, "https://bot.example.com/replies/"+page.Token) || threadPostCount(text, MarkerClassic) != 1 {
+					t.Fatalf("linked reply = %q", text)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			bot := newTestBot(3)
+			config := testConfig(3)
+			config.MaxThreadPosts = 2
+			config.ThreadLengthStrategy = tt.strategy
+			config.FullTextBaseURL = "https://bot.example.com/replies/"
+			bot.config.Store(config)
+			bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageUri: "at://did:plc:alice/app.bsky.feed.post/1", MessageText: "hello"}}
+			bot.model.responses = tt.responses
+
+			if err := bot.processNextMessage(); err != nil {
+				t.Fatalf("processNextMessage() error = %v", err)
+			}
+
+			if bot.model.calls != tt.wantCalls {
+				t.Fatalf("model called %d times; want %d", bot.model.calls, tt.wantCalls)
+			}
+			stored := bot.queries.llmResponses[0]
+			if stored.LengthStrategy == nil || *stored.LengthStrategy != tt.strategy {
+				t.Fatalf("length strategy = %v; want %s", stored.LengthStrategy, tt.strategy)
+			}
+			tt.check(t, bot, *stored.LlmResponse)
+		})
+	}
+}
+
+func TestProcessNextMessageLeavesShortReplyUnchanged(t *testing.T) {
+	bot := newTestBot(3)
+	config := testConfig(3)
+	config.MaxThreadPosts = 1
+	config.ThreadLengthStrategy = lengthStrategySummarize
+	bot.config.Store(config)
+	bot.queries.claimable = []database.ClaimNextMessageRow{{ID: 1, MessageText: "hello"}}
+	bot.model.responses = []*schema.Message{schema.AssistantMessage("Short.", nil)}
+
+	if err := bot.processNextMessage(); err != nil {
+		t.Fatalf("processNextMessage() error = %v", err)
+	}
+
+	stored := bot.queries.llmResponses[0]
+	if *stored.LlmResponse != "Short." || stored.LengthStrategy != nil || bot.model.calls != 1 {
+		t.Fatalf("stored = %+v, calls = %d", stored, bot.model.calls)
+	}
+}
+
+func (q *fakeQuerier) AppendMessageAttempt(_ context.Context, arg database.AppendMessageAttemptParams) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.attempts = append(q.attempts, arg)
+	return nil
+}
+
+func (q *fakeQuerier) DeadLetterQueueMessage(_ context.Context, arg database.DeadLetterQueueMessageParams) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deadLettered = append(q.deadLettered, arg)
+	return int64(len(q.deadLettered)), nil
+}
@@ -7,10 +7,92 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const getMessageHistory = `-- name: GetMessageHistory :one
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+FROM message_history
+WHERE id = $1
+`
+
+func (q *Queries) GetMessageHistory(ctx context.Context, id int64) (MessageHistory, error) {
+	row := q.db.QueryRow(ctx, getMessageHistory, id)
+	var i MessageHistory
+	err := row.Scan(
+		&i.ID,
+		&i.MessageUri,
+		&i.MessageCid,
+		&i.AuthorDid,
+		&i.AuthorHandle,
+		&i.MessageText,
+		&i.LlmResponse,
+		&i.ReplyUri,
+		&i.ReplyCid,
+		&i.Status,
+		&i.RetryCount,
+		&i.ErrorMessage,
+		&i.ModelName,
+		&i.ReceivedAt,
+		&i.ProcessingStartedAt,
+		&i.CompletedAt,
+		&i.LengthStrategy,
+		&i.ReplyPostUris,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.Channel,
+		&i.ConvoID,
+		&i.GuardrailVerdicts,
+		&i.ReviewedBy,
+		&i.ReviewedAt,
+	)
+	return i, err
+}
+
+const getMessageHistoryByReplyPost = `-- name: GetMessageHistoryByReplyPost :one
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+FROM message_history
+WHERE reply_uri = $1::text
+   OR $1::text = ANY(reply_post_uris)
+ORDER BY completed_at DESC
+LIMIT 1
+`
+
+func (q *Queries) GetMessageHistoryByReplyPost(ctx context.Context, postUri string) (MessageHistory, error) {
+	row := q.db.QueryRow(ctx, getMessageHistoryByReplyPost, postUri)
+	var i MessageHistory
+	err := row.Scan(
+		&i.ID,
+		&i.MessageUri,
+		&i.MessageCid,
+		&i.AuthorDid,
+		&i.AuthorHandle,
+		&i.MessageText,
+		&i.LlmResponse,
+		&i.ReplyUri,
+		&i.ReplyCid,
+		&i.Status,
+		&i.RetryCount,
+		&i.ErrorMessage,
+		&i.ModelName,
+		&i.ReceivedAt,
+		&i.ProcessingStartedAt,
+		&i.CompletedAt,
+		&i.LengthStrategy,
+		&i.ReplyPostUris,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.Channel,
+		&i.ConvoID,
+		&i.GuardrailVerdicts,
+		&i.ReviewedBy,
+		&i.ReviewedAt,
+	)
+	return i, err
+}
+
 const insertMessageHistory = `-- name: InsertMessageHistory :one
 INSERT INTO message_history (
     message_uri,
@@ -27,10 +109,17 @@ INSERT INTO message_history (
     model_name,
     received_at,
     processing_started_at,
+    length_strategy,
+    reply_post_uris,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
     completed_at
 ) VALUES (
-    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW()
-) RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, NOW()
+) RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
 `
 
 type InsertMessageHistoryParams struct {
@@ -48,6 +137,13 @@ type InsertMessageHistoryParams struct {
 	ModelName           *string            `json:"model_name"`
 	ReceivedAt          pgtype.Timestamptz `json:"received_at"`
 	ProcessingStartedAt pgtype.Timestamptz `json:"processing_started_at"`
+	LengthStrategy      *string            `json:"length_strategy"`
+	ReplyPostUris       []string           `json:"reply_post_uris"`
+	Channel             string             `json:"channel"`
+	ConvoID             *string            `json:"convo_id"`
+	GuardrailVerdicts   json.RawMessage    `json:"guardrail_verdicts"`
+	ReviewedBy          *string            `json:"reviewed_by"`
+	ReviewedAt          pgtype.Timestamptz `json:"reviewed_at"`
 }
 
 func (q *Queries) InsertMessageHistory(ctx context.Context, arg InsertMessageHistoryParams) (MessageHistory, error) {
@@ -66,6 +162,13 @@ func (q *Queries) InsertMessageHistory(ctx context.Context, arg InsertMessageHis
 		arg.ModelName,
 		arg.ReceivedAt,
 		arg.ProcessingStartedAt,
+		arg.LengthStrategy,
+		arg.ReplyPostUris,
+		arg.Channel,
+		arg.ConvoID,
+		arg.GuardrailVerdicts,
+		arg.ReviewedBy,
+		arg.ReviewedAt,
 	)
 	var i MessageHistory
 	err := row.Scan(
@@ -85,6 +188,261 @@ func (q *Queries) InsertMessageHistory(ctx context.Context, arg InsertMessageHis
 		&i.ReceivedAt,
 		&i.ProcessingStartedAt,
 		&i.CompletedAt,
+		&i.LengthStrategy,
+		&i.ReplyPostUris,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.Channel,
+		&i.ConvoID,
+		&i.GuardrailVerdicts,
+		&i.ReviewedBy,
+		&i.ReviewedAt,
 	)
 	return i, err
 }
+
+const listMessageHistoryBetween = `-- name: ListMessageHistoryBetween :many
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+FROM message_history
+WHERE completed_at >= $1
+  AND completed_at < $2
+ORDER BY completed_at ASC
+`
+
+type ListMessageHistoryBetweenParams struct {
+	FromTime pgtype.Timestamptz `json:"from_time"`
+	ToTime   pgtype.Timestamptz `json:"to_time"`
+}
+
+func (q *Queries) ListMessageHistoryBetween(ctx context.Context, arg ListMessageHistoryBetweenParams) ([]MessageHistory, error) {
+	rows, err := q.db.Query(ctx, listMessageHistoryBetween, arg.FromTime, arg.ToTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []MessageHistory{}
+	for rows.Next() {
+		var i MessageHistory
+		if err := rows.Scan(
+			&i.ID,
+			&i.MessageUri,
+			&i.MessageCid,
+			&i.AuthorDid,
+			&i.AuthorHandle,
+			&i.MessageText,
+			&i.LlmResponse,
+			&i.ReplyUri,
+			&i.ReplyCid,
+			&i.Status,
+			&i.RetryCount,
+			&i.ErrorMessage,
+			&i.ModelName,
+			&i.ReceivedAt,
+			&i.ProcessingStartedAt,
+			&i.CompletedAt,
+			&i.LengthStrategy,
+			&i.ReplyPostUris,
+			&i.DeletedAt,
+			&i.DeletedBy,
+			&i.Channel,
+			&i.ConvoID,
+			&i.GuardrailVerdicts,
+			&i.ReviewedBy,
+			&i.ReviewedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRepliesCompletedSince = `-- name: ListRepliesCompletedSince :many
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+FROM message_history
+WHERE deleted_at IS NULL
+  AND reply_uri IS NOT NULL
+  AND channel = 'post'
+  AND completed_at >= $1
+ORDER BY completed_at ASC
+`
+
+func (q *Queries) ListRepliesCompletedSince(ctx context.Context, since pgtype.Timestamptz) ([]MessageHistory, error) {
+	rows, err := q.db.Query(ctx, listRepliesCompletedSince, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []MessageHistory{}
+	for rows.Next() {
+		var i MessageHistory
+		if err := rows.Scan(
+			&i.ID,
+			&i.MessageUri,
+			&i.MessageCid,
+			&i.AuthorDid,
+			&i.AuthorHandle,
+			&i.MessageText,
+			&i.LlmResponse,
+			&i.ReplyUri,
+			&i.ReplyCid,
+			&i.Status,
+			&i.RetryCount,
+			&i.ErrorMessage,
+			&i.ModelName,
+			&i.ReceivedAt,
+			&i.ProcessingStartedAt,
+			&i.CompletedAt,
+			&i.LengthStrategy,
+			&i.ReplyPostUris,
+			&i.DeletedAt,
+			&i.DeletedBy,
+			&i.Channel,
+			&i.ConvoID,
+			&i.GuardrailVerdicts,
+			&i.ReviewedBy,
+			&i.ReviewedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markMessageHistoryDeleted = `-- name: MarkMessageHistoryDeleted :execrows
+UPDATE message_history
+SET
+    status = 'deleted',
+    deleted_at = NOW(),
+    deleted_by = $2
+WHERE id = $1
+  AND deleted_at IS NULL
+`
+
+type MarkMessageHistoryDeletedParams struct {
+	ID        int64   `json:"id"`
+	DeletedBy *string `json:"deleted_by"`
+}
+
+func (q *Queries) MarkMessageHistoryDeleted(ctx context.Context, arg MarkMessageHistoryDeletedParams) (int64, error) {
+	result, err := q.db.Exec(ctx, markMessageHistoryDeleted, arg.ID, arg.DeletedBy)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const regenerateHistoryMessage = `-- name: RegenerateHistoryMessage :one
+INSERT INTO message_queue (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    model_override,
+    channel,
+    convo_id
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    $1::text,
+    channel,
+    convo_id
+FROM message_history
+WHERE message_history.id = $2
+ON CONFLICT (message_uri) DO NOTHING
+RETURNING id
+`
+
+type RegenerateHistoryMessageParams struct {
+	ModelOverride *string `json:"model_override"`
+	ID            int64   `json:"id"`
+}
+
+func (q *Queries) RegenerateHistoryMessage(ctx context.Context, arg RegenerateHistoryMessageParams) (int64, error) {
+	row := q.db.QueryRow(ctx, regenerateHistoryMessage, arg.ModelOverride, arg.ID)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const searchMessageHistory = `-- name: SearchMessageHistory :many
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response, reply_uri, reply_cid, status, retry_count, error_message, model_name, received_at, processing_started_at, completed_at, length_strategy, reply_post_uris, deleted_at, deleted_by, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+FROM message_history
+WHERE ($1::text IS NULL OR author_handle = $1::text OR author_did = $1::text)
+  AND ($2::text IS NULL OR status = $2::text)
+  AND ($3::text IS NULL
+       OR message_text ILIKE '%' || $3::text || '%'
+       OR llm_response ILIKE '%' || $3::text || '%')
+ORDER BY completed_at DESC
+LIMIT $4
+`
+
+type SearchMessageHistoryParams struct {
+	Author   *string `json:"author"`
+	Status   *string `json:"status"`
+	Query    *string `json:"query"`
+	RowLimit int32   `json:"row_limit"`
+}
+
+func (q *Queries) SearchMessageHistory(ctx context.Context, arg SearchMessageHistoryParams) ([]MessageHistory, error) {
+	rows, err := q.db.Query(ctx, searchMessageHistory,
+		arg.Author,
+		arg.Status,
+		arg.Query,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []MessageHistory{}
+	for rows.Next() {
+		var i MessageHistory
+		if err := rows.Scan(
+			&i.ID,
+			&i.MessageUri,
+			&i.MessageCid,
+			&i.AuthorDid,
+			&i.AuthorHandle,
+			&i.MessageText,
+			&i.LlmResponse,
+			&i.ReplyUri,
+			&i.ReplyCid,
+			&i.Status,
+			&i.RetryCount,
+			&i.ErrorMessage,
+			&i.ModelName,
+			&i.ReceivedAt,
+			&i.ProcessingStartedAt,
+			&i.CompletedAt,
+			&i.LengthStrategy,
+			&i.ReplyPostUris,
+			&i.DeletedAt,
+			&i.DeletedBy,
+			&i.Channel,
+			&i.ConvoID,
+			&i.GuardrailVerdicts,
+			&i.ReviewedBy,
+			&i.ReviewedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -5,16 +5,80 @@
 package database
 
 import (
+	"encoding/json"
+
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type DeadLetter struct {
+	ID             int64              `json:"id"`
+	QueueID        int64              `json:"queue_id"`
+	MessageUri     string             `json:"message_uri"`
+	MessageCid     string             `json:"message_cid"`
+	AuthorDid      string             `json:"author_did"`
+	AuthorHandle   string             `json:"author_handle"`
+	MessageText    string             `json:"message_text"`
+	Notification   json.RawMessage    `json:"notification"`
+	Stage          string             `json:"stage"`
+	LastError      *string            `json:"last_error"`
+	Attempts       json.RawMessage    `json:"attempts"`
+	RetryCount     int32              `json:"retry_count"`
+	ModelName      *string            `json:"model_name"`
+	ReceivedAt     pgtype.Timestamptz `json:"received_at"`
+	DeadLetteredAt pgtype.Timestamptz `json:"dead_lettered_at"`
+	Channel        string             `json:"channel"`
+	ConvoID        *string            `json:"convo_id"`
+	Answered       bool               `json:"answered"`
+}
+
+type FullTextPage struct {
+	Token      string             `json:"token"`
+	MessageUri string             `json:"message_uri"`
+	Text       string             `json:"text"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
+type KbDocument struct {
+	ID             int64              `json:"id"`
+	Source         string             `json:"source"`
+	Title          string             `json:"title"`
+	ContentHash    string             `json:"content_hash"`
+	EmbeddingModel string             `json:"embedding_model"`
+	CreatedAt      pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt      pgtype.Timestamptz `json:"updated_at"`
+}
+
+type KbPassage struct {
+	ID         int64     `json:"id"`
+	DocumentID int64     `json:"document_id"`
+	Ordinal    int32     `json:"ordinal"`
+	Heading    string    `json:"heading"`
+	Content    string    `json:"content"`
+	Embedding  []float32 `json:"embedding"`
+}
+
+type LlmSpendReservation struct {
+	ID           int64              `json:"id"`
+	UsageDate    pgtype.Date        `json:"usage_date"`
+	UsageHour    pgtype.Timestamptz `json:"usage_hour"`
+	AmountMicros int64              `json:"amount_micros"`
+	MessageID    *int64             `json:"message_id"`
+	CreatedAt    pgtype.Timestamptz `json:"created_at"`
+}
+
 type LlmUsageDaily struct {
 	UsageDate            pgtype.Date        `json:"usage_date"`
 	InputCacheTokens     int64              `json:"input_cache_tokens"`
 	InputMissTokens      int64              `json:"input_miss_tokens"`
 	OutputTokens         int64              `json:"output_tokens"`
 	EstimatedSpendMicros int64              `json:"estimated_spend_micros"`
-	ReservedSpendMicros  int64              `json:"reserved_spend_micros"`
+	UpdatedAt            pgtype.Timestamptz `json:"updated_at"`
+	EmbeddingTokens      int64              `json:"embedding_tokens"`
+}
+
+type LlmUsageHourly struct {
+	UsageHour            pgtype.Timestamptz `json:"usage_hour"`
+	EstimatedSpendMicros int64              `json:"estimated_spend_micros"`
 	UpdatedAt            pgtype.Timestamptz `json:"updated_at"`
 }
 
@@ -35,6 +99,15 @@ type MessageHistory struct {
 	ReceivedAt          pgtype.Timestamptz `json:"received_at"`
 	ProcessingStartedAt pgtype.Timestamptz `json:"processing_started_at"`
 	CompletedAt         pgtype.Timestamptz `json:"completed_at"`
+	LengthStrategy      *string            `json:"length_strategy"`
+	ReplyPostUris       []string           `json:"reply_post_uris"`
+	DeletedAt           pgtype.Timestamptz `json:"deleted_at"`
+	DeletedBy           *string            `json:"deleted_by"`
+	Channel             string             `json:"channel"`
+	ConvoID             *string            `json:"convo_id"`
+	GuardrailVerdicts   json.RawMessage    `json:"guardrail_verdicts"`
+	ReviewedBy          *string            `json:"reviewed_by"`
+	ReviewedAt          pgtype.Timestamptz `json:"reviewed_at"`
 }
 
 type MessageQueue struct {
@@ -52,4 +125,44 @@ type MessageQueue struct {
 	ModelName           *string            `json:"model_name"`
 	DeferredUntil       pgtype.Timestamptz `json:"deferred_until"`
 	SpendingNoticeSent  bool               `json:"spending_notice_sent"`
+	NextAttemptAt       pgtype.Timestamptz `json:"next_attempt_at"`
+	LastError           *string            `json:"last_error"`
+	Notification        json.RawMessage    `json:"notification"`
+	Attempts            json.RawMessage    `json:"attempts"`
+	ModelOverride       *string            `json:"model_override"`
+	LengthStrategy      *string            `json:"length_strategy"`
+	Channel             string             `json:"channel"`
+	ConvoID             *string            `json:"convo_id"`
+	GuardrailVerdicts   json.RawMessage    `json:"guardrail_verdicts"`
+	ApprovalRequestedAt pgtype.Timestamptz `json:"approval_requested_at"`
+	ReviewedBy          *string            `json:"reviewed_by"`
+	ReviewedAt          pgtype.Timestamptz `json:"reviewed_at"`
+}
+
+type SpendingAlert struct {
+	Period      string             `json:"period"`
+	PeriodStart pgtype.Date        `json:"period_start"`
+	Threshold   int32              `json:"threshold"`
+	SentAt      pgtype.Timestamptz `json:"sent_at"`
+}
+
+type ToolCall struct {
+	ID         int64              `json:"id"`
+	MessageUri string             `json:"message_uri"`
+	Round      int32              `json:"round"`
+	CallID     string             `json:"call_id"`
+	ToolName   string             `json:"tool_name"`
+	Arguments  string             `json:"arguments"`
+	Result     *string            `json:"result"`
+	Error      *string            `json:"error"`
+	DurationMs int64              `json:"duration_ms"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
+type UserMemory struct {
+	AuthorDid     string             `json:"author_did"`
+	Summary       string             `json:"summary"`
+	LastHistoryID int64              `json:"last_history_id"`
+	ForgottenAt   pgtype.Timestamptz `json:"forgotten_at"`
+	UpdatedAt     pgtype.Timestamptz `json:"updated_at"`
 }
@@ -6,21 +6,83 @@ package database
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type Querier interface {
+	AddDailySpend(ctx context.Context, arg AddDailySpendParams) (AddDailySpendRow, error)
+	AddHourlySpend(ctx context.Context, arg AddHourlySpendParams) error
+	AppendGuardrailVerdicts(ctx context.Context, arg AppendGuardrailVerdictsParams) error
+	AppendMessageAttempt(ctx context.Context, arg AppendMessageAttemptParams) error
+	ApproveQueueMessage(ctx context.Context, arg ApproveQueueMessageParams) (int64, error)
+	CancelQueueMessage(ctx context.Context, arg CancelQueueMessageParams) (int64, error)
 	ClaimNextMessage(ctx context.Context) (ClaimNextMessageRow, error)
+	DeadLetterQueueMessage(ctx context.Context, arg DeadLetterQueueMessageParams) (int64, error)
+	DeleteAllDeadLetters(ctx context.Context) (int64, error)
+	DeleteDeadLetter(ctx context.Context, id int64) (int64, error)
+	DeleteExpiredUserMemories(ctx context.Context, updatedBefore pgtype.Timestamptz) (int64, error)
+	DeleteKBDocument(ctx context.Context, source string) (int64, error)
+	DeleteKBPassages(ctx context.Context, documentID int64) error
 	DeleteMessageFromQueue(ctx context.Context, id int64) error
+	DeleteSpendReservation(ctx context.Context, id int64) (int64, error)
+	EnsureDailyUsage(ctx context.Context, usageDate pgtype.Date) error
+	ExpireSpendReservations(ctx context.Context, createdBefore pgtype.Timestamptz) ([]LlmSpendReservation, error)
+	FinalizeReservedSpend(ctx context.Context, arg FinalizeReservedSpendParams) (FinalizeReservedSpendRow, error)
+	ForgetUserMemory(ctx context.Context, authorDid string) error
+	GetDailyUsage(ctx context.Context, usageDate pgtype.Date) (GetDailyUsageRow, error)
+	GetDeadLetter(ctx context.Context, id int64) (DeadLetter, error)
+	GetFullTextPage(ctx context.Context, token string) (FullTextPage, error)
+	GetKBDocumentBySource(ctx context.Context, source string) (KbDocument, error)
+	GetKBRevision(ctx context.Context) (GetKBRevisionRow, error)
+	GetMessageHistory(ctx context.Context, id int64) (MessageHistory, error)
+	GetMessageHistoryByReplyPost(ctx context.Context, postUri string) (MessageHistory, error)
+	GetQueueMessage(ctx context.Context, id int64) (MessageQueue, error)
 	GetReadyToSendMessages(ctx context.Context, limit int32) ([]GetReadyToSendMessagesRow, error)
-	GetStaleProcessingMessages(ctx context.Context) ([]GetStaleProcessingMessagesRow, error)
+	GetStaleProcessingMessages(ctx context.Context, startedBefore pgtype.Timestamptz) ([]GetStaleProcessingMessagesRow, error)
+	GetUserMemory(ctx context.Context, authorDid string) (UserMemory, error)
+	InsertFullTextPage(ctx context.Context, arg InsertFullTextPageParams) error
+	InsertKBPassage(ctx context.Context, arg InsertKBPassageParams) error
 	InsertMessage(ctx context.Context, arg InsertMessageParams) (int64, error)
 	InsertMessageHistory(ctx context.Context, arg InsertMessageHistoryParams) (MessageHistory, error)
+	InsertSpendReservation(ctx context.Context, arg InsertSpendReservationParams) (int64, error)
+	InsertSpendingAlert(ctx context.Context, arg InsertSpendingAlertParams) (int64, error)
+	InsertToolCall(ctx context.Context, arg InsertToolCallParams) error
+	ListAwaitingApproval(ctx context.Context, rowLimit int32) ([]ListAwaitingApprovalRow, error)
+	ListDailyUsage(ctx context.Context, arg ListDailyUsageParams) ([]ListDailyUsageRow, error)
+	ListDeadLetters(ctx context.Context, rowLimit int32) ([]ListDeadLettersRow, error)
+	ListExpiredApprovals(ctx context.Context, requestedBefore pgtype.Timestamptz) ([]int64, error)
+	ListHourlyUsage(ctx context.Context, since pgtype.Timestamptz) ([]ListHourlyUsageRow, error)
+	ListKBDocuments(ctx context.Context) ([]ListKBDocumentsRow, error)
+	ListKBPassages(ctx context.Context) ([]ListKBPassagesRow, error)
+	ListMemoryExchanges(ctx context.Context, arg ListMemoryExchangesParams) ([]ListMemoryExchangesRow, error)
+	ListMessageHistoryBetween(ctx context.Context, arg ListMessageHistoryBetweenParams) ([]MessageHistory, error)
+	ListQueueMessages(ctx context.Context, arg ListQueueMessagesParams) ([]ListQueueMessagesRow, error)
+	ListQueueSources(ctx context.Context) ([]ListQueueSourcesRow, error)
+	ListRepliesCompletedSince(ctx context.Context, since pgtype.Timestamptz) ([]MessageHistory, error)
+	ListToolCalls(ctx context.Context, messageUri string) ([]ToolCall, error)
+	LockDailyUsage(ctx context.Context, usageDate pgtype.Date) (int64, error)
 	MarkDeferredNoticeSent(ctx context.Context, id int64) error
+	MarkMessageHistoryDeleted(ctx context.Context, arg MarkMessageHistoryDeletedParams) (int64, error)
+	PurgeQueueMessages(ctx context.Context, status string) (int64, error)
+	RegenerateHistoryMessage(ctx context.Context, arg RegenerateHistoryMessageParams) (int64, error)
+	RejectQueueMessage(ctx context.Context, arg RejectQueueMessageParams) (int64, error)
+	ReleaseMessage(ctx context.Context, arg ReleaseMessageParams) error
+	ReplayDeadLetter(ctx context.Context, arg ReplayDeadLetterParams) (int64, error)
+	RequeueMessage(ctx context.Context, id int64) (int64, error)
 	ResetStaleMessage(ctx context.Context, id int64) error
+	// Requires the pgvector extension. The cast allows embeddings of any
+	// dimension in the REAL[] column.
+	SearchKBPassages(ctx context.Context, arg SearchKBPassagesParams) ([]SearchKBPassagesRow, error)
+	SearchMessageHistory(ctx context.Context, arg SearchMessageHistoryParams) ([]MessageHistory, error)
+	SubmitMessageForApproval(ctx context.Context, arg SubmitMessageForApprovalParams) error
+	SumUsageBetween(ctx context.Context, arg SumUsageBetweenParams) (SumUsageBetweenRow, error)
 	UpdateMessageDeferredWithNotice(ctx context.Context, arg UpdateMessageDeferredWithNoticeParams) error
 	UpdateMessageFailed(ctx context.Context, arg UpdateMessageFailedParams) error
 	UpdateMessageWithLLMResponse(ctx context.Context, arg UpdateMessageWithLLMResponseParams) error
 	UpdateReadyToSendMessageFailed(ctx context.Context, arg UpdateReadyToSendMessageFailedParams) error
+	UpsertKBDocument(ctx context.Context, arg UpsertKBDocumentParams) (int64, error)
+	UpsertUserMemory(ctx context.Context, arg UpsertUserMemoryParams) error
 }
 
 var _ Querier = (*Queries)(nil)
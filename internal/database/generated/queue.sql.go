@@ -7,10 +7,134 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const appendGuardrailVerdicts = `-- name: AppendGuardrailVerdicts :exec
+UPDATE message_queue
+SET guardrail_verdicts = guardrail_verdicts || $1::jsonb
+WHERE id = $2
+`
+
+type AppendGuardrailVerdictsParams struct {
+	Verdicts json.RawMessage `json:"verdicts"`
+	ID       int64           `json:"id"`
+}
+
+func (q *Queries) AppendGuardrailVerdicts(ctx context.Context, arg AppendGuardrailVerdictsParams) error {
+	_, err := q.db.Exec(ctx, appendGuardrailVerdicts, arg.Verdicts, arg.ID)
+	return err
+}
+
+const appendMessageAttempt = `-- name: AppendMessageAttempt :exec
+UPDATE message_queue
+SET attempts = attempts || $1::jsonb
+WHERE id = $2
+`
+
+type AppendMessageAttemptParams struct {
+	Attempt json.RawMessage `json:"attempt"`
+	ID      int64           `json:"id"`
+}
+
+func (q *Queries) AppendMessageAttempt(ctx context.Context, arg AppendMessageAttemptParams) error {
+	_, err := q.db.Exec(ctx, appendMessageAttempt, arg.Attempt, arg.ID)
+	return err
+}
+
+const approveQueueMessage = `-- name: ApproveQueueMessage :execrows
+UPDATE message_queue
+SET
+    status = 'ready_to_send',
+    llm_response = COALESCE($1::text, llm_response),
+    reviewed_by = $2,
+    reviewed_at = NOW()
+WHERE id = $3
+  AND status = 'awaiting_approval'
+`
+
+type ApproveQueueMessageParams struct {
+	LlmResponse *string `json:"llm_response"`
+	ReviewedBy  *string `json:"reviewed_by"`
+	ID          int64   `json:"id"`
+}
+
+func (q *Queries) ApproveQueueMessage(ctx context.Context, arg ApproveQueueMessageParams) (int64, error) {
+	result, err := q.db.Exec(ctx, approveQueueMessage, arg.LlmResponse, arg.ReviewedBy, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const cancelQueueMessage = `-- name: CancelQueueMessage :execrows
+WITH cancelled AS (
+    DELETE FROM message_queue
+    WHERE id = $1
+      AND status <> 'processing'
+    RETURNING message_uri, message_cid, author_did, author_handle, message_text, llm_response,
+              retry_count, model_name, created_at, processing_started_at, length_strategy,
+              channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+)
+INSERT INTO message_history (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    llm_response,
+    status,
+    retry_count,
+    error_message,
+    model_name,
+    received_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    completed_at
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    COALESCE(llm_response, ''),
+    'cancelled',
+    retry_count,
+    $2::text,
+    model_name,
+    created_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    NOW()
+FROM cancelled
+`
+
+type CancelQueueMessageParams struct {
+	ID     int64   `json:"id"`
+	Reason *string `json:"reason"`
+}
+
+func (q *Queries) CancelQueueMessage(ctx context.Context, arg CancelQueueMessageParams) (int64, error) {
+	result, err := q.db.Exec(ctx, cancelQueueMessage, arg.ID, arg.Reason)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const claimNextMessage = `-- name: ClaimNextMessage :one
 UPDATE message_queue
 SET
@@ -20,21 +144,26 @@ WHERE id = (
     SELECT id FROM message_queue
     WHERE status = 'pending'
       AND (deferred_until IS NULL OR deferred_until <= NOW())
+      AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
     ORDER BY created_at ASC
     FOR UPDATE SKIP LOCKED
     LIMIT 1
 )
-RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, retry_count
+RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, retry_count, model_override,
+          channel, convo_id
 `
 
 type ClaimNextMessageRow struct {
-	ID           int64  `json:"id"`
-	MessageUri   string `json:"message_uri"`
-	MessageCid   string `json:"message_cid"`
-	AuthorDid    string `json:"author_did"`
-	AuthorHandle string `json:"author_handle"`
-	MessageText  string `json:"message_text"`
-	RetryCount   int32  `json:"retry_count"`
+	ID            int64   `json:"id"`
+	MessageUri    string  `json:"message_uri"`
+	MessageCid    string  `json:"message_cid"`
+	AuthorDid     string  `json:"author_did"`
+	AuthorHandle  string  `json:"author_handle"`
+	MessageText   string  `json:"message_text"`
+	RetryCount    int32   `json:"retry_count"`
+	ModelOverride *string `json:"model_override"`
+	Channel       string  `json:"channel"`
+	ConvoID       *string `json:"convo_id"`
 }
 
 func (q *Queries) ClaimNextMessage(ctx context.Context) (ClaimNextMessageRow, error) {
@@ -48,6 +177,9 @@ func (q *Queries) ClaimNextMessage(ctx context.Context) (ClaimNextMessageRow, er
 		&i.AuthorHandle,
 		&i.MessageText,
 		&i.RetryCount,
+		&i.ModelOverride,
+		&i.Channel,
+		&i.ConvoID,
 	)
 	return i, err
 }
@@ -62,9 +194,50 @@ func (q *Queries) DeleteMessageFromQueue(ctx context.Context, id int64) error {
 	return err
 }
 
+const getQueueMessage = `-- name: GetQueueMessage :one
+SELECT id, status, message_uri, message_cid, author_did, author_handle, message_text, created_at, processing_started_at, retry_count, llm_response, model_name, deferred_until, spending_notice_sent, next_attempt_at, last_error, notification, attempts, model_override, length_strategy, channel, convo_id, guardrail_verdicts, approval_requested_at, reviewed_by, reviewed_at
+FROM message_queue
+WHERE id = $1
+`
+
+func (q *Queries) GetQueueMessage(ctx context.Context, id int64) (MessageQueue, error) {
+	row := q.db.QueryRow(ctx, getQueueMessage, id)
+	var i MessageQueue
+	err := row.Scan(
+		&i.ID,
+		&i.Status,
+		&i.MessageUri,
+		&i.MessageCid,
+		&i.AuthorDid,
+		&i.AuthorHandle,
+		&i.MessageText,
+		&i.CreatedAt,
+		&i.ProcessingStartedAt,
+		&i.RetryCount,
+		&i.LlmResponse,
+		&i.ModelName,
+		&i.DeferredUntil,
+		&i.SpendingNoticeSent,
+		&i.NextAttemptAt,
+		&i.LastError,
+		&i.Notification,
+		&i.Attempts,
+		&i.ModelOverride,
+		&i.LengthStrategy,
+		&i.Channel,
+		&i.ConvoID,
+		&i.GuardrailVerdicts,
+		&i.ApprovalRequestedAt,
+		&i.ReviewedBy,
+		&i.ReviewedAt,
+	)
+	return i, err
+}
+
 const getReadyToSendMessages = `-- name: GetReadyToSendMessages :many
 SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response,
-       model_name, created_at, processing_started_at, retry_count, status, deferred_until, spending_notice_sent
+       model_name, created_at, processing_started_at, retry_count, status, deferred_until, spending_notice_sent,
+       last_error, length_strategy, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
 FROM message_queue
 WHERE status = 'ready_to_send'
 ORDER BY created_at ASC
@@ -86,6 +259,13 @@ type GetReadyToSendMessagesRow struct {
 	Status              string             `json:"status"`
 	DeferredUntil       pgtype.Timestamptz `json:"deferred_until"`
 	SpendingNoticeSent  bool               `json:"spending_notice_sent"`
+	LastError           *string            `json:"last_error"`
+	LengthStrategy      *string            `json:"length_strategy"`
+	Channel             string             `json:"channel"`
+	ConvoID             *string            `json:"convo_id"`
+	GuardrailVerdicts   json.RawMessage    `json:"guardrail_verdicts"`
+	ReviewedBy          *string            `json:"reviewed_by"`
+	ReviewedAt          pgtype.Timestamptz `json:"reviewed_at"`
 }
 
 func (q *Queries) GetReadyToSendMessages(ctx context.Context, limit int32) ([]GetReadyToSendMessagesRow, error) {
@@ -112,6 +292,13 @@ func (q *Queries) GetReadyToSendMessages(ctx context.Context, limit int32) ([]Ge
 			&i.Status,
 			&i.DeferredUntil,
 			&i.SpendingNoticeSent,
+			&i.LastError,
+			&i.LengthStrategy,
+			&i.Channel,
+			&i.ConvoID,
+			&i.GuardrailVerdicts,
+			&i.ReviewedBy,
+			&i.ReviewedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -124,25 +311,26 @@ func (q *Queries) GetReadyToSendMessages(ctx context.Context, limit int32) ([]Ge
 }
 
 const getStaleProcessingMessages = `-- name: GetStaleProcessingMessages :many
-SELECT id, message_uri, message_cid, author_did, author_handle, message_text, retry_count
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, retry_count, processing_started_at
 FROM message_queue
 WHERE status = 'processing'
-  AND processing_started_at < NOW() - INTERVAL '5 minutes'
+  AND processing_started_at < $1
 ORDER BY created_at ASC
 `
 
 type GetStaleProcessingMessagesRow struct {
-	ID           int64  `json:"id"`
-	MessageUri   string `json:"message_uri"`
-	MessageCid   string `json:"message_cid"`
-	AuthorDid    string `json:"author_did"`
-	AuthorHandle string `json:"author_handle"`
-	MessageText  string `json:"message_text"`
-	RetryCount   int32  `json:"retry_count"`
+	ID                  int64              `json:"id"`
+	MessageUri          string             `json:"message_uri"`
+	MessageCid          string             `json:"message_cid"`
+	AuthorDid           string             `json:"author_did"`
+	AuthorHandle        string             `json:"author_handle"`
+	MessageText         string             `json:"message_text"`
+	RetryCount          int32              `json:"retry_count"`
+	ProcessingStartedAt pgtype.Timestamptz `json:"processing_started_at"`
 }
 
-func (q *Queries) GetStaleProcessingMessages(ctx context.Context) ([]GetStaleProcessingMessagesRow, error) {
-	rows, err := q.db.Query(ctx, getStaleProcessingMessages)
+func (q *Queries) GetStaleProcessingMessages(ctx context.Context, startedBefore pgtype.Timestamptz) ([]GetStaleProcessingMessagesRow, error) {
+	rows, err := q.db.Query(ctx, getStaleProcessingMessages, startedBefore)
 	if err != nil {
 		return nil, err
 	}
@@ -158,6 +346,7 @@ func (q *Queries) GetStaleProcessingMessages(ctx context.Context) ([]GetStalePro
 			&i.AuthorHandle,
 			&i.MessageText,
 			&i.RetryCount,
+			&i.ProcessingStartedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -175,20 +364,26 @@ INSERT INTO message_queue (
     message_cid,
     author_did,
     author_handle,
-    message_text
+    message_text,
+    notification,
+    channel,
+    convo_id
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, $6, $7, $8
 )
 ON CONFLICT (message_uri) DO NOTHING
 RETURNING id
 `
 
 type InsertMessageParams struct {
-	MessageUri   string `json:"message_uri"`
-	MessageCid   string `json:"message_cid"`
-	AuthorDid    string `json:"author_did"`
-	AuthorHandle string `json:"author_handle"`
-	MessageText  string `json:"message_text"`
+	MessageUri   string          `json:"message_uri"`
+	MessageCid   string          `json:"message_cid"`
+	AuthorDid    string          `json:"author_did"`
+	AuthorHandle string          `json:"author_handle"`
+	MessageText  string          `json:"message_text"`
+	Notification json.RawMessage `json:"notification"`
+	Channel      string          `json:"channel"`
+	ConvoID      *string         `json:"convo_id"`
 }
 
 func (q *Queries) InsertMessage(ctx context.Context, arg InsertMessageParams) (int64, error) {
@@ -198,12 +393,172 @@ func (q *Queries) InsertMessage(ctx context.Context, arg InsertMessageParams) (i
 		arg.AuthorDid,
 		arg.AuthorHandle,
 		arg.MessageText,
+		arg.Notification,
+		arg.Channel,
+		arg.ConvoID,
 	)
 	var id int64
 	err := row.Scan(&id)
 	return id, err
 }
 
+const listAwaitingApproval = `-- name: ListAwaitingApproval :many
+SELECT id, author_handle, message_text, llm_response, approval_requested_at
+FROM message_queue
+WHERE status = 'awaiting_approval'
+ORDER BY approval_requested_at ASC
+LIMIT $1
+`
+
+type ListAwaitingApprovalRow struct {
+	ID                  int64              `json:"id"`
+	AuthorHandle        string             `json:"author_handle"`
+	MessageText         string             `json:"message_text"`
+	LlmResponse         *string            `json:"llm_response"`
+	ApprovalRequestedAt pgtype.Timestamptz `json:"approval_requested_at"`
+}
+
+func (q *Queries) ListAwaitingApproval(ctx context.Context, rowLimit int32) ([]ListAwaitingApprovalRow, error) {
+	rows, err := q.db.Query(ctx, listAwaitingApproval, rowLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListAwaitingApprovalRow{}
+	for rows.Next() {
+		var i ListAwaitingApprovalRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.AuthorHandle,
+			&i.MessageText,
+			&i.LlmResponse,
+			&i.ApprovalRequestedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExpiredApprovals = `-- name: ListExpiredApprovals :many
+SELECT id
+FROM message_queue
+WHERE status = 'awaiting_approval'
+  AND approval_requested_at < $1
+ORDER BY approval_requested_at ASC
+`
+
+func (q *Queries) ListExpiredApprovals(ctx context.Context, requestedBefore pgtype.Timestamptz) ([]int64, error) {
+	rows, err := q.db.Query(ctx, listExpiredApprovals, requestedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listQueueMessages = `-- name: ListQueueMessages :many
+SELECT id, status, author_handle, message_text, retry_count, created_at, deferred_until, next_attempt_at
+FROM message_queue
+WHERE $1::text IS NULL OR status = $1::text
+ORDER BY created_at ASC
+LIMIT $2
+`
+
+type ListQueueMessagesParams struct {
+	Status   *string `json:"status"`
+	RowLimit int32   `json:"row_limit"`
+}
+
+type ListQueueMessagesRow struct {
+	ID            int64              `json:"id"`
+	Status        string             `json:"status"`
+	AuthorHandle  string             `json:"author_handle"`
+	MessageText   string             `json:"message_text"`
+	RetryCount    int32              `json:"retry_count"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+	DeferredUntil pgtype.Timestamptz `json:"deferred_until"`
+	NextAttemptAt pgtype.Timestamptz `json:"next_attempt_at"`
+}
+
+func (q *Queries) ListQueueMessages(ctx context.Context, arg ListQueueMessagesParams) ([]ListQueueMessagesRow, error) {
+	rows, err := q.db.Query(ctx, listQueueMessages, arg.Status, arg.RowLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListQueueMessagesRow{}
+	for rows.Next() {
+		var i ListQueueMessagesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Status,
+			&i.AuthorHandle,
+			&i.MessageText,
+			&i.RetryCount,
+			&i.CreatedAt,
+			&i.DeferredUntil,
+			&i.NextAttemptAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listQueueSources = `-- name: ListQueueSources :many
+SELECT id, message_uri, message_cid
+FROM message_queue
+WHERE status <> 'processing'
+  AND channel = 'post'
+ORDER BY id
+`
+
+type ListQueueSourcesRow struct {
+	ID         int64  `json:"id"`
+	MessageUri string `json:"message_uri"`
+	MessageCid string `json:"message_cid"`
+}
+
+func (q *Queries) ListQueueSources(ctx context.Context) ([]ListQueueSourcesRow, error) {
+	rows, err := q.db.Query(ctx, listQueueSources)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ListQueueSourcesRow{}
+	for rows.Next() {
+		var i ListQueueSourcesRow
+		if err := rows.Scan(&i.ID, &i.MessageUri, &i.MessageCid); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const markDeferredNoticeSent = `-- name: MarkDeferredNoticeSent :exec
 UPDATE message_queue
 SET
@@ -219,6 +574,133 @@ func (q *Queries) MarkDeferredNoticeSent(ctx context.Context, id int64) error {
 	return err
 }
 
+const purgeQueueMessages = `-- name: PurgeQueueMessages :execrows
+DELETE FROM message_queue
+WHERE status = $1
+`
+
+func (q *Queries) PurgeQueueMessages(ctx context.Context, status string) (int64, error) {
+	result, err := q.db.Exec(ctx, purgeQueueMessages, status)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rejectQueueMessage = `-- name: RejectQueueMessage :execrows
+WITH rejected AS (
+    DELETE FROM message_queue
+    WHERE id = $1
+      AND status = 'awaiting_approval'
+    RETURNING message_uri, message_cid, author_did, author_handle, message_text, llm_response,
+              retry_count, model_name, created_at, processing_started_at, length_strategy,
+              channel, convo_id, guardrail_verdicts
+)
+INSERT INTO message_history (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    llm_response,
+    status,
+    retry_count,
+    error_message,
+    model_name,
+    received_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    completed_at
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    COALESCE(llm_response, ''),
+    'rejected',
+    retry_count,
+    $2::text,
+    model_name,
+    created_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    $3::text,
+    NOW(),
+    NOW()
+FROM rejected
+`
+
+type RejectQueueMessageParams struct {
+	ID         int64   `json:"id"`
+	Reason     *string `json:"reason"`
+	ReviewedBy string  `json:"reviewed_by"`
+}
+
+func (q *Queries) RejectQueueMessage(ctx context.Context, arg RejectQueueMessageParams) (int64, error) {
+	result, err := q.db.Exec(ctx, rejectQueueMessage, arg.ID, arg.Reason, arg.ReviewedBy)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const releaseMessage = `-- name: ReleaseMessage :exec
+UPDATE message_queue
+SET
+    status = 'pending',
+    processing_started_at = NULL,
+    last_error = $2
+WHERE id = $1
+`
+
+type ReleaseMessageParams struct {
+	ID        int64   `json:"id"`
+	LastError *string `json:"last_error"`
+}
+
+func (q *Queries) ReleaseMessage(ctx context.Context, arg ReleaseMessageParams) error {
+	_, err := q.db.Exec(ctx, releaseMessage, arg.ID, arg.LastError)
+	return err
+}
+
+const requeueMessage = `-- name: RequeueMessage :execrows
+UPDATE message_queue
+SET
+    status = 'pending',
+    retry_count = 0,
+    processing_started_at = NULL,
+    llm_response = NULL,
+    model_name = NULL,
+    deferred_until = NULL,
+    spending_notice_sent = FALSE,
+    next_attempt_at = NULL,
+    last_error = NULL,
+    length_strategy = NULL,
+    approval_requested_at = NULL,
+    reviewed_by = NULL,
+    reviewed_at = NULL
+WHERE id = $1
+  AND status <> 'processing'
+`
+
+func (q *Queries) RequeueMessage(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.Exec(ctx, requeueMessage, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const resetStaleMessage = `-- name: ResetStaleMessage :exec
 UPDATE message_queue
 SET
@@ -233,6 +715,39 @@ func (q *Queries) ResetStaleMessage(ctx context.Context, id int64) error {
 	return err
 }
 
+const submitMessageForApproval = `-- name: SubmitMessageForApproval :exec
+UPDATE message_queue
+SET
+    status = 'awaiting_approval',
+    llm_response = $2,
+    model_name = $3,
+    retry_count = 0,
+    next_attempt_at = NULL,
+    last_error = $4,
+    length_strategy = $5,
+    approval_requested_at = NOW()
+WHERE id = $1
+`
+
+type SubmitMessageForApprovalParams struct {
+	ID             int64   `json:"id"`
+	LlmResponse    *string `json:"llm_response"`
+	ModelName      *string `json:"model_name"`
+	LastError      *string `json:"last_error"`
+	LengthStrategy *string `json:"length_strategy"`
+}
+
+func (q *Queries) SubmitMessageForApproval(ctx context.Context, arg SubmitMessageForApprovalParams) error {
+	_, err := q.db.Exec(ctx, submitMessageForApproval,
+		arg.ID,
+		arg.LlmResponse,
+		arg.ModelName,
+		arg.LastError,
+		arg.LengthStrategy,
+	)
+	return err
+}
+
 const updateMessageDeferredWithNotice = `-- name: UpdateMessageDeferredWithNotice :exec
 UPDATE message_queue
 SET
@@ -264,17 +779,26 @@ SET
         ELSE 'failed'
     END,
     retry_count = retry_count + 1,
-    processing_started_at = NULL
+    processing_started_at = NULL,
+    next_attempt_at = $3,
+    last_error = $4
 WHERE id = $1
 `
 
 type UpdateMessageFailedParams struct {
-	ID         int64 `json:"id"`
-	RetryCount int32 `json:"retry_count"`
+	ID            int64              `json:"id"`
+	RetryCount    int32              `json:"retry_count"`
+	NextAttemptAt pgtype.Timestamptz `json:"next_attempt_at"`
+	LastError     *string            `json:"last_error"`
 }
 
 func (q *Queries) UpdateMessageFailed(ctx context.Context, arg UpdateMessageFailedParams) error {
-	_, err := q.db.Exec(ctx, updateMessageFailed, arg.ID, arg.RetryCount)
+	_, err := q.db.Exec(ctx, updateMessageFailed,
+		arg.ID,
+		arg.RetryCount,
+		arg.NextAttemptAt,
+		arg.LastError,
+	)
 	return err
 }
 
@@ -284,18 +808,35 @@ SET
     status = 'ready_to_send',
     llm_response = $2,
     model_name = $3,
-    retry_count = 0
+    retry_count = 0,
+    next_attempt_at = NULL,
+    last_error = $4,
+    length_strategy = $5,
+    reviewed_by = $6,
+    reviewed_at = $7
 WHERE id = $1
 `
 
 type UpdateMessageWithLLMResponseParams struct {
-	ID          int64   `json:"id"`
-	LlmResponse *string `json:"llm_response"`
-	ModelName   *string `json:"model_name"`
+	ID             int64              `json:"id"`
+	LlmResponse    *string            `json:"llm_response"`
+	ModelName      *string            `json:"model_name"`
+	LastError      *string            `json:"last_error"`
+	LengthStrategy *string            `json:"length_strategy"`
+	ReviewedBy     *string            `json:"reviewed_by"`
+	ReviewedAt     pgtype.Timestamptz `json:"reviewed_at"`
 }
 
 func (q *Queries) UpdateMessageWithLLMResponse(ctx context.Context, arg UpdateMessageWithLLMResponseParams) error {
-	_, err := q.db.Exec(ctx, updateMessageWithLLMResponse, arg.ID, arg.LlmResponse, arg.ModelName)
+	_, err := q.db.Exec(ctx, updateMessageWithLLMResponse,
+		arg.ID,
+		arg.LlmResponse,
+		arg.ModelName,
+		arg.LastError,
+		arg.LengthStrategy,
+		arg.ReviewedBy,
+		arg.ReviewedAt,
+	)
 	return err
 }
 
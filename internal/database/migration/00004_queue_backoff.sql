@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue
+    ADD COLUMN next_attempt_at TIMESTAMPTZ,
+    ADD COLUMN last_error TEXT;
+
+CREATE INDEX idx_message_queue_next_attempt_at ON message_queue (next_attempt_at)
+    WHERE status = 'pending' AND next_attempt_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_message_queue_next_attempt_at;
+
+ALTER TABLE message_queue
+    DROP COLUMN IF EXISTS last_error,
+    DROP COLUMN IF EXISTS next_attempt_at;
+-- +goose StatementEnd
@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue
+    ADD COLUMN notification JSONB NOT NULL DEFAULT '{}',
+    ADD COLUMN attempts JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN model_override TEXT;
+
+CREATE TABLE dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    queue_id BIGINT NOT NULL,
+    message_uri TEXT NOT NULL,
+    message_cid TEXT NOT NULL,
+    author_did TEXT NOT NULL,
+    author_handle TEXT NOT NULL,
+    message_text TEXT NOT NULL,
+    notification JSONB NOT NULL,
+    stage VARCHAR(20) NOT NULL,
+    last_error TEXT,
+    attempts JSONB NOT NULL,
+    retry_count INT NOT NULL,
+    model_name TEXT,
+    received_at TIMESTAMPTZ NOT NULL,
+    dead_lettered_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_dead_letters_dead_lettered_at ON dead_letters (dead_lettered_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS dead_letters;
+
+ALTER TABLE message_queue
+    DROP COLUMN IF EXISTS model_override,
+    DROP COLUMN IF EXISTS attempts,
+    DROP COLUMN IF EXISTS notification;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue ADD COLUMN length_strategy VARCHAR(20);
+ALTER TABLE message_history ADD COLUMN length_strategy VARCHAR(20);
+
+CREATE TABLE full_text_pages (
+    token TEXT PRIMARY KEY,
+    message_uri TEXT NOT NULL,
+    text TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS full_text_pages;
+
+ALTER TABLE message_history DROP COLUMN IF EXISTS length_strategy;
+ALTER TABLE message_queue DROP COLUMN IF EXISTS length_strategy;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_history
+    ADD COLUMN reply_post_uris TEXT[],
+    ADD COLUMN deleted_at TIMESTAMPTZ,
+    ADD COLUMN deleted_by TEXT;
+
+CREATE INDEX idx_message_history_reply_uri ON message_history (reply_uri);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_message_history_reply_uri;
+
+ALTER TABLE message_history
+    DROP COLUMN IF EXISTS deleted_by,
+    DROP COLUMN IF EXISTS deleted_at,
+    DROP COLUMN IF EXISTS reply_post_uris;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue
+    ADD COLUMN channel VARCHAR(10) NOT NULL DEFAULT 'post',
+    ADD COLUMN convo_id TEXT;
+
+ALTER TABLE message_history
+    ADD COLUMN channel VARCHAR(10) NOT NULL DEFAULT 'post',
+    ADD COLUMN convo_id TEXT;
+
+ALTER TABLE dead_letters
+    ADD COLUMN channel VARCHAR(10) NOT NULL DEFAULT 'post',
+    ADD COLUMN convo_id TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE dead_letters
+    DROP COLUMN IF EXISTS convo_id,
+    DROP COLUMN IF EXISTS channel;
+
+ALTER TABLE message_history
+    DROP COLUMN IF EXISTS convo_id,
+    DROP COLUMN IF EXISTS channel;
+
+ALTER TABLE message_queue
+    DROP COLUMN IF EXISTS convo_id,
+    DROP COLUMN IF EXISTS channel;
+-- +goose StatementEnd
@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE kb_documents (
+    id BIGSERIAL PRIMARY KEY,
+    source TEXT NOT NULL UNIQUE,
+    title TEXT NOT NULL,
+    content_hash TEXT NOT NULL,
+    embedding_model TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE kb_passages (
+    id BIGSERIAL PRIMARY KEY,
+    document_id BIGINT NOT NULL REFERENCES kb_documents (id) ON DELETE CASCADE,
+    ordinal INT NOT NULL,
+    heading TEXT NOT NULL,
+    content TEXT NOT NULL,
+    embedding REAL[] NOT NULL
+);
+
+CREATE INDEX idx_kb_passages_document_id ON kb_passages (document_id);
+
+ALTER TABLE llm_usage_daily ADD COLUMN embedding_tokens BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE llm_usage_daily DROP COLUMN IF EXISTS embedding_tokens;
+DROP TABLE IF EXISTS kb_passages;
+DROP TABLE IF EXISTS kb_documents;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE user_memories (
+    author_did TEXT PRIMARY KEY,
+    summary TEXT NOT NULL DEFAULT '',
+    last_history_id BIGINT NOT NULL DEFAULT 0,
+    forgotten_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_message_history_author_did ON message_history (author_did, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_message_history_author_did;
+
+DROP TABLE IF EXISTS user_memories;
+-- +goose StatementEnd
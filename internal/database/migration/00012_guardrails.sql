@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue
+    ADD COLUMN guardrail_verdicts JSONB NOT NULL DEFAULT '[]';
+
+ALTER TABLE message_history
+    ADD COLUMN guardrail_verdicts JSONB NOT NULL DEFAULT '[]';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE message_history
+    DROP COLUMN IF EXISTS guardrail_verdicts;
+
+ALTER TABLE message_queue
+    DROP COLUMN IF EXISTS guardrail_verdicts;
+-- +goose StatementEnd
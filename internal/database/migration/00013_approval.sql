@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE message_queue
+    ADD COLUMN approval_requested_at TIMESTAMPTZ,
+    ADD COLUMN reviewed_by TEXT,
+    ADD COLUMN reviewed_at TIMESTAMPTZ;
+
+ALTER TABLE message_history
+    ADD COLUMN reviewed_by TEXT,
+    ADD COLUMN reviewed_at TIMESTAMPTZ;
+
+CREATE INDEX idx_message_queue_awaiting_approval ON message_queue (approval_requested_at)
+    WHERE status = 'awaiting_approval';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_message_queue_awaiting_approval;
+
+ALTER TABLE message_history
+    DROP COLUMN IF EXISTS reviewed_at,
+    DROP COLUMN IF EXISTS reviewed_by;
+
+ALTER TABLE message_queue
+    DROP COLUMN IF EXISTS reviewed_at,
+    DROP COLUMN IF EXISTS reviewed_by,
+    DROP COLUMN IF EXISTS approval_requested_at;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE spending_alerts (
+    period VARCHAR(10) NOT NULL,
+    period_start DATE NOT NULL,
+    threshold INT NOT NULL,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (period, period_start, threshold)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS spending_alerts;
+-- +goose StatementEnd
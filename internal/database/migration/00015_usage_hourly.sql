@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE llm_usage_hourly (
+    usage_hour TIMESTAMPTZ PRIMARY KEY,
+    estimated_spend_micros BIGINT NOT NULL DEFAULT 0,
+    reserved_spend_micros BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS llm_usage_hourly;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE llm_spend_reservations (
+    id BIGSERIAL PRIMARY KEY,
+    usage_date DATE NOT NULL,
+    usage_hour TIMESTAMPTZ NOT NULL,
+    amount_micros BIGINT NOT NULL,
+    message_id BIGINT REFERENCES message_queue (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_llm_spend_reservations_usage_date ON llm_spend_reservations (usage_date);
+CREATE INDEX idx_llm_spend_reservations_usage_hour ON llm_spend_reservations (usage_hour);
+CREATE INDEX idx_llm_spend_reservations_created_at ON llm_spend_reservations (created_at);
+
+ALTER TABLE llm_usage_daily DROP COLUMN reserved_spend_micros;
+ALTER TABLE llm_usage_hourly DROP COLUMN reserved_spend_micros;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE llm_usage_hourly ADD COLUMN reserved_spend_micros BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE llm_usage_daily ADD COLUMN reserved_spend_micros BIGINT NOT NULL DEFAULT 0;
+DROP TABLE IF EXISTS llm_spend_reservations;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE dead_letters
+    ADD COLUMN answered BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE dead_letters
+    DROP COLUMN IF EXISTS answered;
+-- +goose StatementEnd
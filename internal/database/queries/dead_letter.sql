@@ -0,0 +1,94 @@
+-- name: DeadLetterQueueMessage :one
+INSERT INTO dead_letters (
+    queue_id,
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    notification,
+    stage,
+    last_error,
+    attempts,
+    retry_count,
+    model_name,
+    received_at,
+    channel,
+    convo_id,
+    answered
+)
+SELECT
+    id,
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    notification,
+    sqlc.arg(stage)::text,
+    sqlc.narg(last_error)::text,
+    attempts,
+    retry_count,
+    COALESCE(model_override, model_name),
+    created_at,
+    channel,
+    convo_id,
+    sqlc.arg(answered)::boolean
+FROM message_queue
+WHERE message_queue.id = sqlc.arg(queue_id)
+RETURNING id;
+
+-- name: ListDeadLetters :many
+SELECT id, stage, author_handle, message_text, retry_count, last_error, dead_lettered_at, answered
+FROM dead_letters
+ORDER BY dead_lettered_at ASC
+LIMIT sqlc.arg(row_limit);
+
+-- name: GetDeadLetter :one
+SELECT *
+FROM dead_letters
+WHERE id = $1;
+
+-- name: ReplayDeadLetter :one
+-- Moves the dead letter back to the queue in one statement, so that a crash
+-- cannot leave it both queued and dead-lettered.
+WITH replayed AS (
+    DELETE FROM dead_letters
+    WHERE dead_letters.id = sqlc.arg(id)
+      AND NOT EXISTS (
+          SELECT 1
+          FROM message_queue
+          WHERE message_queue.message_uri = dead_letters.message_uri
+      )
+    RETURNING message_uri, message_cid, author_did, author_handle, message_text, notification, channel, convo_id
+)
+INSERT INTO message_queue (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    notification,
+    model_override,
+    channel,
+    convo_id
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    notification,
+    sqlc.narg(model_override)::text,
+    channel,
+    convo_id
+FROM replayed
+RETURNING id;
+
+-- name: DeleteDeadLetter :execrows
+DELETE FROM dead_letters
+WHERE id = $1;
+
+-- name: DeleteAllDeadLetters :execrows
+DELETE FROM dead_letters;
@@ -0,0 +1,8 @@
+-- name: InsertFullTextPage :exec
+INSERT INTO full_text_pages (token, message_uri, text)
+VALUES ($1, $2, $3);
+
+-- name: GetFullTextPage :one
+SELECT *
+FROM full_text_pages
+WHERE token = $1;
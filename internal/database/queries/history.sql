@@ -14,7 +14,88 @@ INSERT INTO message_history (
     model_name,
     received_at,
     processing_started_at,
+    length_strategy,
+    reply_post_uris,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
     completed_at
 ) VALUES (
-    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NOW()
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, NOW()
 ) RETURNING *;
+
+-- name: SearchMessageHistory :many
+SELECT *
+FROM message_history
+WHERE (sqlc.narg(author)::text IS NULL OR author_handle = sqlc.narg(author)::text OR author_did = sqlc.narg(author)::text)
+  AND (sqlc.narg(status)::text IS NULL OR status = sqlc.narg(status)::text)
+  AND (sqlc.narg(query)::text IS NULL
+       OR message_text ILIKE '%' || sqlc.narg(query)::text || '%'
+       OR llm_response ILIKE '%' || sqlc.narg(query)::text || '%')
+ORDER BY completed_at DESC
+LIMIT sqlc.arg(row_limit);
+
+-- name: ListMessageHistoryBetween :many
+SELECT *
+FROM message_history
+WHERE completed_at >= sqlc.arg(from_time)
+  AND completed_at < sqlc.arg(to_time)
+ORDER BY completed_at ASC;
+
+-- name: GetMessageHistory :one
+SELECT *
+FROM message_history
+WHERE id = $1;
+
+-- name: GetMessageHistoryByReplyPost :one
+SELECT *
+FROM message_history
+WHERE reply_uri = sqlc.arg(post_uri)::text
+   OR sqlc.arg(post_uri)::text = ANY(reply_post_uris)
+ORDER BY completed_at DESC
+LIMIT 1;
+
+-- name: MarkMessageHistoryDeleted :execrows
+UPDATE message_history
+SET
+    status = 'deleted',
+    deleted_at = NOW(),
+    deleted_by = $2
+WHERE id = $1
+  AND deleted_at IS NULL;
+
+-- name: RegenerateHistoryMessage :one
+INSERT INTO message_queue (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    model_override,
+    channel,
+    convo_id
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    sqlc.narg(model_override)::text,
+    channel,
+    convo_id
+FROM message_history
+WHERE message_history.id = sqlc.arg(id)
+ON CONFLICT (message_uri) DO NOTHING
+RETURNING id;
+
+-- name: ListRepliesCompletedSince :many
+SELECT *
+FROM message_history
+WHERE deleted_at IS NULL
+  AND reply_uri IS NOT NULL
+  AND channel = 'post'
+  AND completed_at >= sqlc.arg(since)
+ORDER BY completed_at ASC;
@@ -0,0 +1,53 @@
+-- name: GetKBDocumentBySource :one
+SELECT *
+FROM kb_documents
+WHERE source = $1;
+
+-- name: UpsertKBDocument :one
+INSERT INTO kb_documents (source, title, content_hash, embedding_model)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (source) DO UPDATE
+SET title = EXCLUDED.title,
+    content_hash = EXCLUDED.content_hash,
+    embedding_model = EXCLUDED.embedding_model,
+    updated_at = NOW()
+RETURNING id;
+
+-- name: DeleteKBPassages :exec
+DELETE FROM kb_passages
+WHERE document_id = $1;
+
+-- name: InsertKBPassage :exec
+INSERT INTO kb_passages (document_id, ordinal, heading, content, embedding)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: DeleteKBDocument :execrows
+DELETE FROM kb_documents
+WHERE source = $1;
+
+-- name: ListKBDocuments :many
+SELECT d.id, d.source, d.title, d.embedding_model, d.updated_at, COUNT(p.id) AS passages
+FROM kb_documents d
+LEFT JOIN kb_passages p ON p.document_id = d.id
+GROUP BY d.id
+ORDER BY d.source;
+
+-- name: GetKBRevision :one
+SELECT COUNT(*) AS documents, COALESCE(MAX(updated_at), 'epoch')::timestamptz AS updated_at
+FROM kb_documents;
+
+-- name: ListKBPassages :many
+SELECT p.id, d.source, d.title, p.heading, p.content, p.embedding
+FROM kb_passages p
+JOIN kb_documents d ON d.id = p.document_id
+ORDER BY p.id;
+
+-- name: SearchKBPassages :many
+-- Requires the pgvector extension. The cast allows embeddings of any
+-- dimension in the REAL[] column.
+SELECT p.id, d.source, d.title, p.heading, p.content,
+       (1 - (p.embedding::vector <=> sqlc.arg(query)::real[]::vector))::float8 AS score
+FROM kb_passages p
+JOIN kb_documents d ON d.id = p.document_id
+ORDER BY p.embedding::vector <=> sqlc.arg(query)::real[]::vector
+LIMIT sqlc.arg(row_limit);
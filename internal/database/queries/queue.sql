@@ -4,9 +4,12 @@ INSERT INTO message_queue (
     message_cid,
     author_did,
     author_handle,
-    message_text
+    message_text,
+    notification,
+    channel,
+    convo_id
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, $6, $7, $8
 )
 ON CONFLICT (message_uri) DO NOTHING
 RETURNING id;
@@ -20,11 +23,13 @@ WHERE id = (
     SELECT id FROM message_queue
     WHERE status = 'pending'
       AND (deferred_until IS NULL OR deferred_until <= NOW())
+      AND (next_attempt_at IS NULL OR next_attempt_at <= NOW())
     ORDER BY created_at ASC
     FOR UPDATE SKIP LOCKED
     LIMIT 1
 )
-RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, retry_count;
+RETURNING id, message_uri, message_cid, author_did, author_handle, message_text, retry_count, model_override,
+          channel, convo_id;
 
 -- name: UpdateMessageWithLLMResponse :exec
 UPDATE message_queue
@@ -32,7 +37,25 @@ SET
     status = 'ready_to_send',
     llm_response = $2,
     model_name = $3,
-    retry_count = 0
+    retry_count = 0,
+    next_attempt_at = NULL,
+    last_error = $4,
+    length_strategy = $5,
+    reviewed_by = $6,
+    reviewed_at = $7
+WHERE id = $1;
+
+-- name: SubmitMessageForApproval :exec
+UPDATE message_queue
+SET
+    status = 'awaiting_approval',
+    llm_response = $2,
+    model_name = $3,
+    retry_count = 0,
+    next_attempt_at = NULL,
+    last_error = $4,
+    length_strategy = $5,
+    approval_requested_at = NOW()
 WHERE id = $1;
 
 -- name: UpdateMessageFailed :exec
@@ -43,22 +66,25 @@ SET
         ELSE 'failed'
     END,
     retry_count = retry_count + 1,
-    processing_started_at = NULL
+    processing_started_at = NULL,
+    next_attempt_at = $3,
+    last_error = $4
 WHERE id = $1;
 
 -- name: GetReadyToSendMessages :many
 SELECT id, message_uri, message_cid, author_did, author_handle, message_text, llm_response,
-       model_name, created_at, processing_started_at, retry_count, status, deferred_until, spending_notice_sent
+       model_name, created_at, processing_started_at, retry_count, status, deferred_until, spending_notice_sent,
+       last_error, length_strategy, channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
 FROM message_queue
 WHERE status = 'ready_to_send'
 ORDER BY created_at ASC
 LIMIT $1;
 
 -- name: GetStaleProcessingMessages :many
-SELECT id, message_uri, message_cid, author_did, author_handle, message_text, retry_count
+SELECT id, message_uri, message_cid, author_did, author_handle, message_text, retry_count, processing_started_at
 FROM message_queue
 WHERE status = 'processing'
-  AND processing_started_at < NOW() - INTERVAL '5 minutes'
+  AND processing_started_at < sqlc.arg(started_before)
 ORDER BY created_at ASC;
 
 -- name: ResetStaleMessage :exec
@@ -102,3 +128,191 @@ SET
     model_name = NULL,
     processing_started_at = NULL
 WHERE id = $1;
+
+-- name: ListQueueMessages :many
+SELECT id, status, author_handle, message_text, retry_count, created_at, deferred_until, next_attempt_at
+FROM message_queue
+WHERE sqlc.narg(status)::text IS NULL OR status = sqlc.narg(status)::text
+ORDER BY created_at ASC
+LIMIT sqlc.arg(row_limit);
+
+-- name: GetQueueMessage :one
+SELECT *
+FROM message_queue
+WHERE id = $1;
+
+-- name: RequeueMessage :execrows
+UPDATE message_queue
+SET
+    status = 'pending',
+    retry_count = 0,
+    processing_started_at = NULL,
+    llm_response = NULL,
+    model_name = NULL,
+    deferred_until = NULL,
+    spending_notice_sent = FALSE,
+    next_attempt_at = NULL,
+    last_error = NULL,
+    length_strategy = NULL,
+    approval_requested_at = NULL,
+    reviewed_by = NULL,
+    reviewed_at = NULL
+WHERE id = $1
+  AND status <> 'processing';
+
+-- name: PurgeQueueMessages :execrows
+DELETE FROM message_queue
+WHERE status = $1;
+
+-- name: AppendMessageAttempt :exec
+UPDATE message_queue
+SET attempts = attempts || sqlc.arg(attempt)::jsonb
+WHERE id = sqlc.arg(id);
+
+-- name: AppendGuardrailVerdicts :exec
+UPDATE message_queue
+SET guardrail_verdicts = guardrail_verdicts || sqlc.arg(verdicts)::jsonb
+WHERE id = sqlc.arg(id);
+
+-- name: ReleaseMessage :exec
+UPDATE message_queue
+SET
+    status = 'pending',
+    processing_started_at = NULL,
+    last_error = $2
+WHERE id = $1;
+
+-- name: CancelQueueMessage :execrows
+WITH cancelled AS (
+    DELETE FROM message_queue
+    WHERE id = sqlc.arg(id)
+      AND status <> 'processing'
+    RETURNING message_uri, message_cid, author_did, author_handle, message_text, llm_response,
+              retry_count, model_name, created_at, processing_started_at, length_strategy,
+              channel, convo_id, guardrail_verdicts, reviewed_by, reviewed_at
+)
+INSERT INTO message_history (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    llm_response,
+    status,
+    retry_count,
+    error_message,
+    model_name,
+    received_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    completed_at
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    COALESCE(llm_response, ''),
+    'cancelled',
+    retry_count,
+    sqlc.narg(reason)::text,
+    model_name,
+    created_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    NOW()
+FROM cancelled;
+
+-- name: ListQueueSources :many
+SELECT id, message_uri, message_cid
+FROM message_queue
+WHERE status <> 'processing'
+  AND channel = 'post'
+ORDER BY id;
+
+-- name: ListAwaitingApproval :many
+SELECT id, author_handle, message_text, llm_response, approval_requested_at
+FROM message_queue
+WHERE status = 'awaiting_approval'
+ORDER BY approval_requested_at ASC
+LIMIT sqlc.arg(row_limit);
+
+-- name: ListExpiredApprovals :many
+SELECT id
+FROM message_queue
+WHERE status = 'awaiting_approval'
+  AND approval_requested_at < sqlc.arg(requested_before)
+ORDER BY approval_requested_at ASC;
+
+-- name: ApproveQueueMessage :execrows
+UPDATE message_queue
+SET
+    status = 'ready_to_send',
+    llm_response = COALESCE(sqlc.narg(llm_response)::text, llm_response),
+    reviewed_by = sqlc.arg(reviewed_by),
+    reviewed_at = NOW()
+WHERE id = sqlc.arg(id)
+  AND status = 'awaiting_approval';
+
+-- name: RejectQueueMessage :execrows
+WITH rejected AS (
+    DELETE FROM message_queue
+    WHERE id = sqlc.arg(id)
+      AND status = 'awaiting_approval'
+    RETURNING message_uri, message_cid, author_did, author_handle, message_text, llm_response,
+              retry_count, model_name, created_at, processing_started_at, length_strategy,
+              channel, convo_id, guardrail_verdicts
+)
+INSERT INTO message_history (
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    llm_response,
+    status,
+    retry_count,
+    error_message,
+    model_name,
+    received_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    reviewed_by,
+    reviewed_at,
+    completed_at
+)
+SELECT
+    message_uri,
+    message_cid,
+    author_did,
+    author_handle,
+    message_text,
+    COALESCE(llm_response, ''),
+    'rejected',
+    retry_count,
+    sqlc.narg(reason)::text,
+    model_name,
+    created_at,
+    processing_started_at,
+    length_strategy,
+    channel,
+    convo_id,
+    guardrail_verdicts,
+    sqlc.arg(reviewed_by)::text,
+    NOW(),
+    NOW()
+FROM rejected;
@@ -0,0 +1,4 @@
+-- name: InsertSpendingAlert :execrows
+INSERT INTO spending_alerts (period, period_start, threshold)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,19 @@
+-- name: InsertToolCall :exec
+INSERT INTO tool_calls (
+    message_uri,
+    round,
+    call_id,
+    tool_name,
+    arguments,
+    result,
+    error,
+    duration_ms
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8
+);
+
+-- name: ListToolCalls :many
+SELECT *
+FROM tool_calls
+WHERE message_uri = $1
+ORDER BY id;
@@ -0,0 +1,86 @@
+-- name: GetDailyUsage :one
+SELECT estimated_spend_micros,
+       (SELECT COALESCE(SUM(amount_micros), 0) FROM llm_spend_reservations r WHERE r.usage_date = llm_usage_daily.usage_date)::bigint AS reserved_spend_micros
+FROM llm_usage_daily
+WHERE usage_date = $1;
+
+-- name: EnsureDailyUsage :exec
+INSERT INTO llm_usage_daily (usage_date)
+VALUES ($1)
+ON CONFLICT (usage_date) DO NOTHING;
+
+-- name: LockDailyUsage :one
+SELECT estimated_spend_micros
+FROM llm_usage_daily
+WHERE usage_date = $1
+FOR UPDATE;
+
+-- name: InsertSpendReservation :one
+INSERT INTO llm_spend_reservations (usage_date, usage_hour, amount_micros, message_id)
+VALUES (sqlc.arg(usage_date), sqlc.arg(usage_hour), sqlc.arg(amount_micros), sqlc.narg(message_id))
+RETURNING id;
+
+-- name: DeleteSpendReservation :execrows
+DELETE FROM llm_spend_reservations
+WHERE id = $1;
+
+-- name: ExpireSpendReservations :many
+DELETE FROM llm_spend_reservations
+WHERE created_at < sqlc.arg(created_before)
+RETURNING *;
+
+-- name: FinalizeReservedSpend :one
+UPDATE llm_usage_daily
+SET
+    input_cache_tokens = input_cache_tokens + sqlc.arg(input_cache_tokens)::bigint,
+    input_miss_tokens = input_miss_tokens + sqlc.arg(input_miss_tokens)::bigint,
+    output_tokens = output_tokens + sqlc.arg(output_tokens)::bigint,
+    estimated_spend_micros = estimated_spend_micros + sqlc.arg(spend_micros)::bigint,
+    updated_at = NOW()
+WHERE usage_date = sqlc.arg(usage_date)
+RETURNING estimated_spend_micros,
+          (SELECT COALESCE(SUM(amount_micros), 0) FROM llm_spend_reservations r WHERE r.usage_date = llm_usage_daily.usage_date)::bigint AS reserved_spend_micros;
+
+-- name: ListDailyUsage :many
+SELECT usage_date, input_cache_tokens, input_miss_tokens, output_tokens, embedding_tokens, estimated_spend_micros,
+       (SELECT COALESCE(SUM(amount_micros), 0) FROM llm_spend_reservations r WHERE r.usage_date = llm_usage_daily.usage_date)::bigint AS reserved_spend_micros
+FROM llm_usage_daily
+WHERE usage_date BETWEEN sqlc.arg(from_date) AND sqlc.arg(to_date)
+ORDER BY usage_date ASC;
+
+-- name: AddDailySpend :one
+INSERT INTO llm_usage_daily (usage_date, embedding_tokens, estimated_spend_micros)
+VALUES (sqlc.arg(usage_date), sqlc.arg(embedding_tokens)::bigint, sqlc.arg(spend_micros)::bigint)
+ON CONFLICT (usage_date) DO UPDATE
+SET embedding_tokens = llm_usage_daily.embedding_tokens + EXCLUDED.embedding_tokens,
+    estimated_spend_micros = llm_usage_daily.estimated_spend_micros + EXCLUDED.estimated_spend_micros,
+    updated_at = NOW()
+RETURNING estimated_spend_micros,
+          (SELECT COALESCE(SUM(amount_micros), 0) FROM llm_spend_reservations r WHERE r.usage_date = llm_usage_daily.usage_date)::bigint AS reserved_spend_micros;
+
+-- name: SumUsageBetween :one
+SELECT (SELECT COALESCE(SUM(estimated_spend_micros), 0) FROM llm_usage_daily d WHERE d.usage_date BETWEEN sqlc.arg(from_date) AND sqlc.arg(to_date))::bigint AS spent_micros,
+       (SELECT COALESCE(SUM(amount_micros), 0) FROM llm_spend_reservations r WHERE r.usage_date BETWEEN sqlc.arg(from_date) AND sqlc.arg(to_date))::bigint AS reserved_micros;
+
+-- name: AddHourlySpend :exec
+INSERT INTO llm_usage_hourly (usage_hour, estimated_spend_micros)
+VALUES (sqlc.arg(usage_hour), sqlc.arg(spend_micros)::bigint)
+ON CONFLICT (usage_hour) DO UPDATE
+SET estimated_spend_micros = llm_usage_hourly.estimated_spend_micros + EXCLUDED.estimated_spend_micros,
+    updated_at = NOW();
+
+-- name: ListHourlyUsage :many
+SELECT usage_hour,
+       SUM(spent)::bigint AS estimated_spend_micros,
+       SUM(reserved)::bigint AS reserved_spend_micros
+FROM (
+    SELECT h.usage_hour, h.estimated_spend_micros AS spent, 0::bigint AS reserved
+    FROM llm_usage_hourly h
+    WHERE h.usage_hour >= sqlc.arg(since)
+    UNION ALL
+    SELECT r.usage_hour, 0::bigint AS spent, r.amount_micros AS reserved
+    FROM llm_spend_reservations r
+    WHERE r.usage_hour >= sqlc.arg(since)
+) AS usage
+GROUP BY usage_hour
+ORDER BY usage_hour ASC;
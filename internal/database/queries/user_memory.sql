@@ -0,0 +1,48 @@
+-- name: GetUserMemory :one
+SELECT *
+FROM user_memories
+WHERE author_did = $1;
+
+-- name: ListMemoryExchanges :many
+SELECT id, message_text, llm_response
+FROM message_history
+WHERE author_did = sqlc.arg(author_did)
+  AND status = 'completed'
+  AND id > sqlc.arg(after_id)
+  AND completed_at >= sqlc.arg(since)
+  AND (sqlc.narg(forgotten_at)::timestamptz IS NULL OR received_at > sqlc.narg(forgotten_at)::timestamptz)
+ORDER BY id ASC
+LIMIT sqlc.arg(row_limit);
+
+-- name: UpsertUserMemory :exec
+INSERT INTO user_memories (
+    author_did,
+    summary,
+    last_history_id,
+    updated_at
+) VALUES (
+    $1, $2, $3, NOW()
+)
+ON CONFLICT (author_did) DO UPDATE
+SET
+    summary = EXCLUDED.summary,
+    last_history_id = EXCLUDED.last_history_id,
+    updated_at = NOW();
+
+-- name: ForgetUserMemory :exec
+INSERT INTO user_memories (
+    author_did,
+    forgotten_at,
+    updated_at
+) VALUES (
+    $1, NOW(), NOW()
+)
+ON CONFLICT (author_did) DO UPDATE
+SET
+    summary = '',
+    forgotten_at = NOW(),
+    updated_at = NOW();
+
+-- name: DeleteExpiredUserMemories :execrows
+DELETE FROM user_memories
+WHERE updated_at < sqlc.arg(updated_before);